@@ -66,13 +66,10 @@ func main() {
 		log.Println("Background job scheduler shutdown")
 	}
 
-	// Persist the image queue if it exists
+	// Let the image workers finish their uploads; the rest of the queue is already in the spool
 	if image.GlobalImageQueue != nil {
-		if err := image.GlobalImageQueue.PersistToDisk(); err != nil {
-			log.Printf("Error persisting image queue: %v", err)
-		} else {
-			log.Println("Image queue persisted to disk")
-		}
+		image.GlobalImageQueue.StopWorkers()
+		log.Println("Image workers stopped")
 	}
 
 	// Shut down the server with a timeout
@@ -1,21 +1,72 @@
 package api
 
 import (
+	"greenvue/internal/auth"
+	"greenvue/internal/config"
 	"greenvue/internal/jobs"
+	"greenvue/internal/listings"
 	"greenvue/lib/image"
+	"greenvue/lib/storage"
 	"log"
 	"time"
+
+	"github.com/gofiber/fiber/v2"
 )
 
+// initBlobStore selects where images are stored. The local driver's files are served by the API itself.
+func initBlobStore(app *fiber.App, cfg *config.Config) {
+	// Signed URLs of the local driver are checked by the API, so never start with a forgeable key
+	if cfg.Storage.Driver == "local" {
+		if err := auth.CheckDedicatedSecret("STORAGE_SIGNING_KEY", cfg.Storage.SigningKey); err != nil {
+			log.Fatalf("Invalid storage configuration: %v", err)
+		}
+	}
+
+	storage.InitBlobStore(cfg.Storage.Driver, storage.Options{
+		Bucket:      cfg.Storage.Bucket,
+		PublicURL:   cfg.Storage.PublicURL,
+		LocalDir:    cfg.Storage.LocalDir,
+		SigningKey:  cfg.Storage.SigningKey,
+		SupabaseURL: cfg.Database.SupabaseURL,
+		SupabaseKey: cfg.Storage.ServiceKey,
+		S3Endpoint:  cfg.Storage.S3Endpoint,
+		S3Region:    cfg.Storage.S3Region,
+		S3AccessKey: cfg.Storage.S3AccessKey,
+		S3SecretKey: cfg.Storage.S3SecretKey,
+		S3PathStyle: cfg.Storage.S3PathStyle,
+	})
+
+	if local, ok := storage.GetBlobStore().(*storage.LocalBlobStore); ok {
+		app.Get(storage.LocalRoutePrefix+"/*", local.Handler())
+	}
+}
+
 // initImageProcessingQueue initializes the image processing queue
-func initImageProcessingQueue() {
-	// Initialize the global image queue
-	image.InitializeImageQueue()
+func initImageProcessingQueue(cfg *config.Config) {
+	// Invalid presets keep the defaults, so uploads keep working
+	if len(cfg.Images.Renditions) > 0 {
+		presets, err := image.ParseRenditionPresets(cfg.Images.Renditions)
+		if err != nil {
+			log.Printf("Warning: invalid IMAGE_RENDITIONS, using the default renditions: %v", err)
+		} else {
+			image.SetRenditionPresets(presets)
+		}
+	}
+
+	// Initialize the global image queue, replaying the jobs a previous run left in the spool
+	if err := image.InitializeImageQueue(cfg.Images.QueueDir); err != nil {
+		log.Printf("Warning: image queue is not durable: %v", err)
+	}
+
+	// Mark listings once their images are uploaded, and upload images as soon as they are queued
+	image.GlobalImageQueue.OnListingImagesDone(listings.UpdateImageStatus)
+	image.GlobalImageQueue.StartWorkers(cfg.Images.Workers)
 }
 
 // setupDefaultImageProcessingJob sets up a background job to process images
 func setupDefaultImageProcessingJob() {
-	// Set up a job to process images every 10 seconds in non-production environments
+	// Set up a job to process images every 10 seconds in non-production environments.
+	// The worker pool uploads images right away; this only picks up what it left behind.
 	imageProcessingOptions := &jobs.ImageProcessingOptions{
 		BatchSize: 10, // Process up to 10 images at once
 	}
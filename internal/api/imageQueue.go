@@ -1,10 +1,12 @@
 package api
 
 import (
+	stderrors "errors"
 	"greenvue/lib/errors"
 	"greenvue/lib/image"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 )
 
 // GetImageQueueStatusHandler provides information about the current status of the image processing queue
@@ -15,11 +17,89 @@ func GetImageQueueStatusHandler(c *fiber.Ctx) error {
 
 	pendingCount := image.GlobalImageQueue.PendingCount()
 
+	status := "active"
+	if !image.GlobalImageQueue.WorkersRunning() {
+		status = "scheduled"
+	}
+
 	return errors.SuccessResponse(c, fiber.Map{
 		"pending_count": pendingCount,
 		"queue_status": map[string]any{
 			"initialized": image.GlobalImageQueue != nil,
-			"status":      "active",
+			"status":      status,
 		},
+		"metrics": image.GlobalImageQueue.Metrics(),
+	})
+}
+
+// validImageJobID checks the job_id route parameter; image job IDs are UUIDs
+func validImageJobID(c *fiber.Ctx) (string, error) {
+	id := c.Params("job_id")
+	if _, err := uuid.Parse(id); err != nil {
+		return "", errors.BadRequest("Invalid image job ID format")
+	}
+	return id, nil
+}
+
+// GetFailedImageJobsHandler lists the image jobs that ran out of retries, oldest first
+func GetFailedImageJobsHandler(c *fiber.Ctx) error {
+	if image.GlobalImageQueue == nil {
+		return errors.InternalServerError("Image queue not initialized")
+	}
+
+	failed, err := image.GlobalImageQueue.FailedJobs()
+	if err != nil {
+		return errors.InternalServerError("Failed to read failed image jobs: " + err.Error())
+	}
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"count": len(failed),
+		"jobs":  failed,
+	})
+}
+
+// RequeueFailedImageJobHandler puts a failed image job back into the queue with its retries reset
+func RequeueFailedImageJobHandler(c *fiber.Ctx) error {
+	if image.GlobalImageQueue == nil {
+		return errors.InternalServerError("Image queue not initialized")
+	}
+
+	id, err := validImageJobID(c)
+	if err != nil {
+		return err
+	}
+
+	imageJob, err := image.GlobalImageQueue.RequeueFailed(id)
+	if stderrors.Is(err, image.ErrJobNotFound) {
+		return errors.NotFound("Failed image job not found")
+	}
+	if err != nil {
+		return errors.InternalServerError("Failed to requeue image job: " + err.Error())
+	}
+
+	return errors.SuccessResponse(c, imageJob)
+}
+
+// DiscardFailedImageJobHandler deletes a failed image job for good
+func DiscardFailedImageJobHandler(c *fiber.Ctx) error {
+	if image.GlobalImageQueue == nil {
+		return errors.InternalServerError("Image queue not initialized")
+	}
+
+	id, err := validImageJobID(c)
+	if err != nil {
+		return err
+	}
+
+	err = image.GlobalImageQueue.DiscardFailed(id)
+	if stderrors.Is(err, image.ErrJobNotFound) {
+		return errors.NotFound("Failed image job not found")
+	}
+	if err != nil {
+		return errors.InternalServerError("Failed to discard image job: " + err.Error())
+	}
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"message": "Image job discarded successfully",
 	})
 }
@@ -48,8 +48,14 @@ func TestImageQueueHandler(c *fiber.Ctx) error {
 		return errors.BadRequest(fmt.Sprintf("Error reading image file: %v", err))
 	}
 
+	// The file is uploaded as is, so name it after its sniffed format
+	format := image.SniffFormat(fileData)
+	if format == "" {
+		return errors.BadRequest("File is not a supported image")
+	}
+
 	// Generate a unique filename
-	fileName := fmt.Sprintf("%s-%s.webp", lib.SanitizeFilename(req.ListingTitle), uuid.New().String())
+	fileName := fmt.Sprintf("%s-%s.%s", lib.SanitizeFilename(req.ListingTitle), uuid.New().String(), format)
 
 	// Create an image job
 	imageJob := image.ImageJob{
@@ -2,9 +2,64 @@ package api
 
 import (
 	"greenvue/internal/jobs"
+	"log"
+	"time"
 )
 
 // GetJobScheduler returns the global job scheduler
 func GetJobScheduler() *jobs.Scheduler {
 	return jobs.GlobalScheduler
 }
+
+// setupAccountDeletionJob sets up a background job that deletes accounts after their grace period
+func setupAccountDeletionJob() {
+	accountDeletionOptions := &jobs.AccountDeletionOptions{
+		BatchSize: 10, // Delete up to 10 accounts per run
+	}
+
+	err := jobs.GlobalScheduler.AddJob(
+		"process-account-deletions",                           // Job ID
+		"Process Account Deletions",                           // Job Name
+		"Delete accounts whose grace period has passed",       // Description
+		jobs.CreateAccountDeletionJob(accountDeletionOptions), // Job function
+		time.Hour, // Run every hour
+	)
+
+	if err != nil {
+		log.Printf("Warning: Could not add account deletion job: %v", err)
+	}
+}
+
+// setupDataExportJob sets up a background job that builds requested data exports
+func setupDataExportJob() {
+	dataExportOptions := &jobs.DataExportOptions{
+		BatchSize: 5, // Build up to 5 exports per run
+	}
+
+	err := jobs.GlobalScheduler.AddJob(
+		"process-data-exports",                      // Job ID
+		"Process Data Exports",                      // Job Name
+		"Build requested data exports",              // Description
+		jobs.CreateDataExportJob(dataExportOptions), // Job function
+		time.Minute, // Run every minute
+	)
+
+	if err != nil {
+		log.Printf("Warning: Could not add data export job: %v", err)
+	}
+}
+
+// setupSessionPruningJob sets up a background job that removes expired refresh tokens and sessions
+func setupSessionPruningJob() {
+	err := jobs.GlobalScheduler.AddJob(
+		"prune-sessions", // Job ID
+		"Prune Sessions", // Job Name
+		"Remove expired refresh tokens and sessions", // Description
+		jobs.CreateSessionPruningJob(),               // Job function
+		time.Hour,                                    // Run every hour
+	)
+
+	if err != nil {
+		log.Printf("Warning: Could not add session pruning job: %v", err)
+	}
+}
@@ -58,23 +58,17 @@ func setupMiddleware(app *fiber.App, cfg *config.Config) {
 	app.Use(logger.New(logger.Config{
 		Format: "[${time}] [${ip}] ${status} - ${method} ${path} - ${latency}\n",
 	}))
+	origins := allowedOrigins(cfg)
 	app.Use(cors.New(cors.Config{
-		AllowOrigins: func() string {
-			if cfg.Environment != "production" {
-				return "http://localhost:3000,http://localhost:8080,http://localhost:8081,http://127.0.0.1:3000,http://192.168.178.10:3000,http://192.168.178.10"
-			}
-			// Specify allowed origins in production
-			allowedOrigins := []string{
-				"https://www.greenvue.eu",
-				"https://greenvue.eu",
-			}
-			return strings.Join(allowedOrigins, ",")
-		}(),
+		AllowOrigins:     strings.Join(origins, ","),
 		AllowMethods:     "GET,POST,PUT,DELETE,OPTIONS,PATCH",
-		AllowHeaders:     "Origin,Content-Type,Accept,Authorization",
+		AllowHeaders:     "Origin,Content-Type,Accept,Authorization," + auth.CSRFHeaderName,
 		AllowCredentials: true, // Enable credentials for cookies
 	}))
 
+	// Cookie-authenticated mutations are only accepted from the same origins CORS allows
+	auth.SetTrustedOrigins(origins)
+
 	// Configure custom rate limiter with different limits for different endpoints
 	rateLimiter := errors.NewRateLimiter()
 	rateLimiter.Max = 120                // Allow 120 requests
@@ -129,16 +123,68 @@ func setupMiddleware(app *fiber.App, cfg *config.Config) {
 	}))
 }
 
+// allowedOrigins returns the web origins that may call the API with credentials
+func allowedOrigins(cfg *config.Config) []string {
+	if cfg.Environment != "production" {
+		return []string{
+			"http://localhost:3000",
+			"http://localhost:8080",
+			"http://localhost:8081",
+			"http://127.0.0.1:3000",
+			"http://192.168.178.10:3000",
+			"http://192.168.178.10",
+		}
+	}
+	// Specify allowed origins in production
+	return []string{
+		"https://www.greenvue.eu",
+		"https://greenvue.eu",
+	}
+}
+
 // setupRoutes configures all the routes for the application
 func setupRoutes(app *fiber.App, cfg *config.Config) {
 	// Initialize the job scheduler
 	jobs.Initialize()
 
+	// Initialize the refresh token store
+	auth.InitTokenStore(cfg.JWT.TokenStore)
+
+	// Load the JWT signing keys; without them every login fails, but public routes keep working
+	if err := auth.InitKeyrings(cfg.JWT.KeyringFile); err != nil {
+		log.Printf("Warning: failed to load JWT signing keys: %v", err)
+	}
+
+	// Data export links are served without a session, so never start with a forgeable signing key
+	if err := auth.InitDataExportSigning(cfg.DataExport.SigningKey); err != nil {
+		log.Fatalf("Invalid data export configuration: %v", err)
+	}
+
+	// Configure where security audit events are written
+	auth.InitAuditLog(cfg.Audit.Sinks, cfg.Audit.FilePath)
+
+	// Register the OpenID Connect login providers; a broken provider only disables social login
+	if err := auth.InitOIDCProviders(cfg.OIDC.Providers); err != nil {
+		log.Printf("Warning: failed to configure login providers: %v", err)
+	}
+
+	// Relying party settings for passkeys
+	auth.InitWebAuthn(cfg)
+
 	// Initialize email service
 	initEmailService(cfg)
+	if cfg.APIURL == "" {
+		log.Println("Warning: API_URL is not set, emails with login, unlock and confirmation links cannot be sent")
+	}
 
-	// Initialize image processing queue
-	initImageProcessingQueue()
+	// Initialize image storage and the processing queue
+	initBlobStore(app, cfg)
+	initImageProcessingQueue(cfg)
+
+	// Account deletions and data exports run in every environment, otherwise users would wait forever
+	setupAccountDeletionJob()
+	setupDataExportJob()
+	setupSessionPruningJob()
 
 	// Setup default background jobs if not in production
 	if cfg.Environment != "production" {
@@ -164,7 +210,7 @@ func setupRoutes(app *fiber.App, cfg *config.Config) {
 	chat.RegisterWebsocketRoutes(app)
 
 	// Protected routes
-	api := app.Group("/api", auth.AuthMiddleware())
+	api := app.Group("/api", auth.AuthMiddleware(), auth.CSRFMiddleware())
 	setupProtectedListingRoutes(api)
 	setupUserRoutes(api)
 	setupChatRoutes(api)
@@ -173,19 +219,38 @@ func setupRoutes(app *fiber.App, cfg *config.Config) {
 	setupHealthRoutes(api)
 	setupJobRoutes(api)
 	setupProtectedBidRoutes(api)
+	setupModerationRoutes(api)
+	setupAdminRoutes(api)
 }
 
 // setupAuthRoutes configures authentication routes
 func setupAuthRoutes(app *fiber.App) {
 	app.Post("/auth/login", auth.LoginUser)
+	app.Post("/auth/login/mfa", auth.CompleteMFALogin)
+	app.Post("/auth/passkeys/login/begin", auth.BeginPasskeyLogin)
+	app.Post("/auth/passkeys/login/finish", auth.FinishPasskeyLogin)
 	app.Get("/auth/login/google", auth.HandleGoogleLogin)
 	app.Get("/auth/register/google", auth.HandleGoogleRegistrationStart)
 	app.Get("/auth/callback/google", auth.HandleGoogleCallback)
+	app.Get("/auth/oidc/:provider/login", auth.HandleOIDCLogin)
+	app.Get("/auth/oidc/:provider/callback", auth.HandleOIDCCallback)
 	app.Post("/auth/register", auth.RegisterUser)
-	app.Post("/auth/refresh", auth.RefreshTokenHandler)
-	app.Post("/auth/logout", auth.LogoutUser)
+	app.Post("/auth/refresh", auth.OriginCheckMiddleware(), auth.RefreshTokenHandler)
+	app.Post("/auth/logout", auth.OriginCheckMiddleware(), auth.LogoutUser)
+	app.Get("/auth/csrf", auth.GetCSRFToken)
+	app.Get("/auth/data_export/:export_id/download", auth.DownloadDataExport)
 	app.Get("/auth/confirm_email", auth.VerifyEmailRedirect)
 	app.Post("/auth/resend_email", auth.ResendConfirmationEmail)
+	app.Get("/auth/unlock", auth.ShowUnlockConfirmation)
+	app.Post("/auth/unlock", auth.UnlockAccount)
+	app.Post("/auth/magic_link", auth.SendMagicLink)
+	app.Get("/auth/magic_link/verify", auth.ShowMagicLinkConfirmation)
+	app.Post("/auth/magic_link/verify", auth.VerifyMagicLink)
+	app.Get("/auth/email_change/confirm", auth.ShowEmailChangeConfirmation)
+	app.Post("/auth/email_change/confirm", auth.ConfirmEmailChange)
+	app.Get("/auth/email_change/revert", auth.ShowEmailChangeRevert)
+	app.Post("/auth/email_change/revert", auth.RevertEmailChange)
+	app.Get("/.well-known/jwks.json", auth.JWKSHandler)
 }
 
 // setupPublicListingRoutes configures public listing routes
@@ -198,7 +263,8 @@ func setupPublicListingRoutes(app *fiber.App) {
 
 // setupProtectedListingRoutes configures protected listing routes
 func setupProtectedListingRoutes(router fiber.Router) {
-	router.Post("/listings", listings.PostListing) // Create a new listing with image upload
+	router.Get("/listings/seller/:seller_id", listings.GetListingBySeller) // Same as the public route, for API key integrations
+	router.Post("/listings", listings.PostListing)                         // Create a new listing with image upload
 	router.Delete("/listings/:listing_id", listings.DeleteListingById)
 }
 
@@ -212,9 +278,28 @@ func setupUserRoutes(router fiber.Router) {
 	router.Get("/auth/me", auth.GetUserByAccessToken)
 	router.Patch("/auth/user", auth.UpdateUser)
 	router.Get("/auth/download_user_data", auth.DownloadUserData)
+	router.Get("/auth/data_export", auth.GetDataExports)
+	router.Post("/auth/data_export", auth.RequestDataExport)
 	router.Post("/auth/send_reset_password_email", auth.SendResetPasswordEmail)
 	router.Delete("/auth/delete", auth.DeleteAccount)
 	router.Post("/auth/change_password", auth.ChangePassword)
+	router.Post("/auth/change_email", auth.RequestEmailChange)
+	router.Get("/auth/sessions", auth.GetSessions)
+	router.Delete("/auth/sessions", auth.RevokeOtherSessions)
+	router.Delete("/auth/sessions/:session_id", auth.RevokeSession)
+	router.Get("/auth/security_activity", auth.GetSecurityActivity)
+	router.Get("/auth/mfa", auth.GetMFAStatus)
+	router.Post("/auth/mfa/enroll", auth.EnrollMFA)
+	router.Post("/auth/mfa/verify", auth.VerifyMFA)
+	router.Post("/auth/mfa/disable", auth.DisableMFA)
+	router.Get("/auth/passkeys", auth.ListPasskeys)
+	router.Post("/auth/passkeys/register/begin", auth.BeginPasskeyRegistration)
+	router.Post("/auth/passkeys/register/finish", auth.FinishPasskeyRegistration)
+	router.Patch("/auth/passkeys/:passkey_id", auth.RenamePasskey)
+	router.Delete("/auth/passkeys/:passkey_id", auth.DeletePasskey)
+	router.Get("/auth/api_keys", auth.ListAPIKeys)
+	router.Post("/auth/api_keys", auth.CreateAPIKey)
+	router.Delete("/auth/api_keys/:key_id", auth.RevokeAPIKey)
 }
 
 // setupChatRoutes configures chat routes
@@ -231,6 +316,11 @@ func setupChatRoutes(router fiber.Router) {
 // setupProtectedReviewRoutes configures protected review routes
 func setupProtectedReviewRoutes(router fiber.Router) {
 	router.Post("/reviews", reviews.PostReview)
+	router.Patch("/reviews/:review_id", reviews.UpdateReview)
+	router.Delete("/reviews/:review_id", reviews.DeleteReview)
+	router.Post("/reviews/:review_id/reply", reviews.PostReviewReply)
+	router.Post("/reviews/:review_id/helpful", reviews.ToggleHelpful)
+	router.Post("/reviews/:review_id/report", reviews.ReportReview)
 }
 
 // setupPublicReviewRoutes configures public review routes
@@ -252,17 +342,40 @@ func setupHealthRoutes(router fiber.Router) {
 	router.Get("/health/detailed", health.DetailedHealth)
 }
 
-// setupJobRoutes configures background job routes
+// setupJobRoutes configures background job routes, which are limited to staff
 func setupJobRoutes(router fiber.Router) {
-	router.Get("/jobs", jobs.GetJobs)
-	router.Get("/jobs/:job_id", jobs.GetJobByID)
-	router.Post("/jobs", jobs.CreateJob)
-	router.Delete("/jobs/:job_id", jobs.DeleteJob)
+	view := auth.RequirePermission(auth.PermViewJobs)
+	manage := auth.RequirePermission(auth.PermManageJobs)
+
+	router.Get("/jobs", view, jobs.GetJobs)
+	router.Get("/jobs/:job_id", view, jobs.GetJobByID)
+	router.Post("/jobs", manage, jobs.CreateJob)
+	router.Delete("/jobs/:job_id", manage, jobs.DeleteJob)
+}
+
+// setupModerationRoutes configures content moderation routes
+func setupModerationRoutes(router fiber.Router) {
+	moderation := router.Group("/moderation", auth.RequirePermission(auth.PermModerateContent))
+	moderation.Get("/reviews/reports", reviews.GetReviewReports)
+	moderation.Delete("/reviews/:review_id", reviews.RemoveReview)
+	moderation.Delete("/reviews/:review_id/reports", reviews.DismissReviewReports)
+	moderation.Get("/listings/flags", listings.GetListingFlags)
+	moderation.Delete("/listings/:listing_id/flags", listings.DismissListingFlags)
+}
+
+// setupAdminRoutes configures administration routes
+func setupAdminRoutes(router fiber.Router) {
+	admin := router.Group("/admin")
+	admin.Patch("/users/:user_id/role", auth.RequirePermission(auth.PermManageRoles), auth.SetUserRole)
+	admin.Get("/audit_events", auth.RequirePermission(auth.PermViewAudit), auth.QueryAuditEvents)
+	admin.Get("/image_jobs/failed", auth.RequirePermission(auth.PermViewJobs), GetFailedImageJobsHandler)
+	admin.Post("/image_jobs/failed/:job_id/requeue", auth.RequirePermission(auth.PermManageJobs), RequeueFailedImageJobHandler)
+	admin.Delete("/image_jobs/failed/:job_id", auth.RequirePermission(auth.PermManageJobs), DiscardFailedImageJobHandler)
 }
 
 // setupDebugRoutes configures debug routes for development/testing
 func setupDebugRoutes(app *fiber.App) {
-	debug := app.Group("/debug")
+	debug := app.Group("/debug", auth.AuthMiddleware(), auth.CSRFMiddleware(), auth.RequirePermission(auth.PermDebug))
 	debug.Post("/send-test-email", TestEmailHandler)
 	debug.Get("/email-queue-status", GetEmailQueueStatusHandler)
 	debug.Get("/image-queue-status", GetImageQueueStatusHandler)
@@ -280,6 +393,7 @@ func setupPublicBiddingRoutes(app *fiber.App) {
 
 func setupProtectedBidRoutes(router fiber.Router) {
 	// Protected routes requiring authentication
+	router.Get("/listings/:listing_id/bids", bids.GetBids) // Same as the public route, for API key integrations
 	router.Post("/listings/:listing_id/bids", bids.UploadBid)
 	router.Delete("/bids/:bid_id", bids.DeleteBid)
 }
@@ -0,0 +1,414 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"greenvue/internal/db"
+	"greenvue/lib"
+	"greenvue/lib/errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	apiKeysTable = "api_keys"
+
+	// TokenTypeAPIKey marks claims that were built from an API key instead of a JWT
+	TokenTypeAPIKey = "api_key"
+
+	apiKeyPrefix          = "gv_"
+	apiKeyHeaderScheme    = "ApiKey "
+	apiKeyNameMaxLength   = 64
+	maxAPIKeysPerUser     = 10
+	maxAPIKeyLifetimeDays = 365
+	apiKeyTouchInterval   = time.Minute // last_used_at is written at most this often per key
+)
+
+// API key scopes
+const (
+	ScopeListingsRead  = "listings:read"
+	ScopeListingsWrite = "listings:write"
+	ScopeBidsRead      = "bids:read"
+	ScopeChatRead      = "chat:read"
+)
+
+var apiKeyScopes = []string{ScopeListingsRead, ScopeListingsWrite, ScopeBidsRead, ScopeChatRead}
+
+// apiKeyRoute is a protected route that API keys may call with the given scope
+type apiKeyRoute struct {
+	Method  string
+	Pattern string // Fiber style path, e.g. /api/listings/:listing_id
+	Scope   string
+}
+
+// apiKeyRoutes lists every protected route reachable with an API key.
+// Anything not listed here, including account, session and key management, is rejected.
+var apiKeyRoutes = []apiKeyRoute{
+	{fiber.MethodGet, "/api/listings/seller/:seller_id", ScopeListingsRead},
+	{fiber.MethodGet, "/api/listings/:listing_id/bids", ScopeBidsRead},
+	{fiber.MethodPost, "/api/listings", ScopeListingsWrite},
+	{fiber.MethodDelete, "/api/listings/:listing_id", ScopeListingsWrite},
+	{fiber.MethodGet, "/api/chat/conversation", ScopeChatRead},
+	{fiber.MethodGet, "/api/chat/messages/:conversation_id", ScopeChatRead},
+}
+
+// APIKey is a personal API key; only the SHA-256 hash of the secret is stored
+type APIKey struct {
+	ID         uuid.UUID  `json:"id"`
+	UserID     uuid.UUID  `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // First characters of the key, shown to help users tell keys apart
+	KeyHash    string     `json:"key_hash"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// apiKeyResponse is an API key as returned to the client, without the hash
+type apiKeyResponse struct {
+	ID         uuid.UUID  `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func (k APIKey) response() apiKeyResponse {
+	return apiKeyResponse{
+		ID:         k.ID,
+		Name:       k.Name,
+		Prefix:     k.Prefix,
+		Scopes:     k.Scopes,
+		ExpiresAt:  k.ExpiresAt,
+		LastUsedAt: k.LastUsedAt,
+		RevokedAt:  k.RevokedAt,
+		CreatedAt:  k.CreatedAt,
+	}
+}
+
+// isActive reports whether the key is neither revoked nor expired
+func (k APIKey) isActive(now time.Time) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
+
+// hasScope reports whether the key was granted a scope
+func (k APIKey) hasScope(scope string) bool {
+	for _, granted := range k.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// generateAPIKey creates a new random key in the form gv_<32 hex chars>
+func generateAPIKey() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	return apiKeyPrefix + hex.EncodeToString(buf), nil
+}
+
+// hashAPIKey returns the hex encoded SHA-256 hash of a key.
+// Keys carry 128 random bits, so a fast hash is enough to make a leaked table useless.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// getAPIKeys fetches API keys matching a PostgREST query
+func getAPIKeys(query string) ([]APIKey, error) {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return nil, fmt.Errorf("database client not available")
+	}
+
+	data, err := client.GET(apiKeysTable, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch API keys: %w", err)
+	}
+
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse API keys: %w", err)
+	}
+	return keys, nil
+}
+
+// apiKeyTouches remembers when last_used_at was last written for each key
+var apiKeyTouches = struct {
+	sync.Mutex
+	seen map[uuid.UUID]time.Time
+}{seen: make(map[uuid.UUID]time.Time)}
+
+// touchAPIKey updates last_used_at in the background, at most once per apiKeyTouchInterval
+func touchAPIKey(keyID uuid.UUID) {
+	now := time.Now().UTC()
+
+	apiKeyTouches.Lock()
+	if last, ok := apiKeyTouches.seen[keyID]; ok && now.Sub(last) < apiKeyTouchInterval {
+		apiKeyTouches.Unlock()
+		return
+	}
+	apiKeyTouches.seen[keyID] = now
+	apiKeyTouches.Unlock()
+
+	go func() {
+		client := db.GetGlobalClient()
+		if client == nil {
+			return
+		}
+		if _, err := client.PATCH(apiKeysTable, keyID, map[string]any{"last_used_at": now}); err != nil {
+			log.Printf("Failed to update last use of API key %s: %v", keyID, err)
+		}
+	}()
+}
+
+// matchRoutePattern reports whether a path matches a Fiber style pattern with :param segments
+func matchRoutePattern(pattern, path string) bool {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(patternParts) != len(pathParts) {
+		return false
+	}
+
+	for i, part := range patternParts {
+		if strings.HasPrefix(part, ":") {
+			if pathParts[i] == "" {
+				return false
+			}
+			continue
+		}
+		if part != pathParts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// apiKeyScopeFor returns the scope needed to call a route with an API key, or false if keys may not call it
+func apiKeyScopeFor(method, path string) (string, bool) {
+	for _, route := range apiKeyRoutes {
+		if route.Method == method && matchRoutePattern(route.Pattern, path) {
+			return route.Scope, true
+		}
+	}
+	return "", false
+}
+
+// authenticateAPIKey validates an API key for the current request and returns claims for its owner.
+// The claims always carry the plain user role, so API keys never grant staff permissions.
+func authenticateAPIKey(c *fiber.Ctx, key string) (*Claims, error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return nil, errors.Unauthorized("invalid API key")
+	}
+
+	keys, err := getAPIKeys(fmt.Sprintf("key_hash=eq.%s", hashAPIKey(key)))
+	if err != nil {
+		return nil, errors.InternalServerError(err.Error())
+	}
+	if len(keys) == 0 || !keys[0].isActive(time.Now()) {
+		return nil, errors.Unauthorized("invalid, expired or revoked API key")
+	}
+	apiKey := keys[0]
+
+	scope, allowed := apiKeyScopeFor(c.Method(), c.Path())
+	if !allowed {
+		return nil, errors.Forbidden("This endpoint cannot be used with an API key")
+	}
+	if !apiKey.hasScope(scope) {
+		return nil, errors.Forbidden(fmt.Sprintf("API key is missing scope: %s", scope))
+	}
+
+	touchAPIKey(apiKey.ID)
+	c.Locals("api_key", &apiKey)
+
+	return &Claims{
+		UserId: apiKey.UserID,
+		Role:   RoleUser,
+		Type:   TokenTypeAPIKey,
+	}, nil
+}
+
+// normalizeAPIKeyScopes validates and deduplicates requested scopes
+func normalizeAPIKeyScopes(requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return nil, errors.ValidationError("At least one scope is required", "scopes")
+	}
+
+	seen := make(map[string]bool)
+	scopes := make([]string, 0, len(requested))
+	for _, scope := range requested {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		valid := false
+		for _, known := range apiKeyScopes {
+			if scope == known {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, errors.ValidationError(fmt.Sprintf("Unknown scope: %s", scope), "scopes")
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+// ListAPIKeys returns the authenticated user's API keys, newest first
+func ListAPIKeys(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	keys, err := getAPIKeys(fmt.Sprintf("user_id=eq.%s&order=created_at.desc", claims.UserId))
+	if err != nil {
+		return errors.InternalServerError(err.Error())
+	}
+
+	response := make([]apiKeyResponse, 0, len(keys))
+	for _, key := range keys {
+		response = append(response, key.response())
+	}
+
+	return errors.SuccessResponse(c, response)
+}
+
+// CreateAPIKey creates a scoped API key. The key itself is only returned in this response.
+func CreateAPIKey(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	var payload struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expiresInDays"`
+	}
+
+	if err := c.BodyParser(&payload); err != nil {
+		return errors.BadRequest("Invalid request format")
+	}
+
+	name := lib.SanitizeInput(strings.TrimSpace(payload.Name))
+	if name == "" {
+		return errors.ValidationError("Name is required", "name")
+	}
+	if len(name) > apiKeyNameMaxLength {
+		return errors.ValidationError(fmt.Sprintf("Name must be at most %d characters", apiKeyNameMaxLength), "name")
+	}
+
+	scopes, err := normalizeAPIKeyScopes(payload.Scopes)
+	if err != nil {
+		return err
+	}
+
+	if payload.ExpiresInDays < 0 || payload.ExpiresInDays > maxAPIKeyLifetimeDays {
+		return errors.ValidationError(fmt.Sprintf("Expiry must be between 1 and %d days, or 0 for no expiry", maxAPIKeyLifetimeDays), "expiresInDays")
+	}
+
+	existing, err := getAPIKeys(fmt.Sprintf("user_id=eq.%s&revoked_at=is.null", claims.UserId))
+	if err != nil {
+		return errors.InternalServerError(err.Error())
+	}
+	active := 0
+	for _, key := range existing {
+		if key.isActive(time.Now()) {
+			active++
+		}
+	}
+	if active >= maxAPIKeysPerUser {
+		return errors.BadRequest(fmt.Sprintf("You can have at most %d active API keys", maxAPIKeysPerUser))
+	}
+
+	secret, err := generateAPIKey()
+	if err != nil {
+		return errors.InternalServerError(err.Error())
+	}
+
+	now := time.Now().UTC()
+	apiKey := APIKey{
+		ID:        uuid.New(),
+		UserID:    claims.UserId,
+		Name:      name,
+		Prefix:    secret[:len(apiKeyPrefix)+6],
+		KeyHash:   hashAPIKey(secret),
+		Scopes:    scopes,
+		CreatedAt: now,
+	}
+	if payload.ExpiresInDays > 0 {
+		expiresAt := now.AddDate(0, 0, payload.ExpiresInDays)
+		apiKey.ExpiresAt = &expiresAt
+	}
+
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create database client")
+	}
+
+	if _, err := client.POST(apiKeysTable, apiKey); err != nil {
+		return errors.DatabaseError("Failed to create API key: " + err.Error())
+	}
+	auditUserAction(c, AuditAPIKeyCreate, claims.UserId, map[string]any{"key_id": apiKey.ID, "scopes": scopes})
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"key":    secret,
+		"apiKey": apiKey.response(),
+	})
+}
+
+// RevokeAPIKey revokes one of the authenticated user's API keys
+func RevokeAPIKey(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	keyID, err := uuid.Parse(c.Params("key_id"))
+	if err != nil {
+		return errors.BadRequest("Invalid API key ID format")
+	}
+
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create database client")
+	}
+
+	// Revoked keys are kept so the list still shows when they were last used
+	data, err := client.PATCHWhere(apiKeysTable,
+		fmt.Sprintf("id=eq.%s&user_id=eq.%s&revoked_at=is.null", keyID, claims.UserId),
+		map[string]any{"revoked_at": time.Now().UTC()})
+	if err != nil {
+		return errors.DatabaseError("Failed to revoke API key: " + err.Error())
+	}
+	if len(data) == 0 || string(data) == "[]" {
+		return errors.NotFound("API key not found")
+	}
+	auditUserAction(c, AuditAPIKeyRevoke, claims.UserId, map[string]any{"key_id": keyID})
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"message": "API key revoked successfully",
+	})
+}
@@ -0,0 +1,604 @@
+package auth
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"greenvue/internal/db"
+	"greenvue/lib/errors"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Audit actions. Each one is recorded with an outcome, so failed attempts use the same action.
+const (
+	AuditLogin          = "auth.login"
+	AuditLogout         = "auth.logout"
+	AuditTokenRefresh   = "auth.token_refresh"
+	AuditPasswordChange = "auth.password_change"
+	AuditPasswordReset  = "auth.password_reset_request"
+	AuditAccountDelete  = "auth.account_delete"
+	AuditOAuthCallback  = "auth.oauth_callback"
+	AuditEmailChange    = "auth.email_change"
+	AuditMFAChange      = "auth.mfa_change"
+	AuditSessionRevoke  = "auth.session_revoke"
+	AuditAPIKeyCreate   = "auth.api_key_create"
+	AuditAPIKeyRevoke   = "auth.api_key_revoke"
+	AuditDataExport     = "auth.data_export"
+	AuditRoleChange     = "admin.role_change"
+)
+
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 200
+)
+
+// AuditEvent is a single entry in the append-only security audit log
+type AuditEvent struct {
+	ID        uuid.UUID      `json:"id"`
+	ActorID   *uuid.UUID     `json:"actor_id,omitempty"`  // Who did it; empty for anonymous requests such as a failed login
+	Action    string         `json:"action"`              // One of the Audit* actions
+	TargetID  *uuid.UUID     `json:"target_id,omitempty"` // The account the action affects
+	Target    string         `json:"target,omitempty"`    // Other identifiers, e.g. the email address of a failed login
+	Outcome   string         `json:"outcome"`             // "success" or "failure"
+	Reason    string         `json:"reason,omitempty"`    // Why an attempt failed
+	IP        string         `json:"ip"`
+	UserAgent string         `json:"user_agent"`
+	RequestID string         `json:"request_id"`
+	Metadata  map[string]any `json:"metadata,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// AuditFilter selects audit events. Empty fields match everything.
+type AuditFilter struct {
+	UserID         *uuid.UUID // Events where the user is the actor or the target
+	ActorID        *uuid.UUID
+	TargetID       *uuid.UUID
+	Actions        []string
+	ExcludeActions []string
+	Outcome        string
+	IP             string
+	RequestID      string
+	Since          time.Time
+	Until          time.Time
+	Limit          int
+	Offset         int
+}
+
+// matches reports whether an event passes the filter, ignoring paging
+func (f AuditFilter) matches(event AuditEvent) bool {
+	sameID := func(a, b *uuid.UUID) bool { return a != nil && b != nil && *a == *b }
+
+	if f.UserID != nil && !sameID(f.UserID, event.ActorID) && !sameID(f.UserID, event.TargetID) {
+		return false
+	}
+	if f.ActorID != nil && !sameID(f.ActorID, event.ActorID) {
+		return false
+	}
+	if f.TargetID != nil && !sameID(f.TargetID, event.TargetID) {
+		return false
+	}
+	if len(f.Actions) > 0 && !containsString(f.Actions, event.Action) {
+		return false
+	}
+	if containsString(f.ExcludeActions, event.Action) {
+		return false
+	}
+	if f.Outcome != "" && f.Outcome != event.Outcome {
+		return false
+	}
+	if f.IP != "" && f.IP != event.IP {
+		return false
+	}
+	if f.RequestID != "" && f.RequestID != event.RequestID {
+		return false
+	}
+	if !f.Since.IsZero() && event.CreatedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !event.CreatedAt.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditSink stores audit events. Sinks only ever append; there is no way to change or delete an event.
+type AuditSink interface {
+	// Write appends an event
+	Write(event AuditEvent) error
+	// Query returns matching events, newest first
+	Query(filter AuditFilter) ([]AuditEvent, error)
+}
+
+var (
+	auditSink   AuditSink
+	auditSinkMu sync.RWMutex
+)
+
+// InitAuditLog configures the audit sinks by name ("file" or "database").
+// Events are written to every sink and queried from the first one.
+func InitAuditLog(kinds []string, filePath string) {
+	var sinks []AuditSink
+	for _, kind := range kinds {
+		switch kind {
+		case "file":
+			sinks = append(sinks, NewFileAuditSink(filePath))
+		case "database":
+			sinks = append(sinks, NewDatabaseAuditSink())
+		default:
+			log.Printf("Warning: unknown audit sink %q, ignoring it", kind)
+		}
+	}
+
+	if len(sinks) == 0 {
+		log.Printf("Warning: no audit sink configured, falling back to file %s", filePath)
+		sinks = append(sinks, NewFileAuditSink(filePath))
+	}
+
+	if len(sinks) == 1 {
+		SetAuditSink(sinks[0])
+		return
+	}
+	SetAuditSink(MultiAuditSink(sinks))
+}
+
+// SetAuditSink replaces the audit sink
+func SetAuditSink(sink AuditSink) {
+	auditSinkMu.Lock()
+	defer auditSinkMu.Unlock()
+	auditSink = sink
+}
+
+// GetAuditSink returns the configured audit sink, defaulting to a file in the working directory
+func GetAuditSink() AuditSink {
+	auditSinkMu.RLock()
+	if auditSink != nil {
+		defer auditSinkMu.RUnlock()
+		return auditSink
+	}
+	auditSinkMu.RUnlock()
+
+	auditSinkMu.Lock()
+	defer auditSinkMu.Unlock()
+
+	if auditSink == nil {
+		auditSink = NewFileAuditSink("audit.jsonl")
+	}
+
+	return auditSink
+}
+
+// RecordAudit completes an event with the details of the request and writes it to the audit sink.
+// The actor defaults to the authenticated user. Failures to write are logged and never fail the request.
+func RecordAudit(c *fiber.Ctx, event AuditEvent) {
+	event.ID = uuid.New()
+	event.CreatedAt = time.Now().UTC()
+	if event.Outcome == "" {
+		event.Outcome = AuditOutcomeSuccess
+	}
+
+	if c != nil {
+		event.IP = c.IP()
+		event.UserAgent = c.Get(fiber.HeaderUserAgent)
+		event.RequestID, _ = c.Locals("requestID").(string)
+
+		if event.ActorID == nil {
+			if claims, ok := c.Locals("user").(*Claims); ok && claims != nil && claims.UserId != uuid.Nil {
+				actorID := claims.UserId
+				event.ActorID = &actorID
+			}
+		}
+	}
+
+	if err := GetAuditSink().Write(event); err != nil {
+		log.Printf("Failed to write audit event %s (%s %s): %v", event.ID, event.Action, event.Outcome, err)
+	}
+}
+
+// auditFailure records a failed attempt against an account or identifier
+func auditFailure(c *fiber.Ctx, action string, targetID *uuid.UUID, target, reason string) {
+	RecordAudit(c, AuditEvent{
+		Action:   action,
+		TargetID: targetID,
+		Target:   target,
+		Outcome:  AuditOutcomeFailure,
+		Reason:   reason,
+	})
+}
+
+// auditUserAction records a successful action by a user on their own account
+func auditUserAction(c *fiber.Ctx, action string, userID uuid.UUID, metadata map[string]any) {
+	RecordAudit(c, AuditEvent{
+		Action:   action,
+		ActorID:  &userID,
+		TargetID: &userID,
+		Metadata: metadata,
+	})
+}
+
+// MultiAuditSink writes to several sinks and queries the first one
+type MultiAuditSink []AuditSink
+
+func (m MultiAuditSink) Write(event AuditEvent) error {
+	var failed []string
+	for _, sink := range m {
+		if err := sink.Write(event); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("audit sinks failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (m MultiAuditSink) Query(filter AuditFilter) ([]AuditEvent, error) {
+	if len(m) == 0 {
+		return []AuditEvent{}, nil
+	}
+	return m[0].Query(filter)
+}
+
+// File sink limits. Rotated files are never deleted, so the log stays append-only; archive them externally.
+const (
+	auditFileMaxSize     = 10 << 20 // The live file is rotated once it would grow past this size
+	auditFileScanBackups = 3        // Rotated files that queries read besides the live one
+)
+
+// FileAuditSink appends events as JSON lines to a local file, suiting development and small deployments.
+// The file is rotated at auditFileMaxSize, and queries only read the live file and the newest rotated
+// ones, so a query costs a bounded scan. Use the database sink for the full history.
+type FileAuditSink struct {
+	path        string
+	maxSize     int64
+	scanBackups int
+	mu          sync.Mutex
+}
+
+// NewFileAuditSink creates a sink that appends to the given file
+func NewFileAuditSink(path string) *FileAuditSink {
+	return &FileAuditSink{path: path, maxSize: auditFileMaxSize, scanBackups: auditFileScanBackups}
+}
+
+func (f *FileAuditSink) Write(event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit event: %w", err)
+	}
+	line = append(line, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if dir := filepath.Dir(f.path); dir != "." {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return fmt.Errorf("failed to create audit log directory: %w", err)
+		}
+	}
+
+	if info, err := os.Stat(f.path); err == nil && info.Size() > 0 && info.Size()+int64(len(line)) > f.maxSize {
+		// Timestamped names sort in rotation order and never overwrite an earlier file
+		rotated := f.path + "." + time.Now().UTC().Format("20060102T150405.000000000")
+		if err := os.Rename(f.path, rotated); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(line); err != nil {
+		return fmt.Errorf("failed to append audit event: %w", err)
+	}
+	return nil
+}
+
+// openScanFiles opens the newest rotated files and the live file, oldest first.
+// It holds the lock only while opening, so a slow query never blocks writers;
+// open files stay readable when they are rotated.
+func (f *FileAuditSink) openScanFiles() ([]*os.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rotated, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rotated audit logs: %w", err)
+	}
+	sort.Strings(rotated)
+	paths := append(rotated[max(0, len(rotated)-f.scanBackups):], f.path)
+
+	var files []*os.File
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			for _, opened := range files {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func (f *FileAuditSink) Query(filter AuditFilter) ([]AuditEvent, error) {
+	files, err := f.openScanFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	var events []AuditEvent
+	for _, file := range files {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var event AuditEvent
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				continue // Skip a line cut short by a crash or still being written
+			}
+			if filter.matches(event) {
+				events = append(events, event)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read audit log: %w", err)
+		}
+	}
+
+	// Lines are in write order; return the newest first
+	sort.SliceStable(events, func(i, j int) bool { return events[i].CreatedAt.After(events[j].CreatedAt) })
+
+	start := min(filter.Offset, len(events))
+	end := min(start+filter.Limit, len(events))
+	if filter.Limit <= 0 {
+		end = len(events)
+	}
+	if events == nil {
+		return []AuditEvent{}, nil
+	}
+	return events[start:end], nil
+}
+
+// DatabaseAuditSink stores events in the audit_events table.
+// The table should only grant INSERT and SELECT so the log stays append-only.
+type DatabaseAuditSink struct {
+	table string
+}
+
+// NewDatabaseAuditSink creates an audit sink backed by Supabase
+func NewDatabaseAuditSink() *DatabaseAuditSink {
+	return &DatabaseAuditSink{table: "audit_events"}
+}
+
+func (d *DatabaseAuditSink) Write(event AuditEvent) error {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return fmt.Errorf("database client not available")
+	}
+
+	if _, err := client.POST(d.table, event); err != nil {
+		return fmt.Errorf("failed to store audit event: %w", err)
+	}
+	return nil
+}
+
+func (d *DatabaseAuditSink) Query(filter AuditFilter) ([]AuditEvent, error) {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return nil, fmt.Errorf("database client not available")
+	}
+
+	data, err := client.GET(d.table, buildAuditQuery(filter))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch audit events: %w", err)
+	}
+
+	var events []AuditEvent
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, fmt.Errorf("failed to parse audit events: %w", err)
+	}
+
+	if events == nil {
+		events = []AuditEvent{}
+	}
+	return events, nil
+}
+
+// buildAuditQuery translates a filter into a PostgREST query string
+func buildAuditQuery(filter AuditFilter) string {
+	conditions := []string{"order=created_at.desc"}
+
+	if filter.UserID != nil {
+		conditions = append(conditions, fmt.Sprintf("or=(actor_id.eq.%s,target_id.eq.%s)", filter.UserID, filter.UserID))
+	}
+	if filter.ActorID != nil {
+		conditions = append(conditions, "actor_id=eq."+filter.ActorID.String())
+	}
+	if filter.TargetID != nil {
+		conditions = append(conditions, "target_id=eq."+filter.TargetID.String())
+	}
+	if len(filter.Actions) > 0 {
+		conditions = append(conditions, "action=in.("+url.QueryEscape(strings.Join(filter.Actions, ","))+")")
+	}
+	if len(filter.ExcludeActions) > 0 {
+		conditions = append(conditions, "action=not.in.("+url.QueryEscape(strings.Join(filter.ExcludeActions, ","))+")")
+	}
+	if filter.Outcome != "" {
+		conditions = append(conditions, "outcome=eq."+url.QueryEscape(filter.Outcome))
+	}
+	if filter.IP != "" {
+		conditions = append(conditions, "ip=eq."+url.QueryEscape(filter.IP))
+	}
+	if filter.RequestID != "" {
+		conditions = append(conditions, "request_id=eq."+url.QueryEscape(filter.RequestID))
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "created_at=gte."+url.QueryEscape(filter.Since.UTC().Format(time.RFC3339)))
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "created_at=lt."+url.QueryEscape(filter.Until.UTC().Format(time.RFC3339)))
+	}
+	if filter.Limit > 0 {
+		conditions = append(conditions, fmt.Sprintf("limit=%d", filter.Limit))
+	}
+	if filter.Offset > 0 {
+		conditions = append(conditions, fmt.Sprintf("offset=%d", filter.Offset))
+	}
+
+	return strings.Join(conditions, "&")
+}
+
+// GetSecurityActivity returns the recent security events of the authenticated user's account.
+// Routine token refreshes are left out.
+func GetSecurityActivity(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	limit, offset, err := auditPaging(c)
+	if err != nil {
+		return err
+	}
+
+	userID := claims.UserId
+	events, err := GetAuditSink().Query(AuditFilter{
+		UserID:         &userID,
+		ExcludeActions: []string{AuditTokenRefresh},
+		Limit:          limit,
+		Offset:         offset,
+	})
+	if err != nil {
+		return errors.InternalServerError("Failed to fetch security activity: " + err.Error())
+	}
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"events": events,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// QueryAuditEvents lets staff search the audit log.
+// Supported query parameters: user_id, actor_id, target_id, action (comma separated), outcome, ip,
+// request_id, since, until (RFC 3339), limit and offset.
+func QueryAuditEvents(c *fiber.Ctx) error {
+	limit, offset, err := auditPaging(c)
+	if err != nil {
+		return err
+	}
+
+	filter := AuditFilter{
+		Outcome:   c.Query("outcome"),
+		IP:        c.Query("ip"),
+		RequestID: c.Query("request_id"),
+		Limit:     limit,
+		Offset:    offset,
+	}
+
+	if filter.Outcome != "" && filter.Outcome != AuditOutcomeSuccess && filter.Outcome != AuditOutcomeFailure {
+		return errors.ValidationError("outcome must be success or failure", "outcome")
+	}
+
+	for param, target := range map[string]**uuid.UUID{
+		"user_id":   &filter.UserID,
+		"actor_id":  &filter.ActorID,
+		"target_id": &filter.TargetID,
+	} {
+		if value := c.Query(param); value != "" {
+			id, err := uuid.Parse(value)
+			if err != nil {
+				return errors.ValidationError("Invalid "+param, param)
+			}
+			*target = &id
+		}
+	}
+
+	if actions := c.Query("action"); actions != "" {
+		for _, action := range strings.Split(actions, ",") {
+			if action = strings.TrimSpace(action); action != "" {
+				filter.Actions = append(filter.Actions, action)
+			}
+		}
+	}
+
+	for param, target := range map[string]*time.Time{
+		"since": &filter.Since,
+		"until": &filter.Until,
+	} {
+		if value := c.Query(param); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return errors.ValidationError(param+" must be an RFC 3339 timestamp", param)
+			}
+			*target = parsed
+		}
+	}
+
+	events, err := GetAuditSink().Query(filter)
+	if err != nil {
+		return errors.InternalServerError("Failed to fetch audit events: " + err.Error())
+	}
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"events": events,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// auditPaging reads the limit and offset query parameters
+func auditPaging(c *fiber.Ctx) (int, int, error) {
+	limit, offset := defaultAuditPageSize, 0
+
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxAuditPageSize {
+			return 0, 0, errors.ValidationError(fmt.Sprintf("limit must be between 1 and %d", maxAuditPageSize), "limit")
+		}
+		limit = parsed
+	}
+
+	if value := c.Query("offset"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return 0, 0, errors.ValidationError("offset must not be negative", "offset")
+		}
+		offset = parsed
+	}
+
+	return limit, offset, nil
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestFileAuditSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink := NewFileAuditSink(path)
+	sink.maxSize = 1024
+	sink.scanBackups = 1
+
+	userID := uuid.New()
+	start := time.Now().UTC()
+	for i := range 40 {
+		err := sink.Write(AuditEvent{
+			ID:        uuid.New(),
+			ActorID:   &userID,
+			Action:    AuditLogin,
+			Outcome:   AuditOutcomeSuccess,
+			Target:    fmt.Sprintf("event-%d", i),
+			CreatedAt: start.Add(time.Duration(i) * time.Second),
+		})
+		if err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil || len(rotated) < 2 {
+		t.Fatalf("rotated files = %v, %v, want several", rotated, err)
+	}
+
+	// Only the live file and the newest rotated file are scanned
+	events, err := sink.Query(AuditFilter{UserID: &userID})
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if len(events) == 0 || len(events) >= 40 {
+		t.Fatalf("Query() returned %d events, want a bounded, non-empty window", len(events))
+	}
+	if events[0].Target != "event-39" {
+		t.Errorf("newest event = %q, want event-39", events[0].Target)
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].CreatedAt.After(events[i-1].CreatedAt) {
+			t.Fatalf("events are not newest first at %d", i)
+		}
+	}
+
+	page, err := sink.Query(AuditFilter{UserID: &userID, Limit: 2, Offset: 1})
+	if err != nil || len(page) != 2 || page[0].Target != "event-38" {
+		t.Errorf("paged Query() = %+v, %v", page, err)
+	}
+}
+
+func TestFileAuditSinkQueryWithoutFile(t *testing.T) {
+	sink := NewFileAuditSink(filepath.Join(t.TempDir(), "missing.jsonl"))
+	events, err := sink.Query(AuditFilter{})
+	if err != nil || events == nil || len(events) != 0 {
+		t.Errorf("Query() = %v, %v, want an empty list", events, err)
+	}
+}
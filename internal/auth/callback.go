@@ -1,12 +1,15 @@
 package auth
 
 import (
+	"crypto/subtle"
+	stderrors "errors"
 	"fmt"
+	"greenvue/internal/config"
 	"greenvue/internal/db"
 	"greenvue/lib"
 	"greenvue/lib/errors"
 	"log"
-	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -18,9 +21,12 @@ import (
 	"github.com/google/uuid"
 )
 
-type GoogleTokenResponse struct {
-	IDToken string `json:"id_token"`
-}
+const (
+	oauthStateCookieName = "oauthstate"
+	userIdentitiesTable  = "user_identities"
+)
+
+var ErrOIDCAccountExists = stderrors.New("an account with this email already exists")
 
 type User struct {
 	Id uuid.UUID `json:"id"`
@@ -31,12 +37,107 @@ type SupabaseResp struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
 	ExpiresIn    int64  `json:"expires_in"`
+	MFAToken     string `json:"mfa_token,omitempty"` // Set instead of the tokens when a second factor is required
+}
+
+// UserIdentity links an account to a subject at an OpenID Connect provider
+type UserIdentity struct {
+	ID        uuid.UUID `json:"id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HandleOIDCLogin redirects to the login page of a configured provider.
+// With ?mode=register the callback redirects with registration=true.
+func HandleOIDCLogin(c *fiber.Ctx) error {
+	return startOIDCLogin(c, c.Params("provider"), c.Query("mode") == "register")
+}
+
+// HandleOIDCCallback completes a login started by HandleOIDCLogin
+func HandleOIDCCallback(c *fiber.Ctx) error {
+	return finishOIDCLogin(c, c.Params("provider"))
+}
+
+// HandleGoogleLogin starts a Google login
+func HandleGoogleLogin(c *fiber.Ctx) error {
+	return startOIDCLogin(c, "google", false)
+}
+
+// HandleGoogleRegistrationStart starts a Google registration
+func HandleGoogleRegistrationStart(c *fiber.Ctx) error {
+	return startOIDCLogin(c, "google", true)
 }
 
+// HandleGoogleCallback completes a Google login or registration
 func HandleGoogleCallback(c *fiber.Ctx) error {
+	return finishOIDCLogin(c, "google")
+}
+
+// startOIDCLogin creates the state, nonce and PKCE verifier of a login and redirects to the provider
+func startOIDCLogin(c *fiber.Ctx, providerName string, registration bool) error {
+	provider, err := getOIDCProvider(providerName)
+	if err != nil {
+		return errors.NotFound("Unknown login provider")
+	}
+
+	authURL, state, err := provider.AuthorizationURL(registration)
+	if err != nil {
+		log.Printf("Failed to start %s login: %v", provider.Name, err)
+		return errors.InternalServerError("Login provider is unavailable")
+	}
+
+	// Binds the login to this browser, so a callback URL cannot be replayed in someone else's session
+	setOAuthStateCookie(c, state, int(oidcFlowTimeout.Seconds()))
+
+	return c.Redirect(authURL)
+}
+
+// setOAuthStateCookie stores the state of a pending login; a negative maxAge clears it
+func setOAuthStateCookie(c *fiber.Ctx, state string, maxAge int) {
+	cfg := config.LoadConfig()
+
+	// Get the hostname and extract domain for the cookie
+	host := c.Hostname()
+	var domain string
+	// For local development, don't set the domain at all
+	if cfg.Environment != "production" {
+		domain = ""
+	} else {
+		// For production, use the parent domain to share cookies across subdomains
+		// This ensures the cookie works for all subdomains (www, api, etc)
+		if strings.Contains(host, "greenvue.eu") {
+			domain = "greenvue.eu" // Parent domain shared by all subdomains
+		} else {
+			domain = host
+		}
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     oauthStateCookieName,
+		Value:    state,
+		Path:     "/",
+		Domain:   domain,
+		MaxAge:   maxAge,
+		Expires:  time.Now().Add(time.Duration(maxAge) * time.Second),
+		HTTPOnly: true,
+		Secure:   cfg.Environment == "production", // Only secure in production
+		SameSite: "Lax",                           // Lax so the cookie survives the redirect back from the provider
+	})
+}
+
+// finishOIDCLogin validates the callback, verifies the ID token and signs the user in
+func finishOIDCLogin(c *fiber.Ctx, providerName string) error {
+	auditCallbackFailure := func(reason string) {
+		auditFailure(c, AuditOAuthCallback, nil, providerName, reason)
+	}
+
 	// Check for error parameter from OAuth provider
 	if errorMsg := c.Query("error"); errorMsg != "" {
 		errorDescription := c.Query("error_description")
+		auditCallbackFailure("provider_error: " + errorMsg)
 		return errors.BadRequest(fmt.Sprintf("OAuth error: %s", errorDescription))
 	}
 
@@ -45,23 +146,85 @@ func HandleGoogleCallback(c *fiber.Ctx) error {
 		return errors.BadRequest("Missing code parameter")
 	}
 
-	// Check if this is a registration or login flow
-	stateFromQuery := c.Query("state")
-
-	if stateFromQuery == "" {
+	state := c.Query("state")
+	if state == "" {
 		return errors.BadRequest("Missing state parameter")
 	}
 
-	// Exchange code for Google tokens
-	tokenResp, err := exchangeCodeForGoogleToken(code)
+	provider, err := getOIDCProvider(providerName)
 	if err != nil {
-		return errors.InternalServerError("Failed to exchange code for token: " + err.Error())
+		return errors.NotFound("Unknown login provider")
 	}
 
-	// Send Google ID token to Supabase
-	supabaseResp, err := signInWithSupabase(tokenResp.IDToken)
+	cookieState := c.Cookies(oauthStateCookieName)
+	setOAuthStateCookie(c, "", -1)
+	if cookieState == "" || subtle.ConstantTimeCompare([]byte(cookieState), []byte(state)) != 1 {
+		auditCallbackFailure("state_mismatch")
+		return errors.BadRequest("Login state does not match, please try again")
+	}
+
+	flow, err := oidcFlows.consume(state, provider.Name)
 	if err != nil {
-		return errors.InternalServerError("Failed to sign in with Supabase: " + err.Error())
+		auditCallbackFailure("flow_expired")
+		return errors.BadRequest("Login expired, please try again")
+	}
+
+	identity, err := provider.Exchange(code, flow)
+	if err != nil {
+		log.Printf("%s login failed: %v", provider.Name, err)
+		auditCallbackFailure(err.Error())
+		if stderrors.Is(err, ErrOIDCIDToken) {
+			return errors.Unauthorized("Failed to verify login")
+		}
+		return errors.InternalServerError("Failed to exchange code for token")
+	}
+
+	device := DeviceFromContext(c)
+
+	var supabaseResp SupabaseResp
+	if provider.SupabaseProvider != "" {
+		supabaseResp, err = signInWithSupabase(provider.SupabaseProvider, identity, device)
+	} else {
+		supabaseResp, err = signInWithIdentity(provider, identity, device)
+	}
+	if err != nil {
+		auditCallbackFailure(err.Error())
+		if stderrors.Is(err, ErrOIDCAccountExists) {
+			return errors.AlreadyExists("An account with this email already exists. Log in with your password first.")
+		}
+		return errors.InternalServerError("Failed to sign in: " + err.Error())
+	}
+
+	userID := supabaseResp.UserId.Id
+	RecordAudit(c, AuditEvent{
+		Action:   AuditOAuthCallback,
+		ActorID:  &userID,
+		TargetID: &userID,
+		Target:   provider.Name,
+		Metadata: map[string]any{
+			"registration": flow.Registration,
+			"mfa_required": supabaseResp.MFAToken != "",
+		},
+	})
+
+	return redirectAfterLogin(c, supabaseResp, flow.Registration)
+}
+
+// redirectAfterLogin sends the browser back to the web client with the new tokens or an MFA token
+func redirectAfterLogin(c *fiber.Ctx, supabaseResp SupabaseResp, isRegistration bool) error {
+	siteUrl := os.Getenv("URL")
+
+	// Users with two-factor authentication finish the login with POST /auth/login/mfa
+	if supabaseResp.MFAToken != "" {
+		if siteUrl == "" {
+			log.Println("URL environment variable is not set")
+			return c.Redirect("https://www.greenvue.eu/login")
+		}
+		// The token goes in an HttpOnly cookie so it stays out of browser history, logs and Referer headers
+		setMFATokenCookie(c, supabaseResp.MFAToken)
+		query := fmt.Sprintf("?mfa_required=true&user_id=%s&expires_in=%d",
+			supabaseResp.UserId.Id, MFAPendingMaxAge)
+		return c.Redirect(siteUrl + query)
 	}
 
 	// Set the tokens in a cookie
@@ -72,67 +235,26 @@ func HandleGoogleCallback(c *fiber.Ctx) error {
 
 	SetAuthCookies(c, &tokens)
 
-	siteUrl := os.Getenv("URL")
 	if siteUrl == "" {
 		log.Println("URL environment variable is not set")
 		return c.Redirect("https://www.greenvue.eu/login")
 	}
-	// Check if this is a registration flow based on the state parameter
-	isRegistration := stateFromQuery == "register"
 
-	// For registration flow, we need to check if the user exists in our users table
-	// and create them if they don't
+	query := fmt.Sprintf("?access_token=%s&refresh_token=%s&user_id=%s&expires_in=%d",
+		supabaseResp.AccessToken, supabaseResp.RefreshToken, supabaseResp.UserId.Id, supabaseResp.ExpiresIn)
 	if isRegistration {
-		// Get user details and create user record if needed
-		err = handleUserRegistration(supabaseResp)
-		if err != nil {
-			log.Printf("Registration error: %v", err)
-			return errors.InternalServerError("Failed to complete registration: " + err.Error())
-		}
-
 		// Redirect to different page for registration completion
-		query := fmt.Sprintf("?access_token=%s&refresh_token=%s&user_id=%s&expires_in=%d&registration=true",
-			supabaseResp.AccessToken, supabaseResp.RefreshToken, supabaseResp.UserId.Id, supabaseResp.ExpiresIn)
-		return c.Redirect(siteUrl + query)
+		query += "&registration=true"
 	}
-
-	// Regular login flow
-	query := fmt.Sprintf("?access_token=%s&refresh_token=%s&user_id=%s&expires_in=%d",
-		supabaseResp.AccessToken, supabaseResp.RefreshToken, supabaseResp.UserId.Id, supabaseResp.ExpiresIn)
 	return c.Redirect(siteUrl + query)
 }
 
-func exchangeCodeForGoogleToken(code string) (*GoogleTokenResponse, error) {
-	formData := map[string]string{
-		"code":          code,
-		"client_id":     os.Getenv("GOOGLE_CLIENT_ID"),
-		"client_secret": os.Getenv("GOOGLE_CLIENT_SECRET"),
-		"redirect_uri":  os.Getenv("REDIRECT_URI"),
-		"grant_type":    "authorization_code",
-	}
-
-	client := resty.New().SetTimeout(10 * time.Second)
-	resp, err := client.R().
-		SetFormData(formData).
-		SetResult(&GoogleTokenResponse{}).
-		Post("https://oauth2.googleapis.com/token")
-
-	if err != nil {
-		return nil, err
-	}
-
-	if resp.StatusCode() != http.StatusOK {
-		return nil, fmt.Errorf("failed to exchange code: status %d", resp.StatusCode())
-	}
-
-	tokenResp := resp.Result().(*GoogleTokenResponse)
-	return tokenResp, nil
-}
-
-func signInWithSupabase(idToken string) (SupabaseResp, error) {
+// signInWithSupabase exchanges a verified ID token with Supabase Auth, which owns the accounts of these providers
+func signInWithSupabase(supabaseProvider string, identity *OIDCIdentity, device SessionDevice) (SupabaseResp, error) {
 	body := map[string]string{
-		"provider": "google",
-		"id_token": idToken,
+		"provider": supabaseProvider,
+		"id_token": identity.IDToken,
+		"nonce":    identity.RawNonce,
 	}
 
 	client := resty.New().SetTimeout(10 * time.Second)
@@ -147,143 +269,178 @@ func signInWithSupabase(idToken string) (SupabaseResp, error) {
 		return SupabaseResp{}, err
 	}
 
-	var supabaseResp map[string]any
+	var supabaseResp struct {
+		User struct {
+			ID    uuid.UUID `json:"id"`
+			Email string    `json:"email"`
+		} `json:"user"`
+	}
 	if err := json.Unmarshal(resp.Body(), &supabaseResp); err != nil {
 		return SupabaseResp{}, err
 	}
 
-	UserId := supabaseResp["user"].(map[string]any)["id"].(string)
-
-	UserUuid, err := uuid.Parse(UserId)
-
-	if err != nil || UserUuid == uuid.Nil {
+	if supabaseResp.User.ID == uuid.Nil {
 		return SupabaseResp{}, fmt.Errorf("user ID not found in Supabase response")
 	}
-
-	Email := supabaseResp["user"].(map[string]any)["email"].(string)
-	if Email == "" {
+	if supabaseResp.User.Email == "" {
 		return SupabaseResp{}, fmt.Errorf("email not found in Supabase response")
 	}
 
-	authTokens, err := GenerateTokenPair(UserUuid, Email)
+	// Creates the profile on first login; existing profiles are left alone
+	if err := ensureUserProfile(supabaseResp.User.ID, supabaseResp.User.Email, identity); err != nil {
+		log.Printf("Registration error: %v", err)
+		return SupabaseResp{}, fmt.Errorf("failed to complete registration: %v", err)
+	}
+
+	return issueLoginTokens(supabaseResp.User.ID, supabaseResp.User.Email, device)
+}
+
+// signInWithIdentity signs in through an identity linked in our own user_identities table.
+// Unknown identities get a new account, or are linked to an existing one by verified email when the provider allows it.
+func signInWithIdentity(provider *OIDCProvider, identity *OIDCIdentity, device SessionDevice) (SupabaseResp, error) {
+	client := db.NewSupabaseClient(true)
+	if client == nil {
+		return SupabaseResp{}, fmt.Errorf("failed to create database client")
+	}
+
+	data, err := client.GET(userIdentitiesTable, fmt.Sprintf("provider=eq.%s&subject=eq.%s",
+		url.QueryEscape(identity.Provider), url.QueryEscape(identity.Subject)))
 	if err != nil {
-		return SupabaseResp{}, fmt.Errorf("failed to generate token pair: %v", err)
+		return SupabaseResp{}, fmt.Errorf("failed to fetch identity: %v", err)
 	}
 
-	tokens := SupabaseResp{
-		UserId: User{
-			Id: UserUuid,
-		},
-		AccessToken:  authTokens.AccessToken,
-		RefreshToken: authTokens.RefreshToken,
-		ExpiresIn:    authTokens.ExpiresIn,
+	var identities []UserIdentity
+	if err := json.Unmarshal(data, &identities); err != nil {
+		return SupabaseResp{}, fmt.Errorf("failed to parse identity: %v", err)
 	}
 
-	log.Println(authTokens.AccessToken)
+	if len(identities) > 0 {
+		user, err := getUserRecord(identities[0].UserID)
+		if err != nil {
+			return SupabaseResp{}, fmt.Errorf("failed to fetch linked user: %v", err)
+		}
+		return issueLoginTokens(user.ID, user.Email, device)
+	}
 
-	return tokens, nil
-}
+	if identity.Email == "" || !identity.EmailVerified {
+		return SupabaseResp{}, fmt.Errorf("%s did not return a verified email address", provider.Name)
+	}
 
-// handleUserRegistration handles creating a user record in our custom users table
-// when a user signs up with Google OAuth.
-func handleUserRegistration(supabaseResp SupabaseResp) error {
+	data, err = client.GET("users", fmt.Sprintf("email=eq.%s&select=id", url.QueryEscape(identity.Email)))
+	if err != nil {
+		return SupabaseResp{}, fmt.Errorf("failed to look up user: %v", err)
+	}
 
-	// Create Supabase client to interact with the database
-	client := db.NewSupabaseClient(true)
-	if client == nil {
-		return fmt.Errorf("failed to create database client")
+	var existing []User
+	if err := json.Unmarshal(data, &existing); err != nil {
+		return SupabaseResp{}, fmt.Errorf("failed to parse user: %v", err)
 	}
 
-	// Check if user already exists in our users table
-	query := fmt.Sprintf("id=eq.%s", supabaseResp.UserId.Id)
-	data, err := client.GET("user_details", query)
+	var userID uuid.UUID
+	if len(existing) > 0 {
+		if !provider.LinkExisting {
+			return SupabaseResp{}, ErrOIDCAccountExists
+		}
+		userID = existing[0].Id
+	} else {
+		authUser, err := client.CreateAuthUser(identity.Email, map[string]any{
+			"name":     identity.Name,
+			"picture":  identity.Picture,
+			"provider": identity.Provider,
+		})
+		if err != nil {
+			return SupabaseResp{}, fmt.Errorf("failed to create user: %v", err)
+		}
+		userID = authUser.ID
 
-	userExists := false
-	if err == nil && len(data) > 0 && string(data) != "[]" {
-		// User already exists in our database
-		userExists = true
-		return nil // Nothing to do if user exists
+		if err := ensureUserProfile(userID, identity.Email, identity); err != nil {
+			return SupabaseResp{}, fmt.Errorf("failed to complete registration: %v", err)
+		}
 	}
 
-	// Get user details (email, name) from Supabase user profile
-	userEmail := ""
-	userName := ""
-	picture := ""
+	link := UserIdentity{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Provider:  identity.Provider,
+		Subject:   identity.Subject,
+		Email:     identity.Email,
+		CreatedAt: time.Now().UTC(),
+	}
+	if _, err := client.POST(userIdentitiesTable, link); err != nil {
+		return SupabaseResp{}, fmt.Errorf("failed to link identity: %v", err)
+	}
 
-	// Get user profile from Supabase to extract email and name
-	userUrl := fmt.Sprintf("%s/auth/v1/user", os.Getenv("SUPABASE_URL"))
+	log.Printf("Linked %s identity to user %s", identity.Provider, userID)
 
-	restyClient := resty.New().SetTimeout(10 * time.Second)
-	resp, err := restyClient.R().
-		SetHeader("Authorization", "Bearer "+supabaseResp.AccessToken).
-		SetHeader("apikey", os.Getenv("SUPABASE_ANON")).
-		Get(userUrl)
+	return issueLoginTokens(userID, identity.Email, device)
+}
 
+// issueLoginTokens creates a session, or an MFA token when the user has a second factor
+func issueLoginTokens(userID uuid.UUID, email string, device SessionDevice) (SupabaseResp, error) {
+	mfaEnabled, err := isMFAEnabled(userID)
 	if err != nil {
-		return fmt.Errorf("failed to get user profile: %v", err)
+		return SupabaseResp{}, fmt.Errorf("failed to check two-factor authentication: %v", err)
 	}
-
-	if resp.StatusCode() != http.StatusOK {
-		return fmt.Errorf("failed to get user profile, status: %d", resp.StatusCode())
+	if mfaEnabled {
+		mfaToken, err := generateMFAPendingToken(userID)
+		if err != nil {
+			return SupabaseResp{}, fmt.Errorf("failed to generate MFA token: %v", err)
+		}
+		return SupabaseResp{UserId: User{Id: userID}, MFAToken: mfaToken}, nil
 	}
 
-	var userProfile map[string]any
-	if err := json.Unmarshal(resp.Body(), &userProfile); err != nil {
-		return fmt.Errorf("failed to decode user profile: %v", err)
+	authTokens, err := GenerateTokenPair(userID, email, device)
+	if err != nil {
+		return SupabaseResp{}, fmt.Errorf("failed to generate token pair: %v", err)
 	}
 
-	// Extract email
-	if email, ok := userProfile["email"].(string); ok {
-		userEmail = email
-	} else {
-		return fmt.Errorf("no email found in user profile")
+	return SupabaseResp{
+		UserId: User{
+			Id: userID,
+		},
+		AccessToken:  authTokens.AccessToken,
+		RefreshToken: authTokens.RefreshToken,
+		ExpiresIn:    authTokens.ExpiresIn,
+	}, nil
+}
+
+// ensureUserProfile creates a record in our custom users table for a user
+// signing in through an external provider, using the profile from the ID token.
+func ensureUserProfile(userID uuid.UUID, email string, identity *OIDCIdentity) error {
+	// Create Supabase client to interact with the database
+	client := db.NewSupabaseClient(true)
+	if client == nil {
+		return fmt.Errorf("failed to create database client")
 	}
 
-	// Extract user's name
-	// First try to get from user_metadata
-	if userMetadata, ok := userProfile["user_metadata"].(map[string]any); ok {
-		if fullName, ok := userMetadata["full_name"].(string); ok && fullName != "" {
-			userName = fullName
-		} else if name, ok := userMetadata["name"].(string); ok && name != "" {
-			userName = name
-		}
-		if userPicture, ok := userMetadata["picture"].(string); ok && userPicture != "" {
-			picture = userPicture
-		}
+	// Check if user already exists in our users table
+	data, err := client.GET("user_details", fmt.Sprintf("id=eq.%s", userID))
+	if err == nil && len(data) > 0 && string(data) != "[]" {
+		return nil // Nothing to do if user exists
 	}
 
-	// If name is still empty, try to get it from other fields
+	// Use email prefix as fallback for the name
+	userName := identity.Name
 	if userName == "" {
-		if name, ok := userProfile["name"].(string); ok && name != "" {
-			userName = name
-		} else {
-			// Use email prefix as fallback
-			if userEmail != "" {
-				userName = strings.Split(userEmail, "@")[0]
-			} else {
-				userName = "User"
-			}
-		}
+		userName = strings.Split(email, "@")[0]
+	}
+	if userName == "" {
+		userName = "User"
 	}
 
-	// If user doesn't exist in our custom users table, create them
-	if !userExists {
-		// Create a user record using the standardized type
-		newUser := lib.User{
-			ID:            supabaseResp.UserId.Id,
-			Email:         lib.SanitizeInput(userEmail),
-			Name:          lib.SanitizeInput(userName),
-			EmailVerified: true,
-			Picture:       picture,
-			Provider:      "google",
-		}
-
-		// Insert user into the database
-		_, err = client.POST("users", newUser)
-		if err != nil {
-			return fmt.Errorf("failed to store user in database: %v", err)
-		}
+	newUser := lib.User{
+		ID:            userID,
+		Email:         lib.SanitizeInput(email),
+		Name:          lib.SanitizeInput(userName),
+		EmailVerified: true,
+		Picture:       identity.Picture,
+		Provider:      identity.Provider,
+	}
 
+	// Insert user into the database
+	if _, err := client.POST("users", newUser); err != nil {
+		return fmt.Errorf("failed to store user in database: %v", err)
 	}
+
 	return nil
 }
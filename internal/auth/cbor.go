@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// This is a minimal CBOR (RFC 8949) decoder covering what WebAuthn needs:
+// attestation objects and COSE public keys. Indefinite-length items are not supported
+// since authenticators must use the canonical encoding.
+
+var errCBORTruncated = errors.New("cbor: unexpected end of data")
+
+// maxCBORDepth guards against maliciously nested input
+const maxCBORDepth = 16
+
+// decodeCBOR decodes the first CBOR item in data and returns it with the number of bytes consumed.
+// Integers decode to int64, byte strings to []byte, text to string, arrays to []any and maps to map[any]any.
+func decodeCBOR(data []byte) (any, int, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (any, int, error) {
+	if depth > maxCBORDepth {
+		return nil, 0, errors.New("cbor: nesting too deep")
+	}
+	if len(data) == 0 {
+		return nil, 0, errCBORTruncated
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+
+	// Simple values and floats
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, 1, nil
+		case 21:
+			return true, 1, nil
+		case 22, 23:
+			return nil, 1, nil
+		case 25:
+			if len(data) < 3 {
+				return nil, 0, errCBORTruncated
+			}
+			return nil, 3, nil // half-precision floats are not needed, skip them
+		case 26:
+			if len(data) < 5 {
+				return nil, 0, errCBORTruncated
+			}
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(data[1:5]))), 5, nil
+		case 27:
+			if len(data) < 9 {
+				return nil, 0, errCBORTruncated
+			}
+			return math.Float64frombits(binary.BigEndian.Uint64(data[1:9])), 9, nil
+		}
+		return nil, 0, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+
+	argument, offset, err := readCBORArgument(data, info)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch major {
+	case 0: // unsigned integer
+		if argument > math.MaxInt64 {
+			return nil, 0, errors.New("cbor: integer overflow")
+		}
+		return int64(argument), offset, nil
+
+	case 1: // negative integer
+		if argument > math.MaxInt64 {
+			return nil, 0, errors.New("cbor: integer overflow")
+		}
+		return -1 - int64(argument), offset, nil
+
+	case 2, 3: // byte string, text string
+		if argument > uint64(len(data)-offset) {
+			return nil, 0, errCBORTruncated
+		}
+		end := offset + int(argument)
+		raw := make([]byte, end-offset)
+		copy(raw, data[offset:end])
+		if major == 3 {
+			return string(raw), end, nil
+		}
+		return raw, end, nil
+
+	case 4: // array
+		if argument > uint64(len(data)) {
+			return nil, 0, errCBORTruncated
+		}
+		items := make([]any, 0, argument)
+		for range argument {
+			item, n, err := decodeCBORItem(data[offset:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, item)
+			offset += n
+		}
+		return items, offset, nil
+
+	case 5: // map
+		if argument > uint64(len(data)) {
+			return nil, 0, errCBORTruncated
+		}
+		entries := make(map[any]any, argument)
+		for range argument {
+			key, n, err := decodeCBORItem(data[offset:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			offset += n
+
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, 0, errors.New("cbor: unsupported map key type")
+			}
+
+			value, n, err := decodeCBORItem(data[offset:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			offset += n
+			entries[key] = value
+		}
+		return entries, offset, nil
+
+	case 6: // tag, the tagged item is returned as is
+		item, n, err := decodeCBORItem(data[offset:], depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		return item, offset + n, nil
+	}
+
+	return nil, 0, fmt.Errorf("cbor: unsupported major type %d", major)
+}
+
+// readCBORArgument reads the length or value that follows the initial byte
+func readCBORArgument(data []byte, info byte) (uint64, int, error) {
+	switch {
+	case info < 24:
+		return uint64(info), 1, nil
+	case info == 24:
+		if len(data) < 2 {
+			return 0, 0, errCBORTruncated
+		}
+		return uint64(data[1]), 2, nil
+	case info == 25:
+		if len(data) < 3 {
+			return 0, 0, errCBORTruncated
+		}
+		return uint64(binary.BigEndian.Uint16(data[1:3])), 3, nil
+	case info == 26:
+		if len(data) < 5 {
+			return 0, 0, errCBORTruncated
+		}
+		return uint64(binary.BigEndian.Uint32(data[1:5])), 5, nil
+	case info == 27:
+		if len(data) < 9 {
+			return 0, 0, errCBORTruncated
+		}
+		return binary.BigEndian.Uint64(data[1:9]), 9, nil
+	}
+	return 0, 0, errors.New("cbor: indefinite length items are not supported")
+}
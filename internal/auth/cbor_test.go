@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// Minimal CBOR encoding helpers for building test inputs
+
+func cborHead(major byte, argument uint64) []byte {
+	switch {
+	case argument < 24:
+		return []byte{major<<5 | byte(argument)}
+	case argument <= 0xff:
+		return []byte{major<<5 | 24, byte(argument)}
+	case argument <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(argument))
+	case argument <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(argument))
+	}
+	return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, argument)
+}
+
+func cborInt(value int64) []byte {
+	if value < 0 {
+		return cborHead(1, uint64(-1-value))
+	}
+	return cborHead(0, uint64(value))
+}
+
+func cborBytes(value []byte) []byte {
+	return append(cborHead(2, uint64(len(value))), value...)
+}
+
+func cborText(value string) []byte {
+	return append(cborHead(3, uint64(len(value))), value...)
+}
+
+// cborMap encodes alternating, already encoded keys and values
+func cborMap(items ...[]byte) []byte {
+	return append(cborHead(5, uint64(len(items)/2)), bytes.Join(items, nil)...)
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  any
+	}{
+		{"small unsigned", []byte{0x17}, int64(23)},
+		{"one byte unsigned", []byte{0x18, 0x18}, int64(24)},
+		{"eight byte unsigned", cborHead(0, 1<<40), int64(1 << 40)},
+		{"negative", []byte{0x20}, int64(-1)},
+		{"COSE RS256", []byte{0x39, 0x01, 0x00}, int64(-257)},
+		{"byte string", []byte{0x43, 1, 2, 3}, []byte{1, 2, 3}},
+		{"empty byte string", []byte{0x40}, []byte{}},
+		{"text string", cborText("fmt"), "fmt"},
+		{"array", []byte{0x82, 0x01, 0x20}, []any{int64(1), int64(-1)}},
+		{"map", cborMap(cborInt(1), cborInt(2), cborText("a"), cborBytes([]byte{9})), map[any]any{int64(1): int64(2), "a": []byte{9}}},
+		{"tag", []byte{0xc2, 0x41, 0x07}, []byte{7}},
+		{"false", []byte{0xf4}, false},
+		{"true", []byte{0xf5}, true},
+		{"null", []byte{0xf6}, nil},
+		{"float32", []byte{0xfa, 0x3f, 0xc0, 0x00, 0x00}, float64(1.5)},
+		{"float64", []byte{0xfb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, float64(1.5)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Trailing bytes belong to the next item and must not be consumed
+			input := append(append([]byte{}, tt.input...), 0xff)
+			got, n, err := decodeCBOR(input)
+			if err != nil {
+				t.Fatalf("decodeCBOR() error = %v", err)
+			}
+			if n != len(tt.input) {
+				t.Errorf("decodeCBOR() consumed %d bytes, want %d", n, len(tt.input))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeCBOR() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCBORRejectsMalformed(t *testing.T) {
+	nested := func(depth int) []byte {
+		return append(bytes.Repeat([]byte{0x81}, depth), 0x01)
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"empty", nil},
+		{"truncated argument", []byte{0x19, 0x01}},
+		{"truncated byte string", []byte{0x45, 1, 2}},
+		{"truncated text string", []byte{0x63, 'a'}},
+		{"byte string longer than input", append(cborHead(2, 1<<62), 0)},
+		{"text string length overflows int", cborHead(3, 1<<63)},
+		{"array count longer than input", cborHead(4, 1<<32)},
+		{"map count longer than input", cborHead(5, 1<<32)},
+		{"truncated array", []byte{0x82, 0x01}},
+		{"map without value", []byte{0xa1, 0x01}},
+		{"unsigned overflow", cborHead(0, 1<<63)},
+		{"negative overflow", cborHead(1, 1<<63)},
+		{"indefinite length", []byte{0x5f, 0x41, 0x00, 0xff}},
+		{"reserved additional info", []byte{0x1c}},
+		{"byte string map key", cborMap(cborBytes([]byte{1}), cborInt(1))},
+		{"array map key", cborMap([]byte{0x80}, cborInt(1))},
+		{"unsupported simple value", []byte{0xf8, 0x20}},
+		{"truncated half float", []byte{0xf9, 0x00}},
+		{"truncated float32", []byte{0xfa, 0x00, 0x00}},
+		{"truncated float64", []byte{0xfb, 0x00}},
+		{"nesting too deep", nested(maxCBORDepth + 1)},
+		{"deep tags", append(bytes.Repeat([]byte{0xc0}, maxCBORDepth+1), 0x01)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _, err := decodeCBOR(tt.input); err == nil {
+				t.Errorf("decodeCBOR(%x) = %#v, want an error", tt.input, got)
+			}
+		})
+	}
+
+	if _, _, err := decodeCBOR(nested(maxCBORDepth)); err != nil {
+		t.Errorf("decodeCBOR() at the nesting limit error = %v", err)
+	}
+}
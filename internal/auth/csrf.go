@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"greenvue/lib/errors"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// CSRF cookie and header names. The cookie is readable by JavaScript so the web client
+// can copy it into the header (double-submit pattern); a cross-site page can do neither.
+const (
+	CSRFCookieName = "csrf_token"
+	CSRFHeaderName = "X-CSRF-Token"
+)
+
+var trustedOrigins = struct {
+	sync.RWMutex
+	origins map[string]bool
+}{origins: make(map[string]bool)}
+
+// SetTrustedOrigins sets the origins that may send cookie-authenticated, state-changing requests.
+// The API's own origin is always trusted.
+func SetTrustedOrigins(origins []string) {
+	normalized := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		if origin = normalizeOrigin(origin); origin != "" {
+			normalized[origin] = true
+		}
+	}
+
+	trustedOrigins.Lock()
+	trustedOrigins.origins = normalized
+	trustedOrigins.Unlock()
+}
+
+// normalizeOrigin reduces a URL to scheme://host[:port] in lower case
+func normalizeOrigin(raw string) string {
+	parsed, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return ""
+	}
+	return strings.ToLower(parsed.Scheme + "://" + parsed.Host)
+}
+
+// isTrustedOrigin reports whether an origin is the API itself or one of the trusted origins
+func isTrustedOrigin(c *fiber.Ctx, origin string) bool {
+	origin = normalizeOrigin(origin)
+	if origin == "" {
+		return false
+	}
+	if origin == normalizeOrigin(c.BaseURL()) {
+		return true
+	}
+
+	trustedOrigins.RLock()
+	defer trustedOrigins.RUnlock()
+	return trustedOrigins.origins[origin]
+}
+
+// isSafeMethod reports whether a method must not change state
+func isSafeMethod(method string) bool {
+	switch method {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions, fiber.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// cookieAuthLocal is set by authenticateRequest to whether the access token came from a cookie
+const cookieAuthLocal = "cookie_auth"
+
+// usesCookieAuth reports whether a request is authenticated by cookies.
+// After AuthMiddleware it follows the credential that was actually used: cookies take precedence over
+// a bearer token, so adding an Authorization header does not exempt a cookie-authenticated request.
+// Routes without AuthMiddleware, such as refresh and logout, also read the cookies first, so any auth cookie counts.
+func usesCookieAuth(c *fiber.Ctx) bool {
+	if cookieAuth, ok := c.Locals(cookieAuthLocal).(bool); ok {
+		return cookieAuth
+	}
+	return c.Cookies(AccessTokenCookieName) != "" || c.Cookies(RefreshTokenCookieName) != ""
+}
+
+// checkRequestOrigin applies the Origin/Referer policy: when the browser tells us where a request
+// comes from, it must be a trusted origin. Requests without either header fall through to the token check.
+func checkRequestOrigin(c *fiber.Ctx) error {
+	if origin := c.Get(fiber.HeaderOrigin); origin != "" && origin != "null" {
+		if !isTrustedOrigin(c, origin) {
+			log.Printf("Blocked cross-site %s %s from origin %s", c.Method(), c.Path(), origin)
+			return errors.Forbidden("Cross-site request blocked")
+		}
+		return nil
+	}
+
+	if referer := c.Get(fiber.HeaderReferer); referer != "" {
+		if !isTrustedOrigin(c, referer) {
+			log.Printf("Blocked cross-site %s %s from referer %s", c.Method(), c.Path(), referer)
+			return errors.Forbidden("Cross-site request blocked")
+		}
+		return nil
+	}
+
+	// A literal "null" origin comes from sandboxed frames and privacy redirects; it is never trusted
+	if c.Get(fiber.HeaderOrigin) == "null" {
+		return errors.Forbidden("Cross-site request blocked")
+	}
+	return nil
+}
+
+// CSRFMiddleware protects cookie-authenticated, state-changing requests with an Origin/Referer check
+// and a double-submit token: the X-CSRF-Token header must match the csrf_token cookie.
+// Safe methods and requests authenticated by a bearer token or API key pass through.
+func CSRFMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if isSafeMethod(c.Method()) || !usesCookieAuth(c) {
+			return c.Next()
+		}
+
+		if err := checkRequestOrigin(c); err != nil {
+			return err
+		}
+
+		cookieToken := c.Cookies(CSRFCookieName)
+		headerToken := c.Get(CSRFHeaderName)
+		if cookieToken == "" || headerToken == "" ||
+			subtle.ConstantTimeCompare([]byte(cookieToken), []byte(headerToken)) != 1 {
+			return errors.Forbidden("Missing or invalid CSRF token")
+		}
+
+		return c.Next()
+	}
+}
+
+// OriginCheckMiddleware applies only the Origin/Referer policy. It guards cookie-based endpoints such as
+// token refresh and logout, which clients must be able to call before they hold a CSRF token.
+func OriginCheckMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if isSafeMethod(c.Method()) || !usesCookieAuth(c) {
+			return c.Next()
+		}
+
+		if err := checkRequestOrigin(c); err != nil {
+			return err
+		}
+		return c.Next()
+	}
+}
+
+// setCSRFCookie issues the CSRF cookie next to the auth cookies. An existing token is kept
+// so requests that are already in flight keep working; only its lifetime is renewed.
+func setCSRFCookie(c *fiber.Ctx) string {
+	token := c.Cookies(CSRFCookieName)
+	if token == "" {
+		var err error
+		if token, err = randomURLToken(32); err != nil {
+			log.Printf("Failed to generate CSRF token: %v", err)
+			return ""
+		}
+	}
+
+	// Same domain rules as the auth cookies, so the token is sent wherever they are
+	var domain string
+	if cfg.Environment != "production" && SameSite == "None" {
+		domain = ""
+	} else {
+		domain = getDomainFromHost(c.Hostname())
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     CSRFCookieName,
+		Value:    token,
+		Path:     "/",
+		Domain:   domain,
+		MaxAge:   RefreshCookieMaxAge,
+		Expires:  time.Now().Add(time.Duration(RefreshCookieMaxAge) * time.Second),
+		Secure:   Secure,
+		HTTPOnly: false, // The web client reads it to fill the header
+		SameSite: SameSite,
+	})
+	return token
+}
+
+// clearCSRFCookie removes the CSRF cookie on logout
+func clearCSRFCookie(c *fiber.Ctx) {
+	c.Cookie(&fiber.Cookie{
+		Name:     CSRFCookieName,
+		Value:    "",
+		Path:     "/",
+		Domain:   getDomainFromHost(c.Hostname()),
+		MaxAge:   -1,
+		Expires:  time.Now().Add(-time.Hour),
+		Secure:   Secure,
+		SameSite: SameSite,
+	})
+}
+
+// GetCSRFToken issues the CSRF cookie if needed and returns its value, for clients that
+// cannot read the cookie or logged in before CSRF protection existed
+func GetCSRFToken(c *fiber.Ctx) error {
+	token := setCSRFCookie(c)
+	if token == "" {
+		return errors.InternalServerError("Failed to generate CSRF token")
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return errors.SuccessResponse(c, fiber.Map{
+		"csrfToken":  token,
+		"headerName": CSRFHeaderName,
+	})
+}
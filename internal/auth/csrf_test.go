@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+func newTestAccessToken(t *testing.T) string {
+	t.Helper()
+
+	keyringMu.RLock()
+	access, refresh := accessKeyring, refreshKeyring
+	keyringMu.RUnlock()
+	t.Cleanup(func() { SetKeyrings(access, refresh) })
+
+	ring, err := NewKeyring("test", newHMACKey("test", []byte(strings.Repeat("t", 40))))
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+	SetKeyrings(ring, ring)
+
+	// Access tokens are only accepted while their session exists
+	previousStore := GetTokenStore()
+	t.Cleanup(func() { SetTokenStore(previousStore) })
+	store := NewMemoryTokenStore()
+	SetTokenStore(store)
+
+	userID, sessionID := uuid.New(), uuid.New()
+	if err := store.CreateSession(Session{ID: sessionID, UserID: userID}); err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+
+	token, err := signToken(TokenTypeAccess, Claims{
+		UserId:    userID,
+		Type:      TokenTypeAccess,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   userID.String(),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	})
+	if err != nil {
+		t.Fatalf("signToken() error = %v", err)
+	}
+	return token
+}
+
+func TestCSRFFollowsAuthenticatingCredential(t *testing.T) {
+	token := newTestAccessToken(t)
+
+	app := fiber.New(fiber.Config{ErrorHandler: func(c *fiber.Ctx, err error) error {
+		return c.SendStatus(http.StatusForbidden)
+	}})
+	app.Delete("/api/items",
+		func(c *fiber.Ctx) error {
+			if _, err := authenticateRequest(c); err != nil {
+				return c.SendStatus(http.StatusUnauthorized)
+			}
+			return c.Next()
+		},
+		CSRFMiddleware(),
+		func(c *fiber.Ctx) error { return c.SendStatus(http.StatusNoContent) },
+	)
+
+	tests := []struct {
+		name   string
+		cookie string
+		bearer string
+		csrf   bool
+		want   int
+	}{
+		{"bearer only", "", token, false, http.StatusNoContent},
+		{"cookie without token", token, "", false, http.StatusForbidden},
+		{"cookie with token", token, "", true, http.StatusNoContent},
+		{"cookie and junk bearer", token, "junk", false, http.StatusForbidden},
+		{"cookie and valid bearer", token, token, false, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, "/api/items", nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: AccessTokenCookieName, Value: tt.cookie})
+			}
+			if tt.bearer != "" {
+				req.Header.Set(fiber.HeaderAuthorization, "Bearer "+tt.bearer)
+			}
+			if tt.csrf {
+				req.AddCookie(&http.Cookie{Name: CSRFCookieName, Value: "csrf-value"})
+				req.Header.Set(CSRFHeaderName, "csrf-value")
+			}
+
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestOriginCheckWithoutAuthentication(t *testing.T) {
+	app := fiber.New(fiber.Config{ErrorHandler: func(c *fiber.Ctx, err error) error {
+		return c.SendStatus(http.StatusForbidden)
+	}})
+	app.Post("/auth/refresh", OriginCheckMiddleware(), func(c *fiber.Ctx) error {
+		return c.SendStatus(http.StatusNoContent)
+	})
+
+	// The refresh cookie is read before the body, so an Authorization header must not skip the origin policy
+	req := httptest.NewRequest(http.MethodPost, "/auth/refresh", nil)
+	req.AddCookie(&http.Cookie{Name: RefreshTokenCookieName, Value: "refresh"})
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer anything")
+	req.Header.Set(fiber.HeaderOrigin, "https://evil.example")
+
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", resp.StatusCode)
+	}
+}
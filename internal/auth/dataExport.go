@@ -0,0 +1,760 @@
+package auth
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"greenvue/internal/db"
+	"greenvue/lib"
+	"greenvue/lib/email"
+	"greenvue/lib/errors"
+	"greenvue/lib/storage"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	dataExportsTable       = "data_exports"
+	dataExportCooldown     = 24 * time.Hour
+	dataExportStaleAfter   = 30 * time.Minute // A processing export older than this is picked up again
+	dataExportMaxImageSize = 20 << 20
+)
+
+// ErrDataExportSigningKey is returned while no usable key for download links is configured
+var ErrDataExportSigningKey = stderrors.New("data export signing key is not configured")
+
+var (
+	dataExportKey   []byte
+	dataExportKeyMu sync.RWMutex
+)
+
+// Data export states
+const (
+	DataExportPending    = "pending"
+	DataExportProcessing = "processing"
+	DataExportReady      = "ready"
+	DataExportFailed     = "failed"
+	DataExportExpired    = "expired"
+)
+
+// DataExport is a requested copy of all data of a user, stored in the data_exports table.
+// The archive itself lives in the data export directory under <id>.zip.
+type DataExport struct {
+	ID          uuid.UUID  `json:"id"`
+	UserID      uuid.UUID  `json:"user_id"`
+	Status      string     `json:"status"`
+	RequestedAt time.Time  `json:"requested_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	SizeBytes   int64      `json:"size_bytes,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// response is the view of an export returned to its owner
+func (e DataExport) response() fiber.Map {
+	return fiber.Map{
+		"id":          e.ID,
+		"status":      e.Status,
+		"requestedAt": e.RequestedAt,
+		"completedAt": e.CompletedAt,
+		"expiresAt":   e.ExpiresAt,
+		"sizeBytes":   e.SizeBytes,
+	}
+}
+
+// RequestDataExport starts building an archive of all the user's data. The download link is emailed
+// once it is ready. Users can request one export per day.
+func RequestDataExport(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	// The download link is emailed, so do not build an export nobody could download
+	if _, err := apiLink("", nil); err != nil {
+		log.Printf("Cannot send data export links: %v", err)
+		return errors.InternalServerError("Data exports are not available right now")
+	}
+
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create database client")
+	}
+
+	now := time.Now().UTC()
+	recent, err := getDataExports(client, fmt.Sprintf("user_id=eq.%s&status=neq.%s&requested_at=gt.%s&order=requested_at.desc&limit=1",
+		claims.UserId, DataExportFailed, url.QueryEscape(now.Add(-dataExportCooldown).Format(time.RFC3339))))
+	if err != nil {
+		return errors.DatabaseError(err.Error())
+	}
+	if len(recent) > 0 {
+		wait := time.Until(recent[0].RequestedAt.Add(dataExportCooldown))
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(max(int(wait.Seconds()), 1)))
+		return errors.TooManyRequests(fmt.Sprintf("You can request one data export per day. Please try again in %d hours.", max(int(wait.Hours()), 1)))
+	}
+
+	export := DataExport{
+		ID:          uuid.New(),
+		UserID:      claims.UserId,
+		Status:      DataExportPending,
+		RequestedAt: now,
+	}
+	if _, err := client.POST(dataExportsTable, export); err != nil {
+		return errors.DatabaseError("Failed to request data export: " + err.Error())
+	}
+	auditUserAction(c, AuditDataExport, claims.UserId, map[string]any{"export_id": export.ID})
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"message": "Your data export is being prepared. We will email you a download link when it is ready.",
+		"export":  export.response(),
+	})
+}
+
+// GetDataExports lists the authenticated user's data exports, newest first
+func GetDataExports(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create database client")
+	}
+
+	exports, err := getDataExports(client, fmt.Sprintf("user_id=eq.%s&order=requested_at.desc&limit=10", claims.UserId))
+	if err != nil {
+		return errors.DatabaseError(err.Error())
+	}
+
+	response := make([]fiber.Map, 0, len(exports))
+	for _, export := range exports {
+		response = append(response, export.response())
+	}
+
+	return errors.SuccessResponse(c, response)
+}
+
+// DownloadDataExport serves a finished archive. The link from the email is signed and
+// expires together with the archive, so it works without being logged in.
+func DownloadDataExport(c *fiber.Ctx) error {
+	exportID, err := uuid.Parse(c.Params("export_id"))
+	if err != nil {
+		return errors.BadRequest("Invalid export ID format")
+	}
+
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return errors.Forbidden("This download link has expired")
+	}
+	signature, err := signDataExport(exportID, expires)
+	if err != nil {
+		log.Printf("Cannot verify data export link: %v", err)
+		return errors.InternalServerError("Downloads are not available right now")
+	}
+	if !hmac.Equal([]byte(c.Query("signature")), []byte(signature)) {
+		return errors.Forbidden("Invalid download link")
+	}
+
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create database client")
+	}
+
+	exports, err := getDataExports(client, fmt.Sprintf("id=eq.%s&status=eq.%s", exportID, DataExportReady))
+	if err != nil {
+		return errors.DatabaseError(err.Error())
+	}
+	if len(exports) == 0 {
+		return errors.NotFound("Export not found or no longer available")
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	filename := fmt.Sprintf("greenvue-data-%s.zip", exports[0].RequestedAt.Format("2006-01-02"))
+	return c.Download(dataExportPath(exportID), filename)
+}
+
+// dataExportPath returns where the archive of an export is stored
+func dataExportPath(exportID uuid.UUID) string {
+	return filepath.Join(cfg.DataExport.Dir, exportID.String()+".zip")
+}
+
+// InitDataExportSigning sets the key download links are signed with. Links work without a session,
+// so the key must be dedicated, see CheckDedicatedSecret. Call it after InitKeyrings.
+func InitDataExportSigning(key string) error {
+	if err := CheckDedicatedSecret("DATA_EXPORT_SIGNING_KEY", key); err != nil {
+		return fmt.Errorf("%w: %v", ErrDataExportSigningKey, err)
+	}
+
+	dataExportKeyMu.Lock()
+	dataExportKey = []byte(key)
+	dataExportKeyMu.Unlock()
+	return nil
+}
+
+// signDataExport returns the hex encoded signature of a download link
+func signDataExport(exportID uuid.UUID, expires int64) (string, error) {
+	dataExportKeyMu.RLock()
+	key := dataExportKey
+	dataExportKeyMu.RUnlock()
+	if len(key) == 0 {
+		return "", ErrDataExportSigningKey
+	}
+
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "data-export:%s:%d", exportID, expires)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// dataExportDownloadURL builds the signed link sent to the user from API_URL, never from a request's Host header
+func dataExportDownloadURL(export DataExport) (string, error) {
+	expires := export.ExpiresAt.Unix()
+	signature, err := signDataExport(export.ID, expires)
+	if err != nil {
+		return "", err
+	}
+	return apiLink("/auth/data_export/"+export.ID.String()+"/download", url.Values{
+		"expires":   {strconv.FormatInt(expires, 10)},
+		"signature": {signature},
+	})
+}
+
+func getDataExports(client *db.SupabaseClient, query string) ([]DataExport, error) {
+	data, err := client.GET(dataExportsTable, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch data exports: %w", err)
+	}
+
+	var exports []DataExport
+	if err := json.Unmarshal(data, &exports); err != nil {
+		return nil, fmt.Errorf("failed to parse data exports: %w", err)
+	}
+	return exports, nil
+}
+
+// ProcessDataExports builds pending exports and removes expired archives. It returns how many exports were built.
+func ProcessDataExports(ctx context.Context, batchSize int) (int, error) {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return 0, fmt.Errorf("database client not available")
+	}
+
+	expireDataExports(client)
+
+	now := time.Now().UTC()
+	available := fmt.Sprintf("or=(status.eq.%s,and(status.eq.%s,started_at.lt.%s))",
+		DataExportPending, DataExportProcessing, url.QueryEscape(now.Add(-dataExportStaleAfter).Format(time.RFC3339)))
+
+	pending, err := getDataExports(client, fmt.Sprintf("%s&order=requested_at.asc&limit=%d", available, batchSize))
+	if err != nil {
+		return 0, err
+	}
+
+	built := 0
+	for _, export := range pending {
+		if ctx.Err() != nil {
+			return built, ctx.Err()
+		}
+
+		// Claim the export so a second instance does not build it too
+		claimed, err := client.PATCHWhere(dataExportsTable, fmt.Sprintf("id=eq.%s&%s", export.ID, available),
+			map[string]any{"status": DataExportProcessing, "started_at": time.Now().UTC()})
+		if err != nil || len(claimed) == 0 || string(claimed) == "[]" {
+			continue
+		}
+
+		size, err := buildDataExport(ctx, client, export)
+		if err != nil {
+			log.Printf("Data export %s of user %s failed: %v", export.ID, export.UserID, err)
+			os.Remove(dataExportPath(export.ID))
+			if _, patchErr := client.PATCH(dataExportsTable, export.ID, map[string]any{
+				"status": DataExportFailed,
+				"error":  err.Error(),
+			}); patchErr != nil {
+				log.Printf("Failed to mark data export %s as failed: %v", export.ID, patchErr)
+			}
+			continue
+		}
+
+		completedAt := time.Now().UTC()
+		expiresAt := completedAt.Add(cfg.DataExport.TTL)
+		export.Status = DataExportReady
+		export.CompletedAt = &completedAt
+		export.ExpiresAt = &expiresAt
+		export.SizeBytes = size
+
+		if _, err := client.PATCH(dataExportsTable, export.ID, map[string]any{
+			"status":       export.Status,
+			"completed_at": completedAt,
+			"expires_at":   expiresAt,
+			"size_bytes":   size,
+		}); err != nil {
+			log.Printf("Failed to mark data export %s as ready: %v", export.ID, err)
+			continue
+		}
+
+		queueDataExportEmail(client, export)
+		built++
+	}
+
+	return built, nil
+}
+
+// expireDataExports deletes archives whose download period has ended
+func expireDataExports(client *db.SupabaseClient) {
+	expired, err := getDataExports(client, fmt.Sprintf("status=eq.%s&expires_at=lt.%s",
+		DataExportReady, url.QueryEscape(time.Now().UTC().Format(time.RFC3339))))
+	if err != nil {
+		log.Printf("Failed to fetch expired data exports: %v", err)
+		return
+	}
+
+	for _, export := range expired {
+		if err := os.Remove(dataExportPath(export.ID)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove data export %s: %v", export.ID, err)
+			continue
+		}
+		if _, err := client.PATCH(dataExportsTable, export.ID, map[string]any{"status": DataExportExpired}); err != nil {
+			log.Printf("Failed to mark data export %s as expired: %v", export.ID, err)
+		}
+	}
+}
+
+// queueDataExportEmail sends the signed download link to the user's current address
+func queueDataExportEmail(client *db.SupabaseClient, export DataExport) {
+	user, err := getUserRecord(export.UserID)
+	if err != nil {
+		log.Printf("Failed to look up user %s for data export email: %v", export.UserID, err)
+		return
+	}
+
+	downloadURL, err := dataExportDownloadURL(export)
+	if err != nil {
+		log.Printf("Failed to sign download link of data export %s: %v", export.ID, err)
+		return
+	}
+	expires := export.ExpiresAt.Format("2 January 2006 15:04 MST")
+
+	if err := email.QueueEmail(email.Email{
+		ID:      lib.GenerateUUID(),
+		To:      user.Email,
+		Subject: "Your GreenVue data export is ready",
+		Type:    email.NotificationEmail,
+		TextContent: fmt.Sprintf("The copy of your GreenVue data that you requested is ready: %s\n\n"+
+			"The link works until %s. If you did not request this export, please change your password.", downloadURL, expires),
+		HTMLContent: fmt.Sprintf("<p>The copy of your GreenVue data that you requested is ready.</p>"+
+			"<p><a href=\"%s\">Download your data</a></p>"+
+			"<p>The link works until %s. If you did not request this export, please change your password.</p>", html.EscapeString(downloadURL), expires),
+		Status:     "pending",
+		MaxRetries: 3,
+		CreatedAt:  time.Now(),
+	}); err != nil {
+		log.Printf("Failed to queue data export email for user %s: %v", export.UserID, err)
+	}
+}
+
+// exportEntity is one kind of data in the archive, written as <name>.json and <name>.csv
+type exportEntity struct {
+	name  string
+	table string
+	query string
+}
+
+// buildDataExport writes the archive of an export and returns its size in bytes.
+// It is written to a temporary file first, so a half-written archive is never served.
+func buildDataExport(ctx context.Context, client *db.SupabaseClient, export DataExport) (int64, error) {
+	userID := export.UserID
+
+	if err := os.MkdirAll(cfg.DataExport.Dir, 0o750); err != nil {
+		return 0, fmt.Errorf("failed to create export directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(cfg.DataExport.Dir, export.ID.String()+"-*.tmp")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create export file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	archive := zip.NewWriter(tmp)
+	manifest := map[string]any{
+		"export_id":    export.ID,
+		"user_id":      userID,
+		"requested_at": export.RequestedAt,
+		"generated_at": time.Now().UTC(),
+	}
+	counts := make(map[string]int)
+
+	entities := []exportEntity{
+		{"profile", "user_details", fmt.Sprintf("id=eq.%s", userID)},
+		{"listings", "listings", fmt.Sprintf("seller_id=eq.%s&order=created_at.asc", userID)},
+		{"reviews_written", "reviews", fmt.Sprintf("user_id=eq.%s", userID)},
+		{"reviews_received", "reviews", fmt.Sprintf("seller_id=eq.%s", userID)},
+		{"review_replies", "review_replies", fmt.Sprintf("seller_id=eq.%s", userID)},
+		{"conversations", "conversations", fmt.Sprintf("or=(buyer_id.eq.%s,seller_id.eq.%s)", userID, userID)},
+		{"bids", "bids", fmt.Sprintf("user_id=eq.%s", userID)},
+		{"favorites", "favorites", fmt.Sprintf("user_id=eq.%s", userID)},
+		{"api_keys", apiKeysTable, fmt.Sprintf("user_id=eq.%s&select=id,name,prefix,scopes,created_at,last_used_at,expires_at,revoked_at", userID)},
+	}
+
+	rowsByEntity := make(map[string][]map[string]any)
+	for _, entity := range entities {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+
+		rows, err := fetchExportRows(client, entity.table, entity.query)
+		if err != nil {
+			return 0, fmt.Errorf("failed to export %s: %w", entity.name, err)
+		}
+		rowsByEntity[entity.name] = rows
+	}
+
+	// Messages in every conversation of the user, sent and received
+	var conversationIDs []string
+	for _, conversation := range rowsByEntity["conversations"] {
+		if id, ok := conversation["id"].(string); ok {
+			conversationIDs = append(conversationIDs, id)
+		}
+	}
+	rowsByEntity["messages"] = []map[string]any{}
+	if len(conversationIDs) > 0 {
+		rows, err := fetchExportRows(client, "messages",
+			fmt.Sprintf("conversation_id=in.(%s)&order=created_at.asc", strings.Join(conversationIDs, ",")))
+		if err != nil {
+			return 0, fmt.Errorf("failed to export messages: %w", err)
+		}
+		for _, row := range rows {
+			row["direction"] = "received"
+			if row["sender_id"] == userID.String() {
+				row["direction"] = "sent"
+			}
+		}
+		rowsByEntity["messages"] = rows
+	}
+
+	// Sessions and security activity come from the token store and the audit log
+	sessions, err := GetTokenStore().ListSessions(userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to export sessions: %w", err)
+	}
+	if rowsByEntity["sessions"], err = toExportRows(sessions); err != nil {
+		return 0, err
+	}
+
+	activity, err := GetAuditSink().Query(AuditFilter{UserID: &userID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to export security activity: %w", err)
+	}
+	if rowsByEntity["security_activity"], err = toExportRows(activity); err != nil {
+		return 0, err
+	}
+
+	names := make([]string, 0, len(rowsByEntity))
+	for name := range rowsByEntity {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		rows := rowsByEntity[name]
+		if err := writeExportEntity(archive, name, rows); err != nil {
+			return 0, err
+		}
+		counts[name] = len(rows)
+	}
+
+	// The listing images as they are stored
+	imageCount, skipped := writeExportImages(ctx, archive, rowsByEntity["listings"])
+	counts["images"] = imageCount
+	manifest["counts"] = counts
+	if len(skipped) > 0 {
+		manifest["skipped_images"] = skipped
+	}
+
+	if err := writeZipJSON(archive, "manifest.json", manifest); err != nil {
+		return 0, err
+	}
+	if err := writeZipFile(archive, "README.txt", []byte(dataExportReadme)); err != nil {
+		return 0, err
+	}
+
+	if err := archive.Close(); err != nil {
+		return 0, fmt.Errorf("failed to finish archive: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		return 0, fmt.Errorf("failed to read archive size: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), dataExportPath(export.ID)); err != nil {
+		return 0, fmt.Errorf("failed to store archive: %w", err)
+	}
+
+	return info.Size(), nil
+}
+
+const dataExportReadme = `This archive contains a copy of your GreenVue data.
+
+Every kind of data is included twice: as JSON, which keeps nested values, and as CSV for spreadsheets.
+Nested values in the CSV files are written as JSON.
+
+- profile: your account details
+- listings: your listings; their images are in images/<listing id>/
+- reviews_written and reviews_received: reviews you wrote and reviews about you as a seller
+- review_replies: your replies to reviews
+- conversations and messages: your chats; "direction" tells whether you sent or received a message
+- bids and favorites: your bids and saved listings
+- sessions: devices that are currently logged in
+- security_activity: logins, password changes and other security events
+- api_keys: your API keys (the keys themselves are never stored)
+
+manifest.json lists how many records each file contains.
+`
+
+// fetchExportRows reads rows as generic maps so every column ends up in the export
+func fetchExportRows(client *db.SupabaseClient, table, query string) ([]map[string]any, error) {
+	data, err := client.GET(table, query)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var rows []map[string]any
+	if err := decoder.Decode(&rows); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", table, err)
+	}
+	if rows == nil {
+		rows = []map[string]any{}
+	}
+	return rows, nil
+}
+
+// toExportRows converts typed records to generic rows through their JSON form
+func toExportRows(records any) ([]map[string]any, error) {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode export rows: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var rows []map[string]any
+	if err := decoder.Decode(&rows); err != nil {
+		return nil, fmt.Errorf("failed to convert export rows: %w", err)
+	}
+	if rows == nil {
+		rows = []map[string]any{}
+	}
+	return rows, nil
+}
+
+// writeExportEntity writes rows as <name>.json and <name>.csv
+func writeExportEntity(archive *zip.Writer, name string, rows []map[string]any) error {
+	if err := writeZipJSON(archive, name+".json", rows); err != nil {
+		return err
+	}
+
+	columnSet := make(map[string]bool)
+	for _, row := range rows {
+		for column := range row {
+			columnSet[column] = true
+		}
+	}
+	columns := make([]string, 0, len(columnSet))
+	for column := range columnSet {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	if len(columns) > 0 {
+		if err := writer.Write(columns); err != nil {
+			return fmt.Errorf("failed to write %s.csv: %w", name, err)
+		}
+	}
+	for _, row := range rows {
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			record[i] = csvValue(row[column])
+		}
+		if err := writer.Write(record); err != nil {
+			return fmt.Errorf("failed to write %s.csv: %w", name, err)
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("failed to write %s.csv: %w", name, err)
+	}
+
+	return writeZipFile(archive, name+".csv", buf.Bytes())
+}
+
+// csvValue formats a JSON value for a CSV cell; nested values stay JSON
+func csvValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(data)
+	}
+}
+
+// writeExportImages downloads the images of every listing into images/<listing id>/.
+// Images that cannot be downloaded are listed in the manifest instead of failing the export.
+func writeExportImages(ctx context.Context, archive *zip.Writer, listings []map[string]any) (int, []string) {
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	store := storage.GetBlobStore()
+	count := 0
+	var skipped []string
+
+	for _, listing := range listings {
+		listingID, _ := listing["id"].(string)
+
+		for i, imageURL := range exportImageURLs(listing) {
+			if ctx.Err() != nil {
+				return count, append(skipped, imageURL)
+			}
+
+			// Images in our blob store are read directly, anything else over HTTP
+			var data []byte
+			var err error
+			if key, ok := storage.KeyFromURL(store, imageURL); ok {
+				data, err = store.Get(key)
+			} else {
+				data, err = downloadExportImage(ctx, httpClient, imageURL)
+			}
+			if err != nil {
+				log.Printf("Skipping image %s in data export: %v", imageURL, err)
+				skipped = append(skipped, imageURL)
+				continue
+			}
+
+			name := path.Base(strings.SplitN(imageURL, "?", 2)[0])
+			entry := fmt.Sprintf("images/%s/%02d-%s", listingID, i+1, name)
+			if err := writeZipFile(archive, entry, data); err != nil {
+				skipped = append(skipped, imageURL)
+				continue
+			}
+			count++
+		}
+	}
+
+	return count, skipped
+}
+
+// exportImageURLs returns the largest rendition of every image of a listing,
+// or the plain image URLs of listings created before renditions existed
+func exportImageURLs(listing map[string]any) []string {
+	var urls []string
+
+	if raw, err := json.Marshal(listing["images"]); err == nil {
+		var images []lib.ListingImage
+		if json.Unmarshal(raw, &images) == nil {
+			for _, image := range images {
+				if imageURL := image.Largest(); imageURL != "" {
+					urls = append(urls, imageURL)
+				}
+			}
+		}
+	}
+	if len(urls) > 0 {
+		return urls
+	}
+
+	legacy, _ := listing["image_urls"].([]any)
+	for _, raw := range legacy {
+		if imageURL, ok := raw.(string); ok && imageURL != "" {
+			urls = append(urls, imageURL)
+		}
+	}
+	return urls
+}
+
+func downloadExportImage(ctx context.Context, httpClient *http.Client, imageURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, dataExportMaxImageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > dataExportMaxImageSize {
+		return nil, fmt.Errorf("image is larger than %d bytes", dataExportMaxImageSize)
+	}
+	return data, nil
+}
+
+func writeZipJSON(archive *zip.Writer, name string, value any) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", name, err)
+	}
+	return writeZipFile(archive, name, data)
+}
+
+func writeZipFile(archive *zip.Writer, name string, data []byte) error {
+	writer, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add %s to archive: %w", name, err)
+	}
+	if _, err := writer.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	stderrors "errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestInitDataExportSigning(t *testing.T) {
+	t.Setenv("JWT_ACCESS_SECRET", strings.Repeat("a", 40))
+	t.Setenv("JWT_REFRESH_SECRET", strings.Repeat("r", 40))
+
+	keyringMu.RLock()
+	access, refresh := accessKeyring, refreshKeyring
+	keyringMu.RUnlock()
+	t.Cleanup(func() { SetKeyrings(access, refresh) })
+
+	keyfileKey := strings.Repeat("k", 40)
+	ring, err := NewKeyring("2024-01", newHMACKey("2024-01", []byte(keyfileKey)))
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+	SetKeyrings(ring, ring)
+
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{"missing", ""},
+		{"too short", "short-key"},
+		{"development default", "dev-access-secret"},
+		{"access secret", strings.Repeat("a", 40)},
+		{"refresh secret", strings.Repeat("r", 40)},
+		{"keyring file key", keyfileKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := InitDataExportSigning(tt.key); !stderrors.Is(err, ErrDataExportSigningKey) {
+				t.Fatalf("InitDataExportSigning(%q) error = %v, want ErrDataExportSigningKey", tt.key, err)
+			}
+		})
+	}
+
+	if err := InitDataExportSigning(strings.Repeat("e", 40)); err != nil {
+		t.Fatalf("InitDataExportSigning() with a dedicated key error = %v", err)
+	}
+}
+
+func TestSignDataExportWithoutKey(t *testing.T) {
+	dataExportKeyMu.Lock()
+	previous := dataExportKey
+	dataExportKey = nil
+	dataExportKeyMu.Unlock()
+	t.Cleanup(func() {
+		dataExportKeyMu.Lock()
+		dataExportKey = previous
+		dataExportKeyMu.Unlock()
+	})
+
+	if _, err := signDataExport(uuid.New(), time.Now().Add(time.Hour).Unix()); !stderrors.Is(err, ErrDataExportSigningKey) {
+		t.Fatalf("signDataExport() error = %v, want ErrDataExportSigningKey", err)
+	}
+}
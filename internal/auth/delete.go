@@ -1,16 +1,33 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"greenvue/internal/db"
 	"greenvue/lib"
+	"greenvue/lib/email"
 	"greenvue/lib/errors"
+	"greenvue/lib/image"
+	"html"
+	"log"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 )
 
-// DeleteAccount handles the deletion of a user account
+const (
+	accountDeletionsTable = "account_deletions"
+	deletedUserName       = "Deleted user"
+	deletedMessageContent = "[Message from a deleted account]"
+	deletionListingBatch  = 50
+)
+
+// DeleteAccount schedules the deletion of the authenticated user's account.
+// Nothing is removed until the grace period has passed; logging in again before then cancels it.
 func DeleteAccount(c *fiber.Ctx) error {
 	claims, ok := c.Locals("user").(*Claims)
 	if !ok || claims == nil {
@@ -25,40 +42,412 @@ func DeleteAccount(c *fiber.Ctx) error {
 		return errors.InternalServerError("Failed to get database client")
 	}
 
-	// Check if the user exists
-	query := fmt.Sprintf("id=eq.%s", userID)
-	data, err := client.GET("users", query)
+	user, err := getUserRecord(userID)
 	if err != nil {
-		return errors.InternalServerError("Failed to check user existence: " + err.Error())
+		return err
 	}
 
-	if len(data) == 0 {
-		return errors.NotFound("User not found")
+	// Requesting again keeps the original schedule
+	pending, err := getPendingAccountDeletion(userID)
+	if err != nil {
+		return errors.DatabaseError(err.Error())
 	}
 
-	// Unmarshal the user data
-	var users []lib.User
-	if err := json.Unmarshal(data, &users); err != nil {
-		return errors.InternalServerError("Failed to unmarshal user data: " + err.Error())
+	deletion := pending
+	if deletion == nil {
+		now := time.Now().UTC()
+		deletion = &lib.AccountDeletion{
+			ID:           uuid.New(),
+			UserID:       userID,
+			Email:        user.Email,
+			RequestedAt:  now,
+			ScheduledFor: now.Add(lib.AccountDeletionGracePeriod),
+		}
+		if _, err := client.POST(accountDeletionsTable, deletion); err != nil {
+			auditFailure(c, AuditAccountDelete, &userID, "", err.Error())
+			return errors.DatabaseError("Failed to schedule account deletion: " + err.Error())
+		}
+
+		queueDeletionScheduledEmail(deletion)
+		auditUserAction(c, AuditAccountDelete, userID, map[string]any{
+			"step":          "scheduled",
+			"scheduled_for": deletion.ScheduledFor,
+		})
 	}
 
-	if len(users) == 0 {
-		return errors.NotFound("User not found")
+	// Sign out everywhere, so the next login is a deliberate decision to keep the account
+	if err := GetTokenStore().RevokeUser(userID); err != nil {
+		log.Printf("Failed to revoke sessions of user %s after deletion request: %v", userID, err)
+	}
+	if _, err := client.PATCHWhere(apiKeysTable, fmt.Sprintf("user_id=eq.%s&revoked_at=is.null", userID),
+		map[string]any{"revoked_at": time.Now().UTC()}); err != nil {
+		log.Printf("Failed to revoke API keys of user %s after deletion request: %v", userID, err)
 	}
+	ClearAuthCookies(c)
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"message":      "Your account will be deleted. Log in again before the scheduled date to keep it.",
+		"scheduledFor": deletion.ScheduledFor,
+	})
+}
 
-	// Ensure the user ID matches the authenticated user's ID
-	if users[0].ID != userID {
-		return errors.Forbidden("You can only delete your own account")
+// getPendingAccountDeletion returns the scheduled deletion of a user that has not been cancelled or completed
+func getPendingAccountDeletion(userID uuid.UUID) (*lib.AccountDeletion, error) {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return nil, fmt.Errorf("database client not available")
 	}
 
-	// Delete the user from the database
-	data, err = client.DELETE("users", query)
+	data, err := client.GET(accountDeletionsTable,
+		fmt.Sprintf("user_id=eq.%s&cancelled_at=is.null&completed_at=is.null&limit=1", userID))
 	if err != nil {
-		return errors.InternalServerError("Failed to delete user: " + err.Error())
+		return nil, fmt.Errorf("failed to fetch account deletion: %w", err)
 	}
 
-	return errors.SuccessResponse(c, fiber.Map{
-		"message": "User account deleted successfully",
-		"data":    data,
+	var deletions []lib.AccountDeletion
+	if err := json.Unmarshal(data, &deletions); err != nil {
+		return nil, fmt.Errorf("failed to parse account deletion: %w", err)
+	}
+	if len(deletions) == 0 {
+		return nil, nil
+	}
+	return &deletions[0], nil
+}
+
+// cancelAccountDeletion cancels a pending deletion when its user logs in again.
+// Once the cleanup has started the deletion can no longer be cancelled.
+func cancelAccountDeletion(userID uuid.UUID, device SessionDevice) {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return
+	}
+
+	data, err := client.PATCHWhere(accountDeletionsTable,
+		fmt.Sprintf("user_id=eq.%s&cancelled_at=is.null&completed_at=is.null&started_at=is.null", userID),
+		map[string]any{"cancelled_at": time.Now().UTC()})
+	if err != nil {
+		log.Printf("Failed to cancel account deletion of user %s: %v", userID, err)
+		return
+	}
+
+	var cancelled []lib.AccountDeletion
+	if err := json.Unmarshal(data, &cancelled); err != nil || len(cancelled) == 0 {
+		return
+	}
+
+	log.Printf("User %s logged in, account deletion %s cancelled", userID, cancelled[0].ID)
+	RecordAudit(nil, AuditEvent{
+		Action:    AuditAccountDelete,
+		ActorID:   &userID,
+		TargetID:  &userID,
+		IP:        device.IP,
+		UserAgent: device.UserAgent,
+		Metadata:  map[string]any{"step": "cancelled"},
 	})
+	queueDeletionEmail(cancelled[0].Email, "Your GreenVue account will not be deleted",
+		"You logged in to GreenVue, so the scheduled deletion of your account has been cancelled. "+
+			"If you still want to delete it, request the deletion again from your account settings.")
+}
+
+// ProcessAccountDeletions carries out deletions whose grace period has passed and returns how many were completed.
+// A deletion that fails halfway is retried on the next run; every step can safely be repeated.
+func ProcessAccountDeletions(ctx context.Context, batchSize int) (int, error) {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return 0, fmt.Errorf("database client not available")
+	}
+
+	data, err := client.GET(accountDeletionsTable, fmt.Sprintf(
+		"cancelled_at=is.null&completed_at=is.null&scheduled_for=lte.%s&order=scheduled_for.asc&limit=%d",
+		url.QueryEscape(time.Now().UTC().Format(time.RFC3339)), batchSize))
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch due account deletions: %w", err)
+	}
+
+	var due []lib.AccountDeletion
+	if err := json.Unmarshal(data, &due); err != nil {
+		return 0, fmt.Errorf("failed to parse account deletions: %w", err)
+	}
+
+	completed := 0
+	for _, deletion := range due {
+		if ctx.Err() != nil {
+			return completed, ctx.Err()
+		}
+
+		// Claiming the deletion stops a concurrent login from cancelling it halfway through
+		claimed, err := client.PATCHWhere(accountDeletionsTable,
+			fmt.Sprintf("id=eq.%s&cancelled_at=is.null&completed_at=is.null", deletion.ID),
+			map[string]any{"started_at": time.Now().UTC()})
+		if err != nil || len(claimed) == 0 || string(claimed) == "[]" {
+			continue
+		}
+
+		receipt, err := deleteAccountData(ctx, client, deletion)
+		if err != nil {
+			log.Printf("Account deletion %s of user %s failed, will retry: %v", deletion.ID, deletion.UserID, err)
+			continue
+		}
+
+		if _, err := client.PATCH(accountDeletionsTable, deletion.ID, map[string]any{
+			"completed_at": receipt.CompletedAt,
+			"receipt":      receipt,
+		}); err != nil {
+			log.Printf("Failed to store receipt of account deletion %s: %v", deletion.ID, err)
+			continue
+		}
+
+		RecordAudit(nil, AuditEvent{
+			Action:   AuditAccountDelete,
+			TargetID: &deletion.UserID,
+			Metadata: map[string]any{"step": "completed", "deletion_id": deletion.ID},
+		})
+		queueDeletionReceiptEmail(deletion.Email, receipt)
+		completed++
+	}
+
+	return completed, nil
+}
+
+// deleteAccountData removes or anonymizes everything that belongs to the account and returns the receipt.
+// The user row itself is kept but anonymized, so reviews and conversations of other users stay readable.
+func deleteAccountData(ctx context.Context, client *db.SupabaseClient, deletion lib.AccountDeletion) (*lib.DeletionReceipt, error) {
+	userID := deletion.UserID
+	receipt := &lib.DeletionReceipt{
+		DeletionID:  deletion.ID,
+		UserID:      userID,
+		RequestedAt: deletion.RequestedAt,
+	}
+
+	// Listings go together with their images, bids and favorites
+	for {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		data, err := client.GET("listings", fmt.Sprintf("seller_id=eq.%s&select=id,image_urls,images&limit=%d", userID, deletionListingBatch))
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch listings: %w", err)
+		}
+
+		var listings []struct {
+			ID        uuid.UUID          `json:"id"`
+			ImageUrls []string           `json:"image_urls"`
+			Images    []lib.ListingImage `json:"images"`
+		}
+		if err := json.Unmarshal(data, &listings); err != nil {
+			return nil, fmt.Errorf("failed to parse listings: %w", err)
+		}
+		if len(listings) == 0 {
+			break
+		}
+
+		ids := make([]string, 0, len(listings))
+		var imageURLs []string
+		for _, listing := range listings {
+			ids = append(ids, listing.ID.String())
+			imageURLs = append(imageURLs, listing.ImageUrls...)
+			for _, listingImage := range listing.Images {
+				imageURLs = append(imageURLs, listingImage.URLs()...)
+			}
+		}
+		inListings := "listing_id=in.(" + strings.Join(ids, ",") + ")"
+
+		count, err := deleteRows(client, "bids", inListings)
+		if err != nil {
+			return nil, err
+		}
+		receipt.BidsDeleted += count
+
+		count, err = deleteRows(client, "favorites", inListings)
+		if err != nil {
+			return nil, err
+		}
+		receipt.FavoritesDeleted += count
+
+		// Duplicate detection data of the listings, including flags raised by or against them
+		for table, condition := range map[string]string{
+			"image_hashes":  inListings,
+			"listing_flags": fmt.Sprintf("or=(listing_id.in.(%[1]s),matched_listing_id.in.(%[1]s))", strings.Join(ids, ",")),
+		} {
+			if _, err := deleteRows(client, table, condition); err != nil {
+				return nil, err
+			}
+		}
+
+		removed, err := image.DeleteImages(imageURLs)
+		if err != nil {
+			return nil, err
+		}
+		receipt.ImagesDeleted += removed
+
+		count, err = deleteRows(client, "listings", "id=in.("+strings.Join(ids, ",")+")")
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			return nil, fmt.Errorf("listings of user %s could not be deleted", userID)
+		}
+		receipt.ListingsDeleted += count
+	}
+
+	// The user's own bids, favorites and helpful votes
+	for table, field := range map[string]*int{"bids": &receipt.BidsDeleted, "favorites": &receipt.FavoritesDeleted} {
+		count, err := deleteRows(client, table, fmt.Sprintf("user_id=eq.%s", userID))
+		if err != nil {
+			return nil, err
+		}
+		*field += count
+	}
+	if _, err := deleteRows(client, "review_helpful_votes", fmt.Sprintf("user_id=eq.%s", userID)); err != nil {
+		return nil, err
+	}
+
+	// Reviews stay for the sellers' ratings and are shown under the anonymized profile
+	data, err := client.GET("reviews", fmt.Sprintf("user_id=eq.%s&select=id", userID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch reviews: %w", err)
+	}
+	var reviews []struct {
+		ID uuid.UUID `json:"id"`
+	}
+	if err := json.Unmarshal(data, &reviews); err != nil {
+		return nil, fmt.Errorf("failed to parse reviews: %w", err)
+	}
+	receipt.ReviewsAnonymized = len(reviews)
+
+	// Messages are redacted; the other party's side of each conversation is untouched
+	data, err = client.PATCHWhere("messages",
+		fmt.Sprintf("sender_id=eq.%s&content=neq.%s", userID, url.QueryEscape(deletedMessageContent)),
+		map[string]any{"content": deletedMessageContent})
+	if err != nil {
+		return nil, fmt.Errorf("failed to anonymize messages: %w", err)
+	}
+	receipt.MessagesAnonymized = countRows(data)
+
+	// Every way to log in: passkeys, MFA, API keys, linked identities and pending links
+	for table, condition := range map[string]string{
+		passkeysTable:       fmt.Sprintf("user_id=eq.%s", userID),
+		mfaTable:            fmt.Sprintf("id=eq.%s", userID),
+		apiKeysTable:        fmt.Sprintf("user_id=eq.%s", userID),
+		userIdentitiesTable: fmt.Sprintf("user_id=eq.%s", userID),
+		magicLinksTable:     fmt.Sprintf("user_id=eq.%s", userID),
+		emailChangesTable:   fmt.Sprintf("user_id=eq.%s", userID),
+	} {
+		if _, err := deleteRows(client, table, condition); err != nil {
+			return nil, err
+		}
+	}
+	if err := GetTokenStore().RevokeUser(userID); err != nil {
+		return nil, fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+
+	// Anonymize the profile; an uploaded profile picture is removed from storage
+	var profile []lib.User
+	data, err = client.GET("users", fmt.Sprintf("id=eq.%s&select=id,picture", userID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch profile: %w", err)
+	}
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("failed to parse profile: %w", err)
+	}
+	if len(profile) > 0 && profile[0].Picture != "" {
+		removed, err := image.DeleteImages([]string{profile[0].Picture})
+		if err != nil {
+			return nil, err
+		}
+		receipt.ImagesDeleted += removed
+	}
+
+	placeholderEmail := fmt.Sprintf("deleted-%s@deleted.invalid", userID)
+	if _, err := client.PATCH("users", userID, map[string]any{
+		"name":           deletedUserName,
+		"email":          placeholderEmail,
+		"bio":            "",
+		"picture":        "",
+		"location":       nil,
+		"verified":       false,
+		"email_verified": false,
+		"role":           RoleUser,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to anonymize profile: %w", err)
+	}
+	receipt.ProfileAnonymized = true
+
+	// Release the address and block password logins for good
+	if _, err := client.UpdateUser(userID, map[string]any{
+		"email":         placeholderEmail,
+		"ban_duration":  "876000h",
+		"user_metadata": map[string]any{},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to disable login: %w", err)
+	}
+	receipt.LoginDisabled = true
+
+	receipt.CompletedAt = time.Now().UTC()
+	return receipt, nil
+}
+
+// deleteRows deletes matching rows and returns how many were removed
+func deleteRows(client *db.SupabaseClient, table, conditions string) (int, error) {
+	data, err := client.DELETE(table, conditions)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete from %s: %w", table, err)
+	}
+	return countRows(data), nil
+}
+
+// countRows counts the rows of a return=representation response
+func countRows(data []byte) int {
+	var rows []json.RawMessage
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return 0
+	}
+	return len(rows)
+}
+
+// queueDeletionScheduledEmail tells the user when the account will be deleted and how to stop it
+func queueDeletionScheduledEmail(deletion *lib.AccountDeletion) {
+	queueDeletionEmail(deletion.Email, "Your GreenVue account will be deleted",
+		fmt.Sprintf("Your GreenVue account is scheduled for deletion on %s. "+
+			"Until then you can keep your account by simply logging in again. "+
+			"After that date your listings, bids and favorites are removed and your reviews and messages are anonymized.",
+			deletion.ScheduledFor.Format("2 January 2006")))
+}
+
+// queueDeletionReceiptEmail sends the receipt to the address the account had when the deletion was requested
+func queueDeletionReceiptEmail(address string, receipt *lib.DeletionReceipt) {
+	queueDeletionEmail(address, "Your GreenVue account has been deleted",
+		fmt.Sprintf("Your GreenVue account has been deleted on %s.\n\n"+
+			"Receipt %s:\n"+
+			"- Listings deleted: %d\n"+
+			"- Images deleted: %d\n"+
+			"- Bids deleted: %d\n"+
+			"- Favorites deleted: %d\n"+
+			"- Reviews anonymized: %d\n"+
+			"- Messages anonymized: %d\n\n"+
+			"You can no longer log in with this account.",
+			receipt.CompletedAt.Format("2 January 2006"), receipt.DeletionID,
+			receipt.ListingsDeleted, receipt.ImagesDeleted, receipt.BidsDeleted,
+			receipt.FavoritesDeleted, receipt.ReviewsAnonymized, receipt.MessagesAnonymized))
+}
+
+func queueDeletionEmail(address, subject, text string) {
+	if address == "" {
+		return
+	}
+
+	if err := email.QueueEmail(email.Email{
+		ID:          lib.GenerateUUID(),
+		To:          address,
+		Subject:     subject,
+		Type:        email.NotificationEmail,
+		TextContent: text,
+		HTMLContent: "<p>" + strings.ReplaceAll(html.EscapeString(text), "\n", "<br>") + "</p>",
+		Status:      "pending",
+		MaxRetries:  3,
+		CreatedAt:   time.Now(),
+	}); err != nil {
+		log.Printf("Failed to queue account deletion email: %v", err)
+	}
 }
@@ -32,6 +32,10 @@ func ResendConfirmationEmail(c *fiber.Ctx) error {
 		return errors.BadRequest("Email is required")
 	}
 
+	if err := guardEmailRequest(c, "confirmation", requestBody.Email); err != nil {
+		return err
+	}
+
 	// Check if the user exists before queuing the email
 	query := fmt.Sprintf("email=eq.%s", requestBody.Email)
 	data, err := client.GET("user_details", query)
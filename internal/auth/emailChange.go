@@ -0,0 +1,387 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"greenvue/internal/db"
+	"greenvue/lib"
+	"greenvue/lib/email"
+	"greenvue/lib/errors"
+	"greenvue/lib/validation"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	emailChangesTable = "email_changes"
+
+	emailChangeConfirmTTL = 24 * time.Hour     // Time to confirm the new address
+	emailChangeRevertTTL  = 7 * 24 * time.Hour // Time the old address can undo the change
+)
+
+// EmailChange is a pending or completed change of a user's email address.
+// Only hashes of the confirm and revert tokens are stored.
+type EmailChange struct {
+	ID               uuid.UUID  `json:"id"`
+	UserID           uuid.UUID  `json:"user_id"`
+	OldEmail         string     `json:"old_email"`
+	NewEmail         string     `json:"new_email"`
+	ConfirmTokenHash string     `json:"confirm_token_hash"`
+	RevertTokenHash  string     `json:"revert_token_hash"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+	RevertExpiresAt  time.Time  `json:"revert_expires_at"`
+	ConfirmedAt      *time.Time `json:"confirmed_at,omitempty"`
+	RevertedAt       *time.Time `json:"reverted_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	RequestedIP      string     `json:"requested_ip"`
+}
+
+// RequestEmailChange starts an email change. The new address gets a confirmation link and the
+// old address a notice with a link to undo it; the address only changes once the new one is confirmed.
+func RequestEmailChange(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	var payload struct {
+		NewEmail string `json:"newEmail"`
+		Password string `json:"password"`
+	}
+
+	if err := c.BodyParser(&payload); err != nil {
+		return errors.BadRequest("Invalid request format")
+	}
+
+	newEmail := strings.ToLower(strings.TrimSpace(payload.NewEmail))
+	if err := errors.ValidateFields(map[string]string{
+		"newEmail": newEmail,
+		"password": payload.Password,
+	}); err != nil {
+		return err
+	}
+
+	if valid, reason := validation.ValidateEmail(newEmail); !valid {
+		return errors.ValidationError("Invalid email format: "+reason, "newEmail")
+	}
+
+	if err := guardEmailRequest(c, "email_change", claims.UserId.String()); err != nil {
+		return err
+	}
+
+	// Without the revert link the old address could not undo a hostile change, so never start one
+	if _, err := apiLink("", nil); err != nil {
+		log.Printf("Cannot send email change links: %v", err)
+		return errors.InternalServerError("Email changes are not available right now")
+	}
+
+	// A stolen session alone must not be enough to take over the account
+	if err := reauthenticate(claims.UserId, payload.Password); err != nil {
+		return err
+	}
+
+	user, err := getUserRecord(claims.UserId)
+	if err != nil {
+		return err
+	}
+
+	if strings.EqualFold(user.Email, newEmail) {
+		return errors.ValidationError("This is already your email address", "newEmail")
+	}
+
+	taken, err := isEmailTaken(newEmail)
+	if err != nil {
+		return errors.InternalServerError(err.Error())
+	}
+	if taken {
+		return errors.AlreadyExists("This email address is already in use")
+	}
+
+	confirmToken, err := randomURLToken(32)
+	if err != nil {
+		return errors.InternalServerError("Failed to generate confirmation link")
+	}
+	revertToken, err := randomURLToken(32)
+	if err != nil {
+		return errors.InternalServerError("Failed to generate confirmation link")
+	}
+
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create database client")
+	}
+
+	// Only the newest request can be confirmed
+	if _, err := client.DELETE(emailChangesTable, fmt.Sprintf("user_id=eq.%s&confirmed_at=is.null&reverted_at=is.null", claims.UserId)); err != nil {
+		log.Printf("Failed to remove pending email changes of user %s: %v", claims.UserId, err)
+	}
+
+	now := time.Now().UTC()
+	change := EmailChange{
+		ID:               uuid.New(),
+		UserID:           claims.UserId,
+		OldEmail:         user.Email,
+		NewEmail:         newEmail,
+		ConfirmTokenHash: hashMagicLinkToken(confirmToken),
+		RevertTokenHash:  hashMagicLinkToken(revertToken),
+		ExpiresAt:        now.Add(emailChangeConfirmTTL),
+		RevertExpiresAt:  now.Add(emailChangeRevertTTL),
+		CreatedAt:        now,
+		RequestedIP:      c.IP(),
+	}
+	if _, err := client.POST(emailChangesTable, change); err != nil {
+		return errors.DatabaseError("Failed to store email change: " + err.Error())
+	}
+
+	if err := queueEmailChangeEmails(change, confirmToken, revertToken); err != nil {
+		return errors.InternalServerError("Failed to queue confirmation email: " + err.Error())
+	}
+	auditUserAction(c, AuditEmailChange, claims.UserId, map[string]any{"step": "requested"})
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"message":   "We have sent a confirmation link to your new email address",
+		"newEmail":  newEmail,
+		"expiresAt": change.ExpiresAt,
+	})
+}
+
+// isEmailTaken reports whether an address already belongs to an account
+func isEmailTaken(address string) (bool, error) {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return false, fmt.Errorf("database client not available")
+	}
+
+	data, err := client.GET("users", fmt.Sprintf("email=eq.%s&select=id", url.QueryEscape(address)))
+	if err != nil {
+		return false, fmt.Errorf("failed to look up email: %w", err)
+	}
+
+	var users []User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return false, fmt.Errorf("failed to parse users: %w", err)
+	}
+	return len(users) > 0, nil
+}
+
+// queueEmailChangeEmails sends the confirmation link to the new address and the revert link to the old one
+// Both links come from API_URL, so a forged Host header cannot send the revert link elsewhere.
+func queueEmailChangeEmails(change EmailChange, confirmToken, revertToken string) error {
+	confirmURL, err := apiLink("/auth/email_change/confirm", url.Values{"token": {confirmToken}})
+	if err != nil {
+		return err
+	}
+	revertURL, err := apiLink("/auth/email_change/revert", url.Values{"token": {revertToken}})
+	if err != nil {
+		return err
+	}
+	revertDays := int(emailChangeRevertTTL.Hours() / 24)
+
+	if err := email.QueueEmail(email.Email{
+		ID:      lib.GenerateUUID(),
+		To:      change.NewEmail,
+		Subject: "Confirm your new GreenVue email address",
+		Type:    email.NotificationEmail,
+		TextContent: fmt.Sprintf("Please confirm that you want to use this address for your GreenVue account: %s\n\n"+
+			"The link expires in 24 hours. If you did not ask for this, you can ignore this email.", confirmURL),
+		HTMLContent: fmt.Sprintf("<p>Please <a href=\"%s\">confirm</a> that you want to use this address for your GreenVue account.</p>"+
+			"<p>The link expires in 24 hours. If you did not ask for this, you can ignore this email.</p>", confirmURL),
+		Status:     "pending",
+		MaxRetries: 3,
+		CreatedAt:  time.Now(),
+	}); err != nil {
+		return err
+	}
+
+	return email.QueueEmail(email.Email{
+		ID:      lib.GenerateUUID(),
+		To:      change.OldEmail,
+		Subject: "Your GreenVue email address is being changed",
+		Type:    email.NotificationEmail,
+		TextContent: fmt.Sprintf("Someone asked to change the email address of your GreenVue account to %s.\n\n"+
+			"If this was not you, undo the change and sign out all devices: %s\n\n"+
+			"This link works for %d days.", change.NewEmail, revertURL, revertDays),
+		HTMLContent: fmt.Sprintf("<p>Someone asked to change the email address of your GreenVue account to %s.</p>"+
+			"<p>If this was not you, <a href=\"%s\">undo the change and sign out all devices</a>.</p>"+
+			"<p>This link works for %d days.</p>", change.NewEmail, revertURL, revertDays),
+		Status:     "pending",
+		MaxRetries: 3,
+		CreatedAt:  time.Now(),
+	})
+}
+
+// ShowEmailChangeConfirmation renders the page behind the link sent to the new address
+func ShowEmailChangeConfirmation(c *fiber.Ctx) error {
+	return renderConfirmationPage(c, "Confirm your new email address", "Confirm", "/auth/email_change/confirm")
+}
+
+// ShowEmailChangeRevert renders the page behind the link sent to the old address
+func ShowEmailChangeRevert(c *fiber.Ctx) error {
+	return renderConfirmationPage(c, "Undo email change", "Undo change and sign out everywhere", "/auth/email_change/revert")
+}
+
+// ConfirmEmailChange switches the account to the new address
+func ConfirmEmailChange(c *fiber.Ctx) error {
+	token, err := parseEmailChangeToken(c)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	change, err := claimEmailChange(
+		fmt.Sprintf("confirm_token_hash=eq.%s&confirmed_at=is.null&reverted_at=is.null&expires_at=gt.%s",
+			hashMagicLinkToken(token), url.QueryEscape(now.Format(time.RFC3339))),
+		map[string]any{"confirmed_at": now},
+	)
+	if err != nil {
+		return emailChangeResult(c, err, "", "")
+	}
+
+	// Someone may have registered the address since the change was requested
+	taken, err := isEmailTaken(change.NewEmail)
+	if err != nil {
+		return emailChangeResult(c, errors.InternalServerError(err.Error()), "", "")
+	}
+	if taken {
+		return emailChangeResult(c, errors.AlreadyExists("This email address is already in use"), "", "")
+	}
+
+	if err := setUserEmail(change.UserID, change.NewEmail); err != nil {
+		return emailChangeResult(c, err, "", "")
+	}
+
+	log.Printf("User %s changed email address", change.UserID)
+	RecordAudit(c, AuditEvent{
+		Action:   AuditEmailChange,
+		TargetID: &change.UserID,
+		Metadata: map[string]any{"step": "confirmed"},
+	})
+
+	return emailChangeResult(c, nil, "email_changed=true", "Your email address has been updated")
+}
+
+// RevertEmailChange undoes an email change from the old address and signs out every session,
+// since the change may have been made by someone who took over the account
+func RevertEmailChange(c *fiber.Ctx) error {
+	token, err := parseEmailChangeToken(c)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	change, err := claimEmailChange(
+		fmt.Sprintf("revert_token_hash=eq.%s&reverted_at=is.null&revert_expires_at=gt.%s",
+			hashMagicLinkToken(token), url.QueryEscape(now.Format(time.RFC3339))),
+		map[string]any{"reverted_at": now},
+	)
+	if err != nil {
+		return emailChangeResult(c, err, "", "")
+	}
+
+	if change.ConfirmedAt != nil {
+		if err := setUserEmail(change.UserID, change.OldEmail); err != nil {
+			return emailChangeResult(c, err, "", "")
+		}
+	}
+
+	if err := GetTokenStore().RevokeUser(change.UserID); err != nil {
+		log.Printf("Failed to revoke sessions of user %s after email change revert: %v", change.UserID, err)
+	}
+
+	log.Printf("User %s reverted an email change, all sessions revoked", change.UserID)
+	RecordAudit(c, AuditEvent{
+		Action:   AuditEmailChange,
+		TargetID: &change.UserID,
+		Metadata: map[string]any{"step": "reverted"},
+	})
+
+	return emailChangeResult(c, nil, "email_change_reverted=true", "The email change has been undone and all sessions were signed out")
+}
+
+// parseEmailChangeToken reads the token from a form or JSON body
+func parseEmailChangeToken(c *fiber.Ctx) (string, error) {
+	var payload struct {
+		Token string `json:"token" form:"token"`
+	}
+
+	if err := c.BodyParser(&payload); err != nil {
+		return "", errors.BadRequest("Invalid request format")
+	}
+
+	token := strings.TrimSpace(payload.Token)
+	if token == "" {
+		return "", errors.BadRequest("Missing token")
+	}
+	return token, nil
+}
+
+// claimEmailChange applies an update to the single change matching conditions.
+// The conditions include the state, so each link can only be used once.
+func claimEmailChange(conditions string, update map[string]any) (*EmailChange, error) {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return nil, errors.InternalServerError("Failed to create database client")
+	}
+
+	data, err := client.PATCHWhere(emailChangesTable, conditions, update)
+	if err != nil {
+		return nil, errors.DatabaseError("Failed to update email change: " + err.Error())
+	}
+
+	var changes []EmailChange
+	if err := json.Unmarshal(data, &changes); err != nil || len(changes) == 0 {
+		return nil, errors.Unauthorized("Invalid or expired link")
+	}
+	return &changes[0], nil
+}
+
+// setUserEmail changes the address in Supabase Auth and in our users table
+func setUserEmail(userID uuid.UUID, address string) error {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create database client")
+	}
+
+	if _, err := client.UpdateUser(userID, map[string]any{
+		"email":         address,
+		"email_confirm": true,
+	}); err != nil {
+		return errors.InternalServerError("Failed to update email: " + err.Error())
+	}
+
+	if _, err := client.PATCH("users", userID, map[string]any{
+		"email":          address,
+		"email_verified": true,
+	}); err != nil {
+		return errors.DatabaseError("Failed to update email: " + err.Error())
+	}
+
+	return nil
+}
+
+// emailChangeResult redirects form posts to the web client and answers JSON clients directly
+func emailChangeResult(c *fiber.Ctx, err error, successQuery, message string) error {
+	siteURL := os.Getenv("URL")
+	fromForm := strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationForm)
+
+	if err != nil {
+		if fromForm && siteURL != "" {
+			return c.Redirect(siteURL + "/settings?email_change=failed")
+		}
+		return err
+	}
+
+	if fromForm && siteURL != "" {
+		return c.Redirect(siteURL + "/settings?" + successQuery)
+	}
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"message": message,
+	})
+}
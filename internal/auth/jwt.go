@@ -29,14 +29,18 @@ var (
 )
 
 const (
-	TokenTypeAccess  = "access_token"
-	TokenTypeRefresh = "refresh_token"
+	TokenTypeAccess     = "access_token"
+	TokenTypeRefresh    = "refresh_token"
+	TokenTypeMFAPending = "mfa_pending" // Issued after the password step when a second factor is required
+
+	TokenTypeAccountUnlock = "account_unlock" // Sent by email to lift a login lockout
 )
 
 type Claims struct {
-	UserId uuid.UUID `json:"user_id"`
-	Role   string    `json:"role"`
-	Type   string    `json:"type"` // New field to identify token type
+	UserId    uuid.UUID `json:"user_id"`
+	Role      string    `json:"role"`          // One of the RBAC roles, e.g. "user" or "admin"
+	Type      string    `json:"type"`          // New field to identify token type
+	SessionID uuid.UUID `json:"sid,omitempty"` // Refresh token family the token belongs to
 	jwt.RegisteredClaims
 }
 
@@ -103,6 +107,9 @@ func ClearAuthCookies(c *fiber.Ctx) {
 		HTTPOnly: true,
 		SameSite: SameSite,
 	})
+
+	// Clear CSRF cookie
+	clearCSRFCookie(c)
 }
 
 // SetTokenCookie sets the JWT token as a secure HTTP-only cookie
@@ -171,63 +178,94 @@ func SetAuthCookies(c *fiber.Ctx, tokens *TokenPair) {
 
 	// Set the refresh token cookie
 	SetRefreshTokenCookie(c, tokens.RefreshToken)
+
+	// Set the CSRF cookie that cookie-authenticated mutations must echo back
+	setCSRFCookie(c)
 }
 
-func getJWTSecrets() (access []byte, refresh []byte) {
-	accessSecret := os.Getenv("JWT_ACCESS_SECRET")
-	refreshSecret := os.Getenv("JWT_REFRESH_SECRET")
+// GenerateTokenPair creates a new access token and refresh token for a fresh login.
+// Each call starts a new refresh token family and records it as a session for the given device.
+func GenerateTokenPair(userID uuid.UUID, email string, device SessionDevice) (*TokenPair, error) {
+	familyID := uuid.New()
+
+	tokens, err := generateTokenPair(userID, familyID)
+	if err != nil {
+		return nil, err
+	}
 
-	if accessSecret == "" || refreshSecret == "" {
-		log.Fatal("JWT secrets are not set. Please set JWT_ACCESS_SECRET and JWT_REFRESH_SECRET in your environment.")
+	if err := startSession(userID, familyID, device); err != nil {
+		return nil, err
 	}
 
-	return []byte(accessSecret), []byte(refreshSecret)
+	// Logging in during the grace period keeps the account
+	cancelAccountDeletion(userID, device)
+
+	return tokens, nil
 }
 
-// GenerateTokenPair creates a new access token and refresh token
-func GenerateTokenPair(userID uuid.UUID, email string) (*TokenPair, error) {
-	accessExpiration := time.Now().Add(time.Duration(AccessCookieMaxAge) * time.Second)
-	refreshExpiration := time.Now().Add(time.Duration(RefreshCookieMaxAge) * time.Second)
+// generateTokenPair creates a token pair in the given refresh token family and
+// records the refresh token in the token store
+func generateTokenPair(userID uuid.UUID, familyID uuid.UUID) (*TokenPair, error) {
+	now := time.Now()
+	accessExpiration := now.Add(time.Duration(AccessCookieMaxAge) * time.Second)
+	refreshExpiration := now.Add(time.Duration(RefreshCookieMaxAge) * time.Second)
+	refreshID := uuid.New()
+
+	// The role is read on every issue, so role changes apply from the next refresh
+	role := roleForToken(userID)
 
 	// Generate access token
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
-		UserId: userID,
-		Role:   "authenticated",
-		Type:   TokenTypeAccess, // Specify token type
+	accessTokenString, err := signToken(TokenTypeAccess, Claims{
+		UserId:    userID,
+		Role:      role,
+		Type:      TokenTypeAccess, // Specify token type
+		SessionID: familyID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),                  // Unique token identifier
 			Audience:  []string{"greenvue-client"},          // Audience of the token
 			Issuer:    "greenvue",                           // Issuer of the token
 			Subject:   userID.String(),                      // Subject of the token
 			ExpiresAt: jwt.NewNumericDate(accessExpiration), // Expiration time (1 hour)
-			IssuedAt:  jwt.NewNumericDate(time.Now()),       // Time when the token was issued
+			IssuedAt:  jwt.NewNumericDate(now),              // Time when the token was issued
 		},
 	})
 
+	if err != nil {
+		return nil, err
+	}
+
 	// Generate refresh token
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
-		UserId: userID,
-		Role:   "authenticated",
-		Type:   TokenTypeRefresh, // Specify token type
+	refreshTokenString, err := signToken(TokenTypeRefresh, Claims{
+		UserId:    userID,
+		Role:      role,
+		Type:      TokenTypeRefresh, // Specify token type
+		SessionID: familyID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        refreshID.String(), // Used to look up the token in the token store
 			Audience:  []string{"greenvue-client"},
 			Issuer:    "greenvue",
 			Subject:   userID.String(),
 			ExpiresAt: jwt.NewNumericDate(refreshExpiration),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			IssuedAt:  jwt.NewNumericDate(now),
 		},
 	})
 
-	// Sign the tokens
-	accessSecret, refreshSecret := getJWTSecrets()
-	accessTokenString, err := accessToken.SignedString(accessSecret)
 	if err != nil {
 		return nil, err
 	}
 
-	refreshTokenString, err := refreshToken.SignedString(refreshSecret)
+	// Record the refresh token so it can be rotated and revoked later
+	err = GetTokenStore().Save(RefreshTokenRecord{
+		ID:        refreshID,
+		UserID:    userID,
+		FamilyID:  familyID,
+		CreatedAt: now.UTC(),
+		ExpiresAt: refreshExpiration.UTC(),
+	})
 	if err != nil {
 		return nil, err
 	}
+
 	return &TokenPair{
 		AccessToken:  accessTokenString,
 		RefreshToken: refreshTokenString,
@@ -235,18 +273,15 @@ func GenerateTokenPair(userID uuid.UUID, email string) (*TokenPair, error) {
 	}, nil
 }
 
-// ValidateToken validates a JWT token and returns the claims
+// ValidateToken validates a JWT token and returns the claims.
+// The key is selected from the token type's keyring by the token's kid header.
 func ValidateToken(tokenString string, expectedType string) (*Claims, error) {
-	accessSecret, refreshSecret := getJWTSecrets()
-
-	// Determine which secret to use based on expected token type
-	var secret []byte
-	if expectedType == TokenTypeAccess {
-		secret = accessSecret
-	} else if expectedType == TokenTypeRefresh {
-		secret = refreshSecret
-	} else {
-		return nil, errors.New("invalid token type specified")
+	ring, err := getKeyring(expectedType)
+	if err != nil {
+		if errors.Is(err, ErrNoSigningKey) {
+			log.Printf("Cannot validate token: %v", err)
+		}
+		return nil, ErrInvalidToken
 	}
 
 	// Split the token into its parts to check for tampering first
@@ -255,18 +290,28 @@ func ValidateToken(tokenString string, expectedType string) (*Claims, error) {
 		return nil, ErrInvalidToken
 	}
 
+	var key *SigningKey
+
 	// Use ParseWithClaims with strict validation options
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&Claims{},
 		func(token *jwt.Token) (any, error) {
-			// Ensure that the signing method is HMAC
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			kid, _ := token.Header["kid"].(string)
+			found, err := ring.Lookup(kid)
+			if err != nil {
+				return nil, err
+			}
+
+			// Ensure the token was signed with the algorithm its key belongs to
+			if token.Method.Alg() != found.Algorithm {
 				return nil, errors.New("unexpected signing method")
 			}
-			return secret, nil
+
+			key = found
+			return found.verifyKey, nil
 		},
-		jwt.WithValidMethods([]string{"HS256"}),
+		jwt.WithValidMethods([]string{AlgHS256, AlgRS256, AlgEdDSA}),
 		jwt.WithStrictDecoding(),
 		jwt.WithExpirationRequired(),
 	)
@@ -295,17 +340,26 @@ func ValidateToken(tokenString string, expectedType string) (*Claims, error) {
 		return nil, ErrTokenTypeMismatch
 	}
 
+	// Retired keys may only hold a public key, so the exact re-signing check below
+	// is limited to keys we can still sign with
+	if !key.CanSign() {
+		return claims, nil
+	}
+
 	// For the most rigorous verification, we need to regenerate the token
 	// with the exact same claims and ensure it matches the original
 
-	// Create a new token with the same signing method
-	newToken := jwt.New(jwt.SigningMethodHS256)
+	// Create a new token with the same signing method and key ID
+	newToken := jwt.New(key.Method())
+	if kid, ok := token.Header["kid"]; ok {
+		newToken.Header["kid"] = kid
+	}
 
 	// Copy all claims exactly as they were in the original token
 	newToken.Claims = claims
 
-	// Sign the token with the same secret
-	verifiedTokenString, err := newToken.SignedString(secret)
+	// Sign the token with the same key
+	verifiedTokenString, err := newToken.SignedString(key.signKey)
 	if err != nil {
 		return nil, err
 	}
@@ -320,53 +374,43 @@ func ValidateToken(tokenString string, expectedType string) (*Claims, error) {
 	return claims, nil
 }
 
+// JWKSHandler publishes the public access token keys so other services can verify GreenVue tokens.
+// Only RS256 and EdDSA keys are listed; HMAC secrets are never exposed.
+func JWKSHandler(c *fiber.Ctx) error {
+	ring, err := getKeyring(TokenTypeAccess)
+	if err != nil {
+		return response.InternalServerError("Signing keys are not configured")
+	}
+
+	keys := make([]map[string]string, 0)
+	for _, key := range ring.Keys() {
+		if jwk, ok := publicJWK(key); ok {
+			keys = append(keys, jwk)
+		}
+	}
+
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(fiber.Map{"keys": keys})
+}
+
 // AuthMiddleware is a middleware that validates JWT tokens from either a bearer token or a cookie.
 // It prefers to use cookies over bearer tokens when both are available.
+// Access tokens are only accepted while their session exists, so revoking a session takes effect immediately.
+// Personal API keys are accepted through an "Authorization: ApiKey ..." header, on allowlisted routes only.
 // It also checks for a health access token for specific routes.
 // It gets the user ID from the request body and compares it with the token claims.
 // If the user ID in the request body does not match the token claims, it returns an unauthorized error.
 func AuthMiddleware() fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		var tokenString string
-		var err error
-
-		// Check for token in cookie first (cookies take precedence)
-		tokenCookie := c.Cookies(AccessTokenCookieName)
-
-		if tokenCookie != "" {
-			tokenString = tokenCookie
-		} else {
-			// If no cookie, check for token from Authorization header
-			authHeader := c.Get("Authorization")
-			if strings.HasPrefix(authHeader, "Bearer ") {
-				tokenString = strings.TrimPrefix(authHeader, "Bearer ")
-			}
-		}
-
-		// If no token found in either place
-		if tokenString == "" {
-			return response.Unauthorized("invalid or missing token")
+		claims, err := authenticateRequest(c)
+		if err != nil {
+			return err
 		}
-
-		path := c.Path()
-		if strings.HasPrefix(path, "/api/health") {
-			healthAccessToken := os.Getenv("HEALTH_ACCESS_TOKEN")
-			if tokenString != healthAccessToken {
-				return response.Unauthorized("invalid health access token")
-			}
+		if claims == nil {
+			// Health access token, no user involved
 			return c.Next()
 		}
 
-		// Validate token as an access token specifically
-		claims, err := ValidateToken(tokenString, TokenTypeAccess)
-		if err != nil {
-			// If the token is invalid or expired, clear the cookies
-			if err == ErrInvalidToken || err == ErrExpiredToken || err == ErrTokenTypeMismatch || err == ErrTokenTampering {
-				ClearAuthCookies(c)
-			}
-			return response.Unauthorized("authentication failed: " + err.Error())
-		}
-
 		switch c.Method() {
 		case fiber.MethodPost:
 			var payload struct {
@@ -420,6 +464,62 @@ func AuthMiddleware() fiber.Handler {
 	}
 }
 
+// authenticateRequest resolves the claims of a request from an API key, a cookie or a bearer token.
+// It returns nil claims for valid health access tokens.
+func authenticateRequest(c *fiber.Ctx) (*Claims, error) {
+	authHeader := c.Get("Authorization")
+	if strings.HasPrefix(authHeader, apiKeyHeaderScheme) {
+		c.Locals(cookieAuthLocal, false)
+		return authenticateAPIKey(c, strings.TrimSpace(strings.TrimPrefix(authHeader, apiKeyHeaderScheme)))
+	}
+
+	var tokenString string
+
+	// Check for token in cookie first (cookies take precedence)
+	tokenCookie := c.Cookies(AccessTokenCookieName)
+
+	// Record the credential in use, so the CSRF check applies exactly when a cookie authenticated the request
+	c.Locals(cookieAuthLocal, tokenCookie != "")
+
+	if tokenCookie != "" {
+		tokenString = tokenCookie
+	} else if strings.HasPrefix(authHeader, "Bearer ") {
+		// If no cookie, check for token from Authorization header
+		tokenString = strings.TrimPrefix(authHeader, "Bearer ")
+	}
+
+	// If no token found in either place
+	if tokenString == "" {
+		return nil, response.Unauthorized("invalid or missing token")
+	}
+
+	path := c.Path()
+	if strings.HasPrefix(path, "/api/health") {
+		healthAccessToken := os.Getenv("HEALTH_ACCESS_TOKEN")
+		if tokenString != healthAccessToken {
+			return nil, response.Unauthorized("invalid health access token")
+		}
+		return nil, nil
+	}
+
+	// Validate token as an access token specifically
+	claims, err := ValidateToken(tokenString, TokenTypeAccess)
+	if err != nil {
+		// If the token is invalid or expired, clear the cookies
+		if err == ErrInvalidToken || err == ErrExpiredToken || err == ErrTokenTypeMismatch || err == ErrTokenTampering {
+			ClearAuthCookies(c)
+		}
+		return nil, response.Unauthorized("authentication failed: " + err.Error())
+	}
+
+	// A revoked session must not keep working until its access token expires
+	if err := requireActiveSession(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
 func GetAccessToken(c *fiber.Ctx) (*Claims, error) {
 	var tokenString string
 
@@ -449,47 +549,114 @@ func GetAccessToken(c *fiber.Ctx) (*Claims, error) {
 	return claims, nil
 }
 
-// RefreshTokenHandler handles token refresh requests
-func RefreshTokenHandler(c *fiber.Ctx) error {
-	var refreshToken string
-
+// getRefreshToken reads the refresh token from the cookie or the request body
+func getRefreshToken(c *fiber.Ctx) string {
 	// Check for refresh token in cookie first (cookies take precedence)
-	refreshCookie := c.Cookies(RefreshTokenCookieName)
+	if refreshCookie := c.Cookies(RefreshTokenCookieName); refreshCookie != "" {
+		return refreshCookie
+	}
 
-	if refreshCookie != "" {
-		refreshToken = refreshCookie
-	} else {
-		// If no cookie, try to get refresh token from request body
-		var payload struct {
-			RefreshToken string `json:"refreshToken"`
-		}
+	// If no cookie, try to get refresh token from request body
+	var payload struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+
+	if err := c.BodyParser(&payload); err == nil {
+		return payload.RefreshToken
+	}
+
+	return ""
+}
+
+// RotateRefreshToken validates a refresh token against the token store and exchanges it
+// for a new token pair in the same family. Replaying an already rotated token revokes the whole family.
+func RotateRefreshToken(refreshToken string, device SessionDevice) (*Claims, *TokenPair, error) {
+	// Validate refresh token - specifically checking it's a refresh token type
+	claims, err := ValidateToken(refreshToken, TokenTypeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tokenID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		// Tokens issued before rotation was introduced carry no jti
+		return nil, nil, ErrTokenRevoked
+	}
+
+	store := GetTokenStore()
+	record, err := store.Get(tokenID)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		if err := c.BodyParser(&payload); err == nil && payload.RefreshToken != "" {
-			refreshToken = payload.RefreshToken
+	if record.UserID != claims.UserId {
+		return nil, nil, ErrTokenTampering
+	}
+
+	// Generate the replacement first so we know its ID when marking the old token as used
+	tokens, err := generateTokenPair(record.UserID, record.FamilyID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newClaims, err := ValidateToken(tokens.RefreshToken, TokenTypeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	newTokenID, _ := uuid.Parse(newClaims.ID)
+
+	if err := store.MarkUsed(tokenID, newTokenID); err != nil {
+		if errors.Is(err, ErrTokenReused) {
+			// The token was already rotated, so either the client or an attacker is replaying it.
+			// We cannot tell which, so the entire family is revoked.
+			log.Printf("Refresh token reuse detected for user %s, revoking token family %s", record.UserID, record.FamilyID)
+			if revokeErr := store.RevokeFamily(record.FamilyID); revokeErr != nil {
+				log.Printf("Failed to revoke token family %s: %v", record.FamilyID, revokeErr)
+			}
 		}
+		return nil, nil, err
+	}
+
+	// Keep the session's last-used time and client details up to date
+	if err := store.TouchSession(record.FamilyID, device.IP, device.UserAgent); err != nil {
+		log.Printf("Failed to update session %s: %v", record.FamilyID, err)
 	}
 
+	return claims, tokens, nil
+}
+
+// RefreshTokenHandler handles token refresh requests
+func RefreshTokenHandler(c *fiber.Ctx) error {
+	refreshToken := getRefreshToken(c)
+
 	// Return error if no refresh token found
 	if refreshToken == "" {
 		return fiber.NewError(fiber.StatusBadRequest, "missing refresh token")
 	}
 
-	// Validate refresh token - specifically checking it's a refresh token type
-	claims, err := ValidateToken(refreshToken, TokenTypeRefresh)
+	claims, tokens, err := RotateRefreshToken(refreshToken, DeviceFromContext(c))
 	if err != nil {
-		// If refresh token is invalid or expired, clear all cookies
+		// If refresh token is invalid, expired or revoked, clear all cookies
 		ClearAuthCookies(c)
-		return fiber.NewError(fiber.StatusUnauthorized, "invalid refresh token: "+err.Error())
-	}
 
-	// Generate new token pair
-	tokens, err := GenerateTokenPair(claims.UserId, claims.Role)
-	if err != nil {
+		// Attribute the failure to the account when the token itself is genuine, e.g. on reuse
+		var targetID *uuid.UUID
+		if tokenClaims, claimsErr := ValidateToken(refreshToken, TokenTypeRefresh); claimsErr == nil {
+			targetID = &tokenClaims.UserId
+		}
+		auditFailure(c, AuditTokenRefresh, targetID, "", err.Error())
+
+		if errors.Is(err, ErrTokenRevoked) || errors.Is(err, ErrTokenReused) ||
+			errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrExpiredToken) ||
+			errors.Is(err, ErrTokenTypeMismatch) || errors.Is(err, ErrTokenTampering) {
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid refresh token: "+err.Error())
+		}
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to generate tokens")
 	}
 
 	// Set the tokens as secure cookies for web clients
 	SetAuthCookies(c, tokens)
+	auditUserAction(c, AuditTokenRefresh, claims.UserId, map[string]any{"session_id": claims.SessionID})
 
 	return response.SuccessResponse(c, fiber.Map{
 		"userId":       claims.UserId,
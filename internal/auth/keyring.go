@@ -0,0 +1,416 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrNoSigningKey = errors.New("no JWT signing key configured")
+	ErrUnknownKey   = errors.New("unknown JWT key")
+)
+
+// Supported signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// minDedicatedSecretLength is the shortest secret CheckDedicatedSecret accepts
+const minDedicatedSecretLength = 32
+
+// devJWTSecrets are the secrets the config falls back to when JWT_ACCESS_SECRET and JWT_REFRESH_SECRET are not set
+var devJWTSecrets = []string{"dev-access-secret", "dev-refresh-secret"}
+
+// legacyKeyID is the key ID used for tokens signed before kid headers were introduced,
+// and for the keys built from JWT_ACCESS_SECRET and JWT_REFRESH_SECRET
+const legacyKeyID = "default"
+
+// SigningKey is a single key in a keyring, identified by its kid
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	signKey   any // []byte, *rsa.PrivateKey or ed25519.PrivateKey; nil for verification-only keys
+	verifyKey any // []byte, *rsa.PublicKey or ed25519.PublicKey
+}
+
+// Method returns the jwt signing method of the key
+func (k *SigningKey) Method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// CanSign reports whether the key holds private material
+func (k *SigningKey) CanSign() bool {
+	return k.signKey != nil
+}
+
+// Keyring holds every key that may verify a token type and names the one used for signing
+type Keyring struct {
+	current string
+	keys    map[string]*SigningKey
+}
+
+// NewKeyring creates a keyring; current must name one of the keys and that key must be able to sign
+func NewKeyring(current string, keys ...*SigningKey) (*Keyring, error) {
+	ring := &Keyring{
+		current: current,
+		keys:    make(map[string]*SigningKey, len(keys)),
+	}
+
+	for _, key := range keys {
+		if key.ID == "" {
+			return nil, fmt.Errorf("key without kid")
+		}
+		if _, exists := ring.keys[key.ID]; exists {
+			return nil, fmt.Errorf("duplicate kid %q", key.ID)
+		}
+		ring.keys[key.ID] = key
+	}
+
+	currentKey, ok := ring.keys[current]
+	if !ok {
+		return nil, fmt.Errorf("current key %q is not in the keyring", current)
+	}
+	if !currentKey.CanSign() {
+		return nil, fmt.Errorf("current key %q has no private key", current)
+	}
+
+	return ring, nil
+}
+
+// Current returns the key new tokens are signed with
+func (r *Keyring) Current() *SigningKey {
+	return r.keys[r.current]
+}
+
+// Lookup returns the key for a kid; tokens without a kid use the legacy key
+func (r *Keyring) Lookup(kid string) (*SigningKey, error) {
+	if kid == "" {
+		kid = legacyKeyID
+	}
+
+	key, ok := r.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// Keys returns all keys sorted by kid
+func (r *Keyring) Keys() []*SigningKey {
+	keys := make([]*SigningKey, 0, len(r.keys))
+	for _, key := range r.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ID < keys[j].ID
+	})
+	return keys
+}
+
+var (
+	accessKeyring  *Keyring
+	refreshKeyring *Keyring
+	keyringMu      sync.RWMutex
+)
+
+// InitKeyrings loads the signing keys from the keyring file, or from
+// JWT_ACCESS_SECRET and JWT_REFRESH_SECRET when no file is configured
+func InitKeyrings(keyringFile string) error {
+	var (
+		access, refresh *Keyring
+		err             error
+	)
+
+	if keyringFile != "" {
+		access, refresh, err = loadKeyringFile(keyringFile)
+	} else {
+		access, refresh, err = loadSecretKeyrings()
+	}
+	if err != nil {
+		return err
+	}
+
+	SetKeyrings(access, refresh)
+	return nil
+}
+
+// CheckDedicatedSecret makes sure a secret that signs links is set, at least 32 characters long
+// and not shared with the JWT keys or their development defaults; a shared key would let anyone
+// holding one kind of token forge the other. name is the environment variable, for the error.
+// Call it after InitKeyrings so HMAC keys from the keyring file are checked too.
+func CheckDedicatedSecret(name, secret string) error {
+	if secret == "" {
+		return fmt.Errorf("%s is not set", name)
+	}
+	if len(secret) < minDedicatedSecretLength {
+		return fmt.Errorf("%s must be at least %d characters", name, minDedicatedSecretLength)
+	}
+
+	shared := append([]string{os.Getenv("JWT_ACCESS_SECRET"), os.Getenv("JWT_REFRESH_SECRET")}, devJWTSecrets...)
+	for _, jwtSecret := range shared {
+		if jwtSecret != "" && hmac.Equal([]byte(secret), []byte(jwtSecret)) {
+			return fmt.Errorf("%s must not reuse a JWT secret", name)
+		}
+	}
+
+	keyringMu.RLock()
+	rings := []*Keyring{accessKeyring, refreshKeyring}
+	keyringMu.RUnlock()
+	for _, ring := range rings {
+		if ring == nil {
+			continue
+		}
+		for _, key := range ring.Keys() {
+			if jwtSecret, ok := key.verifyKey.([]byte); ok && hmac.Equal([]byte(secret), jwtSecret) {
+				return fmt.Errorf("%s must not reuse JWT key %q", name, key.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// SetKeyrings replaces the access and refresh token keyrings
+func SetKeyrings(access, refresh *Keyring) {
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	accessKeyring = access
+	refreshKeyring = refresh
+}
+
+// getKeyring returns the keyring for a token type, falling back to the env secrets
+// when InitKeyrings has not been called
+func getKeyring(tokenType string) (*Keyring, error) {
+	keyringMu.RLock()
+	access, refresh := accessKeyring, refreshKeyring
+	keyringMu.RUnlock()
+
+	if access == nil || refresh == nil {
+		var err error
+		access, refresh, err = loadSecretKeyrings()
+		if err != nil {
+			return nil, err
+		}
+		SetKeyrings(access, refresh)
+	}
+
+	switch tokenType {
+	case TokenTypeAccess, TokenTypeMFAPending, TokenTypeAccountUnlock:
+		return access, nil
+	case TokenTypeRefresh:
+		return refresh, nil
+	}
+	return nil, errors.New("invalid token type specified")
+}
+
+// loadSecretKeyrings builds single-key HS256 keyrings from the env secrets
+func loadSecretKeyrings() (*Keyring, *Keyring, error) {
+	accessSecret := os.Getenv("JWT_ACCESS_SECRET")
+	refreshSecret := os.Getenv("JWT_REFRESH_SECRET")
+
+	if accessSecret == "" || refreshSecret == "" {
+		return nil, nil, fmt.Errorf("%w: set JWT_KEYRING_FILE or JWT_ACCESS_SECRET and JWT_REFRESH_SECRET", ErrNoSigningKey)
+	}
+
+	access, err := NewKeyring(legacyKeyID, newHMACKey(legacyKeyID, []byte(accessSecret)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refresh, err := NewKeyring(legacyKeyID, newHMACKey(legacyKeyID, []byte(refreshSecret)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return access, refresh, nil
+}
+
+func newHMACKey(kid string, secret []byte) *SigningKey {
+	return &SigningKey{
+		ID:        kid,
+		Algorithm: AlgHS256,
+		signKey:   secret,
+		verifyKey: secret,
+	}
+}
+
+// keyringFile is the JSON layout of JWT_KEYRING_FILE
+type keyringFile struct {
+	Access  keyringFileSection `json:"access"`
+	Refresh keyringFileSection `json:"refresh"`
+}
+
+type keyringFileSection struct {
+	Current string           `json:"current"`
+	Keys    []keyringFileKey `json:"keys"`
+}
+
+type keyringFileKey struct {
+	ID             string `json:"kid"`
+	Algorithm      string `json:"alg"`
+	SecretEnv      string `json:"secret_env,omitempty"`       // HS256: env variable holding the secret
+	PrivateKeyFile string `json:"private_key_file,omitempty"` // RS256/EdDSA: PEM private key
+	PublicKeyFile  string `json:"public_key_file,omitempty"`  // RS256/EdDSA: PEM public key for verification-only keys
+}
+
+func loadKeyringFile(path string) (*Keyring, *Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read keyring file: %w", err)
+	}
+
+	var file keyringFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse keyring file: %w", err)
+	}
+
+	access, err := file.Access.build()
+	if err != nil {
+		return nil, nil, fmt.Errorf("access keyring: %w", err)
+	}
+
+	refresh, err := file.Refresh.build()
+	if err != nil {
+		return nil, nil, fmt.Errorf("refresh keyring: %w", err)
+	}
+
+	return access, refresh, nil
+}
+
+func (s keyringFileSection) build() (*Keyring, error) {
+	if len(s.Keys) == 0 {
+		return nil, ErrNoSigningKey
+	}
+
+	keys := make([]*SigningKey, 0, len(s.Keys))
+	for _, entry := range s.Keys {
+		key, err := entry.load()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", entry.ID, err)
+		}
+		keys = append(keys, key)
+	}
+
+	return NewKeyring(s.Current, keys...)
+}
+
+func (k keyringFileKey) load() (*SigningKey, error) {
+	switch k.Algorithm {
+	case AlgHS256:
+		secret := os.Getenv(k.SecretEnv)
+		if secret == "" {
+			return nil, fmt.Errorf("secret env %q is not set", k.SecretEnv)
+		}
+		return newHMACKey(k.ID, []byte(secret)), nil
+
+	case AlgRS256, AlgEdDSA:
+		key := &SigningKey{ID: k.ID, Algorithm: k.Algorithm}
+
+		if k.PrivateKeyFile != "" {
+			pemData, err := os.ReadFile(k.PrivateKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read private key: %w", err)
+			}
+			if k.Algorithm == AlgRS256 {
+				private, err := jwt.ParseRSAPrivateKeyFromPEM(pemData)
+				if err != nil {
+					return nil, err
+				}
+				key.signKey, key.verifyKey = private, &private.PublicKey
+			} else {
+				private, err := jwt.ParseEdPrivateKeyFromPEM(pemData)
+				if err != nil {
+					return nil, err
+				}
+				signer, ok := private.(crypto.Signer)
+				if !ok {
+					return nil, errors.New("private key is not an Ed25519 key")
+				}
+				key.signKey, key.verifyKey = private, signer.Public()
+			}
+			return key, nil
+		}
+
+		if k.PublicKeyFile != "" {
+			pemData, err := os.ReadFile(k.PublicKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read public key: %w", err)
+			}
+			if k.Algorithm == AlgRS256 {
+				key.verifyKey, err = jwt.ParseRSAPublicKeyFromPEM(pemData)
+			} else {
+				key.verifyKey, err = jwt.ParseEdPublicKeyFromPEM(pemData)
+			}
+			if err != nil {
+				return nil, err
+			}
+			return key, nil
+		}
+
+		return nil, errors.New("private_key_file or public_key_file is required")
+	}
+
+	return nil, fmt.Errorf("unsupported algorithm %q", k.Algorithm)
+}
+
+// signToken signs claims with the current key of the token type's keyring
+func signToken(tokenType string, claims Claims) (string, error) {
+	ring, err := getKeyring(tokenType)
+	if err != nil {
+		return "", err
+	}
+
+	key := ring.Current()
+	token := jwt.NewWithClaims(key.Method(), claims)
+	token.Header["kid"] = key.ID
+
+	return token.SignedString(key.signKey)
+}
+
+// publicJWK converts an asymmetric key into its JSON Web Key representation.
+// HMAC keys are secret and are never published.
+func publicJWK(key *SigningKey) (map[string]string, bool) {
+	switch public := key.verifyKey.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": key.Algorithm,
+			"kid": key.ID,
+			"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(bigEndianBytes(public.E)),
+		}, true
+	case ed25519.PublicKey:
+		return map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"use": "sig",
+			"alg": key.Algorithm,
+			"kid": key.ID,
+			"x":   base64.RawURLEncoding.EncodeToString(public),
+		}, true
+	}
+	return nil, false
+}
+
+// bigEndianBytes encodes an RSA exponent without leading zero bytes
+func bigEndianBytes(value int) []byte {
+	var out []byte
+	for value > 0 {
+		out = append([]byte{byte(value & 0xff)}, out...)
+		value >>= 8
+	}
+	return out
+}
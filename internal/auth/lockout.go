@@ -0,0 +1,455 @@
+package auth
+
+import (
+	"fmt"
+	"greenvue/lib"
+	"greenvue/lib/email"
+	"greenvue/lib/errors"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// AttemptState is the failure history of a single key (an account or an IP in a scope)
+type AttemptState struct {
+	Failures     int
+	FirstFailure time.Time
+	LastFailure  time.Time
+	LockedUntil  time.Time
+}
+
+// AttemptStore persists failed-attempt counters for brute-force protection
+type AttemptStore interface {
+	// Get returns the state of a key; unknown keys return a zero state
+	Get(key string) (AttemptState, error)
+	// RecordFailure counts a failure, starting a new window if the previous one has passed
+	RecordFailure(key string, window time.Duration) (AttemptState, error)
+	// Lock blocks a key until the given time
+	Lock(key string, until time.Time) error
+	// Reset clears the history of a key
+	Reset(key string) error
+}
+
+var (
+	attemptStore   AttemptStore
+	attemptStoreMu sync.RWMutex
+)
+
+// SetAttemptStore replaces the failed-attempt store
+func SetAttemptStore(store AttemptStore) {
+	attemptStoreMu.Lock()
+	defer attemptStoreMu.Unlock()
+	attemptStore = store
+}
+
+// GetAttemptStore returns the configured failed-attempt store, defaulting to an in-memory store
+func GetAttemptStore() AttemptStore {
+	attemptStoreMu.RLock()
+	if attemptStore != nil {
+		defer attemptStoreMu.RUnlock()
+		return attemptStore
+	}
+	attemptStoreMu.RUnlock()
+
+	attemptStoreMu.Lock()
+	defer attemptStoreMu.Unlock()
+
+	if attemptStore == nil {
+		attemptStore = NewMemoryAttemptStore()
+	}
+
+	return attemptStore
+}
+
+// MemoryAttemptStore keeps counters in process memory; they reset on restart
+type MemoryAttemptStore struct {
+	entries    map[string]AttemptState
+	mu         sync.Mutex
+	cleanupDue time.Time
+}
+
+// NewMemoryAttemptStore creates an empty in-memory attempt store
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{
+		entries:    make(map[string]AttemptState),
+		cleanupDue: time.Now().Add(5 * time.Minute),
+	}
+}
+
+func (m *MemoryAttemptStore) Get(key string) (AttemptState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.entries[key], nil
+}
+
+func (m *MemoryAttemptStore) RecordFailure(key string, window time.Duration) (AttemptState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if now.After(m.cleanupDue) {
+		m.cleanup(now)
+	}
+
+	state := m.entries[key]
+	windowExpired := !state.FirstFailure.IsZero() && now.Sub(state.FirstFailure) > window
+	lockExpired := !state.LockedUntil.IsZero() && now.After(state.LockedUntil)
+	if windowExpired || lockExpired {
+		state = AttemptState{}
+	}
+
+	if state.Failures == 0 {
+		state.FirstFailure = now
+	}
+	state.Failures++
+	state.LastFailure = now
+
+	m.entries[key] = state
+	return state, nil
+}
+
+func (m *MemoryAttemptStore) Lock(key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := m.entries[key]
+	state.LockedUntil = until
+	m.entries[key] = state
+	return nil
+}
+
+func (m *MemoryAttemptStore) Reset(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+// cleanup drops entries that have been idle for a day and are not locked, the caller must hold the lock
+func (m *MemoryAttemptStore) cleanup(now time.Time) {
+	for key, state := range m.entries {
+		if now.After(state.LockedUntil) && now.Sub(state.LastFailure) > 24*time.Hour {
+			delete(m.entries, key)
+		}
+	}
+	m.cleanupDue = now.Add(5 * time.Minute)
+}
+
+// LockoutPolicy controls how quickly repeated failures are slowed down and locked out
+type LockoutPolicy struct {
+	MaxFailures     int           // Failures within Window that trigger a lockout
+	Window          time.Duration // Failures older than this are forgotten
+	LockoutDuration time.Duration // How long a lockout lasts
+	DelayAfter      int           // Failures allowed before progressive delays start
+	BaseDelay       time.Duration // First delay, doubled on every further failure
+	MaxDelay        time.Duration // Upper bound for the progressive delay
+}
+
+// delay returns the wait required after the given number of failures
+func (p LockoutPolicy) delay(failures int) time.Duration {
+	if failures <= p.DelayAfter {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.DelayAfter + 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxDelay)
+}
+
+// BruteForceGuard applies a lockout policy to the keys of one scope, e.g. login attempts per account
+type BruteForceGuard struct {
+	scope  string
+	policy LockoutPolicy
+}
+
+// NewBruteForceGuard creates a guard for a scope
+func NewBruteForceGuard(scope string, policy LockoutPolicy) *BruteForceGuard {
+	return &BruteForceGuard{scope: scope, policy: policy}
+}
+
+func (g *BruteForceGuard) key(id string) string {
+	return g.scope + ":" + strings.ToLower(strings.TrimSpace(id))
+}
+
+// Check returns how long the caller has to wait before the next attempt, or zero if it may proceed
+func (g *BruteForceGuard) Check(id string) (time.Duration, error) {
+	state, err := GetAttemptStore().Get(g.key(id))
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	if now.Before(state.LockedUntil) {
+		return state.LockedUntil.Sub(now), nil
+	}
+
+	// Failures outside the window no longer count
+	if state.Failures == 0 || now.Sub(state.FirstFailure) > g.policy.Window || !state.LockedUntil.IsZero() {
+		return 0, nil
+	}
+
+	if wait := state.LastFailure.Add(g.policy.delay(state.Failures)).Sub(now); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+// Fail records a failed attempt and reports whether it started a lockout
+func (g *BruteForceGuard) Fail(id string) (bool, error) {
+	store := GetAttemptStore()
+	key := g.key(id)
+
+	state, err := store.RecordFailure(key, g.policy.Window)
+	if err != nil {
+		return false, err
+	}
+
+	if state.Failures < g.policy.MaxFailures || time.Now().Before(state.LockedUntil) {
+		return false, nil
+	}
+
+	if err := store.Lock(key, time.Now().Add(g.policy.LockoutDuration)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Reset clears the failures of a key, e.g. after a successful login
+func (g *BruteForceGuard) Reset(id string) error {
+	return GetAttemptStore().Reset(g.key(id))
+}
+
+// Guards for the endpoints that can be brute-forced or abused to send email
+var (
+	loginAccountGuard = NewBruteForceGuard("login_account", LockoutPolicy{
+		MaxFailures:     10,
+		Window:          15 * time.Minute,
+		LockoutDuration: 15 * time.Minute,
+		DelayAfter:      3,
+		BaseDelay:       time.Second,
+		MaxDelay:        30 * time.Second,
+	})
+	loginIPGuard = NewBruteForceGuard("login_ip", LockoutPolicy{
+		MaxFailures:     50,
+		Window:          15 * time.Minute,
+		LockoutDuration: 15 * time.Minute,
+		DelayAfter:      20,
+		BaseDelay:       time.Second,
+		MaxDelay:        10 * time.Second,
+	})
+	emailAccountGuard = NewBruteForceGuard("email_account", LockoutPolicy{
+		MaxFailures:     5,
+		Window:          time.Hour,
+		LockoutDuration: time.Hour,
+		DelayAfter:      1,
+		BaseDelay:       30 * time.Second,
+		MaxDelay:        10 * time.Minute,
+	})
+	emailIPGuard = NewBruteForceGuard("email_ip", LockoutPolicy{
+		MaxFailures:     20,
+		Window:          time.Hour,
+		LockoutDuration: time.Hour,
+		DelayAfter:      10,
+		BaseDelay:       5 * time.Second,
+		MaxDelay:        time.Minute,
+	})
+)
+
+// checkGuards returns a 429 error with Retry-After if any guard blocks its key
+func checkGuards(c *fiber.Ctx, checks map[*BruteForceGuard]string) error {
+	var wait time.Duration
+	for guard, id := range checks {
+		retryAfter, err := guard.Check(id)
+		if err != nil {
+			// Fail open: a broken counter store should not lock everyone out
+			log.Printf("Failed to check %s attempts: %v", guard.scope, err)
+			continue
+		}
+		wait = max(wait, retryAfter)
+	}
+
+	if wait <= 0 {
+		return nil
+	}
+
+	seconds := int(wait.Round(time.Second).Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+	return errors.TooManyRequests(fmt.Sprintf("Too many attempts. Please try again in %d seconds.", seconds))
+}
+
+// guardEmailRequest limits how often an email endpoint can send to one address or from one IP.
+// Every request counts, since each one sends an email.
+func guardEmailRequest(c *fiber.Ctx, purpose, address string) error {
+	accountID := purpose + ":" + address
+	ipID := purpose + ":" + c.IP()
+
+	if err := checkGuards(c, map[*BruteForceGuard]string{
+		emailAccountGuard: accountID,
+		emailIPGuard:      ipID,
+	}); err != nil {
+		return err
+	}
+
+	if _, err := emailAccountGuard.Fail(accountID); err != nil {
+		log.Printf("Failed to record email request: %v", err)
+	}
+	if _, err := emailIPGuard.Fail(ipID); err != nil {
+		log.Printf("Failed to record email request: %v", err)
+	}
+	return nil
+}
+
+// recordLoginFailure counts a failed login and notifies the owner when the account gets locked
+func recordLoginFailure(c *fiber.Ctx, address string) {
+	locked, err := loginAccountGuard.Fail(address)
+	if err != nil {
+		log.Printf("Failed to record login failure: %v", err)
+	}
+	if _, err := loginIPGuard.Fail(c.IP()); err != nil {
+		log.Printf("Failed to record login failure: %v", err)
+	}
+
+	if locked {
+		log.Printf("Account %s locked after repeated failed logins from %s", address, c.IP())
+		if err := queueLockoutEmail(address); err != nil {
+			log.Printf("Failed to queue lockout email for %s: %v", address, err)
+		}
+	}
+}
+
+// resetLoginFailures clears the account counter after a successful login
+func resetLoginFailures(address string) {
+	if err := loginAccountGuard.Reset(address); err != nil {
+		log.Printf("Failed to reset login failures: %v", err)
+	}
+}
+
+// generateUnlockToken issues a token that lifts the lockout of an account
+func generateUnlockToken(address string) (string, error) {
+	now := time.Now()
+
+	return signToken(TokenTypeAccountUnlock, Claims{
+		Type: TokenTypeAccountUnlock,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Audience:  []string{"greenvue-client"},
+			Issuer:    "greenvue",
+			Subject:   strings.ToLower(strings.TrimSpace(address)),
+			ExpiresAt: jwt.NewNumericDate(now.Add(loginAccountGuard.policy.LockoutDuration)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	})
+}
+
+// queueLockoutEmail tells the account owner about the lockout and sends an unlock link.
+// The link comes from API_URL, so whoever triggered the lockout cannot point it at their own host.
+// Without API_URL the owner is still told about the lockout, just without a link.
+func queueLockoutEmail(address string) error {
+	minutes := int(loginAccountGuard.policy.LockoutDuration.Minutes())
+	textUnlock, htmlUnlock := "", ""
+
+	token, err := generateUnlockToken(address)
+	if err != nil {
+		return err
+	}
+	unlockURL, err := apiLink("/auth/unlock", url.Values{"token": {token}})
+	if err != nil {
+		log.Printf("Sending lockout email to %s without unlock link: %v", address, err)
+	} else {
+		textUnlock = fmt.Sprintf("If this was you, you can unlock your account now: %s\n\n", unlockURL)
+		htmlUnlock = fmt.Sprintf("<p>If this was you, you can <a href=\"%s\">unlock your account now</a>.</p>", unlockURL)
+	}
+
+	return email.QueueEmail(email.Email{
+		ID:      lib.GenerateUUID(),
+		To:      address,
+		Subject: "Your GreenVue account has been temporarily locked",
+		Type:    email.NotificationEmail,
+		TextContent: fmt.Sprintf("We noticed several failed login attempts on your GreenVue account, "+
+			"so we have locked it for %d minutes.\n\n%s"+
+			"If this was not you, consider changing your password.", minutes, textUnlock),
+		HTMLContent: fmt.Sprintf("<p>We noticed several failed login attempts on your GreenVue account, "+
+			"so we have locked it for %d minutes.</p>%s"+
+			"<p>If this was not you, consider changing your password.</p>", minutes, htmlUnlock),
+		Status:     "pending",
+		MaxRetries: 3,
+		CreatedAt:  time.Now(),
+	})
+}
+
+// ShowUnlockConfirmation renders the page behind the unlock link. The GET only shows a button,
+// so mail scanners that fetch the link do not unlock the account.
+func ShowUnlockConfirmation(c *fiber.Ctx) error {
+	return renderConfirmationPage(c, "Unlock your GreenVue account", "Unlock account", "/auth/unlock")
+}
+
+// UnlockAccount lifts a login lockout using the token from the lockout email.
+// Each token works once; form posts from the confirmation page are redirected to the web client.
+func UnlockAccount(c *fiber.Ctx) error {
+	var payload struct {
+		Token string `json:"token" form:"token"`
+	}
+
+	if err := c.BodyParser(&payload); err != nil {
+		return errors.BadRequest("Invalid request format")
+	}
+
+	token := strings.TrimSpace(payload.Token)
+	if token == "" {
+		return errors.BadRequest("Missing token")
+	}
+
+	claims, err := ValidateToken(token, TokenTypeAccountUnlock)
+	if err != nil || claims.Subject == "" || claims.ID == "" || claims.ExpiresAt == nil {
+		return errors.Unauthorized("Invalid or expired unlock link")
+	}
+
+	used, err := claimTokenID(claims.ID, time.Until(claims.ExpiresAt.Time))
+	if err != nil {
+		return errors.InternalServerError("Failed to unlock account")
+	}
+	if used {
+		return errors.Unauthorized("This unlock link has already been used")
+	}
+
+	if err := loginAccountGuard.Reset(claims.Subject); err != nil {
+		return errors.InternalServerError("Failed to unlock account")
+	}
+
+	fromForm := strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationForm)
+	if siteURL := os.Getenv("URL"); fromForm && siteURL != "" {
+		return c.Redirect(siteURL + "/login?unlocked=true")
+	}
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"message": "Your account has been unlocked",
+	})
+}
+
+// claimTokenID records a single-use token's jti in the attempt store and reports whether it was
+// already used. Recording counts as an atomic increment, so of two concurrent uses only one wins.
+// The record lives as long as the token, after which the token is rejected as expired anyway.
+func claimTokenID(jti string, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return true, nil
+	}
+
+	state, err := GetAttemptStore().RecordFailure("used-token:"+jti, ttl)
+	if err != nil {
+		return false, err
+	}
+	return state.Failures > 1, nil
+}
@@ -1,20 +1,13 @@
 package auth
 
 import (
-	"crypto/rand"
-	"encoding/base64"
-	"fmt"
-	"greenvue/internal/config"
 	"greenvue/internal/db"
 	"greenvue/lib"
 	"greenvue/lib/errors"
 	"log"
-	"net/url"
-	"os"
-	"strings"
-	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 )
 
 func LoginUser(c *fiber.Ctx) error {
@@ -42,26 +35,54 @@ func LoginUser(c *fiber.Ctx) error {
 		return err
 	}
 
+	// Slow down and lock out repeated failures per account and per IP
+	if err := checkGuards(c, map[*BruteForceGuard]string{
+		loginAccountGuard: payload.Email,
+		loginIPGuard:      c.IP(),
+	}); err != nil {
+		auditFailure(c, AuditLogin, nil, payload.Email, "locked_out")
+		return err
+	}
+
 	// Authenticate user (this is a specialized operation that doesn't fit standard CRUD)
 	// We'll continue to use the Login method which is kept in the client for auth operations
 	authResp, err := client.Login(lib.SanitizeInput(payload.Email), lib.SanitizeInput(payload.Password))
 	if err != nil {
+		auditFailure(c, AuditLogin, nil, payload.Email, err.Error())
 		switch err.Error() {
 		case "invalid_credentials":
+			recordLoginFailure(c, payload.Email)
 			return errors.Unauthorized("Invalid email or password")
 		case "user_not_found":
+			if _, err := loginIPGuard.Fail(c.IP()); err != nil {
+				log.Printf("Failed to record login failure: %v", err)
+			}
 			return errors.NotFound("User not found")
 		case "email_not_confirmed":
 			return errors.Forbidden("Email not confirmed")
+		default:
+			return errors.Unauthorized("Login failed")
 		}
 	}
 
+	// Users with two-factor authentication get an mfa_pending token instead of a session.
+	// Their failure counter is only reset once the second factor succeeds.
+	mfaEnabled, err := isMFAEnabled(authResp.User.ID)
+	if err != nil {
+		return errors.InternalServerError("Failed to check two-factor authentication")
+	}
+	if mfaEnabled {
+		return mfaChallenge(c, authResp.User.ID)
+	}
+	resetLoginFailures(payload.Email)
+
 	// Generate JWT tokens
-	tokens, err := GenerateTokenPair(authResp.User.ID, authResp.User.Email)
+	tokens, err := GenerateTokenPair(authResp.User.ID, authResp.User.Email, DeviceFromContext(c))
 	if err != nil {
 		return errors.InternalServerError("Failed to generate tokens")
 	} // Set the tokens as secure cookies for web clients
 	SetAuthCookies(c, tokens)
+	auditUserAction(c, AuditLogin, authResp.User.ID, map[string]any{"method": "password"})
 
 	// Return login success response with JWT tokens for React Native clients
 	return errors.SuccessResponse(c, fiber.Map{
@@ -72,8 +93,19 @@ func LoginUser(c *fiber.Ctx) error {
 	})
 }
 
-// LogoutUser handles user logout by clearing cookies
+// LogoutUser handles user logout by revoking the refresh token family and clearing cookies
 func LogoutUser(c *fiber.Ctx) error {
+	// Revoke the session server-side so a copied refresh token cannot outlive the logout.
+	// Expired or invalid tokens are ignored since there is nothing left to revoke.
+	if refreshToken := getRefreshToken(c); refreshToken != "" {
+		if claims, err := ValidateToken(refreshToken, TokenTypeRefresh); err == nil && claims.SessionID != uuid.Nil {
+			if err := GetTokenStore().RevokeFamily(claims.SessionID); err != nil {
+				log.Printf("Failed to revoke token family %s on logout: %v", claims.SessionID, err)
+			}
+			auditUserAction(c, AuditLogout, claims.UserId, map[string]any{"session_id": claims.SessionID})
+		}
+	}
+
 	// Clear all authentication cookies
 	ClearAuthCookies(c)
 
@@ -85,61 +117,3 @@ func LogoutUser(c *fiber.Ctx) error {
 		"message": "Successfully logged out",
 	})
 }
-
-func generateStateToken() string {
-	b := make([]byte, 16)
-	_, _ = rand.Read(b)
-	return base64.URLEncoding.EncodeToString(b)
-}
-
-func HandleGoogleLogin(c *fiber.Ctx) error {
-	state := generateStateToken()
-	// Load config to determine environment
-	cfg := config.LoadConfig()
-
-	// Get the hostname and extract domain for the cookie
-	host := c.Hostname()
-	var domain string
-	// For local development, don't set the domain at all
-	if cfg.Environment != "production" {
-		domain = ""
-	} else {
-		// For production, use the parent domain to share cookies across subdomains
-		// This ensures the cookie works for all subdomains (www, api, etc)
-		if strings.Contains(host, "greenvue.eu") {
-			domain = "greenvue.eu" // Parent domain shared by all subdomains
-		} else {
-			domain = host
-		}
-	}
-
-	// Log the state for debugging
-	log.Printf("Generated OAuth state: %s", state)
-
-	// Save state in cookie with proper settings
-	c.Cookie(&fiber.Cookie{
-		Name:     "oauthstate",
-		Value:    state,
-		Path:     "/",
-		Domain:   domain,
-		MaxAge:   3600,                      // 1 hour
-		Expires:  time.Now().Add(time.Hour), // 1 hour
-		HTTPOnly: true,
-		Secure:   cfg.Environment == "production", // Only secure in production
-		SameSite: "Lax",                           // Use Lax for better compatibility
-	})
-
-	clientID := os.Getenv("GOOGLE_CLIENT_ID")
-	redirectURI := os.Getenv("REDIRECT_URI")
-	scope := "openid email profile"
-
-	authURL := fmt.Sprintf(
-		"https://accounts.google.com/o/oauth2/v2/auth?client_id=%s&redirect_uri=%s&response_type=code&scope=%s&state=%s",
-		clientID,
-		url.QueryEscape(redirectURI),
-		url.QueryEscape(scope),
-		state,
-	)
-
-	return c.Redirect(authURL)
-}
@@ -0,0 +1,292 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"greenvue/internal/db"
+	"greenvue/lib"
+	"greenvue/lib/email"
+	"greenvue/lib/errors"
+	"html"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	magicLinksTable = "magic_links"
+	magicLinkTTL    = 15 * time.Minute
+)
+
+// MagicLink is a single-use login link; only the SHA-256 hash of its token is stored
+type MagicLink struct {
+	ID          uuid.UUID  `json:"id"`
+	UserID      uuid.UUID  `json:"user_id"`
+	TokenHash   string     `json:"token_hash"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	UsedAt      *time.Time `json:"used_at,omitempty"`
+	RequestedIP string     `json:"requested_ip"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// ErrNoAPIURL is returned when an email with a link to the API cannot be built
+var ErrNoAPIURL = stderrors.New("API_URL is not configured")
+
+// apiLink returns the public URL of an API route for use in emails. It never uses the request's
+// Host or X-Forwarded-Host, which the client controls and could point at another site.
+func apiLink(route string, query url.Values) (string, error) {
+	base := strings.TrimRight(os.Getenv("API_URL"), "/")
+	if base == "" {
+		return "", ErrNoAPIURL
+	}
+	if len(query) > 0 {
+		route += "?" + query.Encode()
+	}
+	return base + route, nil
+}
+
+// hashMagicLinkToken returns the hex encoded SHA-256 hash of a token
+func hashMagicLinkToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// SendMagicLink emails a login link to a registered, confirmed address.
+// The response is the same whether or not the address belongs to an account.
+func SendMagicLink(c *fiber.Ctx) error {
+	var payload struct {
+		Email string `json:"email"`
+	}
+
+	if err := c.BodyParser(&payload); err != nil {
+		return errors.BadRequest("Invalid request format")
+	}
+
+	address := strings.ToLower(strings.TrimSpace(payload.Email))
+	if err := errors.ValidateFields(map[string]string{"email": address}); err != nil {
+		return err
+	}
+
+	if err := guardEmailRequest(c, "magic_link", address); err != nil {
+		return err
+	}
+
+	// Checked before the lookup, so a missing setting does not reveal which addresses have accounts
+	if _, err := apiLink("", nil); err != nil {
+		log.Printf("Cannot send magic links: %v", err)
+		return errors.InternalServerError("Login links are not available right now")
+	}
+
+	sent := func() error {
+		return errors.SuccessResponse(c, fiber.Map{
+			"message": "If an account exists for this address, we have sent a login link to it",
+		})
+	}
+
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create database client")
+	}
+
+	data, err := client.GET("users", fmt.Sprintf("email=eq.%s&select=id,email,email_verified", url.QueryEscape(address)))
+	if err != nil {
+		return errors.DatabaseError("Failed to fetch user: " + err.Error())
+	}
+
+	var users []lib.User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return errors.InternalServerError("Failed to parse user data: " + err.Error())
+	}
+
+	if len(users) == 0 || !users[0].EmailVerified {
+		return sent()
+	}
+	user := users[0]
+
+	token, err := randomURLToken(32)
+	if err != nil {
+		return errors.InternalServerError("Failed to generate login link")
+	}
+
+	// Only the newest link works
+	if _, err := client.DELETE(magicLinksTable, fmt.Sprintf("user_id=eq.%s&used_at=is.null", user.ID)); err != nil {
+		log.Printf("Failed to remove old magic links of user %s: %v", user.ID, err)
+	}
+
+	now := time.Now().UTC()
+	link := MagicLink{
+		ID:          uuid.New(),
+		UserID:      user.ID,
+		TokenHash:   hashMagicLinkToken(token),
+		ExpiresAt:   now.Add(magicLinkTTL),
+		RequestedIP: c.IP(),
+		CreatedAt:   now,
+	}
+	if _, err := client.POST(magicLinksTable, link); err != nil {
+		return errors.DatabaseError("Failed to store login link: " + err.Error())
+	}
+
+	if err := queueMagicLinkEmail(user.Email, token); err != nil {
+		return errors.InternalServerError("Failed to queue login email: " + err.Error())
+	}
+
+	return sent()
+}
+
+// queueMagicLinkEmail sends the login link. The link opens a confirmation page instead of
+// logging in directly, so mail scanners that follow links cannot use up the token.
+func queueMagicLinkEmail(address, token string) error {
+	loginURL, err := apiLink("/auth/magic_link/verify", url.Values{"token": {token}})
+	if err != nil {
+		return err
+	}
+	minutes := int(magicLinkTTL.Minutes())
+
+	return email.QueueEmail(email.Email{
+		ID:      lib.GenerateUUID(),
+		To:      address,
+		Subject: "Your GreenVue login link",
+		Type:    email.MagicLinkEmail,
+		TextContent: fmt.Sprintf("Use this link to log in to GreenVue: %s\n\n"+
+			"The link works once and expires in %d minutes. If you did not ask for it, you can ignore this email.",
+			loginURL, minutes),
+		HTMLContent: fmt.Sprintf("<p><a href=\"%s\">Log in to GreenVue</a></p>"+
+			"<p>The link works once and expires in %d minutes. If you did not ask for it, you can ignore this email.</p>",
+			loginURL, minutes),
+		Status:     "pending",
+		MaxRetries: 3,
+		CreatedAt:  time.Now(),
+	})
+}
+
+// ShowMagicLinkConfirmation renders the page behind the emailed link. It does not use the token;
+// the login only happens when the user presses the button, which posts to VerifyMagicLink.
+func ShowMagicLinkConfirmation(c *fiber.Ctx) error {
+	return renderConfirmationPage(c, "Log in to GreenVue", "Continue", "/auth/magic_link/verify")
+}
+
+// renderConfirmationPage shows a page with a single button that posts the token from the query string to action.
+// Emailed links point here so that nothing happens until a person presses the button.
+func renderConfirmationPage(c *fiber.Ctx, title, button, action string) error {
+	token := c.Query("token")
+	if token == "" {
+		return errors.BadRequest("Missing token parameter")
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set("Referrer-Policy", "no-referrer")
+	c.Type("html", "utf-8")
+	return c.SendString(fmt.Sprintf(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><meta name="robots" content="noindex"><title>%[1]s</title></head>
+<body style="font-family: sans-serif; text-align: center; padding-top: 4rem">
+<h1>%[1]s</h1>
+<form method="POST" action="%[3]s">
+<input type="hidden" name="token" value="%[4]s">
+<button type="submit" style="font-size: 1.1rem; padding: 0.6rem 1.4rem">%[2]s</button>
+</form>
+</body>
+</html>`, html.EscapeString(title), html.EscapeString(button), html.EscapeString(action), html.EscapeString(token)))
+}
+
+// VerifyMagicLink consumes a login link and issues the normal token pair.
+// Form posts from the confirmation page are redirected to the web client; JSON clients get the tokens in the body.
+func VerifyMagicLink(c *fiber.Ctx) error {
+	var payload struct {
+		Token string `json:"token" form:"token"`
+	}
+
+	if err := c.BodyParser(&payload); err != nil {
+		return errors.BadRequest("Invalid request format")
+	}
+
+	fromForm := strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationForm)
+
+	userID, err := consumeMagicLink(strings.TrimSpace(payload.Token))
+	if err != nil {
+		auditFailure(c, AuditLogin, nil, "magic_link", err.Error())
+		if siteURL := os.Getenv("URL"); fromForm && siteURL != "" {
+			return c.Redirect(siteURL + "/login?magic_link=expired")
+		}
+		return err
+	}
+
+	user, err := getUserRecord(userID)
+	if err != nil {
+		return err
+	}
+
+	auditUserAction(c, AuditLogin, user.ID, map[string]any{"method": "magic_link"})
+
+	// The link proves access to the mailbox, just like an unlock link, but the failure counter
+	// still guards the second factor until that succeeds too
+	if fromForm {
+		resp, err := issueLoginTokens(user.ID, user.Email, DeviceFromContext(c))
+		if err != nil {
+			return errors.InternalServerError("Failed to sign in: " + err.Error())
+		}
+		if resp.MFAToken == "" {
+			resetLoginFailures(user.Email)
+		}
+		return redirectAfterLogin(c, resp, false)
+	}
+
+	// Users with two-factor authentication get an mfa_pending token instead of a session
+	mfaEnabled, err := isMFAEnabled(user.ID)
+	if err != nil {
+		return errors.InternalServerError("Failed to check two-factor authentication")
+	}
+	if mfaEnabled {
+		return mfaChallenge(c, user.ID)
+	}
+	resetLoginFailures(user.Email)
+
+	tokens, err := GenerateTokenPair(user.ID, user.Email, DeviceFromContext(c))
+	if err != nil {
+		return errors.InternalServerError("Failed to generate tokens")
+	}
+	SetAuthCookies(c, tokens)
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"userId":       user.ID,
+		"accessToken":  tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken,
+		"expiresIn":    tokens.ExpiresIn,
+	})
+}
+
+// consumeMagicLink marks an unused, unexpired link as used and returns its user.
+// The update is conditional, so two concurrent requests cannot both use the same link.
+func consumeMagicLink(token string) (uuid.UUID, error) {
+	if token == "" {
+		return uuid.Nil, errors.BadRequest("Missing token")
+	}
+
+	client := db.GetGlobalClient()
+	if client == nil {
+		return uuid.Nil, errors.InternalServerError("Failed to create database client")
+	}
+
+	now := time.Now().UTC()
+	data, err := client.PATCHWhere(magicLinksTable,
+		fmt.Sprintf("token_hash=eq.%s&used_at=is.null&expires_at=gt.%s", hashMagicLinkToken(token), url.QueryEscape(now.Format(time.RFC3339))),
+		map[string]any{"used_at": now})
+	if err != nil {
+		return uuid.Nil, errors.DatabaseError("Failed to verify login link: " + err.Error())
+	}
+
+	var links []MagicLink
+	if err := json.Unmarshal(data, &links); err != nil || len(links) == 0 {
+		return uuid.Nil, errors.Unauthorized("Invalid or expired login link")
+	}
+
+	return links[0].UserID, nil
+}
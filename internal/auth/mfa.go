@@ -0,0 +1,613 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"greenvue/internal/db"
+	"greenvue/lib"
+	"greenvue/lib/errors"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	mfaTable = "user_mfa"
+
+	// MFAPendingMaxAge is how long the user has to enter a code after the password step
+	MFAPendingMaxAge = 300 // 5 minutes
+
+	// maxMFAAttempts is the number of wrong codes accepted per pending login
+	maxMFAAttempts = 5
+
+	// MFATokenCookieName holds the mfa_pending token of redirect-based logins, so it never appears in a URL
+	MFATokenCookieName = "mfa_token"
+)
+
+// UserMFA is the two-factor state of a user; the row ID is the user ID
+type UserMFA struct {
+	ID            uuid.UUID  `json:"id"`
+	Secret        string     `json:"secret"`
+	Enabled       bool       `json:"enabled"`
+	RecoveryCodes []string   `json:"recovery_codes"` // SHA-256 hashes of the unused recovery codes
+	LastUsedStep  int64      `json:"last_used_step"` // Last accepted TOTP time step, to reject replays
+	CreatedAt     time.Time  `json:"created_at"`
+	EnabledAt     *time.Time `json:"enabled_at,omitempty"`
+}
+
+// getUserMFA returns the two-factor state of a user, or nil if the user never enrolled
+func getUserMFA(userID uuid.UUID) (*UserMFA, error) {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return nil, fmt.Errorf("database client not available")
+	}
+
+	data, err := client.GET(mfaTable, fmt.Sprintf("id=eq.%s", userID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch MFA settings: %w", err)
+	}
+
+	var records []UserMFA
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse MFA settings: %w", err)
+	}
+
+	if len(records) == 0 {
+		return nil, nil
+	}
+	return &records[0], nil
+}
+
+// isMFAEnabled reports whether a user has completed two-factor enrolment
+func isMFAEnabled(userID uuid.UUID) (bool, error) {
+	record, err := getUserMFA(userID)
+	if err != nil {
+		return false, err
+	}
+	return record != nil && record.Enabled, nil
+}
+
+// verifyMFACode accepts either a TOTP code or an unused recovery code and persists
+// the change that makes the code single-use. The update only applies if nobody used a
+// code since the record was read, so concurrent logins cannot both use the same code.
+func verifyMFACode(record *UserMFA, code string) (bool, error) {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return false, fmt.Errorf("database client not available")
+	}
+
+	if step, ok := verifyTOTP(record.Secret, code, time.Now()); ok {
+		// A code may only be used once, even within its validity window
+		if step <= record.LastUsedStep {
+			return false, nil
+		}
+
+		claimed, err := claimMFAUpdate(client, fmt.Sprintf("id=eq.%s&last_used_step=lt.%d", record.ID, step), map[string]any{
+			"last_used_step": step,
+		})
+		if err != nil || !claimed {
+			return false, err
+		}
+		record.LastUsedStep = step
+		return true, nil
+	}
+
+	hash := hashRecoveryCode(code)
+	for i, stored := range record.RecoveryCodes {
+		if stored != hash {
+			continue
+		}
+
+		remaining := append(append([]string{}, record.RecoveryCodes[:i]...), record.RecoveryCodes[i+1:]...)
+		current := url.QueryEscape("{" + strings.Join(record.RecoveryCodes, ",") + "}")
+		claimed, err := claimMFAUpdate(client, fmt.Sprintf("id=eq.%s&recovery_codes=eq.%s", record.ID, current), map[string]any{
+			"recovery_codes": remaining,
+		})
+		if err != nil || !claimed {
+			return false, err
+		}
+		record.RecoveryCodes = remaining
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// claimMFAUpdate applies a conditional update and reports whether a row matched
+func claimMFAUpdate(client *db.SupabaseClient, conditions string, data map[string]any) (bool, error) {
+	result, err := client.PATCHWhere(mfaTable, conditions, data)
+	if err != nil {
+		return false, fmt.Errorf("failed to update MFA settings: %w", err)
+	}
+
+	var records []UserMFA
+	if err := json.Unmarshal(result, &records); err != nil || len(records) == 0 {
+		return false, nil
+	}
+	return true, nil
+}
+
+// generateMFAPendingToken issues the short-lived token that proves the password step succeeded
+func generateMFAPendingToken(userID uuid.UUID) (string, error) {
+	now := time.Now()
+
+	return signToken(TokenTypeMFAPending, Claims{
+		UserId: userID,
+		Role:   "mfa_pending",
+		Type:   TokenTypeMFAPending,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Audience:  []string{"greenvue-client"},
+			Issuer:    "greenvue",
+			Subject:   userID.String(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(MFAPendingMaxAge * time.Second)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	})
+}
+
+// mfaChallenge responds to a login that still needs a second factor
+func mfaChallenge(c *fiber.Ctx, userID uuid.UUID) error {
+	mfaToken, err := generateMFAPendingToken(userID)
+	if err != nil {
+		return errors.InternalServerError("Failed to generate tokens")
+	}
+
+	// Tell the client which second factors it can offer
+	methods := []string{"totp"}
+	if passkeys, err := getUserPasskeys(userID); err == nil && len(passkeys) > 0 {
+		methods = append(methods, "passkey")
+	}
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"mfaRequired": true,
+		"mfaToken":    mfaToken,
+		"methods":     methods,
+		"expiresIn":   MFAPendingMaxAge,
+	})
+}
+
+// mfaAttemptTracker limits wrong codes per pending login and makes each pending token single-use
+type mfaAttemptTracker struct {
+	mu       sync.Mutex
+	attempts map[string]int
+	expires  map[string]time.Time
+}
+
+var mfaAttempts = &mfaAttemptTracker{
+	attempts: make(map[string]int),
+	expires:  make(map[string]time.Time),
+}
+
+// allow reports whether another attempt may be made with the pending token
+func (t *mfaAttemptTracker) allow(tokenID string, expiresAt time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for id, expiry := range t.expires {
+		if now.After(expiry) {
+			delete(t.expires, id)
+			delete(t.attempts, id)
+		}
+	}
+
+	t.expires[tokenID] = expiresAt
+	return t.attempts[tokenID] < maxMFAAttempts
+}
+
+// fail records a wrong code
+func (t *mfaAttemptTracker) fail(tokenID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.attempts[tokenID]++
+}
+
+// consume uses up the pending token after a successful login
+func (t *mfaAttemptTracker) consume(tokenID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.attempts[tokenID] = maxMFAAttempts
+}
+
+// guardMFALogin checks the login lockout of the account behind a pending MFA login and returns its
+// address. Wrong second factors count as failed logins of the account, so knowing the password does
+// not buy a fresh set of guesses with every new mfa_pending token.
+func guardMFALogin(c *fiber.Ctx, userID uuid.UUID) (string, error) {
+	user, err := getUserRecord(userID)
+	if err != nil {
+		return "", err
+	}
+
+	if err := checkGuards(c, map[*BruteForceGuard]string{
+		loginAccountGuard: user.Email,
+		loginIPGuard:      c.IP(),
+	}); err != nil {
+		auditFailure(c, AuditLogin, &userID, user.Email, "locked_out")
+		return "", err
+	}
+	return user.Email, nil
+}
+
+// setMFATokenCookie hands an mfa_pending token to the browser for the second login step.
+// It is only sent to the /auth routes that finish the login and expires with the token.
+func setMFATokenCookie(c *fiber.Ctx, token string) {
+	// Same domain rules as the auth cookies, so the web client's requests carry it
+	var domain string
+	if cfg.Environment != "production" && SameSite == "None" {
+		domain = ""
+	} else {
+		domain = getDomainFromHost(c.Hostname())
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     MFATokenCookieName,
+		Value:    token,
+		Path:     "/auth",
+		Domain:   domain,
+		MaxAge:   MFAPendingMaxAge,
+		Expires:  time.Now().Add(MFAPendingMaxAge * time.Second),
+		Secure:   Secure,
+		HTTPOnly: true,
+		SameSite: SameSite,
+	})
+}
+
+// clearMFATokenCookie removes the mfa_pending cookie once the login is complete
+func clearMFATokenCookie(c *fiber.Ctx) {
+	if c.Cookies(MFATokenCookieName) == "" {
+		return
+	}
+
+	var domain string
+	if cfg.Environment != "production" && SameSite == "None" {
+		domain = ""
+	} else {
+		domain = getDomainFromHost(c.Hostname())
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     MFATokenCookieName,
+		Value:    "",
+		Path:     "/auth",
+		Domain:   domain,
+		MaxAge:   -1,
+		Expires:  time.Now().Add(-time.Hour),
+		Secure:   Secure,
+		HTTPOnly: true,
+		SameSite: SameSite,
+	})
+}
+
+// mfaTokenFromRequest returns the mfa_pending token from the body, or from the cookie set by redirect-based logins
+func mfaTokenFromRequest(c *fiber.Ctx, bodyToken string) string {
+	if bodyToken != "" {
+		return bodyToken
+	}
+	return c.Cookies(MFATokenCookieName)
+}
+
+// CompleteMFALogin exchanges an mfa_pending token and a valid code for the normal token pair
+func CompleteMFALogin(c *fiber.Ctx) error {
+	var payload struct {
+		MFAToken string `json:"mfaToken"`
+		Code     string `json:"code"`
+	}
+
+	if err := c.BodyParser(&payload); err != nil {
+		return errors.BadRequest("Invalid request format")
+	}
+	payload.MFAToken = mfaTokenFromRequest(c, payload.MFAToken)
+
+	if err := errors.ValidateFields(map[string]string{
+		"mfaToken": payload.MFAToken,
+		"code":     payload.Code,
+	}); err != nil {
+		return err
+	}
+
+	claims, err := ValidateToken(payload.MFAToken, TokenTypeMFAPending)
+	if err != nil {
+		return errors.Unauthorized("Invalid or expired MFA token")
+	}
+
+	if !mfaAttempts.allow(claims.ID, claims.ExpiresAt.Time) {
+		return errors.TooManyRequests("Too many invalid codes, please log in again")
+	}
+
+	address, err := guardMFALogin(c, claims.UserId)
+	if err != nil {
+		return err
+	}
+
+	record, err := getUserMFA(claims.UserId)
+	if err != nil {
+		return errors.InternalServerError("Failed to fetch MFA settings")
+	}
+	if record == nil || !record.Enabled {
+		return errors.Unauthorized("Two-factor authentication is not enabled")
+	}
+
+	valid, err := verifyMFACode(record, payload.Code)
+	if err != nil {
+		return errors.InternalServerError("Failed to verify code")
+	}
+	if !valid {
+		mfaAttempts.fail(claims.ID)
+		recordLoginFailure(c, address)
+		auditFailure(c, AuditLogin, &claims.UserId, "", "invalid_mfa_code")
+		return errors.Unauthorized("Invalid authentication code")
+	}
+	mfaAttempts.consume(claims.ID)
+	resetLoginFailures(address)
+
+	tokens, err := GenerateTokenPair(claims.UserId, "", DeviceFromContext(c))
+	if err != nil {
+		return errors.InternalServerError("Failed to generate tokens")
+	}
+
+	SetAuthCookies(c, tokens)
+	clearMFATokenCookie(c)
+	auditUserAction(c, AuditLogin, claims.UserId, map[string]any{"method": "mfa"})
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"userId":       claims.UserId,
+		"accessToken":  tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken,
+		"expiresIn":    tokens.ExpiresIn,
+	})
+}
+
+// GetMFAStatus reports whether two-factor authentication is enabled for the authenticated user
+func GetMFAStatus(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	record, err := getUserMFA(claims.UserId)
+	if err != nil {
+		return errors.InternalServerError("Failed to fetch MFA settings: " + err.Error())
+	}
+
+	status := fiber.Map{
+		"enabled":                  false,
+		"recovery_codes_remaining": 0,
+	}
+	if record != nil && record.Enabled {
+		status["enabled"] = true
+		status["enabled_at"] = record.EnabledAt
+		status["recovery_codes_remaining"] = len(record.RecoveryCodes)
+	}
+
+	return errors.SuccessResponse(c, status)
+}
+
+// EnrollMFA starts enrolment by creating a new secret and returning its provisioning URI.
+// Two-factor authentication is not active until the first code is verified.
+func EnrollMFA(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create database client")
+	}
+
+	record, err := getUserMFA(claims.UserId)
+	if err != nil {
+		return errors.InternalServerError("Failed to fetch MFA settings: " + err.Error())
+	}
+	if record != nil && record.Enabled {
+		return errors.AlreadyExists("Two-factor authentication is already enabled")
+	}
+
+	user, err := getUserRecord(claims.UserId)
+	if err != nil {
+		return err
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return errors.InternalServerError("Failed to generate secret")
+	}
+
+	// Restarting enrolment replaces the previous unverified secret
+	if record != nil {
+		_, err = client.PATCH(mfaTable, claims.UserId, map[string]any{
+			"secret":         secret,
+			"last_used_step": 0,
+			"recovery_codes": []string{},
+		})
+	} else {
+		_, err = client.POST(mfaTable, UserMFA{
+			ID:            claims.UserId,
+			Secret:        secret,
+			RecoveryCodes: []string{},
+			CreatedAt:     time.Now().UTC(),
+		})
+	}
+	if err != nil {
+		return errors.DatabaseError("Failed to store MFA settings: " + err.Error())
+	}
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"secret":           secret,
+		"provisioning_uri": totpProvisioningURI(secret, user.Email),
+	})
+}
+
+// VerifyMFA confirms enrolment with a code from the authenticator app and returns the recovery codes.
+// The recovery codes are only shown once.
+func VerifyMFA(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	var payload struct {
+		Code string `json:"code"`
+	}
+
+	if err := c.BodyParser(&payload); err != nil {
+		return errors.BadRequest("Invalid request format")
+	}
+
+	if payload.Code == "" {
+		return errors.ValidationError("Code is required", "code")
+	}
+
+	record, err := getUserMFA(claims.UserId)
+	if err != nil {
+		return errors.InternalServerError("Failed to fetch MFA settings: " + err.Error())
+	}
+	if record == nil {
+		return errors.BadRequest("Start enrolment before verifying a code")
+	}
+	if record.Enabled {
+		return errors.AlreadyExists("Two-factor authentication is already enabled")
+	}
+
+	step, valid := verifyTOTP(record.Secret, payload.Code, time.Now())
+	if !valid {
+		return errors.Unauthorized("Invalid authentication code")
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return errors.InternalServerError("Failed to generate recovery codes")
+	}
+
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create database client")
+	}
+
+	now := time.Now().UTC()
+	if _, err := client.PATCH(mfaTable, claims.UserId, map[string]any{
+		"enabled":        true,
+		"enabled_at":     now,
+		"last_used_step": step,
+		"recovery_codes": hashes,
+	}); err != nil {
+		return errors.DatabaseError("Failed to enable two-factor authentication: " + err.Error())
+	}
+
+	// Existing sessions were created with a single factor
+	revokeOtherSessions(claims.UserId, claims.SessionID)
+	auditUserAction(c, AuditMFAChange, claims.UserId, map[string]any{"enabled": true})
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableMFA turns off two-factor authentication. The user has to re-authenticate
+// with their password and a current code or recovery code.
+func DisableMFA(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	var payload struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	if err := c.BodyParser(&payload); err != nil {
+		return errors.BadRequest("Invalid request format")
+	}
+
+	if err := errors.ValidateFields(map[string]string{
+		"password": payload.Password,
+		"code":     payload.Code,
+	}); err != nil {
+		return err
+	}
+
+	record, err := getUserMFA(claims.UserId)
+	if err != nil {
+		return errors.InternalServerError("Failed to fetch MFA settings: " + err.Error())
+	}
+	if record == nil || !record.Enabled {
+		return errors.BadRequest("Two-factor authentication is not enabled")
+	}
+
+	if err := reauthenticate(claims.UserId, payload.Password); err != nil {
+		return err
+	}
+
+	valid, err := verifyMFACode(record, payload.Code)
+	if err != nil {
+		return errors.InternalServerError("Failed to verify code")
+	}
+	if !valid {
+		return errors.Unauthorized("Invalid authentication code")
+	}
+
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create database client")
+	}
+
+	if _, err := client.DELETE(mfaTable, fmt.Sprintf("id=eq.%s", claims.UserId)); err != nil {
+		return errors.DatabaseError("Failed to disable two-factor authentication: " + err.Error())
+	}
+	auditUserAction(c, AuditMFAChange, claims.UserId, map[string]any{"enabled": false})
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"message": "Two-factor authentication disabled",
+	})
+}
+
+// getUserRecord fetches the users row of the given user
+func getUserRecord(userID uuid.UUID) (*lib.User, error) {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return nil, errors.InternalServerError("Failed to create database client")
+	}
+
+	data, err := client.GET("users", fmt.Sprintf("id=eq.%s", userID))
+	if err != nil {
+		return nil, errors.DatabaseError("Failed to fetch user: " + err.Error())
+	}
+
+	var users []lib.User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, errors.InternalServerError("Failed to parse user data: " + err.Error())
+	}
+
+	if len(users) == 0 {
+		return nil, errors.NotFound("User not found")
+	}
+	return &users[0], nil
+}
+
+// reauthenticate confirms the user's password before a sensitive change
+func reauthenticate(userID uuid.UUID, password string) error {
+	user, err := getUserRecord(userID)
+	if err != nil {
+		return err
+	}
+
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create database client")
+	}
+
+	authResp, err := client.Login(user.Email, password)
+	if err != nil || authResp == nil || authResp.User.ID != userID {
+		return errors.Unauthorized("Invalid password")
+	}
+
+	return nil
+}
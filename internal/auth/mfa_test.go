@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func TestRedirectAfterLoginKeepsMFATokenOutOfURL(t *testing.T) {
+	t.Setenv("URL", "https://www.example.com/login")
+
+	userID := uuid.New()
+	app := fiber.New()
+	app.Get("/auth/callback", func(c *fiber.Ctx) error {
+		return redirectAfterLogin(c, SupabaseResp{UserId: User{Id: userID}, MFAToken: "pending-token"}, false)
+	})
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/auth/callback", nil), -1)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	location := resp.Header.Get(fiber.HeaderLocation)
+	if strings.Contains(location, "pending-token") || !strings.Contains(location, "mfa_required=true") {
+		t.Errorf("redirect = %q, want mfa_required without the token", location)
+	}
+
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == MFATokenCookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value != "pending-token" || !cookie.HttpOnly || cookie.Path != "/auth" || cookie.MaxAge != MFAPendingMaxAge {
+		t.Errorf("mfa cookie = %+v, want a short-lived HttpOnly cookie with the token", cookie)
+	}
+}
+
+func TestMFATokenFromRequest(t *testing.T) {
+	app := fiber.New()
+	app.Post("/auth/login/mfa", func(c *fiber.Ctx) error {
+		return c.SendString(mfaTokenFromRequest(c, c.Query("body")))
+	})
+
+	tests := []struct {
+		name   string
+		body   string
+		cookie string
+		want   string
+	}{
+		{"body only", "body-token", "", "body-token"},
+		{"cookie only", "", "cookie-token", "cookie-token"},
+		{"body wins", "body-token", "cookie-token", "body-token"},
+		{"neither", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/auth/login/mfa?body="+tt.body, nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: MFATokenCookieName, Value: tt.cookie})
+			}
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(body); got != tt.want {
+				t.Errorf("mfaTokenFromRequest() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,545 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"greenvue/internal/config"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrOIDCUnknownProvider = errors.New("unknown login provider")
+	ErrOIDCState           = errors.New("invalid or expired login state")
+	ErrOIDCIDToken         = errors.New("invalid ID token")
+)
+
+const (
+	oidcFlowTimeout      = 10 * time.Minute
+	oidcDiscoveryTTL     = time.Hour
+	oidcJWKSTTL          = time.Hour
+	oidcJWKSRefetchDelay = time.Minute // Minimum time between refetches caused by an unknown kid
+	oidcClockSkew        = time.Minute
+)
+
+// oidcHTTPClient is shared by all providers
+var oidcHTTPClient = resty.New().SetTimeout(10 * time.Second)
+
+// oidcDiscovery holds the fields we use from a provider's discovery document
+type oidcDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	SigningAlgsSupported  []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// jsonWebKey is a single key of a JWKS document
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// OIDCProvider is a configured OpenID Connect provider with cached discovery and signing keys
+type OIDCProvider struct {
+	config.OIDCProvider
+
+	mu           sync.Mutex
+	discovery    *oidcDiscovery
+	discoveredAt time.Time
+	keys         map[string]crypto.PublicKey
+	keysFetched  time.Time
+}
+
+// OIDCIdentity is the verified result of an OpenID Connect login
+type OIDCIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Picture       string
+	IDToken       string // Raw ID token, needed when the provider is backed by Supabase Auth
+	RawNonce      string // Nonce before hashing, which Supabase Auth expects alongside the ID token
+}
+
+// oidcIDTokenClaims are the ID token claims we check or use
+type oidcIDTokenClaims struct {
+	Nonce         string `json:"nonce"`
+	AuthorizedBy  string `json:"azp"`
+	Email         string `json:"email"`
+	EmailVerified any    `json:"email_verified"` // Some providers send "true" as a string
+	Name          string `json:"name"`
+	Picture       string `json:"picture"`
+	jwt.RegisteredClaims
+}
+
+var oidcProviders = struct {
+	sync.RWMutex
+	byName map[string]*OIDCProvider
+}{}
+
+// InitOIDCProviders registers the configured providers, replacing any earlier ones
+func InitOIDCProviders(providers []config.OIDCProvider) error {
+	byName := make(map[string]*OIDCProvider, len(providers))
+	for _, provider := range providers {
+		if provider.Name == "" || provider.Issuer == "" || provider.ClientID == "" || provider.RedirectURI == "" {
+			return fmt.Errorf("OIDC provider %q needs a name, issuer, client ID and redirect URI", provider.Name)
+		}
+		if _, exists := byName[provider.Name]; exists {
+			return fmt.Errorf("OIDC provider %q is configured twice", provider.Name)
+		}
+		byName[provider.Name] = &OIDCProvider{OIDCProvider: provider}
+	}
+
+	oidcProviders.Lock()
+	oidcProviders.byName = byName
+	oidcProviders.Unlock()
+	return nil
+}
+
+// getOIDCProvider returns a registered provider by name
+func getOIDCProvider(name string) (*OIDCProvider, error) {
+	oidcProviders.RLock()
+	defer oidcProviders.RUnlock()
+
+	provider, ok := oidcProviders.byName[name]
+	if !ok {
+		return nil, ErrOIDCUnknownProvider
+	}
+	return provider, nil
+}
+
+// getDiscovery returns the provider's discovery document, fetching it when the cache is stale
+func (p *OIDCProvider) getDiscovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil && time.Since(p.discoveredAt) < oidcDiscoveryTTL {
+		return p.discovery, nil
+	}
+
+	discoveryURL := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	resp, err := oidcHTTPClient.R().Get(discoveryURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch discovery document: %w", err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch discovery document: status %d", resp.StatusCode())
+	}
+
+	// Decoded by hand because some providers serve JSON with a generic content type
+	discovery := &oidcDiscovery{}
+	if err := json.Unmarshal(resp.Body(), discovery); err != nil {
+		return nil, fmt.Errorf("failed to parse discovery document: %w", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(p.Issuer, "/") {
+		return nil, fmt.Errorf("discovery document issuer %q does not match %q", discovery.Issuer, p.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document is missing endpoints")
+	}
+
+	p.discovery = discovery
+	p.discoveredAt = time.Now()
+	return discovery, nil
+}
+
+// getSigningKey returns the provider key with the given kid, refreshing the JWKS when the key is unknown
+func (p *OIDCProvider) getSigningKey(kid string) (crypto.PublicKey, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.lookupKey(kid); ok && time.Since(p.keysFetched) < oidcJWKSTTL {
+		return key, nil
+	}
+
+	// Providers rotate keys, so an unknown kid triggers a refetch, but not more than once per delay
+	if p.keys != nil && time.Since(p.keysFetched) < oidcJWKSRefetchDelay {
+		if key, ok := p.lookupKey(kid); ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	resp, err := oidcHTTPClient.R().Get(discovery.JWKSURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: status %d", resp.StatusCode())
+	}
+	if err := json.Unmarshal(resp.Body(), &jwks); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := parseJWK(jwk)
+		if err != nil {
+			// Skip keys we cannot use instead of failing on the whole set
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	p.keys = keys
+	p.keysFetched = time.Now()
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookupKey finds a cached key; an empty kid is only accepted when the provider publishes a single key.
+// The caller must hold p.mu.
+func (p *OIDCProvider) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+// parseJWK converts an RSA, EC or OKP (Ed25519) JWK into a public key
+func parseJWK(jwk jsonWebKey) (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("RSA exponent out of range")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("EC point is not on curve")
+		}
+		return key, nil
+
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key length")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+// oidcFlow is the server side state of a login that was sent to a provider
+type oidcFlow struct {
+	Provider     string
+	CodeVerifier string
+	RawNonce     string
+	Registration bool
+	ExpiresAt    time.Time
+}
+
+// oidcFlowStore keeps pending logins in memory, keyed by the state parameter; each state can be used once
+type oidcFlowStore struct {
+	mu    sync.Mutex
+	items map[string]oidcFlow
+}
+
+var oidcFlows = &oidcFlowStore{items: make(map[string]oidcFlow)}
+
+// start records a new flow and returns its state
+func (s *oidcFlowStore) start(flow oidcFlow) (string, error) {
+	state, err := randomURLToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, item := range s.items {
+		if now.After(item.ExpiresAt) {
+			delete(s.items, key)
+		}
+	}
+
+	flow.ExpiresAt = now.Add(oidcFlowTimeout)
+	s.items[state] = flow
+	return state, nil
+}
+
+// consume removes and returns a flow if it is still valid for the provider
+func (s *oidcFlowStore) consume(state, provider string) (*oidcFlow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	flow, ok := s.items[state]
+	if !ok {
+		return nil, ErrOIDCState
+	}
+	delete(s.items, state)
+
+	if flow.Provider != provider || time.Now().After(flow.ExpiresAt) {
+		return nil, ErrOIDCState
+	}
+	return &flow, nil
+}
+
+// randomURLToken returns n random bytes, base64url encoded
+func randomURLToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// pkceChallenge returns the S256 code challenge for a verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// hashNonce returns the nonce sent to the provider. Supabase Auth expects the hex SHA-256 of the raw nonce in the ID token.
+func hashNonce(rawNonce string) string {
+	sum := sha256.Sum256([]byte(rawNonce))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuthorizationURL starts a login and returns the provider URL to redirect to, together with the state
+func (p *OIDCProvider) AuthorizationURL(registration bool) (string, string, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return "", "", err
+	}
+
+	verifier, err := randomURLToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	rawNonce, err := randomURLToken(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := oidcFlows.start(oidcFlow{
+		Provider:     p.Name,
+		CodeVerifier: verifier,
+		RawNonce:     rawNonce,
+		Registration: registration,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.ClientID)
+	params.Set("redirect_uri", p.RedirectURI)
+	params.Set("scope", strings.Join(p.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", hashNonce(rawNonce))
+	params.Set("code_challenge", pkceChallenge(verifier))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + params.Encode(), state, nil
+}
+
+// Exchange swaps an authorization code for tokens and returns the verified identity
+func (p *OIDCProvider) Exchange(code string, flow *oidcFlow) (*OIDCIdentity, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	form := map[string]string{
+		"grant_type":    "authorization_code",
+		"code":          code,
+		"redirect_uri":  p.RedirectURI,
+		"client_id":     p.ClientID,
+		"code_verifier": flow.CodeVerifier,
+	}
+	if p.ClientSecret != "" {
+		form["client_secret"] = p.ClientSecret
+	}
+
+	var tokenResp struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	resp, err := oidcHTTPClient.R().
+		SetHeader("Accept", "application/json").
+		SetFormData(form).
+		Post(discovery.TokenEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange code: %w", err)
+	}
+	// An unparsable body leaves tokenResp empty, which is reported below
+	_ = json.Unmarshal(resp.Body(), &tokenResp)
+	if resp.StatusCode() != http.StatusOK {
+		return nil, fmt.Errorf("failed to exchange code: status %d %s", resp.StatusCode(), tokenResp.Error)
+	}
+	if tokenResp.IDToken == "" {
+		return nil, fmt.Errorf("token response contains no ID token")
+	}
+
+	return p.VerifyIDToken(tokenResp.IDToken, flow.RawNonce)
+}
+
+// VerifyIDToken checks an ID token's signature against the provider JWKS, its issuer, audience, expiry and nonce
+func (p *OIDCProvider) VerifyIDToken(idToken, rawNonce string) (*OIDCIdentity, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	algorithms := discovery.SigningAlgsSupported
+	if len(algorithms) == 0 {
+		algorithms = []string{"RS256"}
+	}
+	// Never accept unsigned or symmetric tokens, whatever the discovery document says
+	allowed := make([]string, 0, len(algorithms))
+	for _, alg := range algorithms {
+		if alg != "none" && !strings.HasPrefix(alg, "HS") {
+			allowed = append(allowed, alg)
+		}
+	}
+
+	claims := &oidcIDTokenClaims{}
+	token, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.getSigningKey(kid)
+	},
+		jwt.WithValidMethods(allowed),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(oidcClockSkew),
+	)
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("%w: %v", ErrOIDCIDToken, err)
+	}
+
+	if !p.isAcceptedIssuer(claims.Issuer) {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrOIDCIDToken, claims.Issuer)
+	}
+	// With several audiences, the token must have been issued to us
+	if len(claims.Audience) > 1 && claims.AuthorizedBy != p.ClientID {
+		return nil, fmt.Errorf("%w: authorized party mismatch", ErrOIDCIDToken)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing subject", ErrOIDCIDToken)
+	}
+	if claims.Nonce != hashNonce(rawNonce) {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrOIDCIDToken)
+	}
+
+	emailVerified := false
+	switch value := claims.EmailVerified.(type) {
+	case bool:
+		emailVerified = value
+	case string:
+		emailVerified = value == "true"
+	}
+
+	return &OIDCIdentity{
+		Provider:      p.Name,
+		Subject:       claims.Subject,
+		Email:         strings.ToLower(strings.TrimSpace(claims.Email)),
+		EmailVerified: emailVerified,
+		Name:          claims.Name,
+		Picture:       claims.Picture,
+		IDToken:       idToken,
+		RawNonce:      rawNonce,
+	}, nil
+}
+
+// isAcceptedIssuer reports whether iss is the configured issuer or one of its aliases
+func (p *OIDCProvider) isAcceptedIssuer(issuer string) bool {
+	if strings.TrimSuffix(issuer, "/") == strings.TrimSuffix(p.Issuer, "/") {
+		return true
+	}
+	for _, extra := range p.ExtraIssuers {
+		if issuer == extra {
+			return true
+		}
+	}
+	return false
+}
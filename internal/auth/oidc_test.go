@@ -0,0 +1,576 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	stderrors "errors"
+	"greenvue/internal/config"
+	"greenvue/lib/errors"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID    = "greenvue-test"
+	testRedirectURI = "https://api.example.test/auth/oidc/test/callback"
+)
+
+// testIdP is a stand-in OpenID provider serving discovery, JWKS and token endpoints
+type testIdP struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu         sync.Mutex
+	keys       map[string]*rsa.PrivateKey // Published in the JWKS
+	algs       []string
+	jwksHits   int
+	tokenForms []url.Values
+	// issueToken answers the token endpoint; it gets the posted form
+	issueToken func(form url.Values) (int, map[string]any)
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+
+	idp := &testIdP{t: t, keys: map[string]*rsa.PrivateKey{"key-1": newTestRSAKey(t)}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		algs := idp.algs
+		idp.mu.Unlock()
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                idp.server.URL,
+			"authorization_endpoint":                idp.server.URL + "/authorize",
+			"token_endpoint":                        idp.server.URL + "/token",
+			"jwks_uri":                              idp.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": algs,
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+
+		idp.jwksHits++
+		keys := []map[string]string{}
+		for kid, key := range idp.keys {
+			keys = append(keys, map[string]string{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"kid": kid,
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		idp.mu.Lock()
+		idp.tokenForms = append(idp.tokenForms, r.PostForm)
+		issueToken := idp.issueToken
+		idp.mu.Unlock()
+
+		status, body := http.StatusBadRequest, map[string]any{"error": "invalid_request"}
+		if issueToken != nil {
+			status, body = issueToken(r.PostForm)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	})
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// setTokenHandler replaces the token endpoint behaviour
+func (idp *testIdP) setTokenHandler(issueToken func(form url.Values) (int, map[string]any)) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.issueToken = issueToken
+}
+
+// jwksFetches returns how often the JWKS was fetched
+func (idp *testIdP) jwksFetches() int {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	return idp.jwksHits
+}
+
+func newTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+	return key
+}
+
+// provider returns a fresh provider for the stand-in, without cached discovery or keys
+func (idp *testIdP) provider() *OIDCProvider {
+	return &OIDCProvider{OIDCProvider: config.OIDCProvider{
+		Name:        "test",
+		Issuer:      idp.server.URL,
+		ClientID:    testClientID,
+		RedirectURI: testRedirectURI,
+		Scopes:      []string{"openid", "email"},
+	}}
+}
+
+// claims returns valid ID token claims for the nonce
+func (idp *testIdP) claims(rawNonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            idp.server.URL,
+		"sub":            "subject-1",
+		"aud":            testClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          hashNonce(rawNonce),
+		"email":          " Jane@Example.com ",
+		"email_verified": "true",
+		"name":           "Jane",
+	}
+}
+
+// sign signs claims with a published key
+func (idp *testIdP) sign(kid string, claims jwt.MapClaims) string {
+	idp.t.Helper()
+
+	idp.mu.Lock()
+	key, ok := idp.keys[kid]
+	idp.mu.Unlock()
+	if !ok {
+		idp.t.Fatalf("no test key %q", kid)
+	}
+	return signWithKey(idp.t, kid, key, claims)
+}
+
+func signWithKey(t *testing.T, kid string, key *rsa.PrivateKey, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign ID token: %v", err)
+	}
+	return signed
+}
+
+func TestVerifyIDTokenAccepts(t *testing.T) {
+	idp := newTestIdP(t)
+	provider := idp.provider()
+
+	identity, err := provider.VerifyIDToken(idp.sign("key-1", idp.claims("nonce-1")), "nonce-1")
+	if err != nil {
+		t.Fatalf("VerifyIDToken() error = %v", err)
+	}
+
+	if identity.Provider != "test" || identity.Subject != "subject-1" || identity.RawNonce != "nonce-1" {
+		t.Errorf("identity = %+v", identity)
+	}
+	if identity.Email != "jane@example.com" || !identity.EmailVerified {
+		t.Errorf("email = %q verified = %v, want normalised and verified", identity.Email, identity.EmailVerified)
+	}
+}
+
+func TestVerifyIDTokenRejects(t *testing.T) {
+	idp := newTestIdP(t)
+	// Advertising weak algorithms must not make them acceptable
+	idp.mu.Lock()
+	idp.algs = []string{"RS256", "HS256", "none"}
+	idp.mu.Unlock()
+
+	tests := []struct {
+		name  string
+		token func() string
+	}{
+		{
+			name: "alg none",
+			token: func() string {
+				token := jwt.NewWithClaims(jwt.SigningMethodNone, idp.claims("nonce-1"))
+				token.Header["kid"] = "key-1"
+				signed, err := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+				if err != nil {
+					t.Fatalf("failed to sign: %v", err)
+				}
+				return signed
+			},
+		},
+		{
+			name: "HS256 keyed with the public key",
+			token: func() string {
+				idp.mu.Lock()
+				public := idp.keys["key-1"].PublicKey
+				idp.mu.Unlock()
+				token := jwt.NewWithClaims(jwt.SigningMethodHS256, idp.claims("nonce-1"))
+				token.Header["kid"] = "key-1"
+				signed, err := token.SignedString(public.N.Bytes())
+				if err != nil {
+					t.Fatalf("failed to sign: %v", err)
+				}
+				return signed
+			},
+		},
+		{
+			name: "unknown signer",
+			token: func() string {
+				return signWithKey(t, "key-1", newTestRSAKey(t), idp.claims("nonce-1"))
+			},
+		},
+		{
+			name: "wrong issuer",
+			token: func() string {
+				claims := idp.claims("nonce-1")
+				claims["iss"] = "https://evil.example.test"
+				return idp.sign("key-1", claims)
+			},
+		},
+		{
+			name: "wrong audience",
+			token: func() string {
+				claims := idp.claims("nonce-1")
+				claims["aud"] = "another-client"
+				return idp.sign("key-1", claims)
+			},
+		},
+		{
+			name: "several audiences without azp",
+			token: func() string {
+				claims := idp.claims("nonce-1")
+				claims["aud"] = []string{testClientID, "another-client"}
+				return idp.sign("key-1", claims)
+			},
+		},
+		{
+			name: "azp of another client",
+			token: func() string {
+				claims := idp.claims("nonce-1")
+				claims["aud"] = []string{testClientID, "another-client"}
+				claims["azp"] = "another-client"
+				return idp.sign("key-1", claims)
+			},
+		},
+		{
+			name: "nonce mismatch",
+			token: func() string {
+				return idp.sign("key-1", idp.claims("nonce-2"))
+			},
+		},
+		{
+			name: "raw nonce instead of its hash",
+			token: func() string {
+				claims := idp.claims("nonce-1")
+				claims["nonce"] = "nonce-1"
+				return idp.sign("key-1", claims)
+			},
+		},
+		{
+			name: "expired beyond the clock skew",
+			token: func() string {
+				claims := idp.claims("nonce-1")
+				claims["iat"] = time.Now().Add(-time.Hour).Unix()
+				claims["exp"] = time.Now().Add(-oidcClockSkew - time.Minute).Unix()
+				return idp.sign("key-1", claims)
+			},
+		},
+		{
+			name: "missing expiry",
+			token: func() string {
+				claims := idp.claims("nonce-1")
+				delete(claims, "exp")
+				return idp.sign("key-1", claims)
+			},
+		},
+		{
+			name: "missing subject",
+			token: func() string {
+				claims := idp.claims("nonce-1")
+				delete(claims, "sub")
+				return idp.sign("key-1", claims)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := idp.provider().VerifyIDToken(tt.token(), "nonce-1")
+			if !stderrors.Is(err, ErrOIDCIDToken) {
+				t.Fatalf("VerifyIDToken() error = %v, want ErrOIDCIDToken", err)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenAcceptsAuthorizedPartyAndExtraIssuer(t *testing.T) {
+	idp := newTestIdP(t)
+	provider := idp.provider()
+	provider.ExtraIssuers = []string{"accounts.example.test"}
+
+	claims := idp.claims("nonce-1")
+	claims["iss"] = "accounts.example.test"
+	claims["aud"] = []string{testClientID, "another-client"}
+	claims["azp"] = testClientID
+
+	if _, err := provider.VerifyIDToken(idp.sign("key-1", claims), "nonce-1"); err != nil {
+		t.Fatalf("VerifyIDToken() error = %v", err)
+	}
+}
+
+func TestVerifyIDTokenKeyRollover(t *testing.T) {
+	idp := newTestIdP(t)
+	provider := idp.provider()
+
+	if _, err := provider.VerifyIDToken(idp.sign("key-1", idp.claims("nonce-1")), "nonce-1"); err != nil {
+		t.Fatalf("VerifyIDToken() with the first key error = %v", err)
+	}
+
+	// The provider rotates to a new key
+	idp.mu.Lock()
+	idp.keys = map[string]*rsa.PrivateKey{"key-2": newTestRSAKey(t)}
+	idp.mu.Unlock()
+	rotated := idp.sign("key-2", idp.claims("nonce-1"))
+
+	// Right after a fetch an unknown kid does not hit the provider again
+	if _, err := provider.VerifyIDToken(rotated, "nonce-1"); !stderrors.Is(err, ErrOIDCIDToken) {
+		t.Fatalf("VerifyIDToken() within the refetch delay error = %v, want ErrOIDCIDToken", err)
+	}
+	if fetches := idp.jwksFetches(); fetches != 1 {
+		t.Fatalf("JWKS fetched %d times within the refetch delay, want 1", fetches)
+	}
+
+	provider.mu.Lock()
+	provider.keysFetched = time.Now().Add(-oidcJWKSRefetchDelay - time.Second)
+	provider.mu.Unlock()
+
+	if _, err := provider.VerifyIDToken(rotated, "nonce-1"); err != nil {
+		t.Fatalf("VerifyIDToken() after the refetch delay error = %v", err)
+	}
+	if fetches := idp.jwksFetches(); fetches != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", fetches)
+	}
+
+	// The retired key is gone from the refreshed set
+	provider.mu.Lock()
+	_, stillKnown := provider.keys["key-1"]
+	provider.mu.Unlock()
+	if stillKnown {
+		t.Error("retired key-1 is still cached after the refetch")
+	}
+}
+
+// startTestFlow starts a login and returns the flow the callback would consume, with the authorization URL parameters
+func startTestFlow(t *testing.T, provider *OIDCProvider) (*oidcFlow, url.Values) {
+	t.Helper()
+
+	authURL, state, err := provider.AuthorizationURL(false)
+	if err != nil {
+		t.Fatalf("AuthorizationURL() error = %v", err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("invalid authorization URL %q: %v", authURL, err)
+	}
+	params := parsed.Query()
+	if params.Get("state") != state {
+		t.Fatalf("state = %q, want %q", params.Get("state"), state)
+	}
+
+	flow, err := oidcFlows.consume(state, provider.Name)
+	if err != nil {
+		t.Fatalf("consume() error = %v", err)
+	}
+	return flow, params
+}
+
+func TestAuthorizationURLSendsPKCEAndHashedNonce(t *testing.T) {
+	idp := newTestIdP(t)
+	provider := idp.provider()
+
+	flow, params := startTestFlow(t, provider)
+
+	if params.Get("code_challenge_method") != "S256" {
+		t.Errorf("code_challenge_method = %q, want S256", params.Get("code_challenge_method"))
+	}
+	if params.Get("code_challenge") != pkceChallenge(flow.CodeVerifier) {
+		t.Error("code_challenge does not match the flow's verifier")
+	}
+	if params.Get("nonce") != hashNonce(flow.RawNonce) || params.Get("nonce") == flow.RawNonce {
+		t.Error("nonce is not the hash of the flow's raw nonce")
+	}
+	if params.Get("client_id") != testClientID || params.Get("redirect_uri") != testRedirectURI {
+		t.Errorf("client_id = %q redirect_uri = %q", params.Get("client_id"), params.Get("redirect_uri"))
+	}
+	if !strings.HasPrefix(params.Get("scope"), "openid") {
+		t.Errorf("scope = %q", params.Get("scope"))
+	}
+}
+
+func TestExchangeSendsPKCEVerifier(t *testing.T) {
+	idp := newTestIdP(t)
+	provider := idp.provider()
+
+	flow, params := startTestFlow(t, provider)
+	challenge := params.Get("code_challenge")
+
+	// Like a real provider, only answer when the verifier matches the challenge of the authorization request
+	idp.setTokenHandler(func(form url.Values) (int, map[string]any) {
+		if form.Get("code") != "code-1" || pkceChallenge(form.Get("code_verifier")) != challenge {
+			return http.StatusBadRequest, map[string]any{"error": "invalid_grant"}
+		}
+		return http.StatusOK, map[string]any{"id_token": idp.sign("key-1", idp.claims(flow.RawNonce))}
+	})
+
+	identity, err := provider.Exchange("code-1", flow)
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if identity.Subject != "subject-1" {
+		t.Errorf("subject = %q, want subject-1", identity.Subject)
+	}
+
+	idp.mu.Lock()
+	form := idp.tokenForms[0]
+	idp.mu.Unlock()
+	if form.Get("grant_type") != "authorization_code" || form.Get("redirect_uri") != testRedirectURI {
+		t.Errorf("token request = %v", form)
+	}
+	if form.Has("client_secret") {
+		t.Error("client_secret sent for a public client")
+	}
+
+	// A wrong verifier is refused by the provider and reported as an exchange failure
+	wrong := *flow
+	wrong.CodeVerifier = "not-the-verifier"
+	_, err = provider.Exchange("code-1", &wrong)
+	if err == nil || stderrors.Is(err, ErrOIDCIDToken) {
+		t.Fatalf("Exchange() with a wrong verifier error = %v, want a token endpoint failure", err)
+	}
+}
+
+// newTestCallbackApp registers the stand-in as the only provider and serves its callback
+func newTestCallbackApp(t *testing.T, idp *testIdP) *fiber.App {
+	t.Helper()
+
+	if err := InitOIDCProviders([]config.OIDCProvider{idp.provider().OIDCProvider}); err != nil {
+		t.Fatalf("InitOIDCProviders() error = %v", err)
+	}
+	previousSink := GetAuditSink()
+	SetAuditSink(NewFileAuditSink(filepath.Join(t.TempDir(), "audit.jsonl")))
+	t.Cleanup(func() {
+		InitOIDCProviders(nil)
+		SetAuditSink(previousSink)
+	})
+
+	app := fiber.New(fiber.Config{
+		ErrorHandler: errors.ErrorHandler(errors.ErrorResponseConfig{Logger: log.Printf}),
+	})
+	app.Get("/auth/oidc/:provider/callback", HandleOIDCCallback)
+	return app
+}
+
+func callback(t *testing.T, app *fiber.App, query url.Values, cookieState string) int {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/oidc/test/callback?"+query.Encode(), nil)
+	if cookieState != "" {
+		req.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: cookieState})
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("callback request failed: %v", err)
+	}
+	return resp.StatusCode
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	idp := newTestIdP(t)
+	app := newTestCallbackApp(t, idp)
+
+	t.Run("state cookie mismatch", func(t *testing.T) {
+		provider, _ := getOIDCProvider("test")
+		_, state, err := provider.AuthorizationURL(false)
+		if err != nil {
+			t.Fatalf("AuthorizationURL() error = %v", err)
+		}
+
+		status := callback(t, app, url.Values{"code": {"code-1"}, "state": {state}}, "another-state")
+		if status != http.StatusBadRequest {
+			t.Fatalf("status = %d, want 400", status)
+		}
+		// The mismatch does not burn the flow of the browser that started it
+		if _, err := oidcFlows.consume(state, "test"); err != nil {
+			t.Errorf("flow consumed by a mismatched callback: %v", err)
+		}
+	})
+
+	t.Run("unknown state", func(t *testing.T) {
+		status := callback(t, app, url.Values{"code": {"code-1"}, "state": {"forged"}}, "forged")
+		if status != http.StatusBadRequest {
+			t.Fatalf("status = %d, want 400", status)
+		}
+	})
+
+	t.Run("replayed state", func(t *testing.T) {
+		provider, _ := getOIDCProvider("test")
+		_, state, err := provider.AuthorizationURL(false)
+		if err != nil {
+			t.Fatalf("AuthorizationURL() error = %v", err)
+		}
+		if _, err := oidcFlows.consume(state, "test"); err != nil {
+			t.Fatalf("consume() error = %v", err)
+		}
+
+		status := callback(t, app, url.Values{"code": {"code-1"}, "state": {state}}, state)
+		if status != http.StatusBadRequest {
+			t.Fatalf("status = %d, want 400", status)
+		}
+	})
+
+	t.Run("invalid ID token", func(t *testing.T) {
+		provider, _ := getOIDCProvider("test")
+		_, state, err := provider.AuthorizationURL(false)
+		if err != nil {
+			t.Fatalf("AuthorizationURL() error = %v", err)
+		}
+		// Signed for another nonce, as a token replayed from a different login would be
+		token := idp.sign("key-1", idp.claims("other-login"))
+		idp.setTokenHandler(func(form url.Values) (int, map[string]any) {
+			return http.StatusOK, map[string]any{"id_token": token}
+		})
+
+		status := callback(t, app, url.Values{"code": {"code-1"}, "state": {state}}, state)
+		if status != http.StatusUnauthorized {
+			t.Fatalf("status = %d, want 401", status)
+		}
+	})
+
+	t.Run("provider error", func(t *testing.T) {
+		status := callback(t, app, url.Values{"error": {"access_denied"}}, "")
+		if status != http.StatusBadRequest {
+			t.Fatalf("status = %d, want 400", status)
+		}
+	})
+}
@@ -0,0 +1,530 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"greenvue/internal/db"
+	"greenvue/lib"
+	"greenvue/lib/errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	passkeysTable = "passkeys"
+
+	passkeyNameMaxLength = 64
+	defaultPasskeyName   = "Passkey"
+)
+
+// Passkey is a WebAuthn credential registered to a user
+type Passkey struct {
+	ID           uuid.UUID  `json:"id"`
+	UserID       uuid.UUID  `json:"user_id"`
+	CredentialID string     `json:"credential_id"` // base64url encoded
+	PublicKey    string     `json:"public_key"`    // base64url encoded COSE key
+	SignCount    int64      `json:"sign_count"`
+	AAGUID       string     `json:"aaguid"`
+	Transports   []string   `json:"transports"`
+	Name         string     `json:"name"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+}
+
+// passkeyResponse is a passkey as returned to the client, without key material
+type passkeyResponse struct {
+	ID         uuid.UUID  `json:"id"`
+	Name       string     `json:"name"`
+	Transports []string   `json:"transports"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func (p Passkey) response() passkeyResponse {
+	return passkeyResponse{
+		ID:         p.ID,
+		Name:       p.Name,
+		Transports: p.Transports,
+		CreatedAt:  p.CreatedAt,
+		LastUsedAt: p.LastUsedAt,
+	}
+}
+
+// getPasskeys fetches passkeys matching a PostgREST query
+func getPasskeys(query string) ([]Passkey, error) {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return nil, fmt.Errorf("database client not available")
+	}
+
+	data, err := client.GET(passkeysTable, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch passkeys: %w", err)
+	}
+
+	var passkeys []Passkey
+	if err := json.Unmarshal(data, &passkeys); err != nil {
+		return nil, fmt.Errorf("failed to parse passkeys: %w", err)
+	}
+	return passkeys, nil
+}
+
+// getUserPasskeys returns the passkeys of a user, oldest first
+func getUserPasskeys(userID uuid.UUID) ([]Passkey, error) {
+	return getPasskeys(fmt.Sprintf("user_id=eq.%s&order=created_at.asc", userID))
+}
+
+// getOwnedPasskey returns a passkey by ID if it belongs to the user
+func getOwnedPasskey(c *fiber.Ctx, userID uuid.UUID) (*Passkey, error) {
+	passkeyID, err := uuid.Parse(c.Params("passkey_id"))
+	if err != nil {
+		return nil, errors.BadRequest("Invalid passkey ID format")
+	}
+
+	passkeys, err := getPasskeys(fmt.Sprintf("id=eq.%s&user_id=eq.%s", passkeyID, userID))
+	if err != nil {
+		return nil, errors.InternalServerError(err.Error())
+	}
+	if len(passkeys) == 0 {
+		return nil, errors.NotFound("Passkey not found")
+	}
+	return &passkeys[0], nil
+}
+
+// credentialDescriptors lists passkeys in the form expected by allowCredentials/excludeCredentials
+func credentialDescriptors(passkeys []Passkey) []fiber.Map {
+	descriptors := make([]fiber.Map, 0, len(passkeys))
+	for _, passkey := range passkeys {
+		descriptor := fiber.Map{
+			"type": "public-key",
+			"id":   passkey.CredentialID,
+		}
+		if len(passkey.Transports) > 0 {
+			descriptor["transports"] = passkey.Transports
+		}
+		descriptors = append(descriptors, descriptor)
+	}
+	return descriptors
+}
+
+// normalizePasskeyName trims a user supplied name and applies the default
+func normalizePasskeyName(name string) (string, error) {
+	name = lib.SanitizeInput(strings.TrimSpace(name))
+	if name == "" {
+		return defaultPasskeyName, nil
+	}
+	if len(name) > passkeyNameMaxLength {
+		return "", errors.ValidationError(fmt.Sprintf("Name must be at most %d characters", passkeyNameMaxLength), "name")
+	}
+	return name, nil
+}
+
+// BeginPasskeyRegistration returns the options for navigator.credentials.create()
+func BeginPasskeyRegistration(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	settings := getWebAuthnSettings()
+	if settings.RPID == "" || len(settings.Origins) == 0 {
+		return errors.InternalServerError("Passkeys are not configured")
+	}
+
+	user, err := getUserRecord(claims.UserId)
+	if err != nil {
+		return err
+	}
+
+	existing, err := getUserPasskeys(claims.UserId)
+	if err != nil {
+		return errors.InternalServerError(err.Error())
+	}
+
+	challenge, err := webAuthnChallenges.issue(ceremonyCreate, claims.UserId)
+	if err != nil {
+		return errors.InternalServerError("Failed to create challenge")
+	}
+
+	displayName := user.Name
+	if displayName == "" {
+		displayName = user.Email
+	}
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"publicKey": fiber.Map{
+			"challenge": challenge,
+			"rp": fiber.Map{
+				"id":   settings.RPID,
+				"name": settings.RPName,
+			},
+			"user": fiber.Map{
+				"id":          base64.RawURLEncoding.EncodeToString(claims.UserId[:]),
+				"name":        user.Email,
+				"displayName": displayName,
+			},
+			"pubKeyCredParams": []fiber.Map{
+				{"type": "public-key", "alg": coseAlgES256},
+				{"type": "public-key", "alg": coseAlgEdDSA},
+				{"type": "public-key", "alg": coseAlgRS256},
+			},
+			"timeout":            webAuthnTimeout.Milliseconds(),
+			"attestation":        "none",
+			"excludeCredentials": credentialDescriptors(existing),
+			"authenticatorSelection": fiber.Map{
+				"residentKey":      "preferred",
+				"userVerification": "preferred",
+			},
+		},
+	})
+}
+
+// FinishPasskeyRegistration verifies the authenticator's response and stores the new passkey
+func FinishPasskeyRegistration(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	var payload struct {
+		Name       string              `json:"name"`
+		Credential PublicKeyCredential `json:"credential"`
+	}
+
+	if err := c.BodyParser(&payload); err != nil {
+		return errors.BadRequest("Invalid request format")
+	}
+
+	name, err := normalizePasskeyName(payload.Name)
+	if err != nil {
+		return err
+	}
+
+	challenge, credential, err := verifyRegistration(&payload.Credential, getWebAuthnSettings())
+	if err != nil {
+		return errors.BadRequest("Passkey registration failed: " + err.Error())
+	}
+	if challenge.UserID != claims.UserId {
+		return errors.Forbidden("Registration was started by another user")
+	}
+
+	credentialID := base64.RawURLEncoding.EncodeToString(credential.ID)
+
+	duplicates, err := getPasskeys(fmt.Sprintf("credential_id=eq.%s", credentialID))
+	if err != nil {
+		return errors.InternalServerError(err.Error())
+	}
+	if len(duplicates) > 0 {
+		return errors.AlreadyExists("This passkey is already registered")
+	}
+
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create database client")
+	}
+
+	transports := payload.Credential.Response.Transports
+	if transports == nil {
+		transports = []string{}
+	}
+
+	passkey := Passkey{
+		ID:           uuid.New(),
+		UserID:       claims.UserId,
+		CredentialID: credentialID,
+		PublicKey:    base64.RawURLEncoding.EncodeToString(credential.PublicKey),
+		SignCount:    int64(credential.SignCount),
+		AAGUID:       hex.EncodeToString(credential.AAGUID),
+		Transports:   transports,
+		Name:         name,
+		CreatedAt:    time.Now().UTC(),
+	}
+
+	if _, err := client.POST(passkeysTable, passkey); err != nil {
+		return errors.DatabaseError("Failed to store passkey: " + err.Error())
+	}
+
+	return errors.SuccessResponse(c, passkey.response())
+}
+
+// ListPasskeys returns the passkeys of the authenticated user
+func ListPasskeys(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	passkeys, err := getUserPasskeys(claims.UserId)
+	if err != nil {
+		return errors.InternalServerError(err.Error())
+	}
+
+	result := make([]passkeyResponse, 0, len(passkeys))
+	for _, passkey := range passkeys {
+		result = append(result, passkey.response())
+	}
+
+	return errors.SuccessResponse(c, result)
+}
+
+// RenamePasskey changes the display name of a passkey
+func RenamePasskey(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	var payload struct {
+		Name string `json:"name"`
+	}
+
+	if err := c.BodyParser(&payload); err != nil {
+		return errors.BadRequest("Invalid request format")
+	}
+
+	name, err := normalizePasskeyName(payload.Name)
+	if err != nil {
+		return err
+	}
+
+	passkey, err := getOwnedPasskey(c, claims.UserId)
+	if err != nil {
+		return err
+	}
+
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create database client")
+	}
+
+	if _, err := client.PATCH(passkeysTable, passkey.ID, map[string]any{"name": name}); err != nil {
+		return errors.DatabaseError("Failed to rename passkey: " + err.Error())
+	}
+
+	passkey.Name = name
+	return errors.SuccessResponse(c, passkey.response())
+}
+
+// DeletePasskey removes a passkey from the authenticated user's account
+func DeletePasskey(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	passkey, err := getOwnedPasskey(c, claims.UserId)
+	if err != nil {
+		return err
+	}
+
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create database client")
+	}
+
+	if _, err := client.DELETE(passkeysTable, fmt.Sprintf("id=eq.%s", passkey.ID)); err != nil {
+		return errors.DatabaseError("Failed to delete passkey: " + err.Error())
+	}
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"message": "Passkey deleted successfully",
+	})
+}
+
+// BeginPasskeyLogin returns the options for navigator.credentials.get().
+// Without an mfaToken this is a passwordless login with a discoverable credential;
+// with one, the passkey is used as the second factor of a password login.
+func BeginPasskeyLogin(c *fiber.Ctx) error {
+	var payload struct {
+		MFAToken string `json:"mfaToken"`
+	}
+
+	// An empty body is a passwordless login
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&payload); err != nil {
+			return errors.BadRequest("Invalid request format")
+		}
+	}
+	payload.MFAToken = mfaTokenFromRequest(c, payload.MFAToken)
+
+	settings := getWebAuthnSettings()
+	if settings.RPID == "" || len(settings.Origins) == 0 {
+		return errors.InternalServerError("Passkeys are not configured")
+	}
+
+	userID := uuid.Nil
+	allowCredentials := []fiber.Map{}
+	userVerification := "required"
+
+	if payload.MFAToken != "" {
+		claims, err := ValidateToken(payload.MFAToken, TokenTypeMFAPending)
+		if err != nil {
+			return errors.Unauthorized("Invalid or expired MFA token")
+		}
+
+		passkeys, err := getUserPasskeys(claims.UserId)
+		if err != nil {
+			return errors.InternalServerError(err.Error())
+		}
+		if len(passkeys) == 0 {
+			return errors.BadRequest("No passkeys registered for this account")
+		}
+
+		userID = claims.UserId
+		allowCredentials = credentialDescriptors(passkeys)
+		userVerification = "preferred" // The password already counts as one factor
+	}
+
+	challenge, err := webAuthnChallenges.issue(ceremonyGet, userID)
+	if err != nil {
+		return errors.InternalServerError("Failed to create challenge")
+	}
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"publicKey": fiber.Map{
+			"challenge":        challenge,
+			"rpId":             settings.RPID,
+			"timeout":          webAuthnTimeout.Milliseconds(),
+			"allowCredentials": allowCredentials,
+			"userVerification": userVerification,
+		},
+	})
+}
+
+// FinishPasskeyLogin verifies a passkey assertion and signs the user in
+func FinishPasskeyLogin(c *fiber.Ctx) error {
+	var payload struct {
+		MFAToken   string              `json:"mfaToken"`
+		Credential PublicKeyCredential `json:"credential"`
+	}
+
+	if err := c.BodyParser(&payload); err != nil {
+		return errors.BadRequest("Invalid request format")
+	}
+	payload.MFAToken = mfaTokenFromRequest(c, payload.MFAToken)
+
+	settings := getWebAuthnSettings()
+
+	credentialID, err := payload.Credential.credentialID()
+	if err != nil {
+		return errors.BadRequest("Invalid passkey response")
+	}
+
+	challenge, clientDataHash, err := verifyClientData(payload.Credential.Response.ClientDataJSON, ceremonyGet, settings)
+	if err != nil {
+		return errors.Unauthorized("Passkey login failed: " + err.Error())
+	}
+
+	// A challenge bound to a user belongs to the second step of a password login
+	secondFactor := challenge.UserID != uuid.Nil
+	var (
+		mfaClaims *Claims
+		address   string
+	)
+	if secondFactor {
+		mfaClaims, err = ValidateToken(payload.MFAToken, TokenTypeMFAPending)
+		if err != nil || mfaClaims.UserId != challenge.UserID {
+			return errors.Unauthorized("Invalid or expired MFA token")
+		}
+		if !mfaAttempts.allow(mfaClaims.ID, mfaClaims.ExpiresAt.Time) {
+			return errors.TooManyRequests("Too many invalid codes, please log in again")
+		}
+		if address, err = guardMFALogin(c, mfaClaims.UserId); err != nil {
+			return err
+		}
+	}
+
+	// failSecondFactor counts a wrong passkey against the pending login and the account
+	failSecondFactor := func() {
+		if secondFactor {
+			mfaAttempts.fail(mfaClaims.ID)
+			recordLoginFailure(c, address)
+		}
+	}
+
+	passkeys, err := getPasskeys(fmt.Sprintf("credential_id=eq.%s", base64.RawURLEncoding.EncodeToString(credentialID)))
+	if err != nil {
+		return errors.InternalServerError(err.Error())
+	}
+	if len(passkeys) == 0 {
+		failSecondFactor()
+		return errors.Unauthorized("Unknown passkey")
+	}
+	passkey := passkeys[0]
+
+	if secondFactor && passkey.UserID != challenge.UserID {
+		failSecondFactor()
+		return errors.Unauthorized("Passkey belongs to another account")
+	}
+
+	// Discoverable credentials report the user handle we set at registration
+	if userHandle := payload.Credential.Response.UserHandle; userHandle != "" {
+		handle, err := decodeBase64URL(userHandle)
+		if err != nil || string(handle) != string(passkey.UserID[:]) {
+			failSecondFactor()
+			return errors.Unauthorized("Passkey belongs to another account")
+		}
+	}
+
+	publicKey, err := decodeBase64URL(passkey.PublicKey)
+	if err != nil {
+		return errors.InternalServerError("Stored passkey is corrupt")
+	}
+
+	authData, err := verifyAssertion(&payload.Credential, clientDataHash, publicKey, uint32(passkey.SignCount), !secondFactor, settings)
+	if err != nil {
+		failSecondFactor()
+		if err == ErrSignCount {
+			log.Printf("Passkey %s of user %s reported a non-increasing sign count", passkey.ID, passkey.UserID)
+		}
+		auditFailure(c, AuditLogin, &passkey.UserID, "", "passkey: "+err.Error())
+		return errors.Unauthorized("Passkey login failed: " + err.Error())
+	}
+
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create database client")
+	}
+
+	// Only update if nobody else used the passkey in the meantime
+	now := time.Now().UTC()
+	data, err := client.PATCHWhere(passkeysTable, fmt.Sprintf("id=eq.%s&sign_count=eq.%d", passkey.ID, passkey.SignCount), map[string]any{
+		"sign_count":   authData.SignCount,
+		"last_used_at": now,
+	})
+	if err != nil {
+		return errors.DatabaseError("Failed to update passkey: " + err.Error())
+	}
+	if len(data) == 0 || string(data) == "[]" {
+		return errors.Unauthorized("Passkey was used concurrently, please try again")
+	}
+
+	if secondFactor {
+		mfaAttempts.consume(mfaClaims.ID)
+		resetLoginFailures(address)
+	}
+
+	tokens, err := GenerateTokenPair(passkey.UserID, "", DeviceFromContext(c))
+	if err != nil {
+		return errors.InternalServerError("Failed to generate tokens")
+	}
+
+	SetAuthCookies(c, tokens)
+	if secondFactor {
+		clearMFATokenCookie(c)
+	}
+	auditUserAction(c, AuditLogin, passkey.UserID, map[string]any{"method": "passkey", "second_factor": secondFactor})
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"userId":       passkey.UserID,
+		"accessToken":  tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken,
+		"expiresIn":    tokens.ExpiresIn,
+	})
+}
@@ -28,6 +28,11 @@ func SendResetPasswordEmail(c *fiber.Ctx) error {
 	if valid, reason := validation.ValidateEmail(payload.Email); !valid {
 		return errors.BadRequest("Invalid email format: " + reason)
 	}
+
+	if err := guardEmailRequest(c, "password_reset", payload.Email); err != nil {
+		return err
+	}
+
 	// Queue a password reset email to be sent asynchronously
 	resetEmail := email.Email{
 		ID:         lib.GenerateUUID(),
@@ -41,6 +46,8 @@ func SendResetPasswordEmail(c *fiber.Ctx) error {
 	if err := email.QueueEmail(resetEmail); err != nil {
 		return errors.InternalServerError("Failed to queue password reset email: " + err.Error())
 	}
+	RecordAudit(c, AuditEvent{Action: AuditPasswordReset, Target: payload.Email})
+
 	return errors.SuccessResponse(c, fiber.Map{
 		"message": "Password reset email has been queued successfully. Please check your inbox shortly.",
 	})
@@ -74,6 +81,7 @@ func ChangePassword(c *fiber.Ctx) error {
 	})
 
 	if err != nil {
+		auditFailure(c, AuditPasswordChange, &claims.UserId, "", err.Error())
 		return errors.InternalServerError("Failed to update user: " + err.Error())
 	}
 
@@ -81,6 +89,10 @@ func ChangePassword(c *fiber.Ctx) error {
 		return errors.NotFound("User not found")
 	}
 
+	// Sign out every other device, the session that changed the password stays active
+	revokeOtherSessions(claims.UserId, claims.SessionID)
+	auditUserAction(c, AuditPasswordChange, claims.UserId, nil)
+
 	return errors.SuccessResponse(c, fiber.Map{
 		"message": "Password changed successfully",
 	})
@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"greenvue/internal/db"
+	"greenvue/lib/errors"
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Roles a user can have, stored in users.role
+const (
+	RoleUser      = "user"
+	RoleSupport   = "support"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Permission is a single capability that routes can require
+type Permission string
+
+const (
+	PermViewJobs        Permission = "jobs:read"
+	PermManageJobs      Permission = "jobs:manage"
+	PermDebug           Permission = "debug:access"
+	PermModerateContent Permission = "content:moderate"
+	PermViewUsers       Permission = "users:read"
+	PermManageRoles     Permission = "roles:manage"
+	PermViewAudit       Permission = "audit:read"
+)
+
+// rolePermissions maps each role to the permissions it grants.
+// Regular users have no extra permissions; everything they can do is checked by ownership.
+var rolePermissions = map[string][]Permission{
+	RoleUser:      {},
+	RoleSupport:   {PermViewUsers, PermViewJobs, PermViewAudit},
+	RoleModerator: {PermModerateContent, PermViewUsers},
+	RoleAdmin: {
+		PermViewJobs,
+		PermManageJobs,
+		PermDebug,
+		PermModerateContent,
+		PermViewUsers,
+		PermManageRoles,
+		PermViewAudit,
+	},
+}
+
+// IsValidRole reports whether a role is known
+func IsValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// HasPermission reports whether a role grants a permission.
+// Unknown roles, including the "authenticated" role of older tokens, grant nothing.
+func HasPermission(role string, permission Permission) bool {
+	for _, granted := range rolePermissions[role] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// RequirePermission allows the request only if the authenticated user's role grants every permission.
+// A demotion revokes the user's sessions, and AuthMiddleware rejects access tokens of revoked
+// sessions, so staff access ends before the access token expires.
+// It must run after AuthMiddleware.
+func RequirePermission(permissions ...Permission) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		claims, ok := c.Locals("user").(*Claims)
+		if !ok || claims == nil {
+			return errors.Unauthorized("User not authenticated")
+		}
+
+		for _, permission := range permissions {
+			if !HasPermission(claims.Role, permission) {
+				return errors.Forbidden(fmt.Sprintf("Missing permission: %s", permission))
+			}
+		}
+
+		return c.Next()
+	}
+}
+
+// requireActiveSession checks that the session a token was issued for has not been revoked
+func requireActiveSession(claims *Claims) error {
+	if claims.SessionID == uuid.Nil {
+		return errors.Unauthorized("Session has ended, please log in again")
+	}
+
+	session, err := GetTokenStore().GetSession(claims.SessionID)
+	if err == ErrTokenRevoked || (err == nil && session.UserID != claims.UserId) {
+		return errors.Unauthorized("Session has ended, please log in again")
+	}
+	if err != nil {
+		log.Printf("Failed to check session %s: %v", claims.SessionID, err)
+		return errors.InternalServerError("Failed to check session")
+	}
+	return nil
+}
+
+// getUserRole reads a user's role, falling back to RoleUser when it is missing or unknown
+func getUserRole(userID uuid.UUID) (string, error) {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return RoleUser, fmt.Errorf("database client not available")
+	}
+
+	data, err := client.GET("users", fmt.Sprintf("id=eq.%s&select=role", userID))
+	if err != nil {
+		return RoleUser, fmt.Errorf("failed to fetch user role: %w", err)
+	}
+
+	var rows []struct {
+		Role string `json:"role"`
+	}
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return RoleUser, fmt.Errorf("failed to parse user role: %w", err)
+	}
+
+	if len(rows) == 0 || !IsValidRole(rows[0].Role) {
+		return RoleUser, nil
+	}
+	return rows[0].Role, nil
+}
+
+// roleForToken returns the role to embed in new tokens; errors fall back to the least privileged role
+func roleForToken(userID uuid.UUID) string {
+	role, err := getUserRole(userID)
+	if err != nil {
+		log.Printf("Failed to load role for user %s, issuing token as %q: %v", userID, RoleUser, err)
+	}
+	return role
+}
+
+// losesPermissions reports whether changing from one role to another removes any permission
+func losesPermissions(from, to string) bool {
+	for _, permission := range rolePermissions[from] {
+		if !HasPermission(to, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetUserRole lets an admin change the role of another user
+func SetUserRole(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	userID, err := uuid.Parse(c.Params("user_id"))
+	if err != nil {
+		return errors.BadRequest("Invalid user ID format")
+	}
+
+	// Prevents admins from accidentally removing their own access
+	if userID == claims.UserId {
+		return errors.Forbidden("You cannot change your own role")
+	}
+
+	var payload struct {
+		Role string `json:"role"`
+	}
+
+	if err := c.BodyParser(&payload); err != nil {
+		return errors.BadRequest("Invalid request format")
+	}
+
+	role := strings.ToLower(strings.TrimSpace(payload.Role))
+	if !IsValidRole(role) {
+		return errors.ValidationError("Role must be one of user, support, moderator or admin", "role")
+	}
+
+	previous, err := getUserRole(userID)
+	if err != nil {
+		return errors.InternalServerError(err.Error())
+	}
+
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create database client")
+	}
+
+	data, err := client.PATCH("users", userID, map[string]any{"role": role})
+	if err != nil {
+		return errors.DatabaseError("Failed to update role: " + err.Error())
+	}
+	if len(data) == 0 || string(data) == "[]" {
+		return errors.NotFound("User not found")
+	}
+
+	// Roles are embedded in tokens. Revoking the sessions stops refreshes, and RequirePermission
+	// rejects access tokens whose session is gone, so a demotion takes effect right away
+	if losesPermissions(previous, role) {
+		if err := GetTokenStore().RevokeUser(userID); err != nil {
+			log.Printf("Failed to revoke sessions of user %s after role change: %v", userID, err)
+		}
+	}
+
+	log.Printf("User %s changed role of user %s from %q to %q", claims.UserId, userID, previous, role)
+	RecordAudit(c, AuditEvent{
+		Action:   AuditRoleChange,
+		TargetID: &userID,
+		Metadata: map[string]any{"from": previous, "to": role},
+	})
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"user_id": userID,
+		"role":    role,
+	})
+}
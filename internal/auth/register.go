@@ -2,14 +2,10 @@ package auth
 
 import (
 	"encoding/json"
-	"fmt"
 	"greenvue/internal/db"
 	"greenvue/lib"
 	"greenvue/lib/errors"
 	"greenvue/lib/validation"
-	"log"
-	"net/url"
-	"os"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
@@ -102,7 +98,7 @@ func RegisterUser(c *fiber.Ctx) error {
 	}
 
 	// Generate JWT tokens for the new user
-	tokens, err := GenerateTokenPair(user.ID, user.Email)
+	tokens, err := GenerateTokenPair(user.ID, user.Email, DeviceFromContext(c))
 	if err != nil {
 		return errors.InternalServerError("Failed to generate authentication tokens")
 	}
@@ -118,30 +114,3 @@ func RegisterUser(c *fiber.Ctx) error {
 		"expiresIn":    tokens.ExpiresIn,
 	})
 }
-
-// HandleGoogleRegistrationStart initiates the OAuth flow for Google registration
-func HandleGoogleRegistrationStart(c *fiber.Ctx) error {
-	// Build the Google OAuth URL
-	clientID := os.Getenv("GOOGLE_CLIENT_ID")
-	redirectURI := os.Getenv("REDIRECT_URI")
-	state := "register" // This state indicates registration vs login
-
-	// If testing locally, make sure the redirect URI is properly set
-	if redirectURI == "" {
-		log.Println("Warning: REDIRECT_URI is not set. Using default callback URL.")
-		frontendURL := c.Query("redirect_uri", "https://api.greenvue.eu/auth/callback/google")
-		redirectURI = fmt.Sprintf("%s/auth/callback/google", frontendURL)
-	}
-
-	// Build the authorization URL with specific scopes
-	authURL := fmt.Sprintf(
-		"https://accounts.google.com/o/oauth2/auth?client_id=%s&redirect_uri=%s&response_type=code&scope=%s&state=%s",
-		clientID,
-		url.QueryEscape(redirectURI),
-		url.QueryEscape("profile email"),
-		state,
-	)
-
-	// Redirect the user to Google's OAuth page
-	return c.Redirect(authURL, fiber.StatusTemporaryRedirect)
-}
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"greenvue/lib/errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// SessionDevice holds the client details recorded for a session
+type SessionDevice struct {
+	IP        string
+	UserAgent string
+}
+
+// DeviceFromContext extracts the client IP and user agent of a request
+func DeviceFromContext(c *fiber.Ctx) SessionDevice {
+	return SessionDevice{
+		IP:        c.IP(),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+	}
+}
+
+// describeDevice turns a user agent into a short human readable label such as "Chrome on Windows"
+func describeDevice(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+
+	ua := strings.ToLower(userAgent)
+
+	browser := "Unknown browser"
+	switch {
+	case strings.Contains(ua, "okhttp"), strings.Contains(ua, "expo"), strings.Contains(ua, "cfnetwork"):
+		browser = "GreenVue app"
+	case strings.Contains(ua, "edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "opr/"), strings.Contains(ua, "opera"):
+		browser = "Opera"
+	case strings.Contains(ua, "firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "chrome/"), strings.Contains(ua, "crios/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "safari/"):
+		browser = "Safari"
+	case strings.Contains(ua, "curl/"), strings.Contains(ua, "postman"):
+		browser = "API client"
+	}
+
+	platform := "unknown OS"
+	switch {
+	case strings.Contains(ua, "iphone"), strings.Contains(ua, "ipad"), strings.Contains(ua, "ios"):
+		platform = "iOS"
+	case strings.Contains(ua, "android"):
+		platform = "Android"
+	case strings.Contains(ua, "windows"):
+		platform = "Windows"
+	case strings.Contains(ua, "mac os"), strings.Contains(ua, "macintosh"):
+		platform = "macOS"
+	case strings.Contains(ua, "linux"):
+		platform = "Linux"
+	}
+
+	return browser + " on " + platform
+}
+
+// startSession records a new session for a refresh token family
+func startSession(userID uuid.UUID, familyID uuid.UUID, device SessionDevice) error {
+	now := time.Now().UTC()
+	return GetTokenStore().CreateSession(Session{
+		ID:         familyID,
+		UserID:     userID,
+		Device:     describeDevice(device.UserAgent),
+		UserAgent:  device.UserAgent,
+		IP:         device.IP,
+		CreatedAt:  now,
+		LastUsedAt: now,
+	})
+}
+
+// PruneSessions removes expired refresh tokens and sessions from the token store
+func PruneSessions() error {
+	return GetTokenStore().Prune()
+}
+
+// sessionResponse is a session as returned to the client
+type sessionResponse struct {
+	Session
+	Current bool `json:"current"`
+}
+
+// GetSessions lists the active sessions of the authenticated user
+func GetSessions(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	sessions, err := GetTokenStore().ListSessions(claims.UserId)
+	if err != nil {
+		return errors.InternalServerError("Failed to fetch sessions: " + err.Error())
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+
+	result := make([]sessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		result = append(result, sessionResponse{
+			Session: session,
+			Current: session.ID == claims.SessionID,
+		})
+	}
+
+	return errors.SuccessResponse(c, result)
+}
+
+// RevokeSession signs out a single session of the authenticated user
+func RevokeSession(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	sessionID, err := uuid.Parse(c.Params("session_id"))
+	if err != nil {
+		return errors.BadRequest("Invalid session ID format")
+	}
+
+	store := GetTokenStore()
+	session, err := store.GetSession(sessionID)
+	if err != nil {
+		if err == ErrTokenRevoked {
+			return errors.NotFound("Session not found")
+		}
+		return errors.InternalServerError("Failed to fetch session: " + err.Error())
+	}
+
+	// Do not reveal whether sessions of other users exist
+	if session.UserID != claims.UserId {
+		return errors.NotFound("Session not found")
+	}
+
+	if err := store.RevokeFamily(sessionID); err != nil {
+		return errors.InternalServerError("Failed to revoke session: " + err.Error())
+	}
+
+	// Revoking the current session is the same as logging out
+	if sessionID == claims.SessionID {
+		ClearAuthCookies(c)
+	}
+	auditUserAction(c, AuditSessionRevoke, claims.UserId, map[string]any{"session_id": sessionID})
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"message": "Session revoked successfully",
+	})
+}
+
+// RevokeOtherSessions signs out every session of the authenticated user except the current one
+func RevokeOtherSessions(c *fiber.Ctx) error {
+	claims, ok := c.Locals("user").(*Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	if err := GetTokenStore().RevokeUserExcept(claims.UserId, claims.SessionID); err != nil {
+		return errors.InternalServerError("Failed to revoke sessions: " + err.Error())
+	}
+	auditUserAction(c, AuditSessionRevoke, claims.UserId, map[string]any{"all_other_sessions": true})
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"message": "All other sessions have been revoked",
+	})
+}
+
+// revokeOtherSessions is used after security sensitive changes, failures are logged but not returned
+func revokeOtherSessions(userID uuid.UUID, currentSessionID uuid.UUID) {
+	if err := GetTokenStore().RevokeUserExcept(userID, currentSessionID); err != nil {
+		log.Printf("Failed to revoke other sessions for user %s: %v", userID, err)
+	}
+}
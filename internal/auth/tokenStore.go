@@ -0,0 +1,517 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"greenvue/internal/db"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrTokenRevoked = errors.New("refresh token has been revoked")
+	ErrTokenReused  = errors.New("refresh token reuse detected")
+)
+
+// RefreshTokenRecord is the server-side state of an issued refresh token.
+// Every login starts a new family; each refresh rotates to a new token in the same family.
+type RefreshTokenRecord struct {
+	ID         uuid.UUID  `json:"id"` // The token's jti
+	UserID     uuid.UUID  `json:"user_id"`
+	FamilyID   uuid.UUID  `json:"family_id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	UsedAt     *time.Time `json:"used_at,omitempty"`
+	ReplacedBy *uuid.UUID `json:"replaced_by,omitempty"`
+}
+
+// Session describes a single login (one refresh token family) and the device it came from
+type Session struct {
+	ID         uuid.UUID `json:"id"` // Same as the refresh token family ID
+	UserID     uuid.UUID `json:"user_id"`
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// TokenStore persists refresh token records and sessions so they can be rotated and revoked
+type TokenStore interface {
+	// Save stores a newly issued refresh token
+	Save(record RefreshTokenRecord) error
+	// Get returns the record for a token, or ErrTokenRevoked if it is unknown
+	Get(id uuid.UUID) (*RefreshTokenRecord, error)
+	// MarkUsed atomically marks a token as rotated, returning ErrTokenReused if it was already used
+	MarkUsed(id uuid.UUID, replacedBy uuid.UUID) error
+	// RevokeFamily revokes every token that descends from the same login
+	RevokeFamily(familyID uuid.UUID) error
+	// RevokeUser revokes every refresh token of a user
+	RevokeUser(userID uuid.UUID) error
+	// RevokeUserExcept revokes every refresh token of a user outside the given family
+	RevokeUserExcept(userID uuid.UUID, keepFamilyID uuid.UUID) error
+
+	// CreateSession records a new session for a refresh token family
+	CreateSession(session Session) error
+	// TouchSession updates the last-used time and client details of a session
+	TouchSession(id uuid.UUID, ip, userAgent string) error
+	// GetSession returns a session by ID, or ErrTokenRevoked if it does not exist
+	GetSession(id uuid.UUID) (*Session, error)
+	// ListSessions returns all active sessions of a user
+	ListSessions(userID uuid.UUID) ([]Session, error)
+
+	// Prune deletes expired refresh tokens and the sessions that no longer have a live token
+	Prune() error
+}
+
+var (
+	tokenStore   TokenStore
+	tokenStoreMu sync.RWMutex
+)
+
+// InitTokenStore configures the refresh token store by name ("memory" or "database")
+func InitTokenStore(kind string) {
+	switch kind {
+	case "database":
+		SetTokenStore(NewDatabaseTokenStore())
+	case "memory", "":
+		SetTokenStore(NewMemoryTokenStore())
+	default:
+		log.Printf("Warning: unknown token store %q, falling back to memory", kind)
+		SetTokenStore(NewMemoryTokenStore())
+	}
+}
+
+// SetTokenStore replaces the refresh token store
+func SetTokenStore(store TokenStore) {
+	tokenStoreMu.Lock()
+	defer tokenStoreMu.Unlock()
+	tokenStore = store
+}
+
+// GetTokenStore returns the configured refresh token store, defaulting to an in-memory store
+func GetTokenStore() TokenStore {
+	tokenStoreMu.RLock()
+	if tokenStore != nil {
+		defer tokenStoreMu.RUnlock()
+		return tokenStore
+	}
+	tokenStoreMu.RUnlock()
+
+	tokenStoreMu.Lock()
+	defer tokenStoreMu.Unlock()
+
+	if tokenStore == nil {
+		tokenStore = NewMemoryTokenStore()
+	}
+
+	return tokenStore
+}
+
+// MemoryTokenStore keeps refresh tokens in process memory.
+// Tokens are lost on restart, which logs every user out.
+type MemoryTokenStore struct {
+	records    map[uuid.UUID]RefreshTokenRecord
+	sessions   map[uuid.UUID]Session
+	mu         sync.Mutex
+	cleanupDue time.Time
+}
+
+// NewMemoryTokenStore creates an empty in-memory token store
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{
+		records:    make(map[uuid.UUID]RefreshTokenRecord),
+		sessions:   make(map[uuid.UUID]Session),
+		cleanupDue: time.Now().Add(5 * time.Minute),
+	}
+}
+
+func (m *MemoryTokenStore) Save(record RefreshTokenRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if now.After(m.cleanupDue) {
+		m.cleanup(now)
+	}
+
+	m.records[record.ID] = record
+	return nil
+}
+
+func (m *MemoryTokenStore) Get(id uuid.UUID) (*RefreshTokenRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record, ok := m.records[id]
+	if !ok || time.Now().After(record.ExpiresAt) {
+		return nil, ErrTokenRevoked
+	}
+
+	return &record, nil
+}
+
+func (m *MemoryTokenStore) MarkUsed(id uuid.UUID, replacedBy uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record, ok := m.records[id]
+	if !ok {
+		return ErrTokenRevoked
+	}
+	if record.UsedAt != nil {
+		return ErrTokenReused
+	}
+
+	now := time.Now().UTC()
+	record.UsedAt = &now
+	record.ReplacedBy = &replacedBy
+	m.records[id] = record
+	return nil
+}
+
+func (m *MemoryTokenStore) RevokeFamily(familyID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, record := range m.records {
+		if record.FamilyID == familyID {
+			delete(m.records, id)
+		}
+	}
+	delete(m.sessions, familyID)
+	return nil
+}
+
+func (m *MemoryTokenStore) RevokeUser(userID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, record := range m.records {
+		if record.UserID == userID {
+			delete(m.records, id)
+		}
+	}
+	for id, session := range m.sessions {
+		if session.UserID == userID {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryTokenStore) RevokeUserExcept(userID uuid.UUID, keepFamilyID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, record := range m.records {
+		if record.UserID == userID && record.FamilyID != keepFamilyID {
+			delete(m.records, id)
+		}
+	}
+	for id, session := range m.sessions {
+		if session.UserID == userID && id != keepFamilyID {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryTokenStore) CreateSession(session Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[session.ID] = session
+	return nil
+}
+
+func (m *MemoryTokenStore) TouchSession(id uuid.UUID, ip, userAgent string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[id]
+	if !ok {
+		return ErrTokenRevoked
+	}
+
+	session.LastUsedAt = time.Now().UTC()
+	session.IP = ip
+	session.UserAgent = userAgent
+	session.Device = describeDevice(userAgent)
+	m.sessions[id] = session
+	return nil
+}
+
+func (m *MemoryTokenStore) GetSession(id uuid.UUID) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrTokenRevoked
+	}
+	return &session, nil
+}
+
+func (m *MemoryTokenStore) ListSessions(userID uuid.UUID) ([]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sessions := make([]Session, 0)
+	for _, session := range m.sessions {
+		if session.UserID == userID {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (m *MemoryTokenStore) Prune() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cleanup(time.Now())
+	return nil
+}
+
+// cleanup removes expired records and sessions without live tokens, the caller must hold the lock
+func (m *MemoryTokenStore) cleanup(now time.Time) {
+	liveFamilies := make(map[uuid.UUID]bool)
+	for id, record := range m.records {
+		if now.After(record.ExpiresAt) {
+			delete(m.records, id)
+			continue
+		}
+		liveFamilies[record.FamilyID] = true
+	}
+	for id := range m.sessions {
+		if !liveFamilies[id] {
+			delete(m.sessions, id)
+		}
+	}
+	m.cleanupDue = now.Add(5 * time.Minute)
+}
+
+// DatabaseTokenStore keeps refresh tokens in the refresh_tokens table and sessions in the sessions table
+type DatabaseTokenStore struct {
+	table         string
+	sessionsTable string
+}
+
+// NewDatabaseTokenStore creates a token store backed by Supabase
+func NewDatabaseTokenStore() *DatabaseTokenStore {
+	return &DatabaseTokenStore{
+		table:         "refresh_tokens",
+		sessionsTable: "sessions",
+	}
+}
+
+func (d *DatabaseTokenStore) client() (*db.SupabaseClient, error) {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return nil, fmt.Errorf("database client not available")
+	}
+	return client, nil
+}
+
+func (d *DatabaseTokenStore) Save(record RefreshTokenRecord) error {
+	client, err := d.client()
+	if err != nil {
+		return err
+	}
+
+	if _, err := client.POST(d.table, record); err != nil {
+		return fmt.Errorf("failed to store refresh token: %w", err)
+	}
+	return nil
+}
+
+func (d *DatabaseTokenStore) Get(id uuid.UUID) (*RefreshTokenRecord, error) {
+	client, err := d.client()
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf("id=eq.%s&expires_at=gt.%s", id, time.Now().UTC().Format(time.RFC3339))
+	data, err := client.GET(d.table, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch refresh token: %w", err)
+	}
+
+	var records []RefreshTokenRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse refresh token: %w", err)
+	}
+
+	if len(records) == 0 {
+		return nil, ErrTokenRevoked
+	}
+
+	return &records[0], nil
+}
+
+func (d *DatabaseTokenStore) MarkUsed(id uuid.UUID, replacedBy uuid.UUID) error {
+	client, err := d.client()
+	if err != nil {
+		return err
+	}
+
+	// Only update the row if it has not been used yet, so concurrent rotations cannot both succeed
+	data, err := client.PATCHWhere(d.table, fmt.Sprintf("id=eq.%s&used_at=is.null", id), map[string]any{
+		"used_at":     time.Now().UTC(),
+		"replaced_by": replacedBy,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark refresh token as used: %w", err)
+	}
+
+	if len(data) == 0 || string(data) == "[]" {
+		return ErrTokenReused
+	}
+	return nil
+}
+
+func (d *DatabaseTokenStore) RevokeFamily(familyID uuid.UUID) error {
+	client, err := d.client()
+	if err != nil {
+		return err
+	}
+
+	if _, err := client.DELETE(d.table, fmt.Sprintf("family_id=eq.%s", familyID)); err != nil {
+		return fmt.Errorf("failed to revoke token family: %w", err)
+	}
+	if _, err := client.DELETE(d.sessionsTable, fmt.Sprintf("id=eq.%s", familyID)); err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	return nil
+}
+
+func (d *DatabaseTokenStore) RevokeUser(userID uuid.UUID) error {
+	client, err := d.client()
+	if err != nil {
+		return err
+	}
+
+	if _, err := client.DELETE(d.table, fmt.Sprintf("user_id=eq.%s", userID)); err != nil {
+		return fmt.Errorf("failed to revoke user tokens: %w", err)
+	}
+	if _, err := client.DELETE(d.sessionsTable, fmt.Sprintf("user_id=eq.%s", userID)); err != nil {
+		return fmt.Errorf("failed to delete user sessions: %w", err)
+	}
+	return nil
+}
+
+func (d *DatabaseTokenStore) RevokeUserExcept(userID uuid.UUID, keepFamilyID uuid.UUID) error {
+	client, err := d.client()
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("user_id=eq.%s&family_id=neq.%s", userID, keepFamilyID)
+	if _, err := client.DELETE(d.table, query); err != nil {
+		return fmt.Errorf("failed to revoke user tokens: %w", err)
+	}
+
+	query = fmt.Sprintf("user_id=eq.%s&id=neq.%s", userID, keepFamilyID)
+	if _, err := client.DELETE(d.sessionsTable, query); err != nil {
+		return fmt.Errorf("failed to delete user sessions: %w", err)
+	}
+	return nil
+}
+
+func (d *DatabaseTokenStore) CreateSession(session Session) error {
+	client, err := d.client()
+	if err != nil {
+		return err
+	}
+
+	if _, err := client.POST(d.sessionsTable, session); err != nil {
+		return fmt.Errorf("failed to store session: %w", err)
+	}
+	return nil
+}
+
+func (d *DatabaseTokenStore) TouchSession(id uuid.UUID, ip, userAgent string) error {
+	client, err := d.client()
+	if err != nil {
+		return err
+	}
+
+	if _, err := client.PATCH(d.sessionsTable, id, map[string]any{
+		"last_used_at": time.Now().UTC(),
+		"ip":           ip,
+		"user_agent":   userAgent,
+		"device":       describeDevice(userAgent),
+	}); err != nil {
+		return fmt.Errorf("failed to update session: %w", err)
+	}
+	return nil
+}
+
+func (d *DatabaseTokenStore) GetSession(id uuid.UUID) (*Session, error) {
+	client, err := d.client()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := client.GET(d.sessionsTable, fmt.Sprintf("id=eq.%s", id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch session: %w", err)
+	}
+
+	var sessions []Session
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, fmt.Errorf("failed to parse session: %w", err)
+	}
+
+	if len(sessions) == 0 {
+		return nil, ErrTokenRevoked
+	}
+	return &sessions[0], nil
+}
+
+func (d *DatabaseTokenStore) ListSessions(userID uuid.UUID) ([]Session, error) {
+	client, err := d.client()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := client.GET(d.sessionsTable, fmt.Sprintf("user_id=eq.%s&order=last_used_at.desc", userID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch sessions: %w", err)
+	}
+
+	var sessions []Session
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, fmt.Errorf("failed to parse sessions: %w", err)
+	}
+
+	if sessions == nil {
+		sessions = []Session{}
+	}
+	return sessions, nil
+}
+
+func (d *DatabaseTokenStore) Prune() error {
+	client, err := d.client()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if _, err := client.DELETE(d.table, fmt.Sprintf("expires_at=lt.%s", now.Format(time.RFC3339))); err != nil {
+		return fmt.Errorf("failed to delete expired refresh tokens: %w", err)
+	}
+
+	// Every rotation touches the session, so the newest token of a session expires one
+	// refresh lifetime after its last use at the latest
+	cutoff := now.Add(-time.Duration(RefreshCookieMaxAge) * time.Second)
+	if _, err := client.DELETE(d.sessionsTable, fmt.Sprintf("last_used_at=lt.%s", cutoff.Format(time.RFC3339))); err != nil {
+		return fmt.Errorf("failed to delete expired sessions: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func TestAuthMiddlewareRejectsRevokedSession(t *testing.T) {
+	token := newTestAccessToken(t)
+
+	app := fiber.New(fiber.Config{ErrorHandler: func(c *fiber.Ctx, err error) error {
+		return c.SendStatus(http.StatusUnauthorized)
+	}})
+	app.Get("/api/items", AuthMiddleware(), func(c *fiber.Ctx) error {
+		return c.SendStatus(http.StatusNoContent)
+	})
+
+	get := func() int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	if status := get(); status != http.StatusNoContent {
+		t.Fatalf("status with an active session = %d, want 204", status)
+	}
+
+	claims, err := ValidateToken(token, TokenTypeAccess)
+	if err != nil {
+		t.Fatalf("ValidateToken() error = %v", err)
+	}
+	if err := GetTokenStore().RevokeFamily(claims.SessionID); err != nil {
+		t.Fatalf("RevokeFamily() error = %v", err)
+	}
+
+	if status := get(); status != http.StatusUnauthorized {
+		t.Errorf("status after revoking the session = %d, want 401", status)
+	}
+}
+
+func TestMemoryTokenStorePrune(t *testing.T) {
+	store := NewMemoryTokenStore()
+	userID := uuid.New()
+	live, expired := uuid.New(), uuid.New()
+
+	for familyID, expiresAt := range map[uuid.UUID]time.Time{
+		live:    time.Now().Add(time.Hour),
+		expired: time.Now().Add(-time.Minute),
+	} {
+		if err := store.CreateSession(Session{ID: familyID, UserID: userID}); err != nil {
+			t.Fatalf("CreateSession() error = %v", err)
+		}
+		if err := store.Save(RefreshTokenRecord{ID: uuid.New(), UserID: userID, FamilyID: familyID, ExpiresAt: expiresAt}); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+	}
+
+	if err := store.Prune(); err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+
+	if _, err := store.GetSession(live); err != nil {
+		t.Errorf("GetSession() of a live session error = %v", err)
+	}
+	if _, err := store.GetSession(expired); err != ErrTokenRevoked {
+		t.Errorf("GetSession() of an expired session error = %v, want ErrTokenRevoked", err)
+	}
+	if len(store.records) != 1 {
+		t.Errorf("%d refresh tokens left, want 1", len(store.records))
+	}
+}
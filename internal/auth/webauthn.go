@@ -0,0 +1,464 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"greenvue/internal/config"
+	"math/big"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WebAuthn ceremony types, as reported in clientDataJSON
+const (
+	ceremonyCreate = "webauthn.create"
+	ceremonyGet    = "webauthn.get"
+
+	webAuthnTimeout = 5 * time.Minute
+)
+
+// Authenticator data flags
+const (
+	flagUserPresent      = 0x01
+	flagUserVerified     = 0x04
+	flagAttestedCredData = 0x40
+)
+
+// COSE algorithm identifiers we accept, in order of preference
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+var (
+	ErrWebAuthnChallenge = errors.New("unknown or expired challenge")
+	ErrWebAuthnInvalid   = errors.New("invalid passkey response")
+	ErrSignCount         = errors.New("authenticator sign count did not increase, the passkey may have been cloned")
+)
+
+// webAuthnSettings describes the relying party (this API) to authenticators
+type webAuthnSettings struct {
+	RPID    string
+	RPName  string
+	Origins []string
+}
+
+var webAuthnConfig = struct {
+	sync.RWMutex
+	settings webAuthnSettings
+}{}
+
+// InitWebAuthn sets the relying party settings, deriving defaults from URL.
+// Passkeys stay disabled while no RP ID or origin can be determined.
+func InitWebAuthn(appCfg *config.Config) {
+	settings := webAuthnSettings{
+		RPID:    appCfg.WebAuthn.RPID,
+		RPName:  appCfg.WebAuthn.RPName,
+		Origins: appCfg.WebAuthn.Origins,
+	}
+
+	siteURL := strings.TrimRight(appCfg.SiteURL, "/")
+	if len(settings.Origins) == 0 && siteURL != "" {
+		settings.Origins = []string{siteURL}
+	}
+	if settings.RPID == "" && siteURL != "" {
+		if parsed, err := url.Parse(siteURL); err == nil {
+			settings.RPID = parsed.Hostname()
+		}
+	}
+
+	webAuthnConfig.Lock()
+	webAuthnConfig.settings = settings
+	webAuthnConfig.Unlock()
+}
+
+// getWebAuthnSettings returns the relying party settings set by InitWebAuthn
+func getWebAuthnSettings() webAuthnSettings {
+	webAuthnConfig.RLock()
+	defer webAuthnConfig.RUnlock()
+	return webAuthnConfig.settings
+}
+
+// webAuthnChallenge is a pending registration or login ceremony
+type webAuthnChallenge struct {
+	UserID    uuid.UUID // uuid.Nil for passwordless logins, where the user is not known yet
+	Ceremony  string
+	ExpiresAt time.Time
+}
+
+// challengeStore keeps issued challenges in memory; each challenge can be used once
+type challengeStore struct {
+	mu    sync.Mutex
+	items map[string]webAuthnChallenge
+}
+
+var webAuthnChallenges = &challengeStore{items: make(map[string]webAuthnChallenge)}
+
+// issue creates a random challenge for a ceremony
+func (s *challengeStore) issue(ceremony string, userID uuid.UUID) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(raw)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, item := range s.items {
+		if now.After(item.ExpiresAt) {
+			delete(s.items, key)
+		}
+	}
+
+	s.items[challenge] = webAuthnChallenge{
+		UserID:    userID,
+		Ceremony:  ceremony,
+		ExpiresAt: now.Add(webAuthnTimeout),
+	}
+	return challenge, nil
+}
+
+// consume removes and returns a challenge if it is still valid for the ceremony
+func (s *challengeStore) consume(challenge, ceremony string) (*webAuthnChallenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[challenge]
+	if !ok {
+		return nil, ErrWebAuthnChallenge
+	}
+	delete(s.items, challenge)
+
+	if item.Ceremony != ceremony || time.Now().After(item.ExpiresAt) {
+		return nil, ErrWebAuthnChallenge
+	}
+	return &item, nil
+}
+
+// PublicKeyCredential is the JSON form of the browser's PublicKeyCredential, with binary fields base64url encoded
+type PublicKeyCredential struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject,omitempty"` // Registration only
+		AuthenticatorData string   `json:"authenticatorData,omitempty"` // Login only
+		Signature         string   `json:"signature,omitempty"`         // Login only
+		UserHandle        string   `json:"userHandle,omitempty"`        // Login only
+		Transports        []string `json:"transports,omitempty"`
+	} `json:"response"`
+}
+
+// credentialID returns the raw credential ID
+func (p *PublicKeyCredential) credentialID() ([]byte, error) {
+	if p.Type != "public-key" {
+		return nil, ErrWebAuthnInvalid
+	}
+	id := p.RawID
+	if id == "" {
+		id = p.ID
+	}
+	raw, err := decodeBase64URL(id)
+	if err != nil || len(raw) == 0 {
+		return nil, ErrWebAuthnInvalid
+	}
+	return raw, nil
+}
+
+// decodeBase64URL accepts base64url with or without padding
+func decodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// verifyClientData checks the ceremony type and origin and consumes the challenge it names.
+// It returns the challenge and the SHA-256 hash of the raw client data.
+func verifyClientData(encoded string, ceremony string, settings webAuthnSettings) (*webAuthnChallenge, []byte, error) {
+	raw, err := decodeBase64URL(encoded)
+	if err != nil {
+		return nil, nil, ErrWebAuthnInvalid
+	}
+
+	var clientData struct {
+		Type        string `json:"type"`
+		Challenge   string `json:"challenge"`
+		Origin      string `json:"origin"`
+		CrossOrigin bool   `json:"crossOrigin"`
+	}
+	if err := json.Unmarshal(raw, &clientData); err != nil {
+		return nil, nil, ErrWebAuthnInvalid
+	}
+
+	if clientData.Type != ceremony {
+		return nil, nil, fmt.Errorf("%w: unexpected ceremony type", ErrWebAuthnInvalid)
+	}
+
+	if clientData.CrossOrigin || !slices.Contains(settings.Origins, clientData.Origin) {
+		return nil, nil, fmt.Errorf("%w: origin %q is not allowed", ErrWebAuthnInvalid, clientData.Origin)
+	}
+
+	challenge, err := webAuthnChallenges.consume(clientData.Challenge, ceremony)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hash := sha256.Sum256(raw)
+	return challenge, hash[:], nil
+}
+
+// authenticatorData is the parsed binary authenticator data
+type authenticatorData struct {
+	Raw          []byte
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte // COSE encoded, only present during registration
+}
+
+func parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrWebAuthnInvalid)
+	}
+
+	data := &authenticatorData{
+		Raw:       raw,
+		RPIDHash:  raw[:32],
+		Flags:     raw[32],
+		SignCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+
+	if data.Flags&flagAttestedCredData == 0 {
+		return data, nil
+	}
+
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return nil, fmt.Errorf("%w: attested credential data too short", ErrWebAuthnInvalid)
+	}
+	data.AAGUID = rest[:16]
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+
+	if len(rest) < idLength {
+		return nil, fmt.Errorf("%w: credential ID truncated", ErrWebAuthnInvalid)
+	}
+	data.CredentialID = rest[:idLength]
+	rest = rest[idLength:]
+
+	// The COSE key is followed by optional extensions, so decode it to find where it ends
+	_, n, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrWebAuthnInvalid, err)
+	}
+	data.PublicKey = rest[:n]
+
+	return data, nil
+}
+
+// checkRelyingParty verifies the RP ID hash and the user flags of authenticator data
+func (a *authenticatorData) checkRelyingParty(settings webAuthnSettings, requireVerification bool) error {
+	expected := sha256.Sum256([]byte(settings.RPID))
+	if !bytes.Equal(a.RPIDHash, expected[:]) {
+		return fmt.Errorf("%w: relying party mismatch", ErrWebAuthnInvalid)
+	}
+	if a.Flags&flagUserPresent == 0 {
+		return fmt.Errorf("%w: user not present", ErrWebAuthnInvalid)
+	}
+	if requireVerification && a.Flags&flagUserVerified == 0 {
+		return fmt.Errorf("%w: user verification required", ErrWebAuthnInvalid)
+	}
+	return nil
+}
+
+// registeredCredential is the result of a successful registration ceremony
+type registeredCredential struct {
+	ID        []byte
+	PublicKey []byte
+	SignCount uint32
+	AAGUID    []byte
+}
+
+// verifyRegistration validates an attestation response. Attestation statements are not verified;
+// we request "none" attestation and only need the credential's public key.
+func verifyRegistration(credential *PublicKeyCredential, settings webAuthnSettings) (*webAuthnChallenge, *registeredCredential, error) {
+	credentialID, err := credential.credentialID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	challenge, _, err := verifyClientData(credential.Response.ClientDataJSON, ceremonyCreate, settings)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rawAttestation, err := decodeBase64URL(credential.Response.AttestationObject)
+	if err != nil {
+		return nil, nil, ErrWebAuthnInvalid
+	}
+
+	decoded, _, err := decodeCBOR(rawAttestation)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrWebAuthnInvalid, err)
+	}
+	attestation, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, nil, ErrWebAuthnInvalid
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: missing authenticator data", ErrWebAuthnInvalid)
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := authData.checkRelyingParty(settings, false); err != nil {
+		return nil, nil, err
+	}
+	if authData.PublicKey == nil || !bytes.Equal(authData.CredentialID, credentialID) {
+		return nil, nil, fmt.Errorf("%w: credential data mismatch", ErrWebAuthnInvalid)
+	}
+
+	// Reject keys we would not be able to verify at login
+	if _, _, err := parseCOSEKey(authData.PublicKey); err != nil {
+		return nil, nil, err
+	}
+
+	return challenge, &registeredCredential{
+		ID:        credentialID,
+		PublicKey: authData.PublicKey,
+		SignCount: authData.SignCount,
+		AAGUID:    authData.AAGUID,
+	}, nil
+}
+
+// verifyAssertion checks the signature of a login response against a stored public key
+// and returns the parsed authenticator data
+func verifyAssertion(credential *PublicKeyCredential, clientDataHash []byte, publicKey []byte, storedSignCount uint32, requireVerification bool, settings webAuthnSettings) (*authenticatorData, error) {
+	rawAuthData, err := decodeBase64URL(credential.Response.AuthenticatorData)
+	if err != nil {
+		return nil, ErrWebAuthnInvalid
+	}
+	signature, err := decodeBase64URL(credential.Response.Signature)
+	if err != nil {
+		return nil, ErrWebAuthnInvalid
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := authData.checkRelyingParty(settings, requireVerification); err != nil {
+		return nil, err
+	}
+
+	key, alg, err := parseCOSEKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash...)
+	if !verifyCOSESignature(key, alg, signed, signature) {
+		return nil, fmt.Errorf("%w: signature verification failed", ErrWebAuthnInvalid)
+	}
+
+	// Authenticators without a counter always report zero
+	if (authData.SignCount != 0 || storedSignCount != 0) && authData.SignCount <= storedSignCount {
+		return nil, ErrSignCount
+	}
+
+	return authData, nil
+}
+
+// parseCOSEKey converts a COSE_Key into a Go public key
+func parseCOSEKey(raw []byte) (crypto.PublicKey, int64, error) {
+	decoded, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrWebAuthnInvalid, err)
+	}
+	key, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: malformed public key", ErrWebAuthnInvalid)
+	}
+
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+
+	switch {
+	case kty == 2 && alg == coseAlgES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, fmt.Errorf("%w: unsupported EC key", ErrWebAuthnInvalid)
+		}
+
+		// Make sure the point is on the curve before using it
+		point := append(append([]byte{0x04}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, 0, fmt.Errorf("%w: invalid EC point", ErrWebAuthnInvalid)
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, alg, nil
+
+	case kty == 3 && alg == coseAlgRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, fmt.Errorf("%w: unsupported RSA key", ErrWebAuthnInvalid)
+		}
+		exponent := int(new(big.Int).SetBytes(e).Int64())
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, alg, nil
+
+	case kty == 1 && alg == coseAlgEdDSA:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, fmt.Errorf("%w: unsupported OKP key", ErrWebAuthnInvalid)
+		}
+		return ed25519.PublicKey(x), alg, nil
+	}
+
+	return nil, 0, fmt.Errorf("%w: unsupported key type %d with algorithm %d", ErrWebAuthnInvalid, kty, alg)
+}
+
+// verifyCOSESignature verifies a signature made with a key from parseCOSEKey
+func verifyCOSESignature(key crypto.PublicKey, alg int64, message, signature []byte) bool {
+	switch alg {
+	case coseAlgES256:
+		digest := sha256.Sum256(message)
+		return ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), digest[:], signature)
+	case coseAlgRS256:
+		digest := sha256.Sum256(message)
+		return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+	case coseAlgEdDSA:
+		return ed25519.Verify(key.(ed25519.PublicKey), message, signature)
+	}
+	return false
+}
@@ -0,0 +1,394 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	stderrors "errors"
+	"greenvue/internal/config"
+	"math/big"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+var testWebAuthnSettings = webAuthnSettings{
+	RPID:    "greenvue.example",
+	RPName:  "GreenVue",
+	Origins: []string{"https://greenvue.example"},
+}
+
+// testAuthenticator signs like a platform authenticator with one of the supported algorithms
+type testAuthenticator struct {
+	alg     int64
+	coseKey []byte
+	sign    func(message []byte) []byte
+}
+
+func newTestAuthenticator(t *testing.T, alg int64) *testAuthenticator {
+	t.Helper()
+
+	switch alg {
+	case coseAlgES256:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		point, err := key.PublicKey.ECDH()
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw := point.Bytes() // 0x04 || x || y
+		return &testAuthenticator{
+			alg: alg,
+			coseKey: cborMap(
+				cborInt(1), cborInt(2),
+				cborInt(3), cborInt(coseAlgES256),
+				cborInt(-1), cborInt(1),
+				cborInt(-2), cborBytes(raw[1:33]),
+				cborInt(-3), cborBytes(raw[33:]),
+			),
+			sign: func(message []byte) []byte {
+				digest := sha256.Sum256(message)
+				signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+				if err != nil {
+					t.Fatal(err)
+				}
+				return signature
+			},
+		}
+
+	case coseAlgEdDSA:
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &testAuthenticator{
+			alg: alg,
+			coseKey: cborMap(
+				cborInt(1), cborInt(1),
+				cborInt(3), cborInt(coseAlgEdDSA),
+				cborInt(-1), cborInt(6),
+				cborInt(-2), cborBytes(public),
+			),
+			sign: func(message []byte) []byte { return ed25519.Sign(private, message) },
+		}
+
+	case coseAlgRS256:
+		key := newTestRSAKey(t)
+		return &testAuthenticator{
+			alg: alg,
+			coseKey: cborMap(
+				cborInt(1), cborInt(3),
+				cborInt(3), cborInt(coseAlgRS256),
+				cborInt(-1), cborBytes(key.N.Bytes()),
+				cborInt(-2), cborBytes(big.NewInt(int64(key.E)).Bytes()),
+			),
+			sign: func(message []byte) []byte {
+				digest := sha256.Sum256(message)
+				signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+				if err != nil {
+					t.Fatal(err)
+				}
+				return signature
+			},
+		}
+	}
+
+	t.Fatalf("unsupported algorithm %d", alg)
+	return nil
+}
+
+// testAuthData builds authenticator data, with attested credential data when a credential ID is given
+func testAuthData(rpID string, flags byte, signCount uint32, credentialID, coseKey []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, signCount)
+	if credentialID != nil {
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = binary.BigEndian.AppendUint16(data, uint16(len(credentialID)))
+		data = append(data, credentialID...)
+		data = append(data, coseKey...)
+	}
+	return data
+}
+
+// testClientData issues a challenge and returns the encoded client data that answers it
+func testClientData(t *testing.T, ceremony, origin string) string {
+	t.Helper()
+
+	challenge, err := webAuthnChallenges.issue(ceremony, uuid.New())
+	if err != nil {
+		t.Fatalf("issue() error = %v", err)
+	}
+	raw, err := json.Marshal(map[string]any{"type": ceremony, "challenge": challenge, "origin": origin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func TestInitWebAuthn(t *testing.T) {
+	t.Cleanup(func() { InitWebAuthn(&config.Config{}) })
+
+	appCfg := &config.Config{SiteURL: "https://shop.greenvue.example/"}
+	InitWebAuthn(appCfg)
+	settings := getWebAuthnSettings()
+	if settings.RPID != "shop.greenvue.example" || len(settings.Origins) != 1 || settings.Origins[0] != "https://shop.greenvue.example" {
+		t.Errorf("settings derived from URL = %+v", settings)
+	}
+
+	appCfg.WebAuthn.RPID = "greenvue.example"
+	appCfg.WebAuthn.Origins = []string{"https://a.greenvue.example", "https://b.greenvue.example"}
+	InitWebAuthn(appCfg)
+	settings = getWebAuthnSettings()
+	if settings.RPID != "greenvue.example" || len(settings.Origins) != 2 {
+		t.Errorf("configured settings = %+v", settings)
+	}
+}
+
+func TestParseAuthenticatorData(t *testing.T) {
+	key := newTestAuthenticator(t, coseAlgEdDSA).coseKey
+	credentialID := []byte("credential-1")
+
+	valid := testAuthData("greenvue.example", flagUserPresent|flagAttestedCredData, 7, credentialID, key)
+	// Extensions follow the COSE key and must not become part of it
+	withExtensions := append(append([]byte{}, valid...), cborMap(cborText("credProtect"), cborInt(1))...)
+
+	data, err := parseAuthenticatorData(withExtensions)
+	if err != nil {
+		t.Fatalf("parseAuthenticatorData() error = %v", err)
+	}
+	if data.SignCount != 7 || string(data.CredentialID) != string(credentialID) || string(data.PublicKey) != string(key) {
+		t.Errorf("parseAuthenticatorData() = %+v", data)
+	}
+
+	tests := []struct {
+		name string
+		raw  []byte
+	}{
+		{"empty", nil},
+		{"shorter than the header", valid[:36]},
+		{"attested data without AAGUID", valid[:37+15]},
+		{"credential ID length beyond the data", valid[:37+18+len(credentialID)-1]},
+		{"missing public key", valid[:37+18+len(credentialID)]},
+		{"truncated public key", valid[:len(valid)-1]},
+		{"malformed public key", append(testAuthData("greenvue.example", flagAttestedCredData, 0, credentialID, nil), 0x5f)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseAuthenticatorData(tt.raw); !stderrors.Is(err, ErrWebAuthnInvalid) {
+				t.Errorf("parseAuthenticatorData() error = %v, want ErrWebAuthnInvalid", err)
+			}
+		})
+	}
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	key := newTestAuthenticator(t, coseAlgES256).coseKey
+	credentialID := []byte("credential-1")
+	flags := byte(flagUserPresent | flagAttestedCredData)
+
+	attestation := func(authData []byte) string {
+		return base64.RawURLEncoding.EncodeToString(cborMap(
+			cborText("fmt"), cborText("none"),
+			cborText("attStmt"), cborMap(),
+			cborText("authData"), cborBytes(authData),
+		))
+	}
+	offCurve := cborMap(
+		cborInt(1), cborInt(2),
+		cborInt(3), cborInt(coseAlgES256),
+		cborInt(-1), cborInt(1),
+		cborInt(-2), cborBytes(make([]byte, 32)),
+		cborInt(-3), cborBytes(make([]byte, 32)),
+	)
+
+	tests := []struct {
+		name              string
+		ceremony          string
+		origin            string
+		attestationObject string
+		wantErr           error
+	}{
+		{"valid", ceremonyCreate, "https://greenvue.example", attestation(testAuthData("greenvue.example", flags, 0, credentialID, key)), nil},
+		{"login ceremony", ceremonyGet, "https://greenvue.example", attestation(testAuthData("greenvue.example", flags, 0, credentialID, key)), ErrWebAuthnInvalid},
+		{"foreign origin", ceremonyCreate, "https://evil.example", attestation(testAuthData("greenvue.example", flags, 0, credentialID, key)), ErrWebAuthnInvalid},
+		{"foreign relying party", ceremonyCreate, "https://greenvue.example", attestation(testAuthData("evil.example", flags, 0, credentialID, key)), ErrWebAuthnInvalid},
+		{"user not present", ceremonyCreate, "https://greenvue.example", attestation(testAuthData("greenvue.example", flagAttestedCredData, 0, credentialID, key)), ErrWebAuthnInvalid},
+		{"no attested credential", ceremonyCreate, "https://greenvue.example", attestation(testAuthData("greenvue.example", flagUserPresent, 0, nil, nil)), ErrWebAuthnInvalid},
+		{"other credential ID", ceremonyCreate, "https://greenvue.example", attestation(testAuthData("greenvue.example", flags, 0, []byte("credential-2"), key)), ErrWebAuthnInvalid},
+		{"key off the curve", ceremonyCreate, "https://greenvue.example", attestation(testAuthData("greenvue.example", flags, 0, credentialID, offCurve)), ErrWebAuthnInvalid},
+		{"attestation is not a map", ceremonyCreate, "https://greenvue.example", base64.RawURLEncoding.EncodeToString(cborText("none")), ErrWebAuthnInvalid},
+		{"missing authenticator data", ceremonyCreate, "https://greenvue.example", base64.RawURLEncoding.EncodeToString(cborMap(cborText("fmt"), cborText("none"))), ErrWebAuthnInvalid},
+		{"malformed attestation", ceremonyCreate, "https://greenvue.example", base64.RawURLEncoding.EncodeToString([]byte{0xa1}), ErrWebAuthnInvalid},
+		{"invalid base64", ceremonyCreate, "https://greenvue.example", "not base64!", ErrWebAuthnInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var credential PublicKeyCredential
+			credential.Type = "public-key"
+			credential.RawID = base64.RawURLEncoding.EncodeToString(credentialID)
+			credential.Response.ClientDataJSON = testClientData(t, tt.ceremony, tt.origin)
+			credential.Response.AttestationObject = tt.attestationObject
+
+			_, registered, err := verifyRegistration(&credential, testWebAuthnSettings)
+			if tt.wantErr != nil {
+				if !stderrors.Is(err, tt.wantErr) {
+					t.Fatalf("verifyRegistration() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyRegistration() error = %v", err)
+			}
+			if string(registered.ID) != string(credentialID) || string(registered.PublicKey) != string(key) {
+				t.Errorf("verifyRegistration() = %+v", registered)
+			}
+		})
+	}
+}
+
+func TestVerifyRegistrationConsumesChallenge(t *testing.T) {
+	key := newTestAuthenticator(t, coseAlgEdDSA).coseKey
+	credentialID := []byte("credential-1")
+
+	var credential PublicKeyCredential
+	credential.Type = "public-key"
+	credential.RawID = base64.RawURLEncoding.EncodeToString(credentialID)
+	credential.Response.ClientDataJSON = testClientData(t, ceremonyCreate, "https://greenvue.example")
+	credential.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(cborMap(
+		cborText("authData"), cborBytes(testAuthData("greenvue.example", flagUserPresent|flagAttestedCredData, 0, credentialID, key)),
+	))
+
+	if _, _, err := verifyRegistration(&credential, testWebAuthnSettings); err != nil {
+		t.Fatalf("verifyRegistration() error = %v", err)
+	}
+	if _, _, err := verifyRegistration(&credential, testWebAuthnSettings); !stderrors.Is(err, ErrWebAuthnChallenge) {
+		t.Fatalf("replayed verifyRegistration() error = %v, want ErrWebAuthnChallenge", err)
+	}
+}
+
+// testAssertion signs authenticator data and client data the way an authenticator answers a login
+func testAssertion(authenticator *testAuthenticator, authData []byte) (*PublicKeyCredential, []byte) {
+	clientDataHash := sha256.Sum256([]byte(`{"type":"webauthn.get"}`))
+	signature := authenticator.sign(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	var credential PublicKeyCredential
+	credential.Type = "public-key"
+	credential.Response.AuthenticatorData = base64.RawURLEncoding.EncodeToString(authData)
+	credential.Response.Signature = base64.RawURLEncoding.EncodeToString(signature)
+	return &credential, clientDataHash[:]
+}
+
+func TestVerifyAssertionSignatures(t *testing.T) {
+	for _, alg := range []int64{coseAlgES256, coseAlgEdDSA, coseAlgRS256} {
+		authenticator := newTestAuthenticator(t, alg)
+		other := newTestAuthenticator(t, alg)
+		authData := testAuthData("greenvue.example", flagUserPresent|flagUserVerified, 1, nil, nil)
+
+		credential, clientDataHash := testAssertion(authenticator, authData)
+		if _, err := verifyAssertion(credential, clientDataHash, authenticator.coseKey, 0, true, testWebAuthnSettings); err != nil {
+			t.Errorf("alg %d: verifyAssertion() error = %v", alg, err)
+		}
+
+		// Signed by another key
+		if _, err := verifyAssertion(credential, clientDataHash, other.coseKey, 0, true, testWebAuthnSettings); !stderrors.Is(err, ErrWebAuthnInvalid) {
+			t.Errorf("alg %d: verifyAssertion() with another key error = %v, want ErrWebAuthnInvalid", alg, err)
+		}
+
+		// Client data that was not signed
+		otherHash := sha256.Sum256([]byte("other"))
+		if _, err := verifyAssertion(credential, otherHash[:], authenticator.coseKey, 0, true, testWebAuthnSettings); !stderrors.Is(err, ErrWebAuthnInvalid) {
+			t.Errorf("alg %d: verifyAssertion() with other client data error = %v, want ErrWebAuthnInvalid", alg, err)
+		}
+
+		// Authenticator data changed after signing
+		tampered := append([]byte{}, authData...)
+		tampered[len(tampered)-1]++
+		credential.Response.AuthenticatorData = base64.RawURLEncoding.EncodeToString(tampered)
+		if _, err := verifyAssertion(credential, clientDataHash, authenticator.coseKey, 0, true, testWebAuthnSettings); !stderrors.Is(err, ErrWebAuthnInvalid) {
+			t.Errorf("alg %d: verifyAssertion() with tampered data error = %v, want ErrWebAuthnInvalid", alg, err)
+		}
+	}
+}
+
+func TestVerifyAssertionChecks(t *testing.T) {
+	authenticator := newTestAuthenticator(t, coseAlgEdDSA)
+
+	tests := []struct {
+		name                string
+		rpID                string
+		flags               byte
+		signCount           uint32
+		storedSignCount     uint32
+		requireVerification bool
+		wantErr             error
+	}{
+		{"no counter", "greenvue.example", flagUserPresent, 0, 0, false, nil},
+		{"first counted use", "greenvue.example", flagUserPresent, 1, 0, false, nil},
+		{"counter increased", "greenvue.example", flagUserPresent, 42, 41, false, nil},
+		{"counter repeated", "greenvue.example", flagUserPresent, 41, 41, false, ErrSignCount},
+		{"counter went back", "greenvue.example", flagUserPresent, 40, 41, false, ErrSignCount},
+		{"counter reset to zero", "greenvue.example", flagUserPresent, 0, 41, false, ErrSignCount},
+		{"verified", "greenvue.example", flagUserPresent | flagUserVerified, 0, 0, true, nil},
+		{"verification missing", "greenvue.example", flagUserPresent, 0, 0, true, ErrWebAuthnInvalid},
+		{"user not present", "greenvue.example", flagUserVerified, 0, 0, false, ErrWebAuthnInvalid},
+		{"foreign relying party", "evil.example", flagUserPresent, 0, 0, false, ErrWebAuthnInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			credential, clientDataHash := testAssertion(authenticator, testAuthData(tt.rpID, tt.flags, tt.signCount, nil, nil))
+
+			authData, err := verifyAssertion(credential, clientDataHash, authenticator.coseKey, tt.storedSignCount, tt.requireVerification, testWebAuthnSettings)
+			if tt.wantErr != nil {
+				if !stderrors.Is(err, tt.wantErr) {
+					t.Fatalf("verifyAssertion() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyAssertion() error = %v", err)
+			}
+			if authData.SignCount != tt.signCount {
+				t.Errorf("SignCount = %d, want %d", authData.SignCount, tt.signCount)
+			}
+		})
+	}
+}
+
+func TestParseCOSEKeyRejects(t *testing.T) {
+	shortRSA := newTestRSAKey(t).N.Bytes()[:255]
+
+	tests := []struct {
+		name string
+		key  []byte
+	}{
+		{"not a map", cborBytes([]byte{1})},
+		{"malformed", []byte{0xa2, 0x01}},
+		{"unsupported algorithm", cborMap(cborInt(1), cborInt(2), cborInt(3), cborInt(-35))},
+		{"algorithm of another key type", cborMap(cborInt(1), cborInt(1), cborInt(3), cborInt(coseAlgES256))},
+		{"EC on another curve", cborMap(cborInt(1), cborInt(2), cborInt(3), cborInt(coseAlgES256), cborInt(-1), cborInt(2), cborInt(-2), cborBytes(make([]byte, 32)), cborInt(-3), cborBytes(make([]byte, 32)))},
+		{"EC coordinate too short", cborMap(cborInt(1), cborInt(2), cborInt(3), cborInt(coseAlgES256), cborInt(-1), cborInt(1), cborInt(-2), cborBytes(make([]byte, 31)), cborInt(-3), cborBytes(make([]byte, 32)))},
+		{"EC point off the curve", cborMap(cborInt(1), cborInt(2), cborInt(3), cborInt(coseAlgES256), cborInt(-1), cborInt(1), cborInt(-2), cborBytes(make([]byte, 32)), cborInt(-3), cborBytes(make([]byte, 32)))},
+		{"RSA modulus below 2048 bits", cborMap(cborInt(1), cborInt(3), cborInt(3), cborInt(coseAlgRS256), cborInt(-1), cborBytes(shortRSA), cborInt(-2), cborBytes([]byte{1, 0, 1}))},
+		{"RSA exponent too long", cborMap(cborInt(1), cborInt(3), cborInt(3), cborInt(coseAlgRS256), cborInt(-1), cborBytes(make([]byte, 256)), cborInt(-2), cborBytes(make([]byte, 5)))},
+		{"RSA exponent missing", cborMap(cborInt(1), cborInt(3), cborInt(3), cborInt(coseAlgRS256), cborInt(-1), cborBytes(make([]byte, 256)))},
+		{"OKP on another curve", cborMap(cborInt(1), cborInt(1), cborInt(3), cborInt(coseAlgEdDSA), cborInt(-1), cborInt(4), cborInt(-2), cborBytes(make([]byte, 32)))},
+		{"OKP key too short", cborMap(cborInt(1), cborInt(1), cborInt(3), cborInt(coseAlgEdDSA), cborInt(-1), cborInt(6), cborInt(-2), cborBytes(make([]byte, 31)))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := parseCOSEKey(tt.key); !stderrors.Is(err, ErrWebAuthnInvalid) {
+				t.Errorf("parseCOSEKey() error = %v, want ErrWebAuthnInvalid", err)
+			}
+		})
+	}
+}
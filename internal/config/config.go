@@ -2,6 +2,8 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -21,10 +23,62 @@ type Config struct {
 		RefreshSecret string
 		AccessExpiry  time.Duration
 		RefreshExpiry time.Duration
+		TokenStore    string // Refresh token store: "memory" or "database"
+		KeyringFile   string // Optional JSON keyring with rotating and asymmetric signing keys
 	}
+	WebAuthn struct {
+		RPID    string   // Relying party ID, defaults to the host of SiteURL
+		RPName  string   // Name shown by authenticators
+		Origins []string // Allowed origins, defaults to SiteURL
+	}
+	Audit struct {
+		Sinks    []string // Where audit events go: "file" and/or "database"; queries use the first
+		FilePath string   // JSON lines file used by the file sink
+	}
+	DataExport struct {
+		Dir        string        // Directory where finished export archives are kept
+		TTL        time.Duration // How long an archive can be downloaded
+		SigningKey string        // Key for signing download links, required and separate from the JWT secrets
+	}
+	Storage struct {
+		Driver      string // Blob store for images: "supabase", "local" or "s3"
+		Bucket      string // Bucket of the supabase and s3 drivers
+		PublicURL   string // Base URL of stored files; defaults per driver
+		LocalDir    string // Directory of the local driver, served under /uploads
+		SigningKey  string // Key for signed URLs of the local driver, required by it and separate from the JWT secrets
+		ServiceKey  string // Supabase service key of the supabase driver
+		S3Endpoint  string
+		S3Region    string
+		S3AccessKey string
+		S3SecretKey string
+		S3PathStyle bool // Path style bucket addressing, needed by MinIO
+	}
+	Images struct {
+		Renditions []string // Rendition presets as name:max_size:quality; empty uses the defaults
+		Workers    int      // Number of concurrent image upload workers
+		QueueDir   string   // Spool directory that keeps queued images across restarts
+	}
+	OIDC struct {
+		Providers []OIDCProvider // Google when GOOGLE_CLIENT_ID is set, plus every provider in OIDC_PROVIDERS
+	}
+	SiteURL     string // Public URL of the web client
+	APIURL      string // Public URL of this API, used for links in emails
 	Environment string // "development", "production", etc.
 }
 
+// OIDCProvider configures an OpenID Connect login provider
+type OIDCProvider struct {
+	Name             string   // Used in routes, e.g. /auth/oidc/:provider/login
+	Issuer           string   // Issuer URL; the discovery document is read from <issuer>/.well-known/openid-configuration
+	ExtraIssuers     []string // Other accepted iss values, e.g. "accounts.google.com"
+	ClientID         string
+	ClientSecret     string // Optional for public clients, which rely on PKCE alone
+	RedirectURI      string
+	Scopes           []string
+	SupabaseProvider string // Exchange verified ID tokens with Supabase Auth under this provider name instead of linking identities ourselves
+	LinkExisting     bool   // Link a new identity to an existing account with the same verified email
+}
+
 // LoadConfig loads configuration from environment variables with defaults
 func LoadConfig() *Config {
 	cfg := &Config{}
@@ -44,8 +98,83 @@ func LoadConfig() *Config {
 	cfg.JWT.RefreshSecret = getEnv("JWT_REFRESH_SECRET", "dev-refresh-secret")
 	cfg.JWT.AccessExpiry = getDurationEnv("JWT_ACCESS_EXPIRY", 15*time.Minute)
 	cfg.JWT.RefreshExpiry = getDurationEnv("JWT_REFRESH_EXPIRY", 7*24*time.Hour)
+	cfg.JWT.TokenStore = getEnv("JWT_TOKEN_STORE", "memory")
+	cfg.JWT.KeyringFile = getEnv("JWT_KEYRING_FILE", "")
+
+	// WebAuthn config
+	cfg.WebAuthn.RPID = getEnv("WEBAUTHN_RP_ID", "")
+	cfg.WebAuthn.RPName = getEnv("WEBAUTHN_RP_NAME", "GreenVue")
+	cfg.WebAuthn.Origins = getListEnv("WEBAUTHN_ORIGINS")
+
+	// Audit log config
+	cfg.Audit.Sinks = getListEnv("AUDIT_SINKS")
+	if len(cfg.Audit.Sinks) == 0 {
+		cfg.Audit.Sinks = []string{"file"}
+	}
+	cfg.Audit.FilePath = getEnv("AUDIT_LOG_FILE", "audit.jsonl")
+
+	// Data export config
+	cfg.DataExport.Dir = getEnv("DATA_EXPORT_DIR", "exports")
+	cfg.DataExport.TTL = getDurationEnv("DATA_EXPORT_TTL", 48*time.Hour)
+	cfg.DataExport.SigningKey = getEnv("DATA_EXPORT_SIGNING_KEY", "")
+
+	// Blob storage config
+	cfg.Storage.Driver = getEnv("STORAGE_DRIVER", "supabase")
+	cfg.Storage.Bucket = getEnv("STORAGE_BUCKET", "listing-images")
+	cfg.Storage.PublicURL = getEnv("STORAGE_PUBLIC_URL", "")
+	cfg.Storage.LocalDir = getEnv("STORAGE_LOCAL_DIR", "uploads")
+	cfg.Storage.SigningKey = getEnv("STORAGE_SIGNING_KEY", "")
+	cfg.Storage.ServiceKey = getEnv("SUPABASE_SERVICE_KEY", "")
+	cfg.Storage.S3Endpoint = getEnv("S3_ENDPOINT", "")
+	cfg.Storage.S3Region = getEnv("S3_REGION", "us-east-1")
+	cfg.Storage.S3AccessKey = getEnv("S3_ACCESS_KEY_ID", "")
+	cfg.Storage.S3SecretKey = getEnv("S3_SECRET_ACCESS_KEY", "")
+	cfg.Storage.S3PathStyle = getBoolEnv("S3_PATH_STYLE", true)
+	if cfg.Storage.Driver == "local" && cfg.Storage.PublicURL == "" {
+		cfg.Storage.PublicURL = "http://localhost:" + cfg.Server.Port + "/uploads"
+	}
+
+	// Image config
+	cfg.Images.Renditions = getListEnv("IMAGE_RENDITIONS")
+	cfg.Images.Workers = getIntEnv("IMAGE_WORKERS", 4)
+	cfg.Images.QueueDir = getEnv("IMAGE_QUEUE_DIR", "image_queue")
+
+	// OpenID Connect providers
+	if clientID := getEnv("GOOGLE_CLIENT_ID", ""); clientID != "" {
+		cfg.OIDC.Providers = append(cfg.OIDC.Providers, OIDCProvider{
+			Name:             "google",
+			Issuer:           "https://accounts.google.com",
+			ExtraIssuers:     []string{"accounts.google.com"},
+			ClientID:         clientID,
+			ClientSecret:     getEnv("GOOGLE_CLIENT_SECRET", ""),
+			RedirectURI:      getEnv("REDIRECT_URI", ""),
+			Scopes:           []string{"openid", "email", "profile"},
+			SupabaseProvider: "google",
+		})
+	}
+	for _, name := range getListEnv("OIDC_PROVIDERS") {
+		name = strings.ToLower(name)
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		scopes := getListEnv(prefix + "SCOPES")
+		if len(scopes) == 0 {
+			scopes = []string{"openid", "email", "profile"}
+		}
+		cfg.OIDC.Providers = append(cfg.OIDC.Providers, OIDCProvider{
+			Name:             name,
+			Issuer:           getEnv(prefix+"ISSUER", ""),
+			ExtraIssuers:     getListEnv(prefix + "EXTRA_ISSUERS"),
+			ClientID:         getEnv(prefix+"CLIENT_ID", ""),
+			ClientSecret:     getEnv(prefix+"CLIENT_SECRET", ""),
+			RedirectURI:      getEnv(prefix+"REDIRECT_URI", ""),
+			Scopes:           scopes,
+			SupabaseProvider: getEnv(prefix+"SUPABASE_PROVIDER", ""),
+			LinkExisting:     getBoolEnv(prefix+"LINK_EXISTING", false),
+		})
+	}
 
 	// Environment
+	cfg.SiteURL = getEnv("URL", "")
+	cfg.APIURL = getEnv("API_URL", "")
 	cfg.Environment = getEnv("ENV", "development")
 
 	return cfg
@@ -60,6 +189,35 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
+// getListEnv reads a comma separated list, ignoring empty entries
+func getListEnv(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// getBoolEnv reads a boolean such as "true" or "1"
+func getBoolEnv(key string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// getIntEnv reads a positive integer
+func getIntEnv(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value < 1 {
+		return defaultValue
+	}
+	return value
+}
+
 func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
 	str := os.Getenv(key)
 	if str == "" {
@@ -162,55 +162,43 @@ func (s *SupabaseClient) PATCH(table string, id uuid.UUID, data any) ([]byte, er
 	return respBody, nil
 }
 
-// DELETE removes a record based on condition
-func (s *SupabaseClient) DELETE(table, conditions string) ([]byte, error) {
+// PATCHWhere updates all records matching the given conditions
+func (s *SupabaseClient) PATCHWhere(table, conditions string, data any) ([]byte, error) {
 	url := fmt.Sprintf("%s/rest/v1/%s?%s", s.URL, table, conditions)
 
-	resp, err := s.Client.R().Delete(url)
+	resp, err := s.Client.R().
+		SetBody(data).
+		Patch(url)
+
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute DELETE request: %w", err)
+		return nil, err
 	}
 
 	respBody := resp.Body()
 
 	if resp.StatusCode() < 200 || resp.StatusCode() >= 300 {
-		return nil, fmt.Errorf("DELETE operation failed (status %d): %s", resp.StatusCode(), string(respBody))
+		return nil, fmt.Errorf("supabase PATCH error (%d): %s", resp.StatusCode(), string(respBody))
 	}
 
 	return respBody, nil
 }
 
-// UploadImage uploads an image to Supabase storage
-func (s *SupabaseClient) UploadImage(filename, bucket string, image []byte) ([]byte, error) {
-	url := fmt.Sprintf("%s/storage/v1/object/%s/%s", s.URL, bucket, filename)
-	fmt.Printf("Uploading to URL: %s\n", url)
-	contentType := "image/jpeg"
-	if strings.HasSuffix(filename, ".png") {
-		contentType = "image/png"
-	} else if strings.HasSuffix(filename, ".webp") {
-		contentType = "image/webp"
-	}
-
-	fmt.Printf("Using content type: %s\n", contentType)
-
-	resp, err := s.Client.R().
-		SetBody(image).
-		Post(url)
+// DELETE removes a record based on condition
+func (s *SupabaseClient) DELETE(table, conditions string) ([]byte, error) {
+	url := fmt.Sprintf("%s/rest/v1/%s?%s", s.URL, table, conditions)
 
+	resp, err := s.Client.R().Delete(url)
 	if err != nil {
-		fmt.Printf("Error sending request: %v\n", err)
-		return nil, err
+		return nil, fmt.Errorf("failed to execute DELETE request: %w", err)
 	}
 
-	body := resp.Body()
+	respBody := resp.Body()
 
-	fmt.Printf("Status code: %d\n", resp.StatusCode())
-	if resp.StatusCode() >= 400 {
-		fmt.Printf("Error response: %s\n", string(body))
-		return nil, fmt.Errorf("supabase storage error (%d): %s", resp.StatusCode(), string(body))
+	if resp.StatusCode() < 200 || resp.StatusCode() >= 300 {
+		return nil, fmt.Errorf("DELETE operation failed (status %d): %s", resp.StatusCode(), string(respBody))
 	}
 
-	return body, nil
+	return respBody, nil
 }
 
 // SignUp registers a new user
@@ -343,3 +331,40 @@ func (s *SupabaseClient) UpdateUser(id uuid.UUID, data map[string]any) (*lib.Use
 
 	return &user, nil
 }
+
+// CreateAuthUser creates a confirmed Supabase Auth user without a password, for logins through external providers.
+// It needs a client created with the service key.
+func (s *SupabaseClient) CreateAuthUser(email string, metadata map[string]any) (*lib.User, error) {
+	url := fmt.Sprintf("%s/auth/v1/admin/users", s.URL)
+
+	payload := map[string]any{
+		"email":         email,
+		"email_confirm": true,
+		"user_metadata": metadata,
+	}
+
+	resp, err := s.Client.R().
+		SetBody(payload).
+		Post(url)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	body := resp.Body()
+
+	if resp.StatusCode() != http.StatusOK && resp.StatusCode() != http.StatusCreated {
+		return nil, fmt.Errorf("create user failed: %s", string(body))
+	}
+
+	var user lib.User
+	if err := json.Unmarshal(body, &user); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	if user.ID == uuid.Nil {
+		return nil, fmt.Errorf("user ID missing in response")
+	}
+
+	return &user, nil
+}
@@ -113,6 +113,14 @@ func CreateJob(c *fiber.Ctx) error {
 		jobFunc = createEmailProcessingJob(req.Payload)
 	case "process_images":
 		jobFunc = createImageProcessingJob(req.Payload)
+	case "recompute_seller_ratings":
+		jobFunc = CreateRecomputeSellerRatingsJob()
+	case "process_account_deletions":
+		jobFunc = createAccountDeletionJob(req.Payload)
+	case "process_data_exports":
+		jobFunc = createDataExportJob(req.Payload)
+	case "prune_sessions":
+		jobFunc = CreateSessionPruningJob()
 	default:
 		return errors.BadRequest("Unknown job type")
 	}
@@ -182,3 +190,21 @@ func createEmailProcessingJob(payload any) JobFunc {
 	}
 	return CreateEmailProcessingJob(&options)
 }
+
+func createAccountDeletionJob(payload any) JobFunc {
+	var options AccountDeletionOptions
+	if payload != nil {
+		data, _ := json.Marshal(payload)
+		json.Unmarshal(data, &options)
+	}
+	return CreateAccountDeletionJob(&options)
+}
+
+func createDataExportJob(payload any) JobFunc {
+	var options DataExportOptions
+	if payload != nil {
+		data, _ := json.Marshal(payload)
+		json.Unmarshal(data, &options)
+	}
+	return CreateDataExportJob(&options)
+}
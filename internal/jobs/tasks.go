@@ -2,9 +2,16 @@ package jobs
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"greenvue/internal/auth"
+	"greenvue/internal/db"
+	"greenvue/internal/ratings"
 	"greenvue/lib/email"
 	"greenvue/lib/image"
 	"log"
+
+	"github.com/google/uuid"
 )
 
 // Task definitions for common background jobs
@@ -151,3 +158,115 @@ func CreateEmailProcessingJob(opts *EmailProcessingOptions) JobFunc {
 		return nil
 	}
 }
+
+// sellerRatingsPageSize is how many review rows the ratings backfill reads per request
+const sellerRatingsPageSize = 1000
+
+// CreateRecomputeSellerRatingsJob creates a job that rebuilds the rating breakdown of every reviewed seller.
+// Ratings are normally recomputed when a review changes, so this is mainly useful for backfills.
+func CreateRecomputeSellerRatingsJob() JobFunc {
+	return func(ctx context.Context) error {
+		client := db.GetGlobalClient()
+		if client == nil {
+			return fmt.Errorf("database client not available")
+		}
+
+		// Page through the reviewed sellers in seller order. Each page starts after the last seller of
+		// the previous one, so a seller with many reviews costs one page at most and no seller is skipped
+		// when reviews are added or removed while the job runs.
+		var last uuid.UUID
+		recomputed := 0
+		for {
+			query := fmt.Sprintf("select=seller_id&order=seller_id.asc&limit=%d", sellerRatingsPageSize)
+			if recomputed > 0 {
+				query += fmt.Sprintf("&seller_id=gt.%s", last)
+			}
+
+			data, err := client.GET("reviews", query)
+			if err != nil {
+				return fmt.Errorf("failed to fetch reviewed sellers: %w", err)
+			}
+
+			var rows []struct {
+				SellerID uuid.UUID `json:"seller_id"`
+			}
+			if err := json.Unmarshal(data, &rows); err != nil {
+				return fmt.Errorf("failed to parse reviewed sellers: %w", err)
+			}
+			if len(rows) == 0 {
+				break
+			}
+
+			for _, row := range rows {
+				if recomputed > 0 && row.SellerID == last {
+					continue
+				}
+				last = row.SellerID
+				recomputed++
+
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+
+				if _, err := ratings.Recompute(row.SellerID); err != nil {
+					log.Printf("Failed to recompute rating for seller %s: %v", row.SellerID, err)
+				}
+			}
+
+			if len(rows) < sellerRatingsPageSize {
+				break
+			}
+		}
+
+		log.Printf("Recomputed ratings for %d sellers", recomputed)
+		return nil
+	}
+}
+
+// AccountDeletionOptions defines options for the account deletion job
+type AccountDeletionOptions struct {
+	BatchSize int `json:"batch_size"` // Number of accounts to delete in each run
+}
+
+// CreateAccountDeletionJob creates a job that deletes accounts whose grace period has passed.
+// Listings and their images, bids and favorites are removed; reviews, messages and the profile are anonymized.
+func CreateAccountDeletionJob(opts *AccountDeletionOptions) JobFunc {
+	if opts == nil || opts.BatchSize <= 0 {
+		opts = &AccountDeletionOptions{BatchSize: 10}
+	}
+
+	return func(ctx context.Context) error {
+		completed, err := auth.ProcessAccountDeletions(ctx, opts.BatchSize)
+		if completed > 0 {
+			log.Printf("Deleted %d accounts after their grace period", completed)
+		}
+		return err
+	}
+}
+
+// DataExportOptions defines options for the data export job
+type DataExportOptions struct {
+	BatchSize int `json:"batch_size"` // Number of exports to build in each run
+}
+
+// CreateDataExportJob creates a job that builds requested data export archives and removes expired ones
+func CreateDataExportJob(opts *DataExportOptions) JobFunc {
+	if opts == nil || opts.BatchSize <= 0 {
+		opts = &DataExportOptions{BatchSize: 5}
+	}
+
+	return func(ctx context.Context) error {
+		built, err := auth.ProcessDataExports(ctx, opts.BatchSize)
+		if built > 0 {
+			log.Printf("Built %d data exports", built)
+		}
+		return err
+	}
+}
+
+// CreateSessionPruningJob creates a job that removes expired refresh tokens and sessions
+func CreateSessionPruningJob() JobFunc {
+	return func(ctx context.Context) error {
+		return auth.PruneSessions()
+	}
+}
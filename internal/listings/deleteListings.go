@@ -1,25 +1,43 @@
 package listings
 
 import (
+	"fmt"
 	"greenvue/internal/db"
 	"greenvue/lib/errors"
 	"log"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 )
 
 func DeleteListingById(c *fiber.Ctx) error {
 	client := db.GetGlobalClient()
 
 	// Extract listing ID from request path
-	listingId := c.Params("listing_id")
+	listingId, err := uuid.Parse(c.Params("listing_id"))
+	if err != nil {
+		return errors.BadRequest("Invalid listing ID format")
+	}
 
 	if client == nil {
 		return errors.InternalServerError("Database connection failed")
 	}
 
+	// Remove the duplicate detection data first, including flags where the listing is the match,
+	// so deleted photos are neither matched again nor shown to moderators
+	duplicateData := map[string]string{
+		imageHashesTable:  fmt.Sprintf("listing_id=eq.%s", listingId),
+		listingFlagsTable: fmt.Sprintf("or=(listing_id.eq.%[1]s,matched_listing_id.eq.%[1]s)", listingId),
+	}
+	for table, condition := range duplicateData {
+		if _, err := client.DELETE(table, condition); err != nil {
+			log.Printf("Error deleting %s of listing %s: %v", table, listingId, err)
+			return errors.InternalServerError("Failed to delete listing: " + err.Error())
+		}
+	}
+
 	// Delete listing using the standardized DELETE operation
-	_, err := client.DELETE("listings", "id=eq."+listingId)
+	_, err = client.DELETE("listings", fmt.Sprintf("id=eq.%s", listingId))
 	if err != nil {
 		log.Println("Error deleting listing:", err)
 		return errors.InternalServerError("Failed to delete listing: " + err.Error())
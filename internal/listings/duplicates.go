@@ -0,0 +1,213 @@
+package listings
+
+import (
+	"encoding/json"
+	"fmt"
+	"greenvue/internal/db"
+	"greenvue/lib"
+	"greenvue/lib/errors"
+	"greenvue/lib/image"
+	"log"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	imageHashesTable  = "image_hashes"
+	listingFlagsTable = "listing_flags"
+
+	// Images whose hashes differ in at most this many bits are treated as the same photo.
+	// It must stay below 4 so every match shares a hash band.
+	duplicateMaxDistance = 3
+	duplicateCandidates  = 200
+
+	FlagDuplicateImages = "duplicate_images"
+)
+
+// DuplicateMatch is an existing listing that uses the same photo as a new one
+type DuplicateMatch struct {
+	ListingID uuid.UUID `json:"listing_id"`
+	SellerID  uuid.UUID `json:"seller_id"`
+	ImageID   string    `json:"image_id"`
+	Distance  int       `json:"distance"`
+}
+
+// checkDuplicateImages indexes the images of a new listing and compares them with the images of other listings.
+// Matches with listings of other sellers are flagged for moderation; matches with the seller's own
+// listings are returned so the seller can be warned. Failures are logged and never block the listing.
+func checkDuplicateImages(client *db.SupabaseClient, listingID, sellerID uuid.UUID, images []lib.ListingImage) []DuplicateMatch {
+	var own []DuplicateMatch
+	others := make(map[uuid.UUID]DuplicateMatch)
+
+	for _, listingImage := range images {
+		if listingImage.PerceptualHash == "" {
+			continue
+		}
+		hash, err := image.ParseHash(listingImage.PerceptualHash)
+		if err != nil {
+			log.Printf("Invalid perceptual hash %q on image %s: %v", listingImage.PerceptualHash, listingImage.ID, err)
+			continue
+		}
+
+		matches, err := findSimilarImages(client, listingID, hash)
+		if err != nil {
+			log.Printf("Failed to look up duplicates of image %s: %v", listingImage.ID, err)
+		}
+
+		for _, match := range matches {
+			if match.SellerID == sellerID {
+				own = append(own, match)
+				continue
+			}
+			if existing, ok := others[match.ListingID]; !ok || match.Distance < existing.Distance {
+				others[match.ListingID] = match
+			}
+		}
+
+		bands := image.HashBands(hash)
+		if _, err := client.POST(imageHashesTable, lib.ImageHash{
+			ListingID: listingID,
+			SellerID:  sellerID,
+			ImageID:   listingImage.ID,
+			Hash:      listingImage.PerceptualHash,
+			Band0:     bands[0],
+			Band1:     bands[1],
+			Band2:     bands[2],
+			Band3:     bands[3],
+		}); err != nil {
+			log.Printf("Failed to index image %s of listing %s: %v", listingImage.ID, listingID, err)
+		}
+	}
+
+	for _, match := range others {
+		if _, err := client.POST(listingFlagsTable, lib.ListingFlag{
+			ListingID:        listingID,
+			SellerID:         sellerID,
+			Reason:           FlagDuplicateImages,
+			MatchedListingID: match.ListingID,
+			MatchedSellerID:  match.SellerID,
+			Distance:         match.Distance,
+		}); err != nil {
+			log.Printf("Failed to flag listing %s as duplicate of %s: %v", listingID, match.ListingID, err)
+			continue
+		}
+		log.Printf("Flagged listing %s: images match listing %s of seller %s", listingID, match.ListingID, match.SellerID)
+	}
+
+	return own
+}
+
+// findSimilarImages returns indexed images of other listings within duplicateMaxDistance of hash
+func findSimilarImages(client *db.SupabaseClient, listingID uuid.UUID, hash uint64) ([]DuplicateMatch, error) {
+	bands := image.HashBands(hash)
+	query := fmt.Sprintf("or=(band_0.eq.%d,band_1.eq.%d,band_2.eq.%d,band_3.eq.%d)&listing_id=neq.%s&limit=%d",
+		bands[0], bands[1], bands[2], bands[3], listingID, duplicateCandidates)
+
+	data, err := client.GET(imageHashesTable, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []lib.ImageHash
+	if err := json.Unmarshal(data, &candidates); err != nil {
+		return nil, fmt.Errorf("failed to parse image hashes: %w", err)
+	}
+
+	var matches []DuplicateMatch
+	for _, candidate := range candidates {
+		candidateHash, err := image.ParseHash(candidate.Hash)
+		if err != nil {
+			continue
+		}
+		if distance := image.HammingDistance(hash, candidateHash); distance <= duplicateMaxDistance {
+			matches = append(matches, DuplicateMatch{
+				ListingID: candidate.ListingID,
+				SellerID:  candidate.SellerID,
+				ImageID:   candidate.ImageID,
+				Distance:  distance,
+			})
+		}
+	}
+
+	return matches, nil
+}
+
+// duplicateWarnings turns matches with the seller's own listings into messages for the seller
+func duplicateWarnings(matches []DuplicateMatch) []string {
+	seen := make(map[uuid.UUID]bool)
+	warnings := []string{}
+	for _, match := range matches {
+		if seen[match.ListingID] {
+			continue
+		}
+		seen[match.ListingID] = true
+		warnings = append(warnings, fmt.Sprintf("This listing reuses photos from your listing %s. Please remove the old listing if it is the same item.", match.ListingID))
+	}
+	return warnings
+}
+
+// GetListingFlags lists flagged listings for moderators, newest first.
+// Optional query parameters: reason and limit.
+func GetListingFlags(c *fiber.Ctx) error {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create client")
+	}
+
+	query := "order=created_at.desc"
+	if reason := c.Query("reason"); reason != "" {
+		if reason != FlagDuplicateImages {
+			return errors.ValidationError("Invalid flag reason", "reason")
+		}
+		query += "&reason=eq." + reason
+	}
+
+	limit := 50
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 200 {
+			return errors.ValidationError("Limit must be a number between 1 and 200", "limit")
+		}
+		limit = parsed
+	}
+	query += fmt.Sprintf("&limit=%d", limit)
+
+	data, err := client.GET(listingFlagsTable, query)
+	if err != nil {
+		return errors.DatabaseError("Failed to fetch listing flags: " + err.Error())
+	}
+
+	var flags []lib.FetchedListingFlag
+	if err := json.Unmarshal(data, &flags); err != nil {
+		return errors.InternalServerError("Failed to parse listing flags: " + err.Error())
+	}
+
+	if flags == nil {
+		flags = []lib.FetchedListingFlag{}
+	}
+
+	return errors.SuccessResponse(c, flags)
+}
+
+// DismissListingFlags clears the flags of a listing that a moderator decided to keep
+func DismissListingFlags(c *fiber.Ctx) error {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create client")
+	}
+
+	listingID, err := uuid.Parse(c.Params("listing_id"))
+	if err != nil {
+		return errors.BadRequest("Invalid listing ID format")
+	}
+
+	if _, err := client.DELETE(listingFlagsTable, fmt.Sprintf("listing_id=eq.%s", listingID)); err != nil {
+		return errors.DatabaseError("Failed to dismiss listing flags: " + err.Error())
+	}
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"message": "Listing flags dismissed successfully",
+	})
+}
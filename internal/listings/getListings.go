@@ -3,13 +3,16 @@ package listings
 import (
 	"fmt"
 	"greenvue/internal/db"
+	"greenvue/internal/ratings"
 	"greenvue/lib"
 	"greenvue/lib/errors"
+	"log"
 	"strings"
 
 	"encoding/json"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 )
 
 const viewName string = "listing_details"
@@ -43,6 +46,8 @@ func GetListings(c *fiber.Ctx) error {
 		listings = []lib.FetchedListing{}
 	}
 
+	attachSellerRatings(listings)
+
 	return errors.SuccessResponse(c, listings)
 }
 
@@ -81,6 +86,8 @@ func GetListingById(c *fiber.Ctx) error {
 		return errors.SuccessResponse(c, lib.FetchedListing{})
 	}
 
+	attachSellerRatings(listings)
+
 	return errors.SuccessResponse(c, listings[0])
 }
 
@@ -108,6 +115,8 @@ func GetListingByCategory(c *fiber.Ctx) error {
 		return errors.InternalServerError("Failed to parse listings data")
 	}
 
+	attachSellerRatings(listings)
+
 	return errors.SuccessResponse(c, listings)
 }
 
@@ -142,5 +151,30 @@ func GetListingBySeller(c *fiber.Ctx) error {
 		listings = []lib.FetchedListing{}
 	}
 
+	attachSellerRatings(listings)
+
 	return errors.SuccessResponse(c, listings)
 }
+
+// attachSellerRatings adds the seller rating breakdown to each listing.
+// Failures are logged and the listings are returned without breakdowns.
+func attachSellerRatings(listings []lib.FetchedListing) {
+	if len(listings) == 0 {
+		return
+	}
+
+	sellerIDs := make([]uuid.UUID, len(listings))
+	for i, listing := range listings {
+		sellerIDs[i] = listing.SellerID
+	}
+
+	breakdowns, err := ratings.GetMany(sellerIDs)
+	if err != nil {
+		log.Printf("Failed to fetch seller rating breakdowns: %v", err)
+		return
+	}
+
+	for i := range listings {
+		listings[i].SellerRatingBreakdown = breakdowns[listings[i].SellerID]
+	}
+}
@@ -7,10 +7,8 @@ import (
 	"greenvue/lib/errors"
 	img "greenvue/lib/image"
 	"image"
-	"image/jpeg"
 	_ "image/jpeg" // register JPEG format
-	"image/png"
-	_ "image/png" // register PNG format
+	_ "image/png"  // register PNG format
 	"io"
 	"log"
 	"mime/multipart"
@@ -27,72 +25,50 @@ type ImageProcessor struct {
 	processor *FileProcessor
 }
 
-// validateImage checks if the data is a valid image file
+// validateImage checks if the data is a supported image file.
+// The format is sniffed from the content; file names and declared content types are not trusted.
 func validateImage(data []byte) (string, error) {
-	// Create a bytes reader from the data
-	reader := bytes.NewReader(data)
-
-	// Attempt to decode as image
-	_, format, err := image.DecodeConfig(reader)
-	if err != nil {
-		return "", fmt.Errorf("invalid image file: failed to decode image")
-	}
-	// Only allow specific formats
-	format = strings.ToLower(format)
-	allowedFormats := map[string]bool{
-		"jpeg": true,
-		"jpg":  true,
-		"png":  true,
-		"webp": true,
-	}
-	if !allowedFormats[format] {
-		if format == "gif" {
-			return "", fmt.Errorf("GIF format is not supported, please convert to JPG or PNG")
+	format := img.SniffFormat(data)
+
+	switch format {
+	case "jpeg", "png", "webp", "gif":
+	case "heic", "avif":
+		// Only accepted when a decoder for them has been registered
+		if !img.CanDecode(data) {
+			return "", fmt.Errorf("%s images are not supported yet, please convert to JPG or PNG", strings.ToUpper(format))
 		}
+	case "":
+		return "", fmt.Errorf("Unsupported image format")
+	default:
 		return "", fmt.Errorf("Unsupported image format: %s", format)
 	}
 
+	if !img.CanDecode(data) {
+		return "", fmt.Errorf("invalid image file: failed to decode image")
+	}
+
 	return format, nil
 }
 
-// stripExifMetadata removes all EXIF metadata from an image
-func stripExifMetadata(imgData []byte) []byte {
-	// Create a new reader from the image data
-	reader := bytes.NewReader(imgData)
+// decodeUpload decodes an upload and turns it upright according to its EXIF orientation.
+// The decoded pixels carry no metadata, so EXIF data such as GPS positions never reaches the stored files.
+// Animated GIFs are reduced to their first frame.
+func decodeUpload(data []byte) (image.Image, error) {
+	orientation := img.ReadOrientation(data)
 
-	// Decode the image to get its basic properties (without metadata)
-	img, format, err := image.Decode(reader)
+	decoded, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
-		// If we can't decode it, return the original data
-		log.Println("Error decoding image for metadata stripping:", err)
-		return imgData
-	}
-
-	// Create a new buffer to hold the clean image
-	cleanBuffer := new(bytes.Buffer)
-	// Re-encode the image based on its original format, which drops the metadata
-	switch strings.ToLower(format) {
-	case "jpeg", "jpg":
-		// Re-encode as JPEG (this drops metadata)
-		err = jpeg.Encode(cleanBuffer, img, &jpeg.Options{Quality: 100}) // 80% quality is applied when encoding to Webp, keep at 100% to prevent double compression artifacts
-	case "png":
-		// Re-encode as PNG (this drops metadata)
-		err = png.Encode(cleanBuffer, img)
-	default:
-		// For unknown formats, return the original
-		return imgData
-	}
-
-	if err != nil {
-		log.Println("Error re-encoding image for metadata stripping:", err)
-		return imgData // Return original if re-encoding fails
+		return nil, err
 	}
 
-	return cleanBuffer.Bytes()
+	return img.ApplyOrientation(decoded, orientation), nil
 }
 
-// convertToWebP converts any image to WebP format with validation and metadata stripping
-func convertToWebP(reader io.Reader) (*bytes.Buffer, error) {
+// processUpload validates an upload, turns it upright and encodes one WebP per rendition preset.
+// Presets larger than the image reuse the previous rendition instead of enlarging it.
+// The returned job also carries the placeholder and perceptual hash; the placeholder is nil
+// when it could not be computed, the upload does not fail because of it.
+func processUpload(reader io.Reader, baseName string) (*img.ImageJob, error) {
 	// Read all data from the reader
 	imgData, err := io.ReadAll(reader)
 	if err != nil {
@@ -107,43 +83,85 @@ func convertToWebP(reader io.Reader) (*bytes.Buffer, error) {
 		return nil, err
 	}
 
-	// Strip EXIF metadata
-	cleanImgData := stripExifMetadata(imgData)
+	// Decode with the EXIF orientation applied, which also drops the metadata
+	source, err := decodeUpload(imgData)
+	if err != nil {
+		log.Println("Error decoding image:", err)
+		return nil, err
+	}
 
 	// Clear original image data to free memory
 	imgData = nil
 
-	// Decode the cleaned image
-	img, _, err := image.Decode(bytes.NewReader(cleanImgData))
+	// Blurhash, inline preview and dominant colour for the loading state
+	placeholder, err := img.CreatePlaceholder(source)
 	if err != nil {
-		log.Println("Error decoding cleaned image:", err)
-		return nil, err
+		log.Println("Error creating image placeholder:", err)
 	}
 
-	// Clear cleaned image data to free memory
-	cleanImgData = nil
+	// Perceptual hash for finding re-uploaded photos
+	perceptualHash := img.DifferenceHash(source)
+
+	bounds := source.Bounds()
+	var renditions []img.Rendition
+
+	for _, preset := range img.GetRenditionPresets() {
+		width, height := fitWithin(bounds.Dx(), bounds.Dy(), preset.MaxSize)
+
+		// The image is smaller than this preset, so it would be the same file as the previous one
+		if len(renditions) > 0 {
+			previous := renditions[len(renditions)-1]
+			if previous.Width == width && previous.Height == height {
+				renditions = append(renditions, img.Rendition{
+					Name:     preset.Name,
+					FileName: previous.FileName,
+					Width:    previous.Width,
+					Height:   previous.Height,
+					Bytes:    previous.Bytes,
+				})
+				continue
+			}
+		}
 
-	// Resize while maintaining aspect ratio (max 640px)
-	resizedImg := resize.Resize(0, 640, img, resize.Lanczos3)
+		resized := source
+		if width != bounds.Dx() || height != bounds.Dy() {
+			resized = resize.Resize(uint(width), uint(height), source, resize.Lanczos3)
+		}
 
-	// Clear original image to free memory
-	img = nil
+		// Encode to WebP
+		webpBuffer := new(bytes.Buffer)
+		if err := webp.Encode(webpBuffer, resized, &webp.Options{Quality: float32(preset.Quality)}); err != nil {
+			log.Println("Error encoding WebP:", err)
+			return nil, err
+		}
 
-	// Encode to WebP
-	webpBuffer := new(bytes.Buffer)
-	webpOptions := &webp.Options{Quality: 80} // Reduced from 100 to save memory and bandwidth
-	err = webp.Encode(webpBuffer, resizedImg, webpOptions)
+		renditions = append(renditions, img.Rendition{
+			Name:     preset.Name,
+			FileName: img.RenditionFileName(baseName, preset.Name),
+			Width:    width,
+			Height:   height,
+			Bytes:    webpBuffer.Len(),
+			Data:     webpBuffer.Bytes(),
+		})
+	}
 
-	// Clear resized image to free memory
-	resizedImg = nil
+	return &img.ImageJob{
+		Renditions:     renditions,
+		Placeholder:    placeholder,
+		PerceptualHash: img.FormatHash(perceptualHash),
+	}, nil
+}
 
-	if err != nil {
-		log.Println("Error encoding WebP:", err)
-		return nil, err
+// fitWithin scales width and height to fit in a maxSize square, keeping the aspect ratio and never enlarging
+func fitWithin(width, height, maxSize int) (int, int) {
+	if width <= maxSize && height <= maxSize {
+		return width, height
 	}
 
-	// Return the WebP buffer
-	return webpBuffer, nil
+	if width >= height {
+		return maxSize, max(1, height*maxSize/width)
+	}
+	return max(1, width*maxSize/height), maxSize
 }
 
 // ProcessFile handles the processing of a single file
@@ -163,32 +181,25 @@ func (fp *FileProcessor) ProcessFile(fileHeader *multipart.FileHeader) (*img.Ima
 	}
 	defer src.Close()
 
-	// Convert to WebP directly from the reader to avoid keeping original data in memory
-	webpData, err := convertToWebP(src)
+	// Generate unique base name shared by all renditions
+	baseName := fmt.Sprintf("%s-%s", lib.SanitizeFilename(fp.listingTitle), uuid.New().String())
+
+	// Convert to WebP renditions directly from the reader to avoid keeping original data in memory
+	imageJob, err := processUpload(src, baseName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to convert %s to WebP: %w", fileHeader.Filename, err)
 	}
 
-	// Generate unique filename
-	fileName := fmt.Sprintf("%s-%s.webp", lib.SanitizeFilename(fp.listingTitle), uuid.New().String())
-
-	// Create image job
-	imageJob := &img.ImageJob{
-		ID:           uuid.New().String(),
-		FileName:     fileName,
-		ListingTitle: fp.listingTitle,
-		ImageData:    webpData.Bytes(),
-		CreatedAt:    time.Now(),
-		Status:       "pending",
-		MaxRetries:   3,
-	}
-
-	// Clear webpData buffer to free memory
-	webpData = nil
+	// Complete the image job
+	imageJob.ID = uuid.New().String()
+	imageJob.ListingTitle = fp.listingTitle
+	imageJob.CreatedAt = time.Now()
+	imageJob.Status = img.StatusPending
+	imageJob.MaxRetries = 3
 
 	// Queue the image
 	if err := img.QueueImage(*imageJob); err != nil {
-		return nil, fmt.Errorf("failed to queue image %s: %w", fileName, err)
+		return nil, fmt.Errorf("failed to queue image %s: %w", baseName, err)
 	}
 
 	return imageJob, nil
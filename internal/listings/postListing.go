@@ -11,6 +11,7 @@ import (
 	"mime/multipart"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 )
 
 const (
@@ -19,6 +20,11 @@ const (
 	listingFormKey = "listing"
 	fileFormKey    = "file"
 	titleFormKey   = "listing_title"
+
+	// Listing image states, updated once the queued uploads finish
+	ImageStatusProcessing = "processing"
+	ImageStatusReady      = "ready"
+	ImageStatusFailed     = "failed"
 )
 
 // ImageInfo represents the response structure for processed images
@@ -72,10 +78,10 @@ func (fh *FormHandler) ExtractListingJSON(form *multipart.Form) (*lib.Listing, e
 	return &listing, nil
 }
 
-// buildFinalListing creates the final listing with sanitized data and image URLs
-func buildFinalListing(listing *lib.Listing, imageInfos []ImageInfo) lib.Listing {
-	imageUrls := make([]string, len(imageInfos))
-	for i, img := range imageInfos {
+// buildFinalListing creates the final listing with sanitized data and images
+func buildFinalListing(listing *lib.Listing, images []lib.ListingImage) lib.Listing {
+	imageUrls := make([]string, len(images))
+	for i, img := range images {
 		imageUrls[i] = img.URL
 	}
 
@@ -89,6 +95,8 @@ func buildFinalListing(listing *lib.Listing, imageInfos []ImageInfo) lib.Listing
 		EcoScore:      lib.CalculateEcoScore(listing.EcoAttributes),
 		EcoAttributes: listing.EcoAttributes,
 		ImageUrls:     imageUrls,
+		Images:        images,
+		ImageStatus:   ImageStatusProcessing,
 		SellerID:      listing.SellerID,
 	}
 }
@@ -134,6 +142,34 @@ func saveListing(client *db.SupabaseClient, listing lib.Listing) (*lib.Listing,
 	return &createdListing, nil
 }
 
+// UpdateImageStatus records on a listing whether all of its images were uploaded.
+// It is called by the image queue once the last image of the listing is done.
+func UpdateImageStatus(listingID string, done image.ImagesDone) {
+	client := db.GetGlobalClient()
+	if client == nil {
+		log.Printf("Failed to update the image status of listing %s: no database client", listingID)
+		return
+	}
+
+	id, err := uuid.Parse(listingID)
+	if err != nil {
+		log.Printf("Invalid listing ID %q on image jobs", listingID)
+		return
+	}
+
+	status := ImageStatusReady
+	if !done.Ready() {
+		status = ImageStatusFailed
+		log.Printf("%d of the images of listing %s failed to upload", len(done.Failed), listingID)
+	}
+
+	if _, err := client.PATCH("listings", id, map[string]any{
+		"image_status": status,
+	}); err != nil {
+		log.Printf("Failed to update the image status of listing %s: %v", listingID, err)
+	}
+}
+
 // PostListing handles the creation of a new listing with images
 func PostListing(c *fiber.Ctx) error {
 	// Get database client
@@ -179,7 +215,7 @@ func PostListing(c *fiber.Ctx) error {
 	}
 
 	// Store image information before processing to ensure URLs are available
-	var imageInfos []ImageInfo
+	var listingImages []lib.ListingImage
 	for _, id := range queuedImageIds {
 		imageJob, _ := image.GetImageJob(id)
 		if imageJob != nil {
@@ -188,25 +224,12 @@ func PostListing(c *fiber.Ctx) error {
 				imageJob.PublicURL = image.GenerateImageURL(imageJob.FileName)
 			}
 
-			imageInfos = append(imageInfos, ImageInfo{
-				ID:       imageJob.ID,
-				URL:      imageJob.PublicURL,
-				FileName: imageJob.FileName,
-				Status:   "pending", // Will be processed soon
-			})
+			listingImages = append(listingImages, imageJob.ListingImage())
 		}
 	}
 
-	// Process the queued images in the background so we don't block the response
-	if image.GlobalImageQueue != nil {
-		go func() {
-			// Process all queued images (using a large batch size to process all of them)
-			image.GlobalImageQueue.ProcessQueue(len(queuedImageIds))
-		}()
-	}
-
 	// Build final listing with sanitized data and image URLs
-	finalListing := buildFinalListing(listing, imageInfos)
+	finalListing := buildFinalListing(listing, listingImages)
 
 	// Save listing to database
 	savedListing, err := saveListing(client, finalListing)
@@ -214,8 +237,21 @@ func PostListing(c *fiber.Ctx) error {
 		return err
 	}
 
+	// Compare the photos with other listings; the seller is warned about re-posting their own
+	warnings := []string{}
+	if savedListing.ID != nil {
+		ownDuplicates := checkDuplicateImages(client, *savedListing.ID, savedListing.SellerID, finalListing.Images)
+		warnings = duplicateWarnings(ownDuplicates)
+
+		// The image workers are already uploading; the queue marks the listing once they are done
+		if image.GlobalImageQueue != nil {
+			image.GlobalImageQueue.AssignListing(queuedImageIds, savedListing.ID.String())
+		}
+	}
+
 	// Return success response
 	return errors.SuccessResponse(c, fiber.Map{
-		"listing": savedListing,
+		"listing":  savedListing,
+		"warnings": warnings,
 	})
 }
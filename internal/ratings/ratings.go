@@ -0,0 +1,175 @@
+package ratings
+
+import (
+	"encoding/json"
+	"fmt"
+	"greenvue/internal/db"
+	"greenvue/lib"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ratingsTable = "seller_ratings"
+	reviewsTable = "reviews"
+)
+
+// Bayesian prior used to smooth seller scores. A seller with few reviews is pulled
+// towards PriorMean, and needs roughly PriorWeight reviews before their own average dominates.
+var (
+	PriorMean   = 3.5
+	PriorWeight = 5.0
+)
+
+// BayesianScore returns the smoothed rating for a seller with the given number of reviews and rating sum
+func BayesianScore(count int, sum int) float32 {
+	score := (PriorWeight*PriorMean + float64(sum)) / (PriorWeight + float64(count))
+	return round(score)
+}
+
+// Compute builds a rating breakdown from a list of star values
+func Compute(sellerID uuid.UUID, stars []int) lib.SellerRating {
+	rating := lib.SellerRating{
+		SellerID:  sellerID,
+		Histogram: map[int]int{1: 0, 2: 0, 3: 0, 4: 0, 5: 0},
+		UpdatedAt: time.Now().UTC(),
+	}
+
+	sum := 0
+	for _, star := range stars {
+		if star < 1 || star > 5 {
+			continue
+		}
+		rating.Histogram[star]++
+		rating.ReviewCount++
+		sum += star
+	}
+
+	if rating.ReviewCount > 0 {
+		rating.Average = round(float64(sum) / float64(rating.ReviewCount))
+	}
+	rating.Score = BayesianScore(rating.ReviewCount, sum)
+
+	return rating
+}
+
+// Recompute recalculates and stores the rating breakdown for a seller.
+// It should be called whenever one of the seller's reviews is created, edited or deleted.
+func Recompute(sellerID uuid.UUID) (*lib.SellerRating, error) {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return nil, fmt.Errorf("database client not available")
+	}
+
+	data, err := client.GET(reviewsTable, fmt.Sprintf("select=rating&seller_id=eq.%s", sellerID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch reviews: %w", err)
+	}
+
+	var reviews []struct {
+		Rating int `json:"rating"`
+	}
+	if err := json.Unmarshal(data, &reviews); err != nil {
+		return nil, fmt.Errorf("failed to parse reviews: %w", err)
+	}
+
+	stars := make([]int, len(reviews))
+	for i, review := range reviews {
+		stars[i] = review.Rating
+	}
+
+	rating := Compute(sellerID, stars)
+
+	// Update the existing row, or create it if the seller has no breakdown yet
+	resp, err := client.PATCH(ratingsTable, sellerID, rating)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update seller rating: %w", err)
+	}
+
+	if len(resp) == 0 || string(resp) == "[]" {
+		if _, err := client.POST(ratingsTable, rating); err != nil {
+			return nil, fmt.Errorf("failed to create seller rating: %w", err)
+		}
+	}
+
+	// Keep the denormalised rating on the user in sync so existing views stay correct
+	if _, err := client.PATCH("users", sellerID, map[string]any{
+		"rating": rating.Score,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to update user rating: %w", err)
+	}
+
+	return &rating, nil
+}
+
+// RecomputeAsync recalculates a seller's rating in the background and logs failures
+func RecomputeAsync(sellerID uuid.UUID) {
+	go func() {
+		if _, err := Recompute(sellerID); err != nil {
+			log.Printf("Failed to recompute rating for seller %s: %v", sellerID, err)
+		}
+	}()
+}
+
+// Get returns the stored rating breakdown for a seller, or an empty breakdown if none exists
+func Get(sellerID uuid.UUID) (*lib.SellerRating, error) {
+	ratings, err := GetMany([]uuid.UUID{sellerID})
+	if err != nil {
+		return nil, err
+	}
+
+	if rating, ok := ratings[sellerID]; ok {
+		return rating, nil
+	}
+
+	empty := Compute(sellerID, nil)
+	return &empty, nil
+}
+
+// GetMany returns the stored rating breakdowns for a set of sellers keyed by seller ID
+func GetMany(sellerIDs []uuid.UUID) (map[uuid.UUID]*lib.SellerRating, error) {
+	result := make(map[uuid.UUID]*lib.SellerRating, len(sellerIDs))
+	if len(sellerIDs) == 0 {
+		return result, nil
+	}
+
+	client := db.GetGlobalClient()
+	if client == nil {
+		return nil, fmt.Errorf("database client not available")
+	}
+
+	seen := make(map[uuid.UUID]bool, len(sellerIDs))
+	ids := make([]string, 0, len(sellerIDs))
+	for _, id := range sellerIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id.String())
+	}
+
+	data, err := client.GET(ratingsTable, fmt.Sprintf("id=in.(%s)", strings.Join(ids, ",")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch seller ratings: %w", err)
+	}
+
+	var ratings []lib.SellerRating
+	if err := json.Unmarshal(data, &ratings); err != nil {
+		return nil, fmt.Errorf("failed to parse seller ratings: %w", err)
+	}
+
+	for i := range ratings {
+		result[ratings[i].SellerID] = &ratings[i]
+	}
+
+	return result, nil
+}
+
+// round rounds a rating to two decimal places
+func round(value float64) float32 {
+	return float32(math.Round(value*100) / 100)
+}
@@ -0,0 +1,66 @@
+package reviews
+
+import (
+	"fmt"
+	"greenvue/internal/auth"
+	"greenvue/internal/db"
+	"greenvue/internal/ratings"
+	"greenvue/lib"
+	"greenvue/lib/errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// DeleteReview removes a review written by the current user, together with its reply and votes
+func DeleteReview(c *fiber.Ctx) error {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create client")
+	}
+
+	claims, ok := c.Locals("user").(*auth.Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	reviewID, err := uuid.Parse(c.Params("review_id"))
+	if err != nil {
+		return errors.BadRequest("Invalid review ID format")
+	}
+
+	review, err := getReview(client, reviewID)
+	if err != nil {
+		return err
+	}
+
+	if review.UserID != claims.UserId {
+		return errors.Forbidden("You can only delete your own reviews")
+	}
+
+	if err := removeReview(client, review); err != nil {
+		return err
+	}
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"message": "Review deleted successfully",
+	})
+}
+
+// removeReview deletes a review with its reply, votes and reports and refreshes the seller's rating
+func removeReview(client *db.SupabaseClient, review *lib.FetchedReview) error {
+	// Remove dependent rows first so the review can be deleted cleanly
+	dependents := fmt.Sprintf("review_id=eq.%s", review.ID)
+	for _, table := range []string{repliesTable, helpfulVotesTable, reportsTable} {
+		if _, err := client.DELETE(table, dependents); err != nil {
+			return errors.DatabaseError("Failed to delete review data: " + err.Error())
+		}
+	}
+
+	if _, err := client.DELETE(reviewsTable, fmt.Sprintf("id=eq.%s", review.ID)); err != nil {
+		return errors.DatabaseError("Failed to delete review: " + err.Error())
+	}
+
+	ratings.RecomputeAsync(review.SellerID)
+	return nil
+}
@@ -0,0 +1,171 @@
+package reviews
+
+import (
+	"encoding/json"
+	"fmt"
+	"greenvue/internal/auth"
+	"greenvue/internal/db"
+	"greenvue/lib"
+	"greenvue/lib/errors"
+	"greenvue/lib/validation"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	helpfulVotesTable = "review_helpful_votes"
+	reportsTable      = "review_reports"
+)
+
+// ToggleHelpful marks a review as helpful for the current user, or removes the vote if it already exists
+func ToggleHelpful(c *fiber.Ctx) error {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create client")
+	}
+
+	claims, ok := c.Locals("user").(*auth.Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	reviewID, err := uuid.Parse(c.Params("review_id"))
+	if err != nil {
+		return errors.BadRequest("Invalid review ID format")
+	}
+
+	review, err := getReview(client, reviewID)
+	if err != nil {
+		return err
+	}
+
+	if review.UserID == claims.UserId {
+		return errors.Forbidden("You cannot vote on your own review")
+	}
+
+	voteQuery := fmt.Sprintf("review_id=eq.%s&user_id=eq.%s", reviewID, claims.UserId)
+	data, err := client.GET(helpfulVotesTable, voteQuery)
+	if err != nil {
+		return errors.DatabaseError("Failed to check existing vote: " + err.Error())
+	}
+
+	var votes []lib.ReviewHelpfulVote
+	if err := json.Unmarshal(data, &votes); err != nil {
+		return errors.InternalServerError("Failed to parse vote data: " + err.Error())
+	}
+
+	helpful := len(votes) == 0
+	if helpful {
+		_, err = client.POST(helpfulVotesTable, lib.ReviewHelpfulVote{
+			ReviewID: reviewID,
+			UserID:   claims.UserId,
+		})
+		// A concurrent request from the same user already inserted the vote
+		if err != nil && !strings.Contains(err.Error(), "duplicate key value") {
+			return errors.DatabaseError("Failed to add vote: " + err.Error())
+		}
+	} else {
+		if _, err := client.DELETE(helpfulVotesTable, voteQuery); err != nil {
+			return errors.DatabaseError("Failed to remove vote: " + err.Error())
+		}
+	}
+
+	count, err := refreshHelpfulCount(client, reviewID)
+	if err != nil {
+		return errors.DatabaseError("Failed to update helpful count: " + err.Error())
+	}
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"review_id":     reviewID,
+		"helpful":       helpful,
+		"helpful_count": count,
+	})
+}
+
+// refreshHelpfulCount recounts the votes for a review and stores the result on the review
+func refreshHelpfulCount(client *db.SupabaseClient, reviewID uuid.UUID) (int, error) {
+	data, err := client.GET(helpfulVotesTable, fmt.Sprintf("select=user_id&review_id=eq.%s", reviewID))
+	if err != nil {
+		return 0, err
+	}
+
+	var votes []lib.ReviewHelpfulVote
+	if err := json.Unmarshal(data, &votes); err != nil {
+		return 0, err
+	}
+
+	if _, err := client.PATCH(reviewsTable, reviewID, map[string]any{
+		"helpful_count": len(votes),
+	}); err != nil {
+		return 0, err
+	}
+
+	return len(votes), nil
+}
+
+// ReportReview files a moderation report against a review
+func ReportReview(c *fiber.Ctx) error {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create client")
+	}
+
+	claims, ok := c.Locals("user").(*auth.Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	reviewID, err := uuid.Parse(c.Params("review_id"))
+	if err != nil {
+		return errors.BadRequest("Invalid review ID format")
+	}
+
+	var payload struct {
+		Reason  string `json:"reason"`
+		Details string `json:"details"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return errors.BadRequest("Invalid request body: " + err.Error())
+	}
+
+	report := lib.ReviewReport{
+		ReviewID:   reviewID,
+		ReporterID: claims.UserId,
+		Reason:     strings.ToLower(strings.TrimSpace(payload.Reason)),
+		Details:    lib.SanitizeInput(payload.Details),
+	}
+
+	if err := firstValidationError(validation.ValidateReviewReport(report)); err != nil {
+		return err
+	}
+
+	// Make sure the review exists before accepting a report for it
+	if _, err := getReview(client, reviewID); err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("review_id=eq.%s&reporter_id=eq.%s", reviewID, claims.UserId)
+	data, err := client.GET(reportsTable, query)
+	if err != nil {
+		return errors.DatabaseError("Failed to check existing reports: " + err.Error())
+	}
+
+	var reports []lib.ReviewReport
+	if err := json.Unmarshal(data, &reports); err != nil {
+		return errors.InternalServerError("Failed to parse report data: " + err.Error())
+	}
+
+	if len(reports) > 0 {
+		return errors.AlreadyExists("You have already reported this review")
+	}
+
+	if _, err := client.POST(reportsTable, report); err != nil {
+		return errors.DatabaseError("Failed to report review: " + err.Error())
+	}
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"message": "Review reported successfully",
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"greenvue/internal/db"
 	"greenvue/lib"
 	"greenvue/lib/errors"
+	"strconv"
 
 	"encoding/json"
 
@@ -13,6 +14,13 @@ import (
 
 const viewName string = "review_with_username"
 
+// reviewSortOrders maps the supported sort query values to PostgREST order clauses
+var reviewSortOrders = map[string]string{
+	"newest":  "created_at.desc",
+	"helpful": "helpful_count.desc,created_at.desc",
+	"rating":  "rating.desc,created_at.desc",
+}
+
 func GetReviews(c *fiber.Ctx) error {
 	client := db.GetGlobalClient()
 	if client == nil {
@@ -26,7 +34,31 @@ func GetReviews(c *fiber.Ctx) error {
 	}
 
 	limit := c.Query("limit", "50")
-	query := fmt.Sprintf("select=*&limit=%s&seller_id=eq.%s", limit, selectedSeller)
+	if !lib.IsNumeric(limit) {
+		return errors.BadRequest("Limit must be a positive number")
+	}
+
+	sortBy := c.Query("sort", "newest")
+	order, ok := reviewSortOrders[sortBy]
+	if !ok {
+		return errors.BadRequest("Sort must be one of: newest, helpful, rating")
+	}
+
+	// Rating ascending is useful for surfacing critical reviews first
+	if sortBy == "rating" && c.Query("order") == "asc" {
+		order = "rating.asc,created_at.desc"
+	}
+
+	query := fmt.Sprintf("select=*&limit=%s&seller_id=eq.%s&order=%s", limit, selectedSeller, order)
+
+	// Optional filter on star value
+	if stars := c.Query("rating"); stars != "" {
+		rating, err := strconv.Atoi(stars)
+		if err != nil || rating < 1 || rating > 5 {
+			return errors.BadRequest("Rating filter must be between 1 and 5")
+		}
+		query += fmt.Sprintf("&rating=eq.%d", rating)
+	}
 
 	// Use standardized GET operation
 	data, err := client.GET(viewName, query)
@@ -47,5 +79,10 @@ func GetReviews(c *fiber.Ctx) error {
 		reviews = []lib.FetchedReview{}
 	}
 
+	// Seller replies are returned inline with their review
+	if err := attachReplies(client, reviews); err != nil {
+		return errors.DatabaseError("Failed to fetch review replies: " + err.Error())
+	}
+
 	return errors.SuccessResponse(c, reviews)
 }
@@ -0,0 +1,121 @@
+package reviews
+
+import (
+	"encoding/json"
+	"fmt"
+	"greenvue/internal/auth"
+	"greenvue/internal/db"
+	"greenvue/lib"
+	"greenvue/lib/errors"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// GetReviewReports lists reported reviews for moderators, newest reports first.
+// Optional query parameters: reason and limit.
+func GetReviewReports(c *fiber.Ctx) error {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create client")
+	}
+
+	query := "order=created_at.desc"
+
+	if reason := strings.ToLower(c.Query("reason")); reason != "" {
+		valid := false
+		for _, allowed := range lib.ReviewReportReasons {
+			if reason == allowed {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return errors.ValidationError("Invalid report reason", "reason")
+		}
+		query += "&reason=eq." + reason
+	}
+
+	limit := 50
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 200 {
+			return errors.ValidationError("Limit must be a number between 1 and 200", "limit")
+		}
+		limit = parsed
+	}
+	query += fmt.Sprintf("&limit=%d", limit)
+
+	data, err := client.GET(reportsTable, query)
+	if err != nil {
+		return errors.DatabaseError("Failed to fetch reports: " + err.Error())
+	}
+
+	var reports []lib.FetchedReviewReport
+	if err := json.Unmarshal(data, &reports); err != nil {
+		return errors.InternalServerError("Failed to parse report data: " + err.Error())
+	}
+
+	if reports == nil {
+		reports = []lib.FetchedReviewReport{}
+	}
+
+	return errors.SuccessResponse(c, reports)
+}
+
+// RemoveReview lets a moderator delete any review, for example after it was reported
+func RemoveReview(c *fiber.Ctx) error {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create client")
+	}
+
+	claims, ok := c.Locals("user").(*auth.Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	reviewID, err := uuid.Parse(c.Params("review_id"))
+	if err != nil {
+		return errors.BadRequest("Invalid review ID format")
+	}
+
+	review, err := getReview(client, reviewID)
+	if err != nil {
+		return err
+	}
+
+	if err := removeReview(client, review); err != nil {
+		return err
+	}
+
+	log.Printf("Moderator %s removed review %s by user %s", claims.UserId, reviewID, review.UserID)
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"message": "Review removed successfully",
+	})
+}
+
+// DismissReviewReports clears the reports of a review that a moderator decided to keep
+func DismissReviewReports(c *fiber.Ctx) error {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create client")
+	}
+
+	reviewID, err := uuid.Parse(c.Params("review_id"))
+	if err != nil {
+		return errors.BadRequest("Invalid review ID format")
+	}
+
+	if _, err := client.DELETE(reportsTable, fmt.Sprintf("review_id=eq.%s", reviewID)); err != nil {
+		return errors.DatabaseError("Failed to dismiss reports: " + err.Error())
+	}
+
+	return errors.SuccessResponse(c, fiber.Map{
+		"message": "Reports dismissed successfully",
+	})
+}
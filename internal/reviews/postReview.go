@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"greenvue/internal/auth"
 	"greenvue/internal/db"
+	"greenvue/internal/ratings"
 	"greenvue/lib"
 	"greenvue/lib/errors"
 	"greenvue/lib/validation"
+	"strings"
 
 	"encoding/json"
 
@@ -26,36 +28,45 @@ func PostReview(c *fiber.Ctx) error {
 	}
 
 	var payload struct {
-		Rating           int       `json:"rating"`
-		Title            string    `json:"title"`
-		Content          string    `json:"content"`
-		SellerID         uuid.UUID `json:"seller_id"`
-		VerifiedPurchase bool      `json:"verified_purchase"`
+		OrderID  uuid.UUID `json:"order_id"`
+		Rating   int       `json:"rating"`
+		Title    string    `json:"title"`
+		Content  string    `json:"content"`
+		SellerID uuid.UUID `json:"seller_id"`
 	}
 	if err := c.BodyParser(&payload); err != nil {
 		return errors.BadRequest("Invalid request body: " + err.Error())
 	}
 
 	review := lib.Review{
-		Rating:           payload.Rating,
-		Title:            lib.SanitizeInput(payload.Title),
-		Content:          lib.SanitizeInput(payload.Content),
-		SellerID:         payload.SellerID,
-		VerifiedPurchase: payload.VerifiedPurchase,
-		UserID:           claims.UserId,
+		OrderID:  payload.OrderID,
+		Rating:   payload.Rating,
+		Title:    lib.SanitizeInput(payload.Title),
+		Content:  lib.SanitizeInput(payload.Content),
+		SellerID: payload.SellerID,
+		UserID:   claims.UserId,
 	}
+
+	validator := validation.NewReviewValidator()
+
 	// Validate the review using the validation package
-	validationResult := validation.ValidateReview(review)
-	if !validationResult.Valid {
-		// Return the first validation error
-		for _, message := range validationResult.Errors {
-			return errors.BadRequest(message)
-		}
+	if err := firstValidationError(validator.ValidateReview(review)); err != nil {
+		return err
+	}
+
+	// Reviews must be backed by a completed order of the reviewer
+	order, err := getOrder(client, review.OrderID)
+	if err != nil {
+		return err
+	}
+
+	if err := firstValidationError(validator.ValidateReviewOrder(review, *order)); err != nil {
+		return err
 	}
 
-	// Check if the user has already reviewed this seller
-	query := fmt.Sprintf("reviews?user_id=%s&seller_id=%s", claims.UserId.String(), payload.SellerID.String())
-	existingReview, err := client.GET("reviews", query)
+	// Only one review is allowed per order
+	query := fmt.Sprintf("order_id=eq.%s", review.OrderID)
+	existingReview, err := client.GET(reviewsTable, query)
 	if err != nil {
 		return errors.DatabaseError("Failed to check existing reviews: " + err.Error())
 	}
@@ -65,14 +76,20 @@ func PostReview(c *fiber.Ctx) error {
 		return errors.InternalServerError("Failed to parse existing review data: " + err.Error())
 	}
 
-	// If the user has already reviewed this seller, return an error
 	if len(reviews) > 0 {
-		return errors.AlreadyExists("You have already reviewed this seller")
+		return errors.AlreadyExists("You have already reviewed this order")
 	}
 
+	// The order was verified above, so the review is always a verified purchase
+	review.VerifiedPurchase = true
+
 	// Use standardized POST operation
-	data, err := client.POST("reviews", review)
+	data, err := client.POST(reviewsTable, review)
 	if err != nil {
+		// The unique (order_id, user_id) constraint catches a concurrent request that passed the check above
+		if strings.Contains(err.Error(), "duplicate key value") {
+			return errors.AlreadyExists("You have already reviewed this order")
+		}
 		return errors.DatabaseError("Failed to post review: " + err.Error())
 	}
 
@@ -80,21 +97,12 @@ func PostReview(c *fiber.Ctx) error {
 		return errors.InternalServerError("Failed to create review")
 	}
 
-	// Parse the response
-	var createdReview lib.Review
-	if err := json.Unmarshal(data, &createdReview); err != nil {
-		// If the response is an array, try parsing it as an array
-		var reviewArray []lib.Review
-		if err := json.Unmarshal(data, &reviewArray); err != nil {
-			return errors.InternalServerError("Failed to parse review response: " + err.Error())
-		}
-
-		if len(reviewArray) == 0 {
-			return errors.InternalServerError("Empty review response")
-		}
-
-		createdReview = reviewArray[0]
+	createdReview, err := parseCreated[lib.Review](data)
+	if err != nil {
+		return errors.InternalServerError("Failed to parse review response: " + err.Error())
 	}
 
+	ratings.RecomputeAsync(review.SellerID)
+
 	return errors.SuccessResponse(c, createdReview)
 }
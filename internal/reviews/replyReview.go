@@ -0,0 +1,85 @@
+package reviews
+
+import (
+	"encoding/json"
+	"fmt"
+	"greenvue/internal/auth"
+	"greenvue/internal/db"
+	"greenvue/lib"
+	"greenvue/lib/errors"
+	"greenvue/lib/validation"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// PostReviewReply lets the reviewed seller post a single public reply to a review
+func PostReviewReply(c *fiber.Ctx) error {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create client")
+	}
+
+	claims, ok := c.Locals("user").(*auth.Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	reviewID, err := uuid.Parse(c.Params("review_id"))
+	if err != nil {
+		return errors.BadRequest("Invalid review ID format")
+	}
+
+	var payload struct {
+		Content string `json:"content"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return errors.BadRequest("Invalid request body: " + err.Error())
+	}
+
+	review, err := getReview(client, reviewID)
+	if err != nil {
+		return err
+	}
+
+	if review.SellerID != claims.UserId {
+		return errors.Forbidden("Only the reviewed seller can reply to this review")
+	}
+
+	reply := lib.ReviewReply{
+		ReviewID: reviewID,
+		SellerID: claims.UserId,
+		Content:  lib.SanitizeInput(payload.Content),
+	}
+
+	if err := firstValidationError(validation.ValidateReviewReply(reply)); err != nil {
+		return err
+	}
+
+	// Sellers get exactly one reply per review
+	existing, err := client.GET(repliesTable, fmt.Sprintf("review_id=eq.%s", reviewID))
+	if err != nil {
+		return errors.DatabaseError("Failed to check existing replies: " + err.Error())
+	}
+
+	var replies []lib.FetchedReviewReply
+	if err := json.Unmarshal(existing, &replies); err != nil {
+		return errors.InternalServerError("Failed to parse existing reply data: " + err.Error())
+	}
+
+	if len(replies) > 0 {
+		return errors.AlreadyExists("You have already replied to this review")
+	}
+
+	data, err := client.POST(repliesTable, reply)
+	if err != nil {
+		return errors.DatabaseError("Failed to post reply: " + err.Error())
+	}
+
+	createdReply, err := parseCreated[lib.FetchedReviewReply](data)
+	if err != nil {
+		return errors.InternalServerError("Failed to parse reply response: " + err.Error())
+	}
+
+	return errors.SuccessResponse(c, createdReply)
+}
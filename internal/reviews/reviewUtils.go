@@ -0,0 +1,130 @@
+package reviews
+
+import (
+	"encoding/json"
+	"fmt"
+	"greenvue/internal/db"
+	"greenvue/lib"
+	"greenvue/lib/errors"
+	"greenvue/lib/validation"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	reviewsTable = "reviews"
+	ordersTable  = "orders"
+	repliesTable = "review_replies"
+)
+
+// firstValidationError converts a failed validation result into a BadRequest error.
+// Fields are sorted so identical requests always report the same error.
+func firstValidationError(result *validation.ValidationResult) error {
+	if result == nil || result.Valid {
+		return nil
+	}
+	if len(result.Errors) == 0 {
+		return errors.BadRequest("Invalid review")
+	}
+
+	fields := make([]string, 0, len(result.Errors))
+	for field := range result.Errors {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	return errors.ValidationError(result.Errors[fields[0]], fields[0])
+}
+
+// getOrder fetches a single order by ID
+func getOrder(client *db.SupabaseClient, orderID uuid.UUID) (*lib.Order, error) {
+	data, err := client.GET(ordersTable, fmt.Sprintf("id=eq.%s", orderID))
+	if err != nil {
+		return nil, errors.DatabaseError("Failed to fetch order: " + err.Error())
+	}
+
+	var orders []lib.Order
+	if err := json.Unmarshal(data, &orders); err != nil {
+		return nil, errors.InternalServerError("Failed to parse order data: " + err.Error())
+	}
+
+	if len(orders) == 0 {
+		return nil, errors.NotFound("Order not found")
+	}
+
+	return &orders[0], nil
+}
+
+// getReview fetches a single review (with reviewer info) by ID
+func getReview(client *db.SupabaseClient, reviewID uuid.UUID) (*lib.FetchedReview, error) {
+	data, err := client.GET(viewName, fmt.Sprintf("id=eq.%s", reviewID))
+	if err != nil {
+		return nil, errors.DatabaseError("Failed to fetch review: " + err.Error())
+	}
+
+	var reviews []lib.FetchedReview
+	if err := json.Unmarshal(data, &reviews); err != nil {
+		return nil, errors.InternalServerError("Failed to parse review data: " + err.Error())
+	}
+
+	if len(reviews) == 0 {
+		return nil, errors.NotFound("Review not found")
+	}
+
+	return &reviews[0], nil
+}
+
+// attachReplies loads the seller replies for the given reviews and sets them inline
+func attachReplies(client *db.SupabaseClient, reviews []lib.FetchedReview) error {
+	if len(reviews) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(reviews))
+	for i, review := range reviews {
+		ids[i] = review.ID.String()
+	}
+
+	query := fmt.Sprintf("review_id=in.(%s)", strings.Join(ids, ","))
+	data, err := client.GET(repliesTable, query)
+	if err != nil {
+		return err
+	}
+
+	var replies []lib.FetchedReviewReply
+	if err := json.Unmarshal(data, &replies); err != nil {
+		return err
+	}
+
+	byReview := make(map[uuid.UUID]*lib.FetchedReviewReply, len(replies))
+	for i := range replies {
+		byReview[replies[i].ReviewID] = &replies[i]
+	}
+
+	for i := range reviews {
+		reviews[i].Reply = byReview[reviews[i].ID]
+	}
+
+	return nil
+}
+
+// parseCreated parses a Supabase insert/update response that may be an object or an array
+func parseCreated[T any](data []byte) (*T, error) {
+	var item T
+	if err := json.Unmarshal(data, &item); err == nil {
+		return &item, nil
+	}
+
+	var items []T
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, err
+	}
+
+	if len(items) == 0 {
+		return nil, fmt.Errorf("empty response")
+	}
+
+	return &items[0], nil
+}
@@ -0,0 +1,87 @@
+package reviews
+
+import (
+	"greenvue/internal/auth"
+	"greenvue/internal/db"
+	"greenvue/internal/ratings"
+	"greenvue/lib"
+	"greenvue/lib/errors"
+	"greenvue/lib/validation"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// UpdateReview lets the author edit a review within the edit window
+func UpdateReview(c *fiber.Ctx) error {
+	client := db.GetGlobalClient()
+	if client == nil {
+		return errors.InternalServerError("Failed to create client")
+	}
+
+	claims, ok := c.Locals("user").(*auth.Claims)
+	if !ok || claims == nil {
+		return errors.Unauthorized("User not authenticated")
+	}
+
+	reviewID, err := uuid.Parse(c.Params("review_id"))
+	if err != nil {
+		return errors.BadRequest("Invalid review ID format")
+	}
+
+	var payload struct {
+		Rating  int    `json:"rating"`
+		Title   string `json:"title"`
+		Content string `json:"content"`
+	}
+	if err := c.BodyParser(&payload); err != nil {
+		return errors.BadRequest("Invalid request body: " + err.Error())
+	}
+
+	existing, err := getReview(client, reviewID)
+	if err != nil {
+		return err
+	}
+
+	if existing.UserID != claims.UserId {
+		return errors.Forbidden("You can only edit your own reviews")
+	}
+
+	validator := validation.NewReviewValidator()
+	if !validator.CanEdit(existing.CreatedAt) {
+		return errors.Forbidden("Reviews can only be edited within 48 hours of posting")
+	}
+
+	review := lib.Review{
+		OrderID:  existing.OrderID,
+		Rating:   payload.Rating,
+		Title:    lib.SanitizeInput(payload.Title),
+		Content:  lib.SanitizeInput(payload.Content),
+		SellerID: existing.SellerID,
+		UserID:   claims.UserId,
+	}
+
+	if err := firstValidationError(validator.ValidateReview(review)); err != nil {
+		return err
+	}
+
+	data, err := client.PATCH(reviewsTable, reviewID, map[string]any{
+		"rating":     review.Rating,
+		"title":      review.Title,
+		"content":    review.Content,
+		"updated_at": time.Now().UTC(),
+	})
+	if err != nil {
+		return errors.DatabaseError("Failed to update review: " + err.Error())
+	}
+
+	updatedReview, err := parseCreated[lib.Review](data)
+	if err != nil {
+		return errors.InternalServerError("Failed to parse review response: " + err.Error())
+	}
+
+	ratings.RecomputeAsync(existing.SellerID)
+
+	return errors.SuccessResponse(c, updatedReview)
+}
@@ -2,11 +2,13 @@ package seller
 
 import (
 	"fmt"
+	"log"
 	"net/url"
 
 	"encoding/json"
 
 	"greenvue/internal/db"
+	"greenvue/internal/ratings"
 	"greenvue/lib"
 	"greenvue/lib/errors"
 
@@ -36,5 +38,15 @@ func GetSeller(c *fiber.Ctx) error {
 		return errors.SuccessResponse(c, lib.PublicUser{})
 	}
 
-	return errors.SuccessResponse(c, sellers[0])
+	seller := sellers[0]
+
+	// The breakdown is supplementary, so a failure here should not hide the seller
+	breakdown, err := ratings.Get(seller.ID)
+	if err != nil {
+		log.Printf("Failed to fetch rating breakdown for seller %s: %v", seller.ID, err)
+	} else {
+		seller.RatingBreakdown = breakdown
+	}
+
+	return errors.SuccessResponse(c, seller)
 }
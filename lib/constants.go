@@ -12,3 +12,7 @@ var Categories = []string{
 var Conditions = []string{
 	"New", "Like New", "Very Good", "Good", "Acceptable", "For Parts/Not Working",
 }
+
+var ReviewReportReasons = []string{
+	"spam", "offensive", "fake", "off_topic", "personal_information", "other",
+}
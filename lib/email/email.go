@@ -23,6 +23,7 @@ const (
 	NotificationEmail  EmailType = "notification"
 	WelcomeEmail       EmailType = "welcome"
 	MarketingEmail     EmailType = "marketing"
+	MagicLinkEmail     EmailType = "magic_link"
 )
 
 // Email represents an email message to be sent
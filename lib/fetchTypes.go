@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
@@ -28,29 +29,42 @@ type User struct {
 }
 
 type PublicUser struct {
-	ID        uuid.UUID `json:"id"`
-	Name      string    `json:"name"`
-	Location  Location  `json:"location"`
-	Bio       string    `json:"bio"`
-	CreatedAt time.Time `json:"created_at"`
-	Rating    float32   `json:"rating"`
-	Verified  bool      `json:"verified"`
-	Picture   string    `json:"picture"`
+	ID              uuid.UUID     `json:"id"`
+	Name            string        `json:"name"`
+	Location        Location      `json:"location"`
+	Bio             string        `json:"bio"`
+	CreatedAt       time.Time     `json:"created_at"`
+	Rating          float32       `json:"rating"`
+	Verified        bool          `json:"verified"`
+	Picture         string        `json:"picture"`
+	RatingBreakdown *SellerRating `json:"rating_breakdown,omitempty"`
+}
+
+// SellerRating is the aggregated rating of a seller. Score is Bayesian-smoothed so
+// sellers with very few reviews do not outrank established ones.
+type SellerRating struct {
+	SellerID    uuid.UUID   `json:"id"`
+	ReviewCount int         `json:"review_count"`
+	Average     float32     `json:"average"`
+	Score       float32     `json:"score"`
+	Histogram   map[int]int `json:"histogram"`
+	UpdatedAt   time.Time   `json:"updated_at"`
 }
 
 type FetchedListing struct {
-	ID            uuid.UUID `json:"id"`
-	CreatedAt     time.Time `json:"created_at"`
-	Description   string    `json:"description"`
-	Category      string    `json:"category"`
-	Condition     string    `json:"condition"`
-	Price         float64   `json:"price"`
-	Location      Location  `json:"location"`
-	EcoScore      float32   `json:"eco_score"`
-	EcoAttributes []string  `json:"eco_attributes"`
-	Negotiable    bool      `json:"negotiable"`
-	Title         string    `json:"title"`
-	ImageUrl      []string  `json:"image_urls"`
+	ID            uuid.UUID      `json:"id"`
+	CreatedAt     time.Time      `json:"created_at"`
+	Description   string         `json:"description"`
+	Category      string         `json:"category"`
+	Condition     string         `json:"condition"`
+	Price         float64        `json:"price"`
+	Location      Location       `json:"location"`
+	EcoScore      float32        `json:"eco_score"`
+	EcoAttributes []string       `json:"eco_attributes"`
+	Negotiable    bool           `json:"negotiable"`
+	Title         string         `json:"title"`
+	Images        []ListingImage `json:"images"`
+	ImageStatus   string         `json:"image_status,omitempty"` // processing until every image is uploaded, then ready or failed
 
 	SellerID        uuid.UUID `json:"seller_id"`
 	SellerUsername  string    `json:"seller_username"`
@@ -58,6 +72,31 @@ type FetchedListing struct {
 	SellerCreatedAt time.Time `json:"seller_created_at"`
 	SellerRating    float32   `json:"seller_rating"`
 	SellerVerified  bool      `json:"seller_verified"`
+
+	SellerRatingBreakdown *SellerRating `json:"seller_rating_breakdown,omitempty"`
+}
+
+// UnmarshalJSON fills Images from image_urls for listings created before renditions existed
+func (l *FetchedListing) UnmarshalJSON(data []byte) error {
+	type fetchedListing FetchedListing
+	var raw struct {
+		fetchedListing
+		ImageURLs []string `json:"image_urls"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*l = FetchedListing(raw.fetchedListing)
+	if len(l.Images) == 0 {
+		for _, url := range raw.ImageURLs {
+			l.Images = append(l.Images, LegacyListingImage(url))
+		}
+	}
+	if l.Images == nil {
+		l.Images = []ListingImage{}
+	}
+	return nil
 }
 
 type FetchedFavorite struct {
@@ -86,16 +125,58 @@ type FetchedFavorite struct {
 }
 
 type FetchedReview struct {
+	ID               uuid.UUID           `json:"id"`
+	CreatedAt        time.Time           `json:"created_at"`
+	UpdatedAt        *time.Time          `json:"updated_at,omitempty"`
+	OrderID          uuid.UUID           `json:"order_id"`
+	Rating           int                 `json:"rating"`
+	UserID           uuid.UUID           `json:"user_id"`
+	UserName         string              `json:"user_name"`
+	SellerID         uuid.UUID           `json:"seller_id"`
+	Title            string              `json:"title"`
+	Content          string              `json:"content"`
+	HelpfulCount     int                 `json:"helpful_count"`
+	VerifiedPurchase bool                `json:"verified_purchase"`
+	Reply            *FetchedReviewReply `json:"reply,omitempty"`
+}
+
+type FetchedReviewReply struct {
+	ID        uuid.UUID  `json:"id"`
+	ReviewID  uuid.UUID  `json:"review_id"`
+	SellerID  uuid.UUID  `json:"seller_id"`
+	Content   string     `json:"content"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+type FetchedReviewReport struct {
+	ID         uuid.UUID `json:"id"`
+	ReviewID   uuid.UUID `json:"review_id"`
+	ReporterID uuid.UUID `json:"reporter_id"`
+	Reason     string    `json:"reason"`
+	Details    string    `json:"details"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type FetchedListingFlag struct {
 	ID               uuid.UUID `json:"id"`
-	CreatedAt        time.Time `json:"created_at"`
-	Rating           int       `json:"rating"`
-	UserID           uuid.UUID `json:"user_id"`
-	UserName         string    `json:"user_name"`
+	ListingID        uuid.UUID `json:"listing_id"`
 	SellerID         uuid.UUID `json:"seller_id"`
-	Title            string    `json:"title"`
-	Content          string    `json:"content"`
-	HelpfulCount     int       `json:"helpful_count"`
-	VerifiedPurchase bool      `json:"verified_purchase"`
+	Reason           string    `json:"reason"`
+	MatchedListingID uuid.UUID `json:"matched_listing_id"`
+	MatchedSellerID  uuid.UUID `json:"matched_seller_id"`
+	Distance         int       `json:"distance"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+type Order struct {
+	ID          uuid.UUID  `json:"id"`
+	ListingID   uuid.UUID  `json:"listing_id"`
+	BuyerID     uuid.UUID  `json:"buyer_id"`
+	SellerID    uuid.UUID  `json:"seller_id"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
 }
 
 type FetchedBid struct {
@@ -0,0 +1,67 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	_ "image/gif" // register GIF format; decoding returns the first frame
+)
+
+// SniffFormat detects the image format from the file's leading bytes, never from its name.
+// It returns "jpeg", "png", "gif", "webp", "heic", "avif" or "" for anything else.
+func SniffFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return "jpeg"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "gif"
+	case len(data) >= 12 && bytes.Equal(data[0:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return "webp"
+	case len(data) >= 12 && bytes.Equal(data[4:8], []byte("ftyp")):
+		return isoBrandFormat(data)
+	}
+	return ""
+}
+
+// isoBrandFormat tells HEIC and AVIF apart by the brands of the ISO media ftyp box
+func isoBrandFormat(data []byte) string {
+	size := int(binary.BigEndian.Uint32(data[0:4]))
+	if size < 16 || size > len(data) {
+		size = min(len(data), 64)
+	}
+
+	// Major brand at 8, minor version at 12, compatible brands from 16
+	brands := [][]byte{data[8:12]}
+	for offset := 16; offset+4 <= size; offset += 4 {
+		brands = append(brands, data[offset:offset+4])
+	}
+
+	for _, brand := range brands {
+		switch string(brand) {
+		case "avif", "avis":
+			return "avif"
+		case "heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1":
+			return "heic"
+		}
+	}
+	return ""
+}
+
+// ContentType returns the MIME type of a sniffed format
+func ContentType(format string) string {
+	switch format {
+	case "":
+		return "application/octet-stream"
+	default:
+		return "image/" + format
+	}
+}
+
+// CanDecode reports whether a decoder for the data is registered with the image package.
+// HEIC and AVIF have no pure-Go decoder built in; they work once one is registered.
+func CanDecode(data []byte) bool {
+	_, _, err := image.DecodeConfig(bytes.NewReader(data))
+	return err == nil
+}
@@ -0,0 +1,43 @@
+package image
+
+import "testing"
+
+func TestSniffFormat(t *testing.T) {
+	ftyp := func(major string, compatible ...string) []byte {
+		box := []byte{0, 0, 0, byte(16 + 4*len(compatible))}
+		box = append(box, "ftyp"+major+"\x00\x00\x00\x00"...)
+		for _, brand := range compatible {
+			box = append(box, brand...)
+		}
+		return box
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, ""},
+		{"jpeg", []byte{0xFF, 0xD8, 0xFF, 0xE0}, "jpeg"},
+		{"png", []byte("\x89PNG\r\n\x1a\n"), "png"},
+		{"gif87a", []byte("GIF87a"), "gif"},
+		{"gif89a", []byte("GIF89a"), "gif"},
+		{"webp", []byte("RIFF\x00\x00\x00\x00WEBP"), "webp"},
+		{"riff that is not webp", []byte("RIFF\x00\x00\x00\x00WAVE"), ""},
+		{"truncated webp", []byte("RIFF\x00\x00\x00\x00WEB"), ""},
+		{"heic", ftyp("heic"), "heic"},
+		{"heic compatible brand", ftyp("isom", "mif1"), "heic"},
+		{"avif", ftyp("avif", "mif1"), "avif"},
+		{"mp4", ftyp("isom", "mp41"), ""},
+		{"ftyp size past the end", append([]byte{0xFF, 0xFF, 0xFF, 0xFF}, ftyp("isom", "avif")[4:]...), "avif"},
+		{"ftyp size below the header", append([]byte{0, 0, 0, 1}, ftyp("isom", "heic")[4:]...), "heic"},
+		{"html named like an image", []byte("<html><body></body></html>"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SniffFormat(tt.data); got != tt.want {
+				t.Errorf("SniffFormat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
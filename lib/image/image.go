@@ -1,80 +1,108 @@
 package image
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io"
+	"greenvue/lib/storage"
 	"log"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
-	storage "github.com/supabase-community/storage-go"
+)
+
+// Image job states. Jobs move from pending to processing, then to processed, or to retry and back
+// to processing until they fail for good.
+const (
+	StatusPending    = "pending"
+	StatusProcessing = "processing"
+	StatusRetry      = "retry"
+	StatusProcessed  = "processed"
+	StatusFailed     = "failed"
 )
 
 // ImageJob represents an image processing job
 type ImageJob struct {
-	ID           string     `json:"id"`
-	FileName     string     `json:"file_name"`
-	ListingTitle string     `json:"listing_title"`
-	ImageData    []byte     `json:"image_data,omitempty"` // Will be cleared after processing to prevent memory leaks
-	CreatedAt    time.Time  `json:"created_at"`
-	ProcessedAt  *time.Time `json:"processed_at,omitempty"`
-	Status       string     `json:"status"`
-	PublicURL    string     `json:"public_url,omitempty"`
-	Retries      int        `json:"retries"`
-	MaxRetries   int        `json:"max_retries"`
-	Error        string     `json:"error,omitempty"`
+	ID             string       `json:"id"`
+	FileName       string       `json:"file_name"`
+	ListingTitle   string       `json:"listing_title"`
+	ListingID      string       `json:"listing_id,omitempty"` // Set once the listing is saved
+	ImageData      []byte       `json:"image_data,omitempty"` // Kept in the spool file, not in memory, when the queue is durable
+	Renditions     []Rendition  `json:"renditions,omitempty"` // All sizes of the image; FileName and ImageData are unused when set
+	Placeholder    *Placeholder `json:"placeholder,omitempty"`
+	PerceptualHash string       `json:"perceptual_hash,omitempty"` // dHash as 16 hex digits
+	CreatedAt      time.Time    `json:"created_at"`
+	StartedAt      *time.Time   `json:"started_at,omitempty"` // Start of the latest attempt
+	ProcessedAt    *time.Time   `json:"processed_at,omitempty"`
+	NextAttempt    *time.Time   `json:"next_attempt,omitempty"` // Retries wait until then
+	Status         string       `json:"status"`
+	PublicURL      string       `json:"public_url,omitempty"`
+	Retries        int          `json:"retries"`
+	MaxRetries     int          `json:"max_retries"`
+	Error          string       `json:"error,omitempty"`
 }
 
 // Queue manages a queue of images to be processed
 type Queue struct {
 	pendingImages   []ImageJob
-	completedImages []ImageJob // Store completed jobs separately for cleanup
+	processing      map[string]ImageJob // Jobs a worker is uploading right now
+	completedImages []ImageJob          // Store completed jobs separately for cleanup
+	spool           *jobSpool           // Durable copy of the jobs; nil keeps everything in memory
+	jobLocks        jobLocks            // Serialize the spool I/O of each job outside mu
+	onListingDone   func(listingID string, done ImagesDone)
+	metrics         queueMetrics
 	mu              sync.Mutex
-	persistPath     string    // Path to persist the queue
 	maxCompleted    int       // Maximum number of completed jobs to keep
 	lastCleanup     time.Time // Last time cleanup was performed
+
+	// Worker pool, see workers.go
+	workers int
+	wake    chan struct{}
+	stop    chan struct{}
+	wg      sync.WaitGroup
 }
 
 // Global image queue
 var GlobalImageQueue *Queue
 
-// Initialize the global image queue
-func InitializeImageQueue() {
-	if GlobalImageQueue == nil {
-		GlobalImageQueue = NewImageQueue()
-		// Try to restore the queue from disk if it exists
-		GlobalImageQueue.RestoreFromDisk()
+// legacyBackupPath is where the queue was saved on shutdown before it was durable
+const legacyBackupPath = "image_queue_backup.json"
+
+// InitializeImageQueue creates the global image queue, stored in spoolDir and replayed from it.
+// If the spool cannot be opened the queue still works, but only in memory.
+func InitializeImageQueue(spoolDir string) error {
+	if GlobalImageQueue != nil {
+		return nil
 	}
+
+	GlobalImageQueue = NewImageQueue()
+	if spoolDir == "" {
+		return nil
+	}
+	if err := GlobalImageQueue.OpenSpool(spoolDir); err != nil {
+		return err
+	}
+	return GlobalImageQueue.importBackupFile(legacyBackupPath)
 }
 
 // NewImageQueue creates a new image queue
 func NewImageQueue() *Queue {
 	return &Queue{
 		pendingImages:   make([]ImageJob, 0),
+		processing:      make(map[string]ImageJob),
 		completedImages: make([]ImageJob, 0),
-		persistPath:     "image_queue_backup.json", // Default path
-		maxCompleted:    100,                       // Keep max 100 completed jobs for debugging
+		wake:            make(chan struct{}, 1),
+		maxCompleted:    100, // Keep max 100 completed jobs for debugging
 		lastCleanup:     time.Now(),
 	}
 }
 
-// SetPersistPath sets the path for persisting the queue
-func (q *Queue) SetPersistPath(path string) {
-	q.persistPath = path
-}
-
 // QueueImage adds an image to the processing queue
 func QueueImage(imageJob ImageJob) error {
 	if GlobalImageQueue == nil {
 		return fmt.Errorf("image queue not initialized")
 	}
 
-	GlobalImageQueue.AddToQueue(imageJob)
-	return nil
+	return GlobalImageQueue.AddToQueue(imageJob)
 }
 
 // GetImageJob retrieves an image job from the queue by ID
@@ -86,17 +114,14 @@ func GetImageJob(id string) (*ImageJob, error) {
 	return GlobalImageQueue.GetJobByID(id)
 }
 
-// AddToQueue adds an image to the queue
-func (q *Queue) AddToQueue(imageJob ImageJob) {
-	q.mu.Lock()
-	defer q.mu.Unlock()
-
+// AddToQueue adds an image to the queue. With a spool, the job is on disk before it returns.
+func (q *Queue) AddToQueue(imageJob ImageJob) error {
 	// Set default values if not provided
 	if imageJob.CreatedAt.IsZero() {
 		imageJob.CreatedAt = time.Now()
 	}
 	if imageJob.Status == "" {
-		imageJob.Status = "pending"
+		imageJob.Status = StatusPending
 	}
 	if imageJob.MaxRetries == 0 {
 		imageJob.MaxRetries = 3
@@ -105,12 +130,38 @@ func (q *Queue) AddToQueue(imageJob ImageJob) {
 		imageJob.ID = uuid.New().String()
 	}
 
-	// Generate the expected URL for this image
+	// Generate the expected URLs for this image; the full rendition is its main URL
+	for i := range imageJob.Renditions {
+		rendition := &imageJob.Renditions[i]
+		if rendition.URL == "" {
+			rendition.URL = GenerateImageURL(rendition.FileName)
+		}
+		if rendition.Name == FullRendition || (imageJob.FileName == "" && i == len(imageJob.Renditions)-1) {
+			imageJob.FileName = rendition.FileName
+		}
+	}
 	if imageJob.PublicURL == "" {
 		imageJob.PublicURL = GenerateImageURL(imageJob.FileName)
 	}
 
+	q.mu.Lock()
+	spool := q.spool
+	q.mu.Unlock()
+
+	// The job is not visible to the workers yet, so it is written without holding any lock
+	if spool != nil {
+		if err := spool.save(spoolPending, imageJob); err != nil {
+			return err
+		}
+		// The workers read the data back from the spool
+		imageJob = imageJob.withoutData()
+	}
+
+	q.mu.Lock()
 	q.pendingImages = append(q.pendingImages, imageJob)
+	q.signal()
+	q.mu.Unlock()
+	return nil
 }
 
 // HasPendingImages checks if there are any pending images in the queue
@@ -141,6 +192,10 @@ func (q *Queue) GetJobByID(id string) (*ImageJob, error) {
 		}
 	}
 
+	if job, ok := q.processing[id]; ok {
+		return &job, nil
+	}
+
 	// Check completed jobs
 	for i, job := range q.completedImages {
 		if job.ID == id {
@@ -153,76 +208,48 @@ func (q *Queue) GetJobByID(id string) (*ImageJob, error) {
 	return nil, fmt.Errorf("job not found with ID: %s", id)
 }
 
-// ProcessQueue processes the image queue with memory leak prevention
+// ProcessQueue claims up to batchSize jobs that are due and uploads them on the worker pool's
+// number of goroutines. It is used when no workers are running and by the scheduled job as a fallback.
 func (q *Queue) ProcessQueue(batchSize int) ([]string, error) {
-	q.mu.Lock()
+	var batch []ImageJob
+	for len(batch) < batchSize {
+		imageJob, ok := q.next()
+		if !ok {
+			break
+		}
+		batch = append(batch, imageJob)
+	}
 
-	if len(q.pendingImages) == 0 {
-		q.mu.Unlock()
+	if len(batch) == 0 {
 		// Perform cleanup if it's been a while
 		q.cleanupCompletedJobs()
 		return nil, nil
 	}
 
-	// Process images in batches
-	endIdx := min(batchSize, len(q.pendingImages))
-	batch := make([]ImageJob, endIdx)
-	copy(batch, q.pendingImages[:endIdx])
-	q.pendingImages = q.pendingImages[endIdx:]
-
-	// Release the lock while processing
+	var (
+		processedURLs []string
+		urlsMu        sync.Mutex
+		wg            sync.WaitGroup
+	)
+	q.mu.Lock()
+	limit := make(chan struct{}, max(q.workers, 1))
 	q.mu.Unlock()
 
-	processedURLs := make([]string, 0, len(batch))
-
-	for i := range batch {
-		imageJob := &batch[i]
-
-		if imageJob.Status != "pending" && imageJob.Status != "retry" {
-			continue
-		}
-
-		// Convert image data to a buffer that we can pass to the processor
-		buffer := bytes.NewBuffer(imageJob.ImageData)
-
-		// Upload to Supabase
-		publicURL, err := UploadToSupabase(imageJob.FileName, buffer)
-		now := time.Now()
-
-		if err != nil {
-			imageJob.Retries++
-			imageJob.Error = err.Error()
-
-			if imageJob.Retries >= imageJob.MaxRetries {
-				imageJob.Status = "failed"
-				// Clear image data to free memory
-				imageJob.ImageData = nil
-				log.Printf("Failed to process image %s after %d retries: %v",
-					imageJob.ID, imageJob.Retries, err)
-			} else {
-				imageJob.Status = "retry"
-				log.Printf("Image processing for %s failed, will retry (attempt %d/%d)",
-					imageJob.ID, imageJob.Retries, imageJob.MaxRetries)
-				// Re-queue for retry but don't clear image data yet
-				q.mu.Lock()
-				q.pendingImages = append(q.pendingImages, *imageJob)
-				q.mu.Unlock()
-				continue
+	for _, imageJob := range batch {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(imageJob ImageJob) {
+			defer wg.Done()
+			defer func() { <-limit }()
+
+			if publicURL, ok := q.processJob(imageJob); ok {
+				urlsMu.Lock()
+				processedURLs = append(processedURLs, publicURL)
+				urlsMu.Unlock()
 			}
-		} else {
-			imageJob.Status = "processed"
-			imageJob.ProcessedAt = &now
-			imageJob.PublicURL = publicURL
-			// Clear image data to free memory after successful upload
-			imageJob.ImageData = nil
-			processedURLs = append(processedURLs, publicURL)
-		}
-
-		// Move completed/failed jobs to completed queue
-		q.mu.Lock()
-		q.completedImages = append(q.completedImages, *imageJob)
-		q.mu.Unlock()
+		}(imageJob)
 	}
+	wg.Wait()
 
 	// Cleanup old completed jobs periodically
 	q.cleanupCompletedJobs()
@@ -230,124 +257,69 @@ func (q *Queue) ProcessQueue(batchSize int) ([]string, error) {
 	return processedURLs, nil
 }
 
-// UploadToSupabase uploads an image buffer to Supabase storage
-func UploadToSupabase(filename string, fileData *bytes.Buffer) (string, error) {
-	// Get Supabase URL and key from environment variables
-	supabaseUrl := os.Getenv("SUPABASE_URL")
-	supabaseKey := os.Getenv("SUPABASE_SERVICE_KEY")
+// uploadImageJob uploads every rendition that is not stored yet, so a retry continues where it failed
+func uploadImageJob(imageJob *ImageJob) error {
+	store := storage.GetBlobStore()
 
-	// Declare the bucket name (fixed)
-	bucket := "listing-images"
-
-	// Create a new Supabase client
-	client := storage.NewClient(supabaseUrl+"/storage/v1", supabaseKey, nil)
-
-	// Set file options
-	upsert := true
-	cacheControl := "3600"
-	fileType := "image/webp"
-
-	fileOptions := storage.FileOptions{
-		CacheControl: &cacheControl,
-		Upsert:       &upsert,
-		ContentType:  &fileType,
+	// The content type comes from the data itself, not from the file name
+	if len(imageJob.Renditions) == 0 {
+		return store.Put(imageJob.FileName, imageJob.ImageData, ContentType(SniffFormat(imageJob.ImageData)))
 	}
 
-	// Create a reader that will automatically close when upload is done
-	reader := io.NopCloser(bytes.NewReader(fileData.Bytes()))
-
-	// Upload the file to Supabase
-	_, err := client.UploadFile(bucket, filename, reader, fileOptions)
-	if err != nil {
-		log.Println("Error uploading to Supabase:", err)
-		return "", err
+	for i := range imageJob.Renditions {
+		rendition := &imageJob.Renditions[i]
+		// Renditions that share a file with a smaller one carry no data
+		if rendition.Data == nil {
+			continue
+		}
+		if err := store.Put(rendition.FileName, rendition.Data, ContentType(SniffFormat(rendition.Data))); err != nil {
+			return fmt.Errorf("failed to upload %s rendition: %w", rendition.Name, err)
+		}
+		rendition.Data = nil
 	}
-
-	// Return the public URL of the uploaded file
-	publicURL := fmt.Sprintf("%s/storage/v1/object/public/%s/%s", supabaseUrl, bucket, filename)
-	return publicURL, nil
+	return nil
 }
 
 // GenerateImageURL generates the public URL for an image without uploading it
 // This can be used to return URLs immediately before background processing
 func GenerateImageURL(filename string) string {
-	supabaseUrl := os.Getenv("SUPABASE_URL")
-	bucket := "listing-images"
-	return fmt.Sprintf("%s/storage/v1/object/public/%s/%s", supabaseUrl, bucket, filename)
+	return storage.GetBlobStore().PublicURL(filename)
 }
 
-// PersistToDisk saves the current queue state to a JSON file
-func (q *Queue) PersistToDisk() error {
-	q.mu.Lock()
-	defer q.mu.Unlock()
+// DeleteImages removes images from the blob store by their public URLs.
+// URLs that do not belong to the store are skipped. It returns the number of files removed.
+func DeleteImages(publicURLs []string) (int, error) {
+	store := storage.GetBlobStore()
 
-	// Skip if no images or no persist path
-	if len(q.pendingImages) == 0 || q.persistPath == "" {
-		return nil
+	var keys []string
+	for _, publicURL := range publicURLs {
+		if key, ok := storage.KeyFromURL(store, publicURL); ok {
+			keys = append(keys, key)
+		}
 	}
 
-	// Marshal the queue to JSON
-	data, err := json.Marshal(q.pendingImages)
-	if err != nil {
-		return fmt.Errorf("error marshaling image queue: %w", err)
+	if len(keys) == 0 {
+		return 0, nil
 	}
 
-	// Write to file
-	err = os.WriteFile(q.persistPath, data, 0644)
+	removed, err := store.Delete(keys)
 	if err != nil {
-		return fmt.Errorf("error writing image queue to disk: %w", err)
+		return removed, fmt.Errorf("failed to remove images from storage: %w", err)
 	}
 
-	log.Printf("Persisted %d pending images to %s", len(q.pendingImages), q.persistPath)
-	return nil
+	return removed, nil
 }
 
-// RestoreFromDisk loads the queue state from a JSON file if it exists
-func (q *Queue) RestoreFromDisk() error {
+// cleanupCompletedJobs removes old completed jobs to prevent memory leaks
+func (q *Queue) cleanupCompletedJobs() {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
-	// Skip if no persist path or file doesn't exist
-	if q.persistPath == "" {
-		return nil
-	}
-
-	data, err := os.ReadFile(q.persistPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// File doesn't exist, not an error
-			return nil
-		}
-		return fmt.Errorf("error reading image queue from disk: %w", err)
-	}
-
-	// Unmarshal the queue
-	var images []ImageJob
-	err = json.Unmarshal(data, &images)
-	if err != nil {
-		return fmt.Errorf("error unmarshaling image queue: %w", err)
-	}
-
-	// Add the images to the queue
-	q.pendingImages = images
-	log.Printf("Restored %d pending images from %s", len(images), q.persistPath)
-
-	// Delete the file after successful restore
-	os.Remove(q.persistPath)
-
-	return nil
-}
-
-// cleanupCompletedJobs removes old completed jobs to prevent memory leaks
-func (q *Queue) cleanupCompletedJobs() {
 	// Only cleanup every 5 minutes to avoid excessive work
 	if time.Since(q.lastCleanup) < 5*time.Minute {
 		return
 	}
 
-	q.mu.Lock()
-	defer q.mu.Unlock()
-
 	// Remove excess completed jobs, keeping only the most recent ones
 	if len(q.completedImages) > q.maxCompleted {
 		// Keep only the last maxCompleted jobs
@@ -356,6 +328,7 @@ func (q *Queue) cleanupCompletedJobs() {
 		// Clear image data from jobs being removed to free memory
 		for i := 0; i < toRemove; i++ {
 			q.completedImages[i].ImageData = nil
+			q.completedImages[i].clearRenditionData()
 		}
 
 		// Keep only recent jobs
@@ -386,6 +359,21 @@ func (q *Queue) cleanupCompletedJobs() {
 	q.lastCleanup = time.Now()
 }
 
+// clearRenditionData drops the encoded renditions to free memory
+func (j *ImageJob) clearRenditionData() {
+	for i := range j.Renditions {
+		j.Renditions[i].Data = nil
+	}
+}
+
+// withoutData returns a copy of the job without image data. The job itself keeps its data.
+func (j ImageJob) withoutData() ImageJob {
+	j.ImageData = nil
+	j.Renditions = append([]Rendition(nil), j.Renditions...)
+	j.clearRenditionData()
+	return j
+}
+
 // GetCompletedJobsCount returns the number of completed jobs
 func (q *Queue) GetCompletedJobsCount() int {
 	q.mu.Lock()
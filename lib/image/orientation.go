@@ -0,0 +1,174 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+)
+
+const exifOrientationTag = 0x0112
+
+// ReadOrientation returns the EXIF orientation (1-8) of a JPEG, PNG or WebP file, or 1 when there is none.
+// It must be read before the metadata is dropped, otherwise portrait phone photos end up sideways.
+func ReadOrientation(data []byte) int {
+	var exif []byte
+	switch SniffFormat(data) {
+	case "jpeg":
+		exif = jpegExif(data)
+	case "png":
+		exif = pngExif(data)
+	case "webp":
+		exif = webpExif(data)
+	}
+
+	if orientation := tiffOrientation(exif); orientation >= 1 && orientation <= 8 {
+		return orientation
+	}
+	return 1
+}
+
+// jpegExif returns the TIFF data of the APP1 Exif segment
+func jpegExif(data []byte) []byte {
+	offset := 2
+	for offset+4 <= len(data) {
+		if data[offset] != 0xFF {
+			return nil
+		}
+		marker := data[offset+1]
+		// Start of scan or end of image: no more metadata
+		if marker == 0xDA || marker == 0xD9 {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[offset+2 : offset+4]))
+		if length < 2 || offset+2+length > len(data) {
+			return nil
+		}
+		segment := data[offset+4 : offset+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		offset += 2 + length
+	}
+	return nil
+}
+
+// pngExif returns the contents of the eXIf chunk
+func pngExif(data []byte) []byte {
+	offset := 8
+	for offset+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		kind := string(data[offset+4 : offset+8])
+		if length < 0 || offset+8+length > len(data) {
+			return nil
+		}
+		if kind == "eXIf" {
+			return data[offset+8 : offset+8+length]
+		}
+		if kind == "IDAT" || kind == "IEND" {
+			return nil
+		}
+		offset += 12 + length
+	}
+	return nil
+}
+
+// webpExif returns the contents of the EXIF chunk
+func webpExif(data []byte) []byte {
+	offset := 12
+	for offset+8 <= len(data) {
+		kind := string(data[offset : offset+4])
+		length := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		if length < 0 || offset+8+length > len(data) {
+			return nil
+		}
+		if kind == "EXIF" {
+			return bytes.TrimPrefix(data[offset+8:offset+8+length], []byte("Exif\x00\x00"))
+		}
+		offset += 8 + length + length%2
+	}
+	return nil
+}
+
+// tiffOrientation reads the orientation tag from the first IFD of TIFF data
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+
+	entries := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:entry+2]) == exifOrientationTag {
+			// A SHORT value is stored in the first two bytes of the value field
+			return int(order.Uint16(tiff[entry+8 : entry+10]))
+		}
+	}
+	return 0
+}
+
+// ApplyOrientation rotates and mirrors an image so it displays upright for the given EXIF orientation
+func ApplyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// Orientations 5-8 swap width and height
+	outWidth, outHeight := width, height
+	if orientation >= 5 {
+		outWidth, outHeight = height, width
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, outWidth, outHeight))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				dx, dy = width-1-x, y
+			case 3: // Rotated 180°
+				dx, dy = width-1-x, height-1-y
+			case 4: // Mirrored vertically
+				dx, dy = x, height-1-y
+			case 5: // Mirrored along the top-left diagonal
+				dx, dy = y, x
+			case 6: // Rotated 90° clockwise to display
+				dx, dy = height-1-y, x
+			case 7: // Mirrored along the top-right diagonal
+				dx, dy = height-1-y, width-1-x
+			case 8: // Rotated 90° counter-clockwise to display
+				dx, dy = y, width-1-x
+			}
+
+			si := src.PixOffset(x, y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+
+	return dst
+}
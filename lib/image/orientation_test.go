@@ -0,0 +1,210 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// testTIFF builds TIFF data whose first IFD holds a single orientation entry
+func testTIFF(order binary.AppendByteOrder, orientation uint16) []byte {
+	tiff := []byte("MM")
+	if order == binary.LittleEndian {
+		tiff = []byte("II")
+	}
+	tiff = order.AppendUint16(tiff, 42)
+	tiff = order.AppendUint32(tiff, 8) // First IFD right after the header
+	tiff = order.AppendUint16(tiff, 1) // One entry
+	tiff = order.AppendUint16(tiff, exifOrientationTag)
+	tiff = order.AppendUint16(tiff, 3) // SHORT
+	tiff = order.AppendUint32(tiff, 1) // Count
+	tiff = order.AppendUint16(tiff, orientation)
+	tiff = order.AppendUint16(tiff, 0) // Padding of the value field
+	return order.AppendUint32(tiff, 0) // No next IFD
+}
+
+func testJPEG(tiff []byte) []byte {
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	data := []byte{0xFF, 0xD8}
+	data = append(data, 0xFF, 0xE0, 0x00, 0x04, 0x00, 0x00) // Unrelated APP0 segment first
+	data = append(data, 0xFF, 0xE1)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(segment)+2))
+	data = append(data, segment...)
+	return append(data, 0xFF, 0xDA, 0x00, 0x02)
+}
+
+func testPNGChunk(kind string, payload []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, payload...)
+	return append(chunk, 0, 0, 0, 0) // The CRC is not checked
+}
+
+func testPNG(tiff []byte) []byte {
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = append(data, testPNGChunk("IHDR", make([]byte, 13))...)
+	data = append(data, testPNGChunk("eXIf", tiff)...)
+	return append(data, testPNGChunk("IEND", nil)...)
+}
+
+func testWebPChunk(kind string, payload []byte) []byte {
+	chunk := append([]byte(kind), binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))...)
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func testWebP(tiff []byte) []byte {
+	body := []byte("WEBP")
+	body = append(body, testWebPChunk("VP8X", make([]byte, 9))...) // Odd length, so the walker must skip the padding
+	body = append(body, testWebPChunk("EXIF", tiff)...)
+	data := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+	return append(data, body...)
+}
+
+func TestReadOrientation(t *testing.T) {
+	containers := map[string]func([]byte) []byte{
+		"jpeg": testJPEG,
+		"png":  testPNG,
+		"webp": testWebP,
+	}
+	for name, build := range containers {
+		for _, order := range []binary.AppendByteOrder{binary.BigEndian, binary.LittleEndian} {
+			for orientation := uint16(1); orientation <= 8; orientation++ {
+				if got := ReadOrientation(build(testTIFF(order, orientation))); got != int(orientation) {
+					t.Errorf("%s %v orientation %d: ReadOrientation() = %d", name, order, orientation, got)
+				}
+			}
+			// Values outside 1-8 fall back to upright
+			for _, orientation := range []uint16{0, 9, 0xffff} {
+				if got := ReadOrientation(build(testTIFF(order, orientation))); got != 1 {
+					t.Errorf("%s %v orientation %d: ReadOrientation() = %d, want 1", name, order, orientation, got)
+				}
+			}
+		}
+	}
+
+	// WebP writers may keep the JPEG Exif header in the chunk
+	if got := ReadOrientation(testWebP(append([]byte("Exif\x00\x00"), testTIFF(binary.BigEndian, 6)...))); got != 6 {
+		t.Errorf("WebP with Exif header: ReadOrientation() = %d, want 6", got)
+	}
+}
+
+func TestReadOrientationTruncated(t *testing.T) {
+	// Every prefix of a valid file must be read without panicking and never yield a bogus value
+	for name, data := range map[string][]byte{
+		"jpeg": testJPEG(testTIFF(binary.BigEndian, 6)),
+		"png":  testPNG(testTIFF(binary.LittleEndian, 6)),
+		"webp": testWebP(testTIFF(binary.BigEndian, 6)),
+	} {
+		for n := range len(data) {
+			if got := ReadOrientation(data[:n]); got != 1 && got != 6 {
+				t.Errorf("%s truncated to %d bytes: ReadOrientation() = %d", name, n, got)
+			}
+		}
+	}
+}
+
+func TestReadOrientationMalformed(t *testing.T) {
+	tiff := testTIFF(binary.BigEndian, 6)
+	withIFD := func(offset uint32) []byte {
+		bad := bytes.Clone(tiff)
+		binary.BigEndian.PutUint32(bad[4:8], offset)
+		return bad
+	}
+	withEntries := func(count uint16) []byte {
+		bad := bytes.Clone(tiff)
+		binary.BigEndian.PutUint16(bad[8:10], count)
+		binary.BigEndian.PutUint16(bad[10:12], 0x0100) // Image width, so the walk goes on past the end
+		return bad
+	}
+
+	jpegLength := func(length uint16) []byte {
+		data := testJPEG(tiff)
+		binary.BigEndian.PutUint16(data[4:6], length)
+		return data
+	}
+	pngLength := func(length uint32) []byte {
+		data := testPNG(tiff)
+		binary.BigEndian.PutUint32(data[33:37], length) // Length of the eXIf chunk after IHDR
+		return data
+	}
+	webpLength := func(length uint32) []byte {
+		data := testWebP(tiff)
+		binary.LittleEndian.PutUint32(data[16:20], length) // Length of the VP8X chunk
+		return data
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"jpeg marker only", []byte{0xFF, 0xD8, 0xFF}},
+		{"jpeg segment length below 2", jpegLength(1)},
+		{"jpeg segment length past the end", jpegLength(0xFFFF)},
+		{"jpeg without marker byte", append([]byte{0xFF, 0xD8, 0x00}, testJPEG(tiff)[2:]...)},
+		{"jpeg exif after start of scan", append([]byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02}, testJPEG(tiff)[2:]...)},
+		{"png chunk length past the end", pngLength(0xFFFFFFFF)},
+		{"png exif after image data", append(append([]byte("\x89PNG\r\n\x1a\n"), testPNGChunk("IDAT", nil)...), testPNGChunk("eXIf", tiff)...)},
+		{"webp chunk length past the end", webpLength(0xFFFFFFFF)},
+		{"unknown byte order", testJPEG(append([]byte("XX"), tiff[2:]...))},
+		{"tiff header only", testJPEG(tiff[:8])},
+		{"ifd inside the header", testJPEG(withIFD(4))},
+		{"ifd past the end", testJPEG(withIFD(0xFFFFFFF0))},
+		{"entry count past the end", testJPEG(withEntries(0xFFFF))},
+		{"gif", []byte("GIF89a")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ReadOrientation(tt.data); got != 1 {
+				t.Errorf("ReadOrientation() = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// A 3x2 image whose pixels are numbered row by row, as stored by the camera:
+	//   1 2 3
+	//   4 5 6
+	stored := image.NewGray(image.Rect(10, 20, 13, 22)) // A non-zero origin, like a sub-image
+	for i := range 6 {
+		stored.SetGray(10+i%3, 20+i/3, color.Gray{Y: uint8(i + 1)})
+	}
+
+	tests := []struct {
+		orientation int
+		want        [][]uint8
+	}{
+		{0, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+		{1, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+		{2, [][]uint8{{3, 2, 1}, {6, 5, 4}}},
+		{3, [][]uint8{{6, 5, 4}, {3, 2, 1}}},
+		{4, [][]uint8{{4, 5, 6}, {1, 2, 3}}},
+		{5, [][]uint8{{1, 4}, {2, 5}, {3, 6}}},
+		{6, [][]uint8{{4, 1}, {5, 2}, {6, 3}}},
+		{7, [][]uint8{{6, 3}, {5, 2}, {4, 1}}},
+		{8, [][]uint8{{3, 6}, {2, 5}, {1, 4}}},
+		{9, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+	}
+	for _, tt := range tests {
+		got := ApplyOrientation(stored, tt.orientation)
+		bounds := got.Bounds()
+		if bounds.Dx() != len(tt.want[0]) || bounds.Dy() != len(tt.want) {
+			t.Errorf("orientation %d: size = %dx%d, want %dx%d", tt.orientation, bounds.Dx(), bounds.Dy(), len(tt.want[0]), len(tt.want))
+			continue
+		}
+		for y, row := range tt.want {
+			for x, want := range row {
+				if pixel := color.GrayModel.Convert(got.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray).Y; pixel != want {
+					t.Errorf("orientation %d: pixel (%d,%d) = %d, want %d", tt.orientation, x, y, pixel, want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package image
+
+import (
+	"fmt"
+	"image"
+	"math/bits"
+	"strconv"
+
+	"github.com/nfnt/resize"
+)
+
+// DifferenceHash computes the 64 bit dHash of an image. The image is shrunk to 9x8 grey pixels
+// and each bit tells whether a pixel is brighter than its right neighbour, so resizing and
+// re-encoding the same photo barely change the hash.
+func DifferenceHash(img image.Image) uint64 {
+	small := resize.Resize(9, 8, img, resize.Bilinear)
+	bounds := small.Bounds()
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := luminance(small, bounds.Min.X+x, bounds.Min.Y+y)
+			right := luminance(small, bounds.Min.X+x+1, bounds.Min.Y+y)
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// HammingDistance returns the number of differing bits between two hashes
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// FormatHash writes a hash as 16 hex digits
+func FormatHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// ParseHash reads a hash written by FormatHash
+func ParseHash(value string) (uint64, error) {
+	return strconv.ParseUint(value, 16, 64)
+}
+
+// HashBands splits a hash into four 16 bit bands. Two hashes within a distance of 3
+// always share at least one band, which lets a database find candidates with equality lookups.
+func HashBands(hash uint64) [4]int {
+	return [4]int{
+		int(hash >> 48 & 0xffff),
+		int(hash >> 32 & 0xffff),
+		int(hash >> 16 & 0xffff),
+		int(hash & 0xffff),
+	}
+}
+
+func luminance(img image.Image, x, y int) float64 {
+	r, g, b, _ := img.At(x, y).RGBA()
+	return 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+}
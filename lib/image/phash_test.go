@@ -0,0 +1,72 @@
+package image
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func sharesBand(a, b uint64) bool {
+	bandsA, bandsB := HashBands(a), HashBands(b)
+	for i := range bandsA {
+		if bandsA[i] == bandsB[i] {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHashBands(t *testing.T) {
+	if got, want := HashBands(0x0123456789abcdef), [4]int{0x0123, 0x4567, 0x89ab, 0xcdef}; got != want {
+		t.Errorf("HashBands() = %#v, want %#v", got, want)
+	}
+
+	tests := []struct {
+		name string
+		flip uint64
+	}{
+		{"identical", 0},
+		{"one bit", 1 << 63},
+		{"three bits in one band", 0b111},
+		{"three bits in three bands", 1<<63 | 1<<40 | 1<<20},
+		{"band edges", 1<<48 | 1<<47 | 1<<16},
+		{"last three bands", 1<<47 | 1<<31 | 1<<15},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, hash := range []uint64{0, ^uint64(0), 0x0123456789abcdef} {
+				if !sharesBand(hash, hash^tt.flip) {
+					t.Errorf("%016x and %016x share no band", hash, hash^tt.flip)
+				}
+			}
+		})
+	}
+
+	// Four bands cannot absorb four differing bits
+	if sharesBand(0, 1<<63|1<<47|1<<31|1<<15) {
+		t.Error("one flipped bit per band still shares a band")
+	}
+
+	random := rand.New(rand.NewSource(1))
+	for range 10000 {
+		hash := random.Uint64()
+		other := hash
+		for range random.Intn(4) {
+			other ^= 1 << random.Intn(64)
+		}
+		if !sharesBand(hash, other) {
+			t.Fatalf("%016x and %016x at distance %d share no band", hash, other, HammingDistance(hash, other))
+		}
+	}
+}
+
+func TestParseHash(t *testing.T) {
+	for _, hash := range []uint64{0, 1, 0x0123456789abcdef, ^uint64(0)} {
+		formatted := FormatHash(hash)
+		if len(formatted) != 16 {
+			t.Errorf("FormatHash(%d) = %q, want 16 digits", hash, formatted)
+		}
+		if parsed, err := ParseHash(formatted); err != nil || parsed != hash {
+			t.Errorf("ParseHash(%q) = %x, %v, want %x", formatted, parsed, err, hash)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package image
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	"github.com/chai2010/webp"
+	"github.com/nfnt/resize"
+)
+
+const (
+	blurhashComponentsX = 4
+	blurhashComponentsY = 3
+	placeholderSample   = 32 // Blurhash and dominant colour are computed on a copy at most this big
+	previewSize         = 16 // Longest side of the inline preview
+	previewQuality      = 50
+)
+
+// Placeholder is shown by clients while the real image loads
+type Placeholder struct {
+	Blurhash      string `json:"blurhash"`
+	Preview       string `json:"preview"`        // Tiny WebP as a data URI
+	DominantColor string `json:"dominant_color"` // Hex colour such as #7a8b3c
+}
+
+// CreatePlaceholder computes the blurhash, inline preview and dominant colour of an image
+func CreatePlaceholder(img image.Image) (*Placeholder, error) {
+	bounds := img.Bounds()
+	if bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return nil, fmt.Errorf("image is empty")
+	}
+
+	sample := resize.Thumbnail(placeholderSample, placeholderSample, img, resize.Bilinear)
+
+	blurhash, err := encodeBlurhash(sample, blurhashComponentsX, blurhashComponentsY)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := new(bytes.Buffer)
+	small := resize.Thumbnail(previewSize, previewSize, img, resize.Bilinear)
+	if err := webp.Encode(preview, small, &webp.Options{Quality: previewQuality}); err != nil {
+		return nil, fmt.Errorf("failed to encode preview: %w", err)
+	}
+
+	return &Placeholder{
+		Blurhash:      blurhash,
+		Preview:       "data:image/webp;base64," + base64.StdEncoding.EncodeToString(preview.Bytes()),
+		DominantColor: dominantColor(sample),
+	}, nil
+}
+
+// dominantColor groups pixels into coarse colour buckets and returns the average of the fullest bucket.
+// Transparent pixels are ignored.
+func dominantColor(img image.Image) string {
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	buckets := make(map[int]*bucket)
+	var best *bucket
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a < 0x8000 {
+				continue
+			}
+			r, g, b = r>>8, g>>8, b>>8
+
+			key := int(r>>4)<<8 | int(g>>4)<<4 | int(b>>4)
+			current, ok := buckets[key]
+			if !ok {
+				current = &bucket{}
+				buckets[key] = current
+			}
+			current.count++
+			current.r += int(r)
+			current.g += int(g)
+			current.b += int(b)
+
+			if best == nil || current.count > best.count {
+				best = current
+			}
+		}
+	}
+
+	if best == nil {
+		return "#000000"
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.count, best.g/best.count, best.b/best.count)
+}
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// encodeBlurhash implements the blurhash algorithm (https://blurha.sh)
+func encodeBlurhash(img image.Image, componentsX, componentsY int) (string, error) {
+	if componentsX < 1 || componentsX > 9 || componentsY < 1 || componentsY > 9 {
+		return "", fmt.Errorf("blurhash components must be between 1 and 9")
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// Convert the image to linear RGB once
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			linear[y*width+x] = [3]float64{sRGBToLinear(int(r >> 8)), sRGBToLinear(int(g >> 8)), sRGBToLinear(int(b >> 8))}
+		}
+	}
+
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for j := 0; j < componentsY; j++ {
+		for i := 0; i < componentsX; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+					pixel := linear[y*width+x]
+					factor[0] += basis * pixel[0]
+					factor[1] += basis * pixel[1]
+					factor[2] += basis * pixel[2]
+				}
+			}
+
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((componentsX-1)+(componentsY-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		actualMaximum := 0.0
+		for _, factor := range ac {
+			actualMaximum = math.Max(actualMaximum, math.Max(math.Abs(factor[0]), math.Max(math.Abs(factor[1]), math.Abs(factor[2]))))
+		}
+		quantisedMaximum := clampInt(int(math.Floor(actualMaximum*166-0.5)), 0, 82)
+		maximumValue = float64(quantisedMaximum+1) / 166
+		hash.WriteString(encodeBase83(quantisedMaximum, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+
+	for _, factor := range ac {
+		quantise := func(value float64) int {
+			return clampInt(int(math.Floor(signPow(value/maximumValue, 0.5)*9+9.5)), 0, 18)
+		}
+		hash.WriteString(encodeBase83(quantise(factor[0])*19*19+quantise(factor[1])*19+quantise(factor[2]), 2))
+	}
+
+	return hash.String(), nil
+}
+
+func encodeBase83(value, length int) string {
+	result := make([]byte, length)
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		result[i-1] = base83Chars[digit]
+	}
+	return string(result)
+}
+
+func sRGBToLinear(value int) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
+
+func clampInt(value, low, high int) int {
+	return max(low, min(high, value))
+}
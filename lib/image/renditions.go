@@ -0,0 +1,136 @@
+package image
+
+import (
+	"fmt"
+	"greenvue/lib"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RenditionPreset describes one size generated for every uploaded image.
+// Images are scaled to fit in a MaxSize x MaxSize box and are never enlarged.
+type RenditionPreset struct {
+	Name    string `json:"name"`
+	MaxSize int    `json:"max_size"`
+	Quality int    `json:"quality"` // WebP quality from 1 to 100
+}
+
+// Rendition is one encoded size of an image job
+type Rendition struct {
+	Name     string `json:"name"`
+	FileName string `json:"file_name"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Bytes    int    `json:"bytes"`
+	URL      string `json:"url,omitempty"`
+	Data     []byte `json:"data,omitempty"` // Cleared once uploaded
+}
+
+// DefaultRenditionPresets are used unless IMAGE_RENDITIONS is set
+var DefaultRenditionPresets = []RenditionPreset{
+	{Name: "thumb", MaxSize: 200, Quality: 70},
+	{Name: "card", MaxSize: 480, Quality: 75},
+	{Name: "full", MaxSize: 1280, Quality: 80},
+	{Name: "zoom", MaxSize: 2048, Quality: 85},
+}
+
+// FullRendition is the preset whose URL is used where a single image URL is needed
+const FullRendition = "full"
+
+var (
+	renditionPresets   = DefaultRenditionPresets
+	renditionPresetsMu sync.RWMutex
+)
+
+// SetRenditionPresets replaces the presets, ordered from smallest to largest
+func SetRenditionPresets(presets []RenditionPreset) {
+	if len(presets) == 0 {
+		return
+	}
+
+	renditionPresetsMu.Lock()
+	defer renditionPresetsMu.Unlock()
+	renditionPresets = presets
+}
+
+// GetRenditionPresets returns the configured presets, ordered from smallest to largest
+func GetRenditionPresets() []RenditionPreset {
+	renditionPresetsMu.RLock()
+	defer renditionPresetsMu.RUnlock()
+	return renditionPresets
+}
+
+// ParseRenditionPresets reads presets written as name:max_size:quality, e.g. "thumb:200:70".
+// The result is sorted by size.
+func ParseRenditionPresets(specs []string) ([]RenditionPreset, error) {
+	presets := make([]RenditionPreset, 0, len(specs))
+	seen := make(map[string]bool)
+
+	for _, spec := range specs {
+		var preset RenditionPreset
+		parts := strings.Split(spec, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid rendition %q, expected name:max_size:quality", spec)
+		}
+		var err error
+		preset.Name = strings.TrimSpace(parts[0])
+		if preset.MaxSize, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil || preset.MaxSize <= 0 {
+			return nil, fmt.Errorf("invalid size in rendition %q", spec)
+		}
+		if preset.Quality, err = strconv.Atoi(strings.TrimSpace(parts[2])); err != nil || preset.Quality < 1 || preset.Quality > 100 {
+			return nil, fmt.Errorf("invalid quality in rendition %q", spec)
+		}
+		if preset.Name == "" || seen[preset.Name] {
+			return nil, fmt.Errorf("rendition names must be unique and not empty: %q", spec)
+		}
+		seen[preset.Name] = true
+		presets = append(presets, preset)
+	}
+
+	sort.SliceStable(presets, func(i, j int) bool { return presets[i].MaxSize < presets[j].MaxSize })
+
+	return presets, nil
+}
+
+// RenditionFileName returns the storage key of a rendition of an upload
+func RenditionFileName(baseName, rendition string) string {
+	return fmt.Sprintf("%s-%s.webp", baseName, rendition)
+}
+
+// ListingImage describes a job's renditions for storing with a listing.
+// Jobs without renditions (queued before they existed) become a single image.
+func (j ImageJob) ListingImage() lib.ListingImage {
+	if len(j.Renditions) == 0 {
+		image := lib.LegacyListingImage(j.PublicURL)
+		image.ID = j.ID
+		return image
+	}
+
+	image := lib.ListingImage{ID: j.ID, URL: j.PublicURL, PerceptualHash: j.PerceptualHash}
+	if j.Placeholder != nil {
+		image.Blurhash = j.Placeholder.Blurhash
+		image.Preview = j.Placeholder.Preview
+		image.DominantColor = j.Placeholder.DominantColor
+	}
+	srcset := make([]string, 0, len(j.Renditions))
+	for _, rendition := range j.Renditions {
+		image.Renditions = append(image.Renditions, lib.ImageRendition{
+			Name:   rendition.Name,
+			URL:    rendition.URL,
+			Width:  rendition.Width,
+			Height: rendition.Height,
+			Bytes:  rendition.Bytes,
+		})
+
+		// Presets that ended up the same size share a file; list it once
+		entry := fmt.Sprintf("%s %dw", rendition.URL, rendition.Width)
+		if len(srcset) == 0 || srcset[len(srcset)-1] != entry {
+			srcset = append(srcset, entry)
+		}
+	}
+	image.SrcSet = strings.Join(srcset, ", ")
+
+	return image
+}
@@ -0,0 +1,357 @@
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Spool subdirectories
+const (
+	spoolPending = "pending" // Jobs that still need uploading, with their image data
+	spoolDead    = "dead"    // Jobs that ran out of retries, kept so they can be requeued
+)
+
+// ErrJobNotFound is returned when a job is not in the queue or the dead letters
+var ErrJobNotFound = errors.New("image job not found")
+
+// jobSpool stores every queued job as a JSON file, so uploads survive a crash or restart.
+// Files are replaced atomically; a job is removed only after its upload succeeded.
+type jobSpool struct {
+	dir string
+}
+
+// jobLocks serializes the spool I/O of each job, so the queue lock is never held during disk writes.
+// When both are needed, a job's lock is taken before q.mu.
+type jobLocks struct {
+	mu    sync.Mutex
+	locks map[string]*jobLock
+}
+
+type jobLock struct {
+	mu   sync.Mutex
+	refs int // Holders and waiters; the entry is dropped at zero
+}
+
+// lock locks a job and returns the function that unlocks it
+func (l *jobLocks) lock(id string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*jobLock)
+	}
+	entry, ok := l.locks[id]
+	if !ok {
+		entry = &jobLock{}
+		l.locks[id] = entry
+	}
+	entry.refs++
+	l.mu.Unlock()
+
+	entry.mu.Lock()
+	return func() {
+		entry.mu.Unlock()
+
+		l.mu.Lock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(l.locks, id)
+		}
+		l.mu.Unlock()
+	}
+}
+
+func openJobSpool(dir string) (*jobSpool, error) {
+	for _, state := range []string{spoolPending, spoolDead} {
+		path := filepath.Join(dir, state)
+		if err := os.MkdirAll(path, 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create spool directory: %w", err)
+		}
+
+		// Remove half written files of a previous crash
+		leftovers, _ := filepath.Glob(filepath.Join(path, "*.tmp"))
+		for _, leftover := range leftovers {
+			os.Remove(leftover)
+		}
+	}
+	return &jobSpool{dir: dir}, nil
+}
+
+func (s *jobSpool) path(state, id string) (string, error) {
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("invalid job ID %q", id)
+	}
+	return filepath.Join(s.dir, state, id+".json"), nil
+}
+
+// save writes a job and syncs it to disk before returning
+func (s *jobSpool) save(state string, imageJob ImageJob) error {
+	path, err := s.path(state, imageJob.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(imageJob)
+	if err != nil {
+		return fmt.Errorf("failed to encode image job: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), imageJob.ID+"-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write image job: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write image job: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync image job: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write image job: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store image job: %w", err)
+	}
+
+	// Make the rename itself durable
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+func (s *jobSpool) load(state, id string) (ImageJob, error) {
+	var imageJob ImageJob
+
+	path, err := s.path(state, id)
+	if err != nil {
+		return imageJob, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return imageJob, ErrJobNotFound
+	}
+	if err != nil {
+		return imageJob, fmt.Errorf("failed to read image job: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &imageJob); err != nil {
+		return imageJob, fmt.Errorf("failed to decode image job %s: %w", id, err)
+	}
+	return imageJob, nil
+}
+
+func (s *jobSpool) remove(state, id string) error {
+	path, err := s.path(state, id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove image job: %w", err)
+	}
+	return nil
+}
+
+// move stores a job under another state, then removes the old file.
+// A crash in between leaves the job in both places, never in neither.
+func (s *jobSpool) move(from, to string, imageJob ImageJob) error {
+	if err := s.save(to, imageJob); err != nil {
+		return err
+	}
+	return s.remove(from, imageJob.ID)
+}
+
+// list returns the jobs of a state, oldest first. Unreadable files are logged and skipped.
+func (s *jobSpool) list(state string) ([]ImageJob, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, state, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]ImageJob, 0, len(paths))
+	for _, path := range paths {
+		imageJob, err := s.load(state, strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			log.Printf("Skipping spooled image job %s: %v", path, err)
+			continue
+		}
+		jobs = append(jobs, imageJob)
+	}
+
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs, nil
+}
+
+// OpenSpool makes the queue durable: jobs are written to dir before AddToQueue returns, and the
+// jobs already in dir are replayed. Uploads are at least once; a job interrupted by a crash is
+// uploaded again, which replaces the same files.
+func (q *Queue) OpenSpool(dir string) error {
+	spool, err := openJobSpool(dir)
+	if err != nil {
+		return err
+	}
+
+	jobs, err := spool.list(spoolPending)
+	if err != nil {
+		return fmt.Errorf("failed to read image spool: %w", err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.spool = spool
+	for _, imageJob := range jobs {
+		// A job that was being uploaded when the process stopped starts over
+		if imageJob.Status != StatusRetry {
+			imageJob.Status = StatusPending
+		}
+		imageJob.StartedAt = nil
+		imageJob.ImageData = nil
+		imageJob.clearRenditionData()
+		q.pendingImages = append(q.pendingImages, imageJob)
+	}
+
+	if len(jobs) > 0 {
+		log.Printf("Replayed %d pending images from %s", len(jobs), dir)
+		q.signal()
+	}
+	return nil
+}
+
+// importBackupFile queues the jobs of a backup file written on shutdown by older versions, then removes it
+func (q *Queue) importBackupFile(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading image queue backup: %w", err)
+	}
+
+	var jobs []ImageJob
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return fmt.Errorf("error unmarshaling image queue backup: %w", err)
+	}
+
+	for _, imageJob := range jobs {
+		if err := q.AddToQueue(imageJob); err != nil {
+			return fmt.Errorf("error importing image queue backup: %w", err)
+		}
+	}
+
+	log.Printf("Imported %d pending images from %s", len(jobs), path)
+	return os.Remove(path)
+}
+
+// FailedJobs returns the dead-lettered jobs, oldest first, without their image data.
+// Without a spool it returns the failed jobs still in memory, which cannot be requeued.
+func (q *Queue) FailedJobs() ([]ImageJob, error) {
+	q.mu.Lock()
+	spool := q.spool
+	if spool == nil {
+		jobs := []ImageJob{}
+		for _, imageJob := range q.completedImages {
+			if imageJob.Status == StatusFailed {
+				jobs = append(jobs, imageJob)
+			}
+		}
+		q.mu.Unlock()
+		return jobs, nil
+	}
+	q.mu.Unlock()
+
+	jobs, err := spool.list(spoolDead)
+	if err != nil {
+		return nil, err
+	}
+	for i := range jobs {
+		jobs[i].ImageData = nil
+		jobs[i].clearRenditionData()
+	}
+	return jobs, nil
+}
+
+// RequeueFailed moves a dead-lettered job back into the queue with its retries reset
+func (q *Queue) RequeueFailed(id string) (*ImageJob, error) {
+	q.mu.Lock()
+	spool := q.spool
+	q.mu.Unlock()
+
+	if spool == nil {
+		return nil, fmt.Errorf("failed jobs can only be requeued from the spool")
+	}
+
+	unlock := q.jobLocks.lock(id)
+	defer unlock()
+
+	imageJob, err := spool.load(spoolDead, id)
+	if err != nil {
+		return nil, err
+	}
+
+	imageJob.Status = StatusPending
+	imageJob.Retries = 0
+	imageJob.Error = ""
+	imageJob.StartedAt = nil
+	imageJob.ProcessedAt = nil
+	imageJob.NextAttempt = nil
+	if err := spool.move(spoolDead, spoolPending, imageJob); err != nil {
+		return nil, err
+	}
+
+	imageJob = imageJob.withoutData()
+	q.mu.Lock()
+	q.removeCompleted(id)
+	q.pendingImages = append(q.pendingImages, imageJob)
+	q.signal()
+	q.mu.Unlock()
+
+	return &imageJob, nil
+}
+
+// DiscardFailed deletes a dead-lettered job for good
+func (q *Queue) DiscardFailed(id string) error {
+	q.mu.Lock()
+	spool := q.spool
+	q.mu.Unlock()
+
+	if spool == nil {
+		return fmt.Errorf("failed jobs can only be discarded from the spool")
+	}
+
+	unlock := q.jobLocks.lock(id)
+	defer unlock()
+
+	if _, err := spool.load(spoolDead, id); err != nil {
+		return err
+	}
+	if err := spool.remove(spoolDead, id); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	q.removeCompleted(id)
+	q.mu.Unlock()
+	return nil
+}
+
+// removeCompleted drops a job from the completed jobs. The caller must hold q.mu.
+func (q *Queue) removeCompleted(id string) {
+	for i, imageJob := range q.completedImages {
+		if imageJob.ID == id {
+			q.completedImages = append(q.completedImages[:i:i], q.completedImages[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package image
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	workerIdlePoll = time.Second      // Idle workers look for due retries this often
+	retryBaseDelay = 2 * time.Second  // Doubled for every failed attempt
+	retryMaxDelay  = 30 * time.Second // Upper bound of the retry delay
+	metricSamples  = 200              // Latency percentiles cover this many recent jobs
+)
+
+// StartWorkers starts a pool of workers that upload jobs as soon as they are queued.
+// Calling it again while the pool is running has no effect.
+func (q *Queue) StartWorkers(workers int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.stop != nil || workers < 1 {
+		return
+	}
+
+	q.workers = workers
+	q.stop = make(chan struct{})
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.worker(q.stop)
+	}
+
+	log.Printf("Started %d image upload workers", workers)
+}
+
+// StopWorkers stops the pool and waits for the jobs in progress to finish.
+// Jobs that were not started stay in the spool and are replayed on the next start.
+func (q *Queue) StopWorkers() {
+	q.mu.Lock()
+	stop := q.stop
+	q.stop = nil
+	q.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	q.wg.Wait()
+}
+
+// WorkersRunning reports whether the worker pool is started
+func (q *Queue) WorkersRunning() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stop != nil
+}
+
+func (q *Queue) worker(stop chan struct{}) {
+	defer q.wg.Done()
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if imageJob, ok := q.next(); ok {
+			q.processJob(imageJob)
+			continue
+		}
+
+		q.cleanupCompletedJobs()
+
+		select {
+		case <-stop:
+			return
+		case <-q.wake:
+		case <-time.After(workerIdlePoll):
+		}
+	}
+}
+
+// signal wakes an idle worker without blocking
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next claims the oldest job that is due and marks it as processing
+func (q *Queue) next() (ImageJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for i, imageJob := range q.pendingImages {
+		if imageJob.Status != StatusPending && imageJob.Status != StatusRetry {
+			continue
+		}
+		if imageJob.NextAttempt != nil && imageJob.NextAttempt.After(now) {
+			continue
+		}
+
+		q.pendingImages = append(q.pendingImages[:i:i], q.pendingImages[i+1:]...)
+
+		if imageJob.Retries == 0 {
+			q.metrics.wait.add(now.Sub(imageJob.CreatedAt))
+		}
+		imageJob.Status = StatusProcessing
+		imageJob.StartedAt = &now
+		imageJob.NextAttempt = nil
+		q.processing[imageJob.ID] = imageJob
+
+		// Let another idle worker pick up the rest
+		if len(q.pendingImages) > 0 {
+			q.signal()
+		}
+		return imageJob, true
+	}
+
+	return ImageJob{}, false
+}
+
+// processJob uploads a claimed job and moves it to its next state.
+// It returns the job's public URL and whether the upload succeeded.
+// The spool is updated under the job's lock after q.mu is released, so disk writes never block the queue.
+func (q *Queue) processJob(imageJob ImageJob) (string, bool) {
+	unlock := q.jobLocks.lock(imageJob.ID)
+	defer unlock()
+
+	q.mu.Lock()
+	spool := q.spool
+	q.mu.Unlock()
+
+	err := loadJobData(spool, &imageJob)
+	if err == nil {
+		err = uploadImageJob(&imageJob)
+	}
+	now := time.Now()
+
+	q.mu.Lock()
+	// The listing may have been assigned while the upload ran
+	if current, ok := q.processing[imageJob.ID]; ok {
+		imageJob.ListingID = current.ListingID
+	}
+	delete(q.processing, imageJob.ID)
+	if imageJob.StartedAt != nil {
+		q.metrics.upload.add(now.Sub(*imageJob.StartedAt))
+	}
+
+	if err != nil {
+		imageJob.Retries++
+		imageJob.Error = err.Error()
+
+		if imageJob.Retries < imageJob.MaxRetries {
+			nextAttempt := now.Add(retryDelay(imageJob.Retries))
+			imageJob.Status = StatusRetry
+			imageJob.NextAttempt = &nextAttempt
+
+			// Without a spool the queue keeps the image data for the next attempt
+			retry := imageJob
+			if spool != nil {
+				retry = imageJob.withoutData()
+			}
+			q.pendingImages = append(q.pendingImages, retry)
+			q.metrics.retried++
+			q.mu.Unlock()
+
+			// A worker that claims the retry early waits for this write on the job's lock
+			spoolJob(spool, spoolPending, imageJob)
+
+			log.Printf("Image processing for %s failed, will retry (attempt %d/%d): %v",
+				imageJob.ID, imageJob.Retries, imageJob.MaxRetries, err)
+			return "", false
+		}
+
+		imageJob.Status = StatusFailed
+		imageJob.ProcessedAt = &now
+		q.metrics.failed++
+	} else {
+		imageJob.Status = StatusProcessed
+		imageJob.Error = ""
+		imageJob.ProcessedAt = &now
+		q.metrics.processed++
+		q.metrics.total.add(now.Sub(imageJob.CreatedAt))
+	}
+
+	// Completed jobs are kept in memory without their data
+	q.completedImages = append(q.completedImages, imageJob.withoutData())
+
+	notify := q.listingNotification(imageJob.ListingID)
+	q.mu.Unlock()
+
+	if err != nil {
+		// Dead letters keep their data so they can be requeued
+		if spool != nil {
+			if spoolErr := spool.move(spoolPending, spoolDead, imageJob); spoolErr != nil {
+				log.Printf("Failed to dead-letter image job %s: %v", imageJob.ID, spoolErr)
+			}
+		}
+		log.Printf("Failed to process image %s after %d retries: %v",
+			imageJob.ID, imageJob.Retries, err)
+	} else if spool != nil {
+		if spoolErr := spool.remove(spoolPending, imageJob.ID); spoolErr != nil {
+			log.Printf("Failed to remove image job %s from the spool: %v", imageJob.ID, spoolErr)
+		}
+	}
+
+	if notify != nil {
+		go notify()
+	}
+
+	return imageJob.PublicURL, err == nil
+}
+
+// loadJobData reads the image data of a job back from the spool. The caller must hold the job's lock.
+func loadJobData(spool *jobSpool, imageJob *ImageJob) error {
+	if spool == nil {
+		return nil
+	}
+
+	stored, err := spool.load(spoolPending, imageJob.ID)
+	if err != nil {
+		return err
+	}
+	imageJob.ImageData = stored.ImageData
+	imageJob.Renditions = stored.Renditions
+	return nil
+}
+
+// spoolJob saves a job's new state, logging failures: the upload itself already happened or failed.
+// The caller must hold the job's lock.
+func spoolJob(spool *jobSpool, state string, imageJob ImageJob) {
+	if spool == nil {
+		return
+	}
+	if err := spool.save(state, imageJob); err != nil {
+		log.Printf("Failed to update image job %s in the spool: %v", imageJob.ID, err)
+	}
+}
+
+// retryDelay is the exponential backoff before the given retry
+func retryDelay(retries int) time.Duration {
+	delay := retryBaseDelay << (retries - 1)
+	if delay <= 0 || delay > retryMaxDelay {
+		return retryMaxDelay
+	}
+	return delay
+}
+
+// ImagesDone reports the outcome of the images of a listing
+type ImagesDone struct {
+	Processed []string `json:"processed"`
+	Failed    []string `json:"failed"`
+}
+
+// Ready reports whether every image was uploaded
+func (d ImagesDone) Ready() bool {
+	return len(d.Failed) == 0
+}
+
+// OnListingImagesDone sets the function called, on its own goroutine, once every image of a listing
+// is processed or failed. This is the "all images ready" signal; a requeued image signals again.
+func (q *Queue) OnListingImagesDone(notify func(listingID string, done ImagesDone)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.onListingDone = notify
+}
+
+// AssignListing links queued jobs to the listing they belong to, which is only known once it is saved.
+// The link is stored with the jobs, so the listing is still signalled after a restart.
+func (q *Queue) AssignListing(ids []string, listingID string) {
+	q.mu.Lock()
+
+	assigned := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		assigned[id] = true
+	}
+
+	var spooled []string
+	for i := range q.pendingImages {
+		if imageJob := &q.pendingImages[i]; assigned[imageJob.ID] {
+			imageJob.ListingID = listingID
+			spooled = append(spooled, imageJob.ID)
+		}
+	}
+	for id, imageJob := range q.processing {
+		if assigned[id] {
+			imageJob.ListingID = listingID
+			q.processing[id] = imageJob
+			spooled = append(spooled, id)
+		}
+	}
+	for i := range q.completedImages {
+		if imageJob := &q.completedImages[i]; assigned[imageJob.ID] {
+			imageJob.ListingID = listingID
+		}
+	}
+
+	spool := q.spool
+	notify := q.listingNotification(listingID)
+	q.mu.Unlock()
+
+	for _, id := range spooled {
+		q.updateSpooledListing(spool, id, listingID)
+	}
+
+	if notify != nil {
+		go notify()
+	}
+}
+
+// updateSpooledListing stores the listing ID in a job's spool file
+func (q *Queue) updateSpooledListing(spool *jobSpool, id, listingID string) {
+	if spool == nil {
+		return
+	}
+
+	unlock := q.jobLocks.lock(id)
+	defer unlock()
+
+	stored, err := spool.load(spoolPending, id)
+	if err == ErrJobNotFound {
+		return // Finished in the meantime, with the listing ID it had in memory
+	}
+	if err != nil {
+		log.Printf("Failed to link image job %s to listing %s: %v", id, listingID, err)
+		return
+	}
+	stored.ListingID = listingID
+	spoolJob(spool, spoolPending, stored)
+}
+
+// listingNotification returns the listing callback if every known job of the listing is done, or nil.
+// The caller must hold q.mu.
+func (q *Queue) listingNotification(listingID string) func() {
+	if listingID == "" || q.onListingDone == nil {
+		return nil
+	}
+
+	for _, imageJob := range q.pendingImages {
+		if imageJob.ListingID == listingID {
+			return nil
+		}
+	}
+	for _, imageJob := range q.processing {
+		if imageJob.ListingID == listingID {
+			return nil
+		}
+	}
+
+	var done ImagesDone
+	for _, imageJob := range q.completedImages {
+		if imageJob.ListingID != listingID {
+			continue
+		}
+		if imageJob.Status == StatusProcessed {
+			done.Processed = append(done.Processed, imageJob.ID)
+		} else {
+			done.Failed = append(done.Failed, imageJob.ID)
+		}
+	}
+	if len(done.Processed) == 0 && len(done.Failed) == 0 {
+		return nil
+	}
+
+	notify := q.onListingDone
+	return func() { notify(listingID, done) }
+}
+
+// QueueMetrics describes the throughput and latency of the image queue since startup.
+// Latencies are in milliseconds over the most recent jobs.
+type QueueMetrics struct {
+	Workers       int   `json:"workers"`
+	Pending       int   `json:"pending"`
+	Processing    int   `json:"processing"`
+	Processed     int64 `json:"processed"`
+	Failed        int64 `json:"failed"`
+	Retried       int64 `json:"retried"`
+	WaitAvgMs     int64 `json:"wait_avg_ms"` // Queued until a worker picks the job up
+	WaitP95Ms     int64 `json:"wait_p95_ms"`
+	UploadAvgMs   int64 `json:"upload_avg_ms"` // Duration of one upload attempt
+	UploadP95Ms   int64 `json:"upload_p95_ms"`
+	TotalAvgMs    int64 `json:"total_avg_ms"` // Queued until uploaded, retries included
+	TotalP95Ms    int64 `json:"total_p95_ms"`
+	OldestPending int64 `json:"oldest_pending_ms"` // Age of the oldest job still waiting
+}
+
+type queueMetrics struct {
+	processed, failed, retried int64
+	wait, upload, total        latencySamples
+}
+
+// latencySamples keeps the most recent durations in a ring
+type latencySamples struct {
+	values []time.Duration
+	next   int
+}
+
+func (l *latencySamples) add(d time.Duration) {
+	if len(l.values) < metricSamples {
+		l.values = append(l.values, d)
+		return
+	}
+	l.values[l.next] = d
+	l.next = (l.next + 1) % metricSamples
+}
+
+// summary returns the average and 95th percentile in milliseconds
+func (l *latencySamples) summary() (int64, int64) {
+	if len(l.values) == 0 {
+		return 0, 0
+	}
+
+	sorted := make([]time.Duration, len(l.values))
+	copy(sorted, l.values)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+	p95 := sorted[(len(sorted)*95-1)/100]
+
+	return (sum / time.Duration(len(sorted))).Milliseconds(), p95.Milliseconds()
+}
+
+// Metrics returns the queue's counters and latencies
+func (q *Queue) Metrics() QueueMetrics {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	metrics := QueueMetrics{
+		Workers:    q.workers,
+		Pending:    len(q.pendingImages),
+		Processing: len(q.processing),
+		Processed:  q.metrics.processed,
+		Failed:     q.metrics.failed,
+		Retried:    q.metrics.retried,
+	}
+	if q.stop == nil {
+		metrics.Workers = 0
+	}
+	metrics.WaitAvgMs, metrics.WaitP95Ms = q.metrics.wait.summary()
+	metrics.UploadAvgMs, metrics.UploadP95Ms = q.metrics.upload.summary()
+	metrics.TotalAvgMs, metrics.TotalP95Ms = q.metrics.total.summary()
+
+	for _, imageJob := range q.pendingImages {
+		if age := time.Since(imageJob.CreatedAt).Milliseconds(); age > metrics.OldestPending {
+			metrics.OldestPending = age
+		}
+	}
+
+	return metrics
+}
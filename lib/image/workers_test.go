@@ -0,0 +1,197 @@
+package image
+
+import (
+	"fmt"
+	"greenvue/lib/storage"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBlobStore keeps objects in memory and fails every Put while fail is set
+type testBlobStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	fail    bool
+}
+
+func (s *testBlobStore) Put(key string, data []byte, contentType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return fmt.Errorf("upload failed")
+	}
+	s.objects[key] = data
+	return nil
+}
+
+func (s *testBlobStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return data, nil
+}
+
+func (s *testBlobStore) Delete(keys []string) (int, error)              { return 0, nil }
+func (s *testBlobStore) List(prefix string) ([]storage.BlobInfo, error) { return nil, nil }
+func (s *testBlobStore) SignedURL(key string, expiry time.Duration) (string, error) {
+	return s.PublicURL(key), nil
+}
+func (s *testBlobStore) PublicURL(key string) string { return "https://cdn.example/" + key }
+
+func newTestQueue(t *testing.T) (*Queue, *testBlobStore, string) {
+	t.Helper()
+
+	store := &testBlobStore{objects: make(map[string][]byte)}
+	storage.SetBlobStore(store)
+	t.Cleanup(func() { storage.SetBlobStore(nil) })
+
+	dir := t.TempDir()
+	queue := NewImageQueue()
+	if err := queue.OpenSpool(dir); err != nil {
+		t.Fatalf("OpenSpool() error = %v", err)
+	}
+	return queue, store, dir
+}
+
+func spooledJobs(t *testing.T, dir, state string) int {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, state, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(paths)
+}
+
+func TestQueueSpoolsJobsAndAssignsListings(t *testing.T) {
+	queue, store, dir := newTestQueue(t)
+
+	done := make(chan ImagesDone, 1)
+	queue.OnListingImagesDone(func(listingID string, result ImagesDone) {
+		if listingID == "listing-1" {
+			done <- result
+		}
+	})
+
+	const jobs = 20
+	ids := make([]string, jobs)
+	for i := range jobs {
+		ids[i] = fmt.Sprintf("job-%02d", i)
+		if err := queue.AddToQueue(ImageJob{ID: ids[i], FileName: ids[i] + ".webp", ImageData: []byte{byte(i)}}); err != nil {
+			t.Fatalf("AddToQueue() error = %v", err)
+		}
+	}
+	if spooled := spooledJobs(t, dir, spoolPending); spooled != jobs {
+		t.Fatalf("%d jobs spooled, want %d", spooled, jobs)
+	}
+
+	// The listing is assigned while the workers upload, as PostListing does
+	queue.StartWorkers(4)
+	defer queue.StopWorkers()
+	queue.AssignListing(ids, "listing-1")
+
+	select {
+	case result := <-done:
+		if !result.Ready() || len(result.Processed) != jobs {
+			t.Fatalf("listing result = %+v, want %d processed", result, jobs)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("listing was never signalled")
+	}
+
+	if spooled := spooledJobs(t, dir, spoolPending); spooled != 0 {
+		t.Errorf("%d jobs left in the spool, want 0", spooled)
+	}
+	if len(store.objects) != jobs {
+		t.Errorf("%d objects uploaded, want %d", len(store.objects), jobs)
+	}
+}
+
+func TestQueueDeadLettersAndRequeues(t *testing.T) {
+	queue, store, dir := newTestQueue(t)
+	store.fail = true
+
+	if err := queue.AddToQueue(ImageJob{ID: "job-1", FileName: "job-1.webp", ImageData: []byte{1}, MaxRetries: 1}); err != nil {
+		t.Fatalf("AddToQueue() error = %v", err)
+	}
+	if _, err := queue.ProcessQueue(1); err != nil {
+		t.Fatalf("ProcessQueue() error = %v", err)
+	}
+
+	if spooledJobs(t, dir, spoolPending) != 0 || spooledJobs(t, dir, spoolDead) != 1 {
+		t.Fatalf("job was not dead-lettered")
+	}
+	failed, err := queue.FailedJobs()
+	if err != nil || len(failed) != 1 || failed[0].ImageData != nil {
+		t.Fatalf("FailedJobs() = %+v, %v", failed, err)
+	}
+
+	store.mu.Lock()
+	store.fail = false
+	store.mu.Unlock()
+
+	requeued, err := queue.RequeueFailed("job-1")
+	if err != nil || requeued.Retries != 0 || requeued.ImageData != nil {
+		t.Fatalf("RequeueFailed() = %+v, %v", requeued, err)
+	}
+	if _, err := queue.RequeueFailed("job-1"); err != ErrJobNotFound {
+		t.Errorf("second RequeueFailed() error = %v, want ErrJobNotFound", err)
+	}
+
+	urls, err := queue.ProcessQueue(1)
+	if err != nil || len(urls) != 1 {
+		t.Fatalf("ProcessQueue() = %v, %v", urls, err)
+	}
+	if data, err := store.Get("job-1.webp"); err != nil || len(data) != 1 {
+		t.Errorf("uploaded data = %v, %v; the spool must keep the data of dead letters", data, err)
+	}
+	if spooledJobs(t, dir, spoolPending) != 0 || spooledJobs(t, dir, spoolDead) != 0 {
+		t.Errorf("spool is not empty after the retry")
+	}
+}
+
+func TestQueueWithoutSpoolKeepsDataForRetries(t *testing.T) {
+	store := &testBlobStore{objects: make(map[string][]byte), fail: true}
+	storage.SetBlobStore(store)
+	t.Cleanup(func() { storage.SetBlobStore(nil) })
+
+	queue := NewImageQueue()
+	imageJob := ImageJob{ID: "job-1", FileName: "job-1.webp", ImageData: []byte{1}, MaxRetries: 2}
+	if err := queue.AddToQueue(imageJob); err != nil {
+		t.Fatalf("AddToQueue() error = %v", err)
+	}
+	queue.ProcessQueue(1)
+
+	job, err := queue.GetJobByID("job-1")
+	if err != nil || job.Status != StatusRetry || len(job.ImageData) != 1 {
+		t.Fatalf("job after a failed attempt = %+v, %v", job, err)
+	}
+}
+
+func TestJobLocks(t *testing.T) {
+	var locks jobLocks
+	var wg sync.WaitGroup
+	counter := 0
+
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := locks.lock("job")
+			counter++
+			unlock()
+		}()
+	}
+	wg.Wait()
+
+	if counter != 50 {
+		t.Errorf("counter = %d, want 50", counter)
+	}
+	if len(locks.locks) != 0 {
+		t.Errorf("%d locks left, want 0", len(locks.locks))
+	}
+}
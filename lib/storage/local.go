@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// LocalRoutePrefix is where the API serves files of the local blob store
+	LocalRoutePrefix = "/uploads"
+	// LocalPrivatePrefix marks keys that the local blob store only serves through signed URLs
+	LocalPrivatePrefix = "private/"
+)
+
+// LocalBlobStore keeps objects in a directory on disk and is meant for development.
+// Files are public like the Supabase bucket, except keys under LocalPrivatePrefix, which need a
+// signed URL. A signature, when present, is always checked.
+type LocalBlobStore struct {
+	root       string
+	publicURL  string
+	signingKey []byte
+}
+
+// NewLocalBlobStore creates a store in dir that is served under publicURL
+func NewLocalBlobStore(dir, publicURL, signingKey string) (*LocalBlobStore, error) {
+	if dir == "" {
+		dir = "uploads"
+	}
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage directory: %w", err)
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	if publicURL == "" {
+		publicURL = "http://localhost:8080" + LocalRoutePrefix
+	}
+	if signingKey == "" {
+		return nil, fmt.Errorf("a signing key is required for signed URLs")
+	}
+
+	return &LocalBlobStore{
+		root:       root,
+		publicURL:  strings.TrimRight(publicURL, "/") + "/",
+		signingKey: []byte(signingKey),
+	}, nil
+}
+
+// path returns the file of a key inside the root directory
+func (l *LocalBlobStore) path(key string) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+func (l *LocalBlobStore) Put(key string, data []byte, contentType string) error {
+	file, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", key, err)
+	}
+
+	// Write next to the target and rename, so readers never see a partial file
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to store %s: %w", key, err)
+	}
+	return nil
+}
+
+func (l *LocalBlobStore) Get(key string) ([]byte, error) {
+	file, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (l *LocalBlobStore) Delete(keys []string) (int, error) {
+	removed := 0
+	for _, key := range keys {
+		file, err := l.path(key)
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return removed, fmt.Errorf("failed to remove %s: %w", key, err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func (l *LocalBlobStore) List(prefix string) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	err := filepath.WalkDir(l.root, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasSuffix(file, ".tmp") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.root, file)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, BlobInfo{
+			Key:          key,
+			Size:         info.Size(),
+			ContentType:  mime.TypeByExtension(filepath.Ext(file)),
+			LastModified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+	return blobs, nil
+}
+
+func (l *LocalBlobStore) SignedURL(key string, expiry time.Duration) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	expires := time.Now().Add(expiry).Unix()
+	return fmt.Sprintf("%s?expires=%d&signature=%s", l.PublicURL(key), expires, l.sign(key, expires)), nil
+}
+
+func (l *LocalBlobStore) PublicURL(key string) string {
+	return l.publicURL + strings.TrimPrefix(key, "/")
+}
+
+func (l *LocalBlobStore) sign(key string, expires int64) string {
+	mac := hmac.New(sha256.New, l.signingKey)
+	fmt.Fprintf(mac, "blob:%s:%d", key, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Handler serves stored files. Mount it under LocalRoutePrefix with a wildcard, e.g. /uploads/*.
+func (l *LocalBlobStore) Handler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key, err := url.PathUnescape(c.Params("*"))
+		if err != nil {
+			return fiber.ErrBadRequest
+		}
+		key, err = cleanKey(key)
+		if err != nil {
+			return fiber.ErrNotFound
+		}
+		file := filepath.Join(l.root, filepath.FromSlash(key))
+
+		// Private files need a signature; dropping the query string must not skip the check
+		signature := c.Query("signature")
+		if signature != "" || strings.HasPrefix(key, LocalPrivatePrefix) {
+			expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+			if err != nil || time.Now().Unix() > expires ||
+				!hmac.Equal([]byte(signature), []byte(l.sign(key, expires))) {
+				return fiber.ErrForbidden
+			}
+		}
+
+		if info, err := os.Stat(file); err != nil || info.IsDir() {
+			return fiber.ErrNotFound
+		}
+
+		c.Set(fiber.HeaderCacheControl, "public, max-age=3600")
+		return c.SendFile(file)
+	}
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestCleanKey(t *testing.T) {
+	valid := map[string]string{
+		"listings/1/a.webp":  "listings/1/a.webp",
+		"/listings/1/a.webp": "listings/1/a.webp",
+		`listings\1\a.webp`:  "listings/1/a.webp",
+		"a..b/c.webp":        "a..b/c.webp",
+	}
+	for key, want := range valid {
+		got, err := cleanKey(key)
+		if err != nil || got != want {
+			t.Errorf("cleanKey(%q) = %q, %v, want %q", key, got, err, want)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"/",
+		"..",
+		"../secret",
+		"/../secret",
+		`..\secret`,
+		"listings/../../secret",
+		"listings/../a.webp",
+		"listings/./a.webp",
+		"listings//a.webp",
+		"listings/1/",
+	}
+	for _, key := range invalid {
+		if got, err := cleanKey(key); err == nil {
+			t.Errorf("cleanKey(%q) = %q, want an error", key, got)
+		}
+	}
+}
+
+func newTestLocalStore(t *testing.T) (*LocalBlobStore, string) {
+	t.Helper()
+
+	parent := t.TempDir()
+	store, err := NewLocalBlobStore(filepath.Join(parent, "uploads"), "http://localhost:8080/uploads", "test-signing-key")
+	if err != nil {
+		t.Fatalf("NewLocalBlobStore() error = %v", err)
+	}
+	return store, parent
+}
+
+func TestNewLocalBlobStoreRequiresSigningKey(t *testing.T) {
+	if _, err := NewLocalBlobStore(t.TempDir(), "", ""); err == nil {
+		t.Fatal("NewLocalBlobStore() without a signing key succeeded")
+	}
+}
+
+func TestLocalBlobStoreRejectsTraversal(t *testing.T) {
+	store, parent := newTestLocalStore(t)
+
+	secret := filepath.Join(parent, "secret.txt")
+	if err := os.WriteFile(secret, []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"../secret.txt", "a/../../secret.txt", `..\secret.txt`} {
+		if err := store.Put(key, []byte("overwritten"), "text/plain"); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+		if data, err := store.Get(key); err == nil {
+			t.Errorf("Get(%q) = %q, want an error", key, data)
+		}
+		if removed, _ := store.Delete([]string{key}); removed != 0 {
+			t.Errorf("Delete(%q) removed %d files", key, removed)
+		}
+	}
+
+	if data, err := os.ReadFile(secret); err != nil || string(data) != "secret" {
+		t.Errorf("file outside the store changed: %q, %v", data, err)
+	}
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	store, _ := newTestLocalStore(t)
+
+	if err := store.Put("listings/1/a.webp", []byte("a"), "image/webp"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if err := store.Put("listings/2/b.webp", []byte("bb"), "image/webp"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	data, err := store.Get("/listings/1/a.webp")
+	if err != nil || string(data) != "a" {
+		t.Fatalf("Get() = %q, %v, want a", data, err)
+	}
+	if _, err := store.Get("listings/1/missing.webp"); err != ErrNotFound {
+		t.Errorf("Get() of a missing key error = %v, want ErrNotFound", err)
+	}
+
+	blobs, err := store.List("listings/1/")
+	if err != nil || len(blobs) != 1 || blobs[0].Key != "listings/1/a.webp" || blobs[0].Size != 1 {
+		t.Fatalf("List() = %+v, %v", blobs, err)
+	}
+
+	removed, err := store.Delete([]string{"listings/1/a.webp", "listings/1/missing.webp"})
+	if err != nil || removed != 1 {
+		t.Errorf("Delete() = %d, %v, want 1 removed", removed, err)
+	}
+}
+
+func TestLocalBlobStoreHandler(t *testing.T) {
+	store, parent := newTestLocalStore(t)
+	if err := os.WriteFile(filepath.Join(parent, "secret.txt"), []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("listings/1/a.webp", []byte("a"), "image/webp"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	app := fiber.New()
+	app.Get(LocalRoutePrefix+"/*", store.Handler())
+
+	get := func(target string) int {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil), -1)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", target, err)
+		}
+		return resp.StatusCode
+	}
+
+	if status := get("/uploads/listings/1/a.webp"); status != http.StatusOK {
+		t.Errorf("GET of a stored file = %d, want 200", status)
+	}
+	if status := get("/uploads/%2e%2e/secret.txt"); status == http.StatusOK {
+		t.Errorf("GET of an escaped ../ key = %d, want an error", status)
+	}
+	if status := get("/uploads/listings/%2e%2e%2f%2e%2e%2f..%2fsecret.txt"); status == http.StatusOK {
+		t.Errorf("GET of an encoded ../ key = %d, want an error", status)
+	}
+
+	signed, err := store.SignedURL("listings/1/a.webp", time.Minute)
+	if err != nil {
+		t.Fatalf("SignedURL() error = %v", err)
+	}
+	path := strings.TrimPrefix(signed, "http://localhost:8080")
+	if status := get(path); status != http.StatusOK {
+		t.Errorf("GET of a signed URL = %d, want 200", status)
+	}
+	if status := get(strings.Replace(path, "signature=", "signature=0", 1)); status != http.StatusForbidden {
+		t.Errorf("GET with a tampered signature = %d, want 403", status)
+	}
+
+	if err := store.Put("private/exports/1.zip", []byte("private"), "application/zip"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	for _, target := range []string{"/uploads/private/exports/1.zip", "/uploads//private/exports/1.zip", "/uploads/private%2fexports/1.zip"} {
+		if status := get(target); status != http.StatusForbidden {
+			t.Errorf("GET %s without a signature = %d, want 403", target, status)
+		}
+	}
+	signed, err = store.SignedURL("private/exports/1.zip", time.Minute)
+	if err != nil {
+		t.Fatalf("SignedURL() error = %v", err)
+	}
+	if status := get(strings.TrimPrefix(signed, "http://localhost:8080")); status != http.StatusOK {
+		t.Errorf("GET of a signed private URL = %d, want 200", status)
+	}
+
+	expired := time.Now().Add(-time.Minute).Unix()
+	expiredPath := "/uploads/listings/1/a.webp?expires=" + strconv.FormatInt(expired, 10) + "&signature=" + store.sign("listings/1/a.webp", expired)
+	if status := get(expiredPath); status != http.StatusForbidden {
+		t.Errorf("GET of an expired signed URL = %d, want 403", status)
+	}
+}
@@ -0,0 +1,394 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Service        = "s3"
+	s3Algorithm      = "AWS4-HMAC-SHA256"
+	s3UnsignedBody   = "UNSIGNED-PAYLOAD"
+	s3MaxPresignTime = 7 * 24 * time.Hour
+)
+
+// S3BlobStore keeps objects in an S3-compatible bucket (AWS S3, MinIO, Cloudflare R2, ...).
+// Requests are signed with AWS Signature Version 4.
+type S3BlobStore struct {
+	endpoint   *url.URL
+	region     string
+	bucket     string
+	accessKey  string
+	secretKey  string
+	pathStyle  bool
+	publicURL  string
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+// NewS3BlobStore creates a store from the S3 options
+func NewS3BlobStore(opts Options) (*S3BlobStore, error) {
+	if opts.S3Endpoint == "" || opts.Bucket == "" {
+		return nil, fmt.Errorf("S3 endpoint and bucket are required")
+	}
+	if opts.S3AccessKey == "" || opts.S3SecretKey == "" {
+		return nil, fmt.Errorf("S3 access key and secret key are required")
+	}
+
+	endpoint, err := url.Parse(strings.TrimRight(opts.S3Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", opts.S3Endpoint)
+	}
+
+	region := opts.S3Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	store := &S3BlobStore{
+		endpoint:   endpoint,
+		region:     region,
+		bucket:     opts.Bucket,
+		accessKey:  opts.S3AccessKey,
+		secretKey:  opts.S3SecretKey,
+		pathStyle:  opts.S3PathStyle,
+		httpClient: &http.Client{Timeout: 60 * time.Second},
+		now:        time.Now,
+	}
+
+	store.publicURL = opts.PublicURL
+	if store.publicURL == "" {
+		store.publicURL = store.bucketURL().String()
+	}
+	store.publicURL = strings.TrimRight(store.publicURL, "/") + "/"
+
+	return store, nil
+}
+
+// bucketURL returns the base URL of the bucket for the addressing style
+func (s *S3BlobStore) bucketURL() *url.URL {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = strings.TrimRight(u.Path, "/") + "/" + s.bucket
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	return &u
+}
+
+// objectURL returns the URL of an object
+func (s *S3BlobStore) objectURL(key string) *url.URL {
+	u := s.bucketURL()
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + key
+	return u
+}
+
+func (s *S3BlobStore) Put(key string, data []byte, contentType string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(key).String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Cache-Control", "max-age=3600")
+
+	resp, err := s.do(req, data)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3BlobStore) Get(key string) ([]byte, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+// Delete removes objects one by one; S3 treats deleting a missing key as success,
+// so the count is the number of keys that were requested to be removed.
+func (s *S3BlobStore) Delete(keys []string) (int, error) {
+	removed := 0
+	for _, key := range keys {
+		key, err := cleanKey(key)
+		if err != nil {
+			continue
+		}
+
+		req, err := http.NewRequest(http.MethodDelete, s.objectURL(key).String(), nil)
+		if err != nil {
+			return removed, err
+		}
+		resp, err := s.do(req, nil)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return removed, fmt.Errorf("failed to remove %s: %w", key, err)
+		}
+		resp.Body.Close()
+		removed++
+	}
+	return removed, nil
+}
+
+// listBucketResult is the response of ListObjectsV2
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3BlobStore) List(prefix string) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	continuation := ""
+
+	for {
+		u := s.bucketURL()
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if continuation != "" {
+			query.Set("continuation-token", continuation)
+		}
+		u.RawQuery = query.Encode()
+
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse object list: %w", err)
+		}
+
+		for _, object := range result.Contents {
+			blobs = append(blobs, BlobInfo{Key: object.Key, Size: object.Size, LastModified: object.LastModified})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return blobs, nil
+		}
+		continuation = result.NextContinuationToken
+	}
+}
+
+// SignedURL returns a presigned GET URL. S3 accepts at most seven days.
+func (s *S3BlobStore) SignedURL(key string, expiry time.Duration) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	if expiry <= 0 || expiry > s3MaxPresignTime {
+		return "", fmt.Errorf("signed URL expiry must be between 1s and %s", s3MaxPresignTime)
+	}
+
+	u := s.objectURL(key)
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := s.scope(now)
+
+	query := url.Values{
+		"X-Amz-Algorithm":     {s3Algorithm},
+		"X-Amz-Credential":    {s.accessKey + "/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.Itoa(int(expiry.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	u.RawQuery = canonicalQuery(query)
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		canonicalPath(u),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		s3UnsignedBody,
+	}, "\n")
+
+	signature := s.signature(now, amzDate, scope, canonicalRequest)
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String(), nil
+}
+
+func (s *S3BlobStore) PublicURL(key string) string {
+	return s.publicURL + strings.TrimPrefix(key, "/")
+}
+
+// do signs and sends a request. Responses outside 2xx are turned into errors.
+func (s *S3BlobStore) do(req *http.Request, body []byte) (*http.Response, error) {
+	s.sign(req, body)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 error (%d): %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	return resp, nil
+}
+
+// sign adds an Authorization header to a request
+func (s *S3BlobStore) sign(req *http.Request, body []byte) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := s.scope(now)
+
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	req.Host = req.URL.Host
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	signature := s.signature(now, amzDate, scope, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.accessKey, scope, signedHeaders, signature))
+}
+
+func (s *S3BlobStore) scope(now time.Time) string {
+	return fmt.Sprintf("%s/%s/%s/aws4_request", now.Format("20060102"), s.region, s3Service)
+}
+
+// signature derives the signing key for the day and signs the canonical request
+func (s *S3BlobStore) signature(now time.Time, amzDate, scope, canonicalRequest string) string {
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{s3Algorithm, amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalPath URI-encodes every path segment as SigV4 requires
+func canonicalPath(u *url.URL) string {
+	p := u.Path
+	if p == "" {
+		return "/"
+	}
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery sorts and encodes query parameters as SigV4 requires
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, s3Escape(key)+"="+s3Escape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything except unreserved characters
+func s3Escape(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BlobInfo describes a stored object
+type BlobInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"content_type,omitempty"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// BlobStore stores files such as listing images. Keys are slash separated paths inside the store.
+type BlobStore interface {
+	// Put stores data under key, replacing an existing object
+	Put(key string, data []byte, contentType string) error
+	// Get returns the contents of an object
+	Get(key string) ([]byte, error)
+	// Delete removes objects and returns how many were removed. Missing keys are not an error.
+	Delete(keys []string) (int, error)
+	// List returns the objects whose key starts with prefix
+	List(prefix string) ([]BlobInfo, error)
+	// SignedURL returns a URL that grants read access to an object until expiry
+	SignedURL(key string, expiry time.Duration) (string, error)
+	// PublicURL returns the permanent URL of an object without checking that it exists
+	PublicURL(key string) string
+}
+
+// ErrNotFound is returned by Get when an object does not exist
+var ErrNotFound = fmt.Errorf("object not found")
+
+// Options configures the blob store drivers
+type Options struct {
+	Bucket     string // Bucket used by the supabase and s3 drivers
+	PublicURL  string // Base URL of public objects; defaults per driver
+	LocalDir   string // Root directory of the local driver
+	SigningKey string // Key for signed URLs of the local driver
+
+	SupabaseURL string
+	SupabaseKey string
+
+	S3Endpoint  string // e.g. https://s3.eu-central-1.amazonaws.com or http://localhost:9000
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+	S3PathStyle bool // Address the bucket as <endpoint>/<bucket> instead of <bucket>.<endpoint>, as MinIO expects
+}
+
+var (
+	blobStore   BlobStore
+	blobStoreMu sync.RWMutex
+)
+
+// InitBlobStore selects the blob store driver: "supabase" (default), "local" or "s3"
+func InitBlobStore(driver string, opts Options) {
+	switch driver {
+	case "local":
+		store, err := NewLocalBlobStore(opts.LocalDir, opts.PublicURL, opts.SigningKey)
+		if err != nil {
+			log.Printf("Warning: could not use local blob store: %v, falling back to supabase", err)
+			break
+		}
+		SetBlobStore(store)
+		return
+	case "s3":
+		store, err := NewS3BlobStore(opts)
+		if err != nil {
+			log.Printf("Warning: could not use s3 blob store: %v, falling back to supabase", err)
+			break
+		}
+		SetBlobStore(store)
+		return
+	case "supabase", "":
+	default:
+		log.Printf("Warning: unknown storage driver %q, falling back to supabase", driver)
+	}
+
+	SetBlobStore(NewSupabaseBlobStore(opts.SupabaseURL, opts.SupabaseKey, opts.Bucket, opts.PublicURL))
+}
+
+// SetBlobStore replaces the blob store used by the application
+func SetBlobStore(store BlobStore) {
+	blobStoreMu.Lock()
+	defer blobStoreMu.Unlock()
+	blobStore = store
+}
+
+// GetBlobStore returns the configured blob store, defaulting to the listing-images bucket in Supabase Storage
+func GetBlobStore() BlobStore {
+	blobStoreMu.RLock()
+	if blobStore != nil {
+		defer blobStoreMu.RUnlock()
+		return blobStore
+	}
+	blobStoreMu.RUnlock()
+
+	blobStoreMu.Lock()
+	defer blobStoreMu.Unlock()
+
+	if blobStore == nil {
+		blobStore = NewSupabaseBlobStore(os.Getenv("SUPABASE_URL"), os.Getenv("SUPABASE_SERVICE_KEY"), "listing-images", "")
+	}
+
+	return blobStore
+}
+
+// KeyFromURL returns the key of an object from its public URL.
+// It reports false for URLs that do not belong to the store.
+func KeyFromURL(store BlobStore, publicURL string) (string, bool) {
+	base := store.PublicURL("")
+	if base == "" || !strings.HasPrefix(publicURL, base) {
+		return "", false
+	}
+
+	key := publicURL[len(base):]
+	if q := strings.IndexAny(key, "?#"); q != -1 {
+		key = key[:q]
+	}
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", false
+	}
+	return key, true
+}
+
+// cleanKey normalizes a key and rejects keys that would escape the store
+func cleanKey(key string) (string, error) {
+	key = strings.TrimPrefix(strings.ReplaceAll(key, "\\", "/"), "/")
+	if key == "" {
+		return "", fmt.Errorf("empty object key")
+	}
+
+	cleaned := path.Clean(key)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") || cleaned != key {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return cleaned, nil
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	supabase "github.com/supabase-community/storage-go"
+)
+
+// SupabaseBlobStore keeps objects in a public Supabase Storage bucket
+type SupabaseBlobStore struct {
+	client    *supabase.Client
+	url       string
+	bucket    string
+	publicURL string
+}
+
+// NewSupabaseBlobStore creates a store for a bucket. publicURL defaults to the bucket's public object URL.
+func NewSupabaseBlobStore(supabaseURL, serviceKey, bucket, publicURL string) *SupabaseBlobStore {
+	if bucket == "" {
+		bucket = "listing-images"
+	}
+	if publicURL == "" {
+		publicURL = fmt.Sprintf("%s/storage/v1/object/public/%s", supabaseURL, bucket)
+	}
+
+	return &SupabaseBlobStore{
+		client:    supabase.NewClient(supabaseURL+"/storage/v1", serviceKey, nil),
+		url:       supabaseURL,
+		bucket:    bucket,
+		publicURL: strings.TrimRight(publicURL, "/") + "/",
+	}
+}
+
+func (s *SupabaseBlobStore) Put(key string, data []byte, contentType string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+
+	upsert := true
+	cacheControl := "3600"
+	options := supabase.FileOptions{
+		CacheControl: &cacheControl,
+		Upsert:       &upsert,
+		ContentType:  &contentType,
+	}
+
+	if _, err := s.client.UploadFile(s.bucket, key, io.NopCloser(bytes.NewReader(data)), options); err != nil {
+		return fmt.Errorf("failed to upload %s to supabase: %w", key, err)
+	}
+	return nil
+}
+
+func (s *SupabaseBlobStore) Get(key string) ([]byte, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := s.client.DownloadFile(s.bucket, key)
+	if err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "not found") {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to download %s from supabase: %w", key, err)
+	}
+	return data, nil
+}
+
+func (s *SupabaseBlobStore) Delete(keys []string) (int, error) {
+	var paths []string
+	for _, key := range keys {
+		if key, err := cleanKey(key); err == nil {
+			paths = append(paths, key)
+		}
+	}
+	if len(paths) == 0 {
+		return 0, nil
+	}
+
+	removed, err := s.client.RemoveFile(s.bucket, paths)
+	if err != nil {
+		return 0, fmt.Errorf("failed to remove files from supabase: %w", err)
+	}
+	return len(removed), nil
+}
+
+// List returns the objects directly inside the folder of prefix whose name starts with the rest of prefix.
+// Supabase Storage lists one folder at a time.
+func (s *SupabaseBlobStore) List(prefix string) ([]BlobInfo, error) {
+	folder, namePrefix := "", prefix
+	if i := strings.LastIndex(prefix, "/"); i != -1 {
+		folder, namePrefix = prefix[:i], prefix[i+1:]
+	}
+
+	const pageSize = 1000
+	var blobs []BlobInfo
+	for offset := 0; ; offset += pageSize {
+		files, err := s.client.ListFiles(s.bucket, folder, supabase.FileSearchOptions{Limit: pageSize, Offset: offset})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list files in supabase: %w", err)
+		}
+
+		for _, file := range files {
+			// Folders have no ID
+			if file.Id == "" || !strings.HasPrefix(file.Name, namePrefix) {
+				continue
+			}
+
+			key := file.Name
+			if folder != "" {
+				key = folder + "/" + file.Name
+			}
+			info := BlobInfo{Key: key}
+			if metadata, ok := file.Metadata.(map[string]any); ok {
+				if size, ok := metadata["size"].(float64); ok {
+					info.Size = int64(size)
+				}
+				info.ContentType, _ = metadata["mimetype"].(string)
+			}
+			info.LastModified, _ = time.Parse(time.RFC3339, file.UpdatedAt)
+			blobs = append(blobs, info)
+		}
+
+		if len(files) < pageSize {
+			return blobs, nil
+		}
+	}
+}
+
+func (s *SupabaseBlobStore) SignedURL(key string, expiry time.Duration) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := s.client.CreateSignedUrl(s.bucket, key, int(expiry.Seconds()))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign %s: %w", key, err)
+	}
+	return resp.SignedURL, nil
+}
+
+func (s *SupabaseBlobStore) PublicURL(key string) string {
+	return s.publicURL + strings.TrimPrefix(key, "/")
+}
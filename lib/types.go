@@ -1,7 +1,10 @@
 package lib
 
 import (
+	"time"
+
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 )
 
 type AuthResponse struct {
@@ -32,3 +35,36 @@ type CompleteUser struct {
 	Messages  []Message         `json:"messages"`
 	Favorites []FetchedFavorite `json:"favorites"`
 }
+
+// AccountDeletionGracePeriod is how long a scheduled deletion can be cancelled by logging in
+const AccountDeletionGracePeriod = 14 * 24 * time.Hour
+
+// AccountDeletion is a scheduled account deletion, stored in the account_deletions table.
+// The email address is kept so the receipt can still be sent after the profile is anonymized.
+type AccountDeletion struct {
+	ID           uuid.UUID        `json:"id"`
+	UserID       uuid.UUID        `json:"user_id"`
+	Email        string           `json:"email"`
+	RequestedAt  time.Time        `json:"requested_at"`
+	ScheduledFor time.Time        `json:"scheduled_for"`
+	StartedAt    *time.Time       `json:"started_at,omitempty"` // Set when the cleanup begins; from then on a login no longer cancels it
+	CancelledAt  *time.Time       `json:"cancelled_at,omitempty"`
+	CompletedAt  *time.Time       `json:"completed_at,omitempty"`
+	Receipt      *DeletionReceipt `json:"receipt,omitempty"`
+}
+
+// DeletionReceipt summarizes what was removed or anonymized when an account was deleted
+type DeletionReceipt struct {
+	DeletionID         uuid.UUID `json:"deletion_id"`
+	UserID             uuid.UUID `json:"user_id"`
+	RequestedAt        time.Time `json:"requested_at"`
+	CompletedAt        time.Time `json:"completed_at"`
+	ListingsDeleted    int       `json:"listings_deleted"`
+	ImagesDeleted      int       `json:"images_deleted"`
+	BidsDeleted        int       `json:"bids_deleted"`
+	FavoritesDeleted   int       `json:"favorites_deleted"`
+	ReviewsAnonymized  int       `json:"reviews_anonymized"`
+	MessagesAnonymized int       `json:"messages_anonymized"`
+	ProfileAnonymized  bool      `json:"profile_anonymized"`
+	LoginDisabled      bool      `json:"login_disabled"`
+}
@@ -17,6 +17,7 @@ type Favorite struct {
 
 type Review struct {
 	ID               *uuid.UUID `json:"id,omitempty"`
+	OrderID          uuid.UUID  `json:"order_id"`
 	Rating           int        `json:"rating"`
 	UserID           uuid.UUID  `json:"user_id"`
 	SellerID         uuid.UUID  `json:"seller_id"`
@@ -25,17 +26,121 @@ type Review struct {
 	VerifiedPurchase bool       `json:"verified_purchase"`
 }
 
+type ReviewReply struct {
+	ReviewID uuid.UUID `json:"review_id"`
+	SellerID uuid.UUID `json:"seller_id"`
+	Content  string    `json:"content"`
+}
+
+type ReviewHelpfulVote struct {
+	ReviewID uuid.UUID `json:"review_id"`
+	UserID   uuid.UUID `json:"user_id"`
+}
+
+type ReviewReport struct {
+	ReviewID   uuid.UUID `json:"review_id"`
+	ReporterID uuid.UUID `json:"reporter_id"`
+	Reason     string    `json:"reason"`
+	Details    string    `json:"details"`
+}
+
 type Listing struct {
-	Title         string    `json:"title"`
-	Description   string    `json:"description"`
-	Category      string    `json:"category"`
-	Condition     string    `json:"condition"`
-	Price         float64   `json:"price"`
-	Negotiable    bool      `json:"negotiable"`
-	EcoScore      float32   `json:"eco_score"`
-	EcoAttributes []string  `json:"eco_attributes"`
-	ImageUrls     []string  `json:"image_urls"`
-	SellerID      uuid.UUID `json:"seller_id"`
+	ID            *uuid.UUID     `json:"id,omitempty"`
+	Title         string         `json:"title"`
+	Description   string         `json:"description"`
+	Category      string         `json:"category"`
+	Condition     string         `json:"condition"`
+	Price         float64        `json:"price"`
+	Negotiable    bool           `json:"negotiable"`
+	EcoScore      float32        `json:"eco_score"`
+	EcoAttributes []string       `json:"eco_attributes"`
+	ImageUrls     []string       `json:"image_urls"` // URL of the full rendition of each image, kept for older clients
+	Images        []ListingImage `json:"images"`
+	ImageStatus   string         `json:"image_status,omitempty"` // processing, ready or failed
+	SellerID      uuid.UUID      `json:"seller_id"`
+}
+
+// ImageRendition is one size of a listing image
+type ImageRendition struct {
+	Name   string `json:"name"` // Preset name, e.g. "thumb" or "zoom"
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Bytes  int    `json:"bytes"`
+}
+
+// ListingImage is an uploaded image with all its renditions, smallest first
+type ListingImage struct {
+	ID         string           `json:"id"`
+	URL        string           `json:"url"`    // Full rendition, for clients that do not use srcset
+	SrcSet     string           `json:"srcset"` // e.g. "a.webp 200w, b.webp 480w"
+	Renditions []ImageRendition `json:"renditions"`
+
+	// Shown while the image loads
+	Blurhash      string `json:"blurhash,omitempty"`
+	Preview       string `json:"preview,omitempty"`        // Tiny inline WebP as a data URI
+	DominantColor string `json:"dominant_color,omitempty"` // Hex colour such as #7a8b3c
+
+	PerceptualHash string `json:"phash,omitempty"` // dHash used to find re-uploaded photos
+}
+
+// Rendition returns the rendition with the given preset name
+func (i ListingImage) Rendition(name string) *ImageRendition {
+	for k := range i.Renditions {
+		if i.Renditions[k].Name == name {
+			return &i.Renditions[k]
+		}
+	}
+	return nil
+}
+
+// Largest returns the URL of the biggest rendition
+func (i ListingImage) Largest() string {
+	if len(i.Renditions) == 0 {
+		return i.URL
+	}
+	return i.Renditions[len(i.Renditions)-1].URL
+}
+
+// URLs returns every distinct file URL of the image
+func (i ListingImage) URLs() []string {
+	seen := map[string]bool{i.URL: true}
+	urls := []string{i.URL}
+	for _, rendition := range i.Renditions {
+		if !seen[rendition.URL] {
+			seen[rendition.URL] = true
+			urls = append(urls, rendition.URL)
+		}
+	}
+	return urls
+}
+
+// LegacyListingImage describes an image uploaded before renditions existed; it only has one size
+func LegacyListingImage(url string) ListingImage {
+	return ListingImage{ID: url, URL: url, Renditions: []ImageRendition{}}
+}
+
+// ImageHash indexes the perceptual hash of a listing image. The hash is also stored as four
+// 16 bit bands so near duplicates can be found with equality lookups.
+type ImageHash struct {
+	ListingID uuid.UUID `json:"listing_id"`
+	SellerID  uuid.UUID `json:"seller_id"`
+	ImageID   string    `json:"image_id"`
+	Hash      string    `json:"hash"`
+	Band0     int       `json:"band_0"`
+	Band1     int       `json:"band_1"`
+	Band2     int       `json:"band_2"`
+	Band3     int       `json:"band_3"`
+}
+
+// ListingFlag puts a listing into the moderation queue
+type ListingFlag struct {
+	ListingID        uuid.UUID `json:"listing_id"`
+	SellerID         uuid.UUID `json:"seller_id"`
+	Reason           string    `json:"reason"`
+	MatchedListingID uuid.UUID `json:"matched_listing_id"`
+	MatchedSellerID  uuid.UUID `json:"matched_seller_id"`
+	Distance         int       `json:"distance"` // Smallest Hamming distance between the images of both listings
 }
 
 type Message struct {
@@ -3,6 +3,7 @@ package validation
 import (
 	"fmt"
 	"greenvue/lib"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -15,6 +16,12 @@ type ReviewValidator struct {
 	TitleMaxLength       int
 	DescriptionMinLength int
 	DescriptionMaxLength int
+	ReplyMinLength       int
+	ReplyMaxLength       int
+	ReportDetailsMaxLen  int
+	AllowedReportReasons []string
+	ReviewWindow         time.Duration // How long after order completion a review may be posted
+	EditWindow           time.Duration // How long after posting a review may be edited
 }
 
 // NewReviewValidator creates a validator with default settings
@@ -26,6 +33,12 @@ func NewReviewValidator() *ReviewValidator {
 		TitleMaxLength:       100,
 		DescriptionMinLength: 20,
 		DescriptionMaxLength: 1000,
+		ReplyMinLength:       2,
+		ReplyMaxLength:       1000,
+		ReportDetailsMaxLen:  500,
+		AllowedReportReasons: lib.ReviewReportReasons,
+		ReviewWindow:         30 * 24 * time.Hour,
+		EditWindow:           48 * time.Hour,
 	}
 }
 
@@ -49,6 +62,9 @@ func (v *ReviewValidator) ValidateReview(review lib.Review) *ValidationResult {
 	}
 
 	// Validate required UUIDs
+	if review.OrderID == uuid.Nil {
+		result.AddError("order_id", "OrderID is required")
+	}
 	if review.UserID == uuid.Nil {
 		result.AddError("user_id", "UserID is required")
 	}
@@ -64,8 +80,95 @@ func (v *ReviewValidator) ValidateReview(review lib.Review) *ValidationResult {
 	return result
 }
 
+// ValidateReviewOrder checks that the order backing a review belongs to the reviewer,
+// has been completed and is still inside the review window
+func (v *ReviewValidator) ValidateReviewOrder(review lib.Review, order lib.Order) *ValidationResult {
+	result := NewValidationResult()
+
+	if order.BuyerID != review.UserID {
+		result.AddError("order_id", "You can only review orders you have purchased")
+	}
+	if order.SellerID != review.SellerID {
+		result.AddError("seller_id", "Seller does not match the order")
+	}
+	if order.Status != "completed" || order.CompletedAt == nil {
+		result.AddError("order_id", "Order must be completed before it can be reviewed")
+		return result
+	}
+	if time.Since(*order.CompletedAt) > v.ReviewWindow {
+		result.AddError("order_id", fmt.Sprintf("Reviews must be posted within %d days of order completion", int(v.ReviewWindow.Hours()/24)))
+	}
+
+	return result
+}
+
+// CanEdit reports whether a review created at the given time may still be edited
+func (v *ReviewValidator) CanEdit(createdAt time.Time) bool {
+	return time.Since(createdAt) <= v.EditWindow
+}
+
+// ValidateReply validates a seller reply to a review
+func (v *ReviewValidator) ValidateReply(reply lib.ReviewReply) *ValidationResult {
+	result := NewValidationResult()
+
+	if len(reply.Content) < v.ReplyMinLength || len(reply.Content) > v.ReplyMaxLength {
+		result.AddError("content", fmt.Sprintf("Reply must be between %d and %d characters", v.ReplyMinLength, v.ReplyMaxLength))
+	}
+	if reply.ReviewID == uuid.Nil {
+		result.AddError("review_id", "ReviewID is required")
+	}
+	if reply.SellerID == uuid.Nil {
+		result.AddError("seller_id", "SellerID is required")
+	}
+
+	return result
+}
+
+// ValidateReport validates a report filed against a review
+func (v *ReviewValidator) ValidateReport(report lib.ReviewReport) *ValidationResult {
+	result := NewValidationResult()
+
+	// Validate reason
+	reasonValid := false
+	for _, validReason := range v.AllowedReportReasons {
+		if report.Reason == validReason {
+			reasonValid = true
+			break
+		}
+	}
+	if !reasonValid {
+		result.AddError("reason", "Invalid report reason")
+	}
+	if len(report.Details) > v.ReportDetailsMaxLen {
+		result.AddError("details", fmt.Sprintf("Details must be at most %d characters", v.ReportDetailsMaxLen))
+	}
+	if report.Reason == "other" && report.Details == "" {
+		result.AddError("details", "Details are required when the reason is 'other'")
+	}
+	if report.ReviewID == uuid.Nil {
+		result.AddError("review_id", "ReviewID is required")
+	}
+	if report.ReporterID == uuid.Nil {
+		result.AddError("reporter_id", "ReporterID is required")
+	}
+
+	return result
+}
+
 // ValidateReview is a convenience function using the default validator
 func ValidateReview(review lib.Review) *ValidationResult {
 	validator := NewReviewValidator()
 	return validator.ValidateReview(review)
 }
+
+// ValidateReviewReply is a convenience function using the default validator
+func ValidateReviewReply(reply lib.ReviewReply) *ValidationResult {
+	validator := NewReviewValidator()
+	return validator.ValidateReply(reply)
+}
+
+// ValidateReviewReport is a convenience function using the default validator
+func ValidateReviewReport(report lib.ReviewReport) *ValidationResult {
+	validator := NewReviewValidator()
+	return validator.ValidateReport(report)
+}